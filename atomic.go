@@ -0,0 +1,244 @@
+package treedb
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"os"
+	"strconv"
+	"time"
+)
+
+//tmpSibling returns a path in the same directory as 'p' that can be used to stage its new content
+func tmpSibling(p P, rnd *rand.Rand) P {
+	return append(append(P{}, p.Parent()...), "."+p.Base()+"."+strconv.FormatUint(uint64(rnd.Uint32()), 36)+".tmp")
+}
+
+//tmpFile is an open temporary file that stages the content of the file at 'p', an intent in the journal makes sure it doesn't outlive a crash
+type tmpFile struct {
+	*File
+	p    P      //path that the content is meant for
+	tmpp P      //path of the temporary file
+	id   uint64 //id of the intent in the journal
+}
+
+//createTmp creates and opens a temporary file next to 'p' with a name that is not yet taken, and journals the intent of operation 'op' to rename it over 'p'
+func (fs *FileSystem) createTmp(op string, p P, perm os.FileMode) (tf *tmpFile, err error) {
+	rnd := rand.New(rand.NewSource(time.Now().UnixNano()))
+	tf = &tmpFile{p: p}
+	if err = fs.db.Update(func(tx Tx) (err error) {
+
+		//a batched transaction is run again when another in its batch fails, what the rolled back run opened is released
+		if tf.File != nil {
+			tf.File.Close()
+			tf.File = nil
+		}
+
+		if tf.id > 0 {
+			fs.doneIntent(tf.id)
+			tf.id = 0
+		}
+
+		//content is written to the file that symbolic links lead to, the links are kept
+		if tf.p, err = fs.followContent(tx, p); err != nil {
+			return err
+		}
+
+		for i := 0; i < 100; i++ {
+			tf.tmpp = tmpSibling(tf.p, rnd)
+			tf.File, err = fs.OpenFileTx(tx, tf.tmpp, os.O_CREATE|os.O_EXCL|os.O_WRONLY, perm)
+			if err == nil || !os.IsExist(err) {
+				break
+			}
+		}
+
+		if err != nil {
+			return err
+		}
+
+		tf.id, err = fs.beginIntent(tx, &intent{Op: op, Tmp: tf.tmpp, Dst: tf.p})
+		return err
+	}); err != nil {
+		if tf.File != nil {
+			tf.File.Close() //opened, but the transaction failed to commit
+		}
+
+		if tf.id > 0 {
+			fs.doneIntent(tf.id)
+		}
+
+		return nil, pathErr("open", tf.tmpp, err)
+	}
+
+	//the transaction has ended, io will use transactions of its own
+	tf.File.tx = nil
+	return tf, nil
+}
+
+//commitTmp renames closed temporary file 'tf' over the file its content is meant for. All content is marked as staged first, such that a crash before the rename is committed completes it when the file system is opened again
+func (fs *FileSystem) commitTmp(tf *tmpFile) (err error) {
+	defer fs.doneIntent(tf.id)
+	if err = fs.db.Update(func(tx Tx) error {
+		return fs.stageIntent(tx, tf.id)
+	}); err != nil {
+		return tf.tmpp.Err("rename", err)
+	}
+
+	if err = fs.db.Update(func(tx Tx) error {
+		if err := fs.rename(tx, tf.tmpp, tf.p); err != nil {
+			return err
+		}
+
+		return fs.endIntent(tx, tf.id)
+	}); err != nil {
+		return tf.tmpp.Err("rename", err)
+	}
+
+	fs.inodes.moved(tf.tmpp, tf.p)
+	return nil
+}
+
+//abortTmp removes closed temporary file 'tf' together with its intent
+func (fs *FileSystem) abortTmp(tf *tmpFile) {
+	defer fs.doneIntent(tf.id)
+	fs.db.Update(func(tx Tx) error {
+		if err := fs.RemoveTx(tx, tf.tmpp); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+
+		return fs.endIntent(tx, tf.id)
+	})
+}
+
+//WriteFileAtomic writes 'data' to a temporary file next to 'p' and then renames it over 'p' such that readers either see the old content or the new content but never a partially written file. The temporary file is removed when anything goes wrong, or when the file system is opened again after a crash. If there is an error, it will be of type *PathError.
+func WriteFileAtomic(fs *FileSystem, p P, data []byte, perm os.FileMode) (err error) {
+	err = p.Validate()
+	if err != nil {
+		return p.Err("writefileatomic", err)
+	}
+
+	f, err := fs.createTmp("writefileatomic", p, perm)
+	if err != nil {
+		return err
+	}
+
+	//whatever happens from here, the temporary file shouldn't stick around
+	defer func() {
+		if err != nil {
+			fs.abortTmp(f)
+		}
+	}()
+
+	if _, err = f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+
+	if err = f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+
+	if err = f.Close(); err != nil {
+		return err
+	}
+
+	return fs.commitTmp(f)
+}
+
+//ImportFile streams everything that is read from 'src' into the file at 'p' until io.EOF and returns the number of bytes imported. Content is chunked as it arrives and committed in transactions of a bounded size, such that large files never have to be held in memory. The content is staged in a temporary file that is renamed over 'p' at the end: if reading from 'src' fails halfway, or the process crashes, the temporary file is removed and 'p' is left untouched. If there is an error, it will be of type *PathError.
+func (fs *FileSystem) ImportFile(p P, src io.Reader) (n int64, err error) {
+	err = p.Validate()
+	if err != nil {
+		return 0, p.Err("import", err)
+	}
+
+	f, err := fs.createTmp("import", p, 0666)
+	if err != nil {
+		return 0, err
+	}
+
+	defer func() {
+		if err != nil {
+			fs.abortTmp(f)
+		}
+	}()
+
+	if n, err = f.ReadFrom(src); err != nil {
+		f.Close()
+		if _, ok := err.(*os.PathError); !ok {
+			err = p.Err("import", err)
+		}
+
+		return 0, err
+	}
+
+	if err = f.Close(); err != nil {
+		return 0, err
+	}
+
+	if err = fs.commitTmp(f); err != nil {
+		return 0, err
+	}
+
+	return n, nil
+}
+
+//CompareAndSwap replaces the content of the file at 'p' with 'new', but only if its current content equals 'expected'. Comparing and writing happen in a single transaction, so concurrent swappers that expect the same content can't both succeed. It returns false without an error when the content didn't match, it is meant for small files such as leases or configuration. If there is an error, it will be of type *PathError.
+func (fs *FileSystem) CompareAndSwap(p P, expected, new []byte) (swapped bool, err error) {
+	err = p.Validate()
+	if err != nil {
+		return false, p.Err("compareandswap", err)
+	}
+
+	if err = fs.db.Update(func(tx Tx) error {
+		swapped = false
+		rp, err := fs.followContent(tx, p)
+		if err != nil {
+			return err
+		}
+
+		fi, err := fs.getfi(tx, rp)
+		if err != nil {
+			return err
+		}
+
+		if fi.IsDir() {
+			return ErrIsDirectory
+		}
+
+		if fi.S != int64(len(expected)) {
+			return nil
+		}
+
+		current := make([]byte, fi.S)
+		if _, err = fs.readChunks(tx, fi, 0, current); err != nil && err != io.EOF {
+			return err
+		}
+
+		if !bytes.Equal(current, expected) {
+			return nil
+		}
+
+		if err = fs.delChunkPtrs(tx, fi); err != nil {
+			return err
+		}
+
+		fi.S, fi.D = 0, nil
+		if _, _, err = fs.writeChunks(tx, fi, 0, new, true); err != nil {
+			return err
+		}
+
+		fi.T = fs.clock.Now()
+		if err = fs.putfi(tx, rp, fi); err != nil {
+			return err
+		}
+
+		swapped = true
+		return nil
+	}); err != nil {
+		return false, p.Err("compareandswap", err)
+	}
+
+	return swapped, nil
+}
@@ -0,0 +1,162 @@
+package treedb
+
+import (
+	"bytes"
+	"os"
+	"sync"
+	"testing"
+)
+
+func TestWriteFileAtomic(t *testing.T) {
+	fs, closefs := testfs(t)
+	defer closefs()
+
+	//each version consists of a single repeated byte, with a different size
+	versions := [][]byte{}
+	for i := 0; i < 5; i++ {
+		versions = append(versions, bytes.Repeat([]byte{byte('a' + i)}, (i+1)*700*kiB))
+	}
+
+	err := WriteFileAtomic(fs, P{"a.txt"}, versions[0], 0666)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+
+	done := make(chan struct{})
+	wg := sync.WaitGroup{}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+
+			data, err := NewIOFS(fs).ReadFile("a.txt")
+			if err != nil {
+				t.Errorf("expected no error while reading, got: %v", err)
+				return
+			}
+
+			complete := false
+			for _, v := range versions {
+				if bytes.Equal(data, v) {
+					complete = true
+				}
+			}
+
+			if !complete {
+				t.Errorf("expected reader to see a complete version, got %d bytes", len(data))
+				return
+			}
+		}
+	}()
+
+	for _, v := range versions[1:] {
+		err = WriteFileAtomic(fs, P{"a.txt"}, v, 0666)
+		if err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+	}
+
+	close(done)
+	wg.Wait()
+
+	output, err := NewIOFS(fs).ReadFile("a.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(output, versions[len(versions)-1]) {
+		t.Error("expected file to contain last written version")
+	}
+
+	//a failed rename cleans up the temporary file
+	err = fs.Mkdir(P{"dir"}, 0777)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = WriteFileAtomic(fs, P{"dir"}, versions[0], 0666)
+	if err == nil || err.(*os.PathError).Err != ErrNotDirectory {
+		t.Errorf("expected ErrNotDirectory, got: %v", err)
+	}
+
+	names, err := testopen(fs, t, Root).Readdirnames(-1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(names) != 2 {
+		t.Errorf("expected no temporary files to remain, got: %v", names)
+	}
+}
+
+func TestCompareAndSwap(t *testing.T) {
+	fs, closefs := testfs(t)
+	defer closefs()
+
+	testwrite(fs, t, P{"lease"}, []byte("v0"))
+	swapped, err := fs.CompareAndSwap(P{"lease"}, []byte("v0"), []byte("v1 is longer"))
+	if err != nil || !swapped {
+		t.Fatalf("expected swap, got: %v, %v", swapped, err)
+	}
+
+	swapped, err = fs.CompareAndSwap(P{"lease"}, []byte("v0"), []byte("v2"))
+	if err != nil || swapped {
+		t.Fatalf("expected no swap without an error, got: %v, %v", swapped, err)
+	}
+
+	if data := testread(fs, t, P{"lease"}); string(data) != "v1 is longer" {
+		t.Errorf("expected content of the first swap, got: %q", data)
+	}
+
+	_, err = fs.CompareAndSwap(P{"nope"}, nil, []byte("v0"))
+	if err == nil || err.(*os.PathError).Err != os.ErrNotExist {
+		t.Errorf("expected ErrNotExist, got: %v", err)
+	}
+
+	//of many concurrent swappers expecting the same content, exactly one wins
+	wg := sync.WaitGroup{}
+	wins := make(chan int, 10)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			swapped, err := fs.CompareAndSwap(P{"lease"}, []byte("v1 is longer"), []byte{byte('a' + i)})
+			if err != nil {
+				t.Errorf("expected no error, got: %v", err)
+			}
+
+			if swapped {
+				wins <- i
+			}
+		}(i)
+	}
+
+	wg.Wait()
+	close(wins)
+	winners := []int{}
+	for i := range wins {
+		winners = append(winners, i)
+	}
+
+	if len(winners) != 1 {
+		t.Fatalf("expected exactly one winner, got: %v", winners)
+	}
+
+	if data := testread(fs, t, P{"lease"}); !bytes.Equal(data, []byte{byte('a' + winners[0])}) {
+		t.Errorf("expected content of the winner, got: %q", data)
+	}
+}
+
+func testopen(fs *FileSystem, t *testing.T, p P) *File {
+	f, err := fs.Open(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return f
+}
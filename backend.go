@@ -0,0 +1,102 @@
+package treedb
+
+import (
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/boltdb/bolt"
+)
+
+//ChunkBackend stores chunk blobs by their content key outside of a file system's own transactions, for example to keep a backup of the chunks on another medium. Get returns os.ErrNotExist for chunks that are not stored, Put replaces a chunk that is already stored
+type ChunkBackend interface {
+	Get(k K) (data []byte, err error)
+	Put(k K, data []byte) error
+}
+
+//NewBoltChunkBackend returns a ChunkBackend that stores chunks in bucket 'bucket' of bolt database 'db', each call runs in a transaction of its own. It can't mirror the chunks of a file system in the same database, since the mirror is written while the file system's transaction is open
+func NewBoltChunkBackend(db *bolt.DB, bucket []byte) ChunkBackend {
+	return &boltChunkBackend{db: db, bucket: bucket}
+}
+
+type boltChunkBackend struct {
+	db     *bolt.DB
+	bucket []byte
+}
+
+func (b *boltChunkBackend) Get(k K) (data []byte, err error) {
+	if err = b.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(b.bucket)
+		if bucket == nil {
+			return os.ErrNotExist
+		}
+
+		v := bucket.Get(k[:])
+		if v == nil {
+			return os.ErrNotExist
+		}
+
+		data = append([]byte{}, v...)
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	return data, nil
+}
+
+func (b *boltChunkBackend) Put(k K, data []byte) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists(b.bucket)
+		if err != nil {
+			return err
+		}
+
+		return bucket.Put(k[:], append([]byte{}, data...))
+	})
+}
+
+//NewDirChunkBackend returns a ChunkBackend that stores each chunk as a file in directory 'dir', named by the hex encoding of its key and spread over subdirectories by the first byte of the key
+func NewDirChunkBackend(dir string) ChunkBackend {
+	return &dirChunkBackend{dir: dir}
+}
+
+type dirChunkBackend struct {
+	dir string
+}
+
+//path returns the location of the file for chunk 'k'
+func (b *dirChunkBackend) path(k K) string {
+	name := hex.EncodeToString(k[:])
+	return filepath.Join(b.dir, name[:2], name)
+}
+
+func (b *dirChunkBackend) Get(k K) (data []byte, err error) {
+	return ioutil.ReadFile(b.path(k))
+}
+
+//Put writes the chunk to a temporary file first such that a crash never leaves a partial chunk under its key
+func (b *dirChunkBackend) Put(k K, data []byte) (err error) {
+	path := b.path(k)
+	if err = os.MkdirAll(filepath.Dir(path), 0777); err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(path), ".chunk")
+	if err != nil {
+		return err
+	}
+
+	defer os.Remove(tmp.Name())
+	if _, err = tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,118 @@
+package treedb
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/boltdb/bolt"
+)
+
+func TestChunkBackends(t *testing.T) {
+	db, close := testdb(t)
+	defer close()
+
+	dir, err := ioutil.TempDir("", "treedb_backend_")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+	for name, b := range map[string]ChunkBackend{
+		"bolt": NewBoltChunkBackend(db, []byte("backup")),
+		"dir":  NewDirChunkBackend(dir),
+	} {
+		data := []byte("hello chunk")
+		k := K(sha256.Sum256(data))
+		if _, err = b.Get(k); !os.IsNotExist(err) {
+			t.Errorf("%s: expected a chunk that was never stored not to exist, got: %v", name, err)
+		}
+
+		for i := 0; i < 2; i++ {
+			if err = b.Put(k, data); err != nil {
+				t.Fatalf("%s: %v", name, err)
+			}
+		}
+
+		if stored, err := b.Get(k); err != nil || !bytes.Equal(stored, data) {
+			t.Errorf("%s: expected the chunk to be stored, got: %q, %v", name, stored, err)
+		}
+	}
+}
+
+func TestChunkMirror(t *testing.T) {
+	db, close := testdb(t)
+	defer close()
+
+	dir, err := ioutil.TempDir("", "treedb_mirror_")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+	fs, err := NewFileSystem(t.Name(), db, WithChunkMirror(NewDirChunkBackend(dir), 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := make([]byte, 600*kiB)
+	rand.Read(data)
+	testwrite(fs, t, P{"a.txt"}, data)
+
+	//lose all chunks in the database
+	if err = db.Update(func(tx *bolt.Tx) error {
+		if err := tx.DeleteBucket(ChunkBucketName); err != nil {
+			return err
+		}
+
+		_, err := tx.CreateBucket(ChunkBucketName)
+		return err
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if read := testread(fs, t, P{"a.txt"}); !bytes.Equal(read, data) {
+		t.Fatal("expected content to be read from the mirror")
+	}
+
+	if problems, err := fs.Check(); err != nil || len(problems) != 0 {
+		t.Errorf("expected missing chunks to be repaired, got: %v, %v", problems, err)
+	}
+}
+
+func TestChunkMirrorSameDatabase(t *testing.T) {
+	db, close := testdb(t)
+	defer close()
+
+	if _, err := NewFileSystem(t.Name(), db, WithChunkMirror(NewBoltChunkBackend(db, []byte("backup")), 0)); err == nil {
+		t.Fatal("expected a mirror in the database of the file system to be rejected")
+	}
+
+	//a bolt mirror in another database is written while the transaction of the file system is open
+	mdb, mclose := testdb(t)
+	defer mclose()
+
+	mirror := NewBoltChunkBackend(mdb, []byte("backup"))
+	fs, err := NewFileSystem(t.Name(), db, WithChunkMirror(mirror, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := make([]byte, 600*kiB)
+	rand.Read(data)
+	testwrite(fs, t, P{"a.txt"}, data)
+
+	refs, err := fs.FileChunks(P{"a.txt"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, ref := range refs {
+		if _, err = mirror.Get(ref.Key); err != nil {
+			t.Errorf("expected chunk %x to be mirrored, got: %v", ref.Key, err)
+		}
+	}
+}
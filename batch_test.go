@@ -0,0 +1,143 @@
+package treedb
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+func TestBatchWrites(t *testing.T) {
+	db, close := testdb(t)
+	defer close()
+
+	fs, err := NewFileSystem(t.Name(), db, WithBatchWrites(5*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testwrite(fs, t, P{"taken.txt"}, []byte("taken"))
+
+	//exclusive creates of a taken name fail in the middle of batches, which runs the other writes of those batches again
+	const writers, files = 16, 8
+	errs := make(chan error, writers*files*2)
+	wg := sync.WaitGroup{}
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < files; j++ {
+				name := fmt.Sprintf("%d-%d.txt", i, j)
+				if err := WriteFileAtomic(fs, P{name}, []byte(name), 0666); err != nil {
+					errs <- err
+				}
+
+				if _, err := fs.OpenFile(P{"taken.txt"}, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0666); !os.IsExist(err) {
+					errs <- fmt.Errorf("expected exclusive create to fail, got: %v", err)
+				}
+			}
+		}(i)
+	}
+
+	wg.Wait()
+	for len(errs) > 0 {
+		t.Error(<-errs)
+	}
+
+	if n := len(fs.handles.counts); n != 0 {
+		t.Errorf("expected no handles to remain open after writes were run again, got: %d", n)
+	}
+
+	//all writes that returned are durable once the database is opened again
+	path := db.Path()
+	if err = db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if db, err = bolt.Open(path, 0666, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	defer db.Close()
+	if fs, err = NewFileSystem(t.Name(), db); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < writers; i++ {
+		for j := 0; j < files; j++ {
+			name := fmt.Sprintf("%d-%d.txt", i, j)
+			if output := testread(fs, t, P{name}); string(output) != name {
+				t.Errorf("expected %s to be durable, got: %q", name, output)
+			}
+		}
+	}
+
+	if problems, err := fs.Check(); err != nil || len(problems) != 0 {
+		t.Errorf("expected no problems, got: %v, %v", problems, err)
+	}
+
+	if _, err = NewFileSystemWithStore(t.Name(), NewMemStore(), WithBatchWrites(time.Millisecond)); err == nil {
+		t.Error("expected batching on another store than bolt to be refused")
+	}
+}
+
+func TestBatchWritesWindow(t *testing.T) {
+	db, close := testdb(t)
+	defer close()
+
+	if _, err := NewFileSystem("a", db, WithBatchWrites(5*time.Millisecond)); err != nil {
+		t.Fatal(err)
+	}
+
+	if db.MaxBatchDelay != 5*time.Millisecond {
+		t.Errorf("expected the window to be set on the database, got: %s", db.MaxBatchDelay)
+	}
+
+	//the same window can be shared, another one would change the window of the first file system
+	if _, err := NewFileSystem("b", db, WithBatchWrites(5*time.Millisecond)); err != nil {
+		t.Errorf("expected a file system with the same window to open, got: %v", err)
+	}
+
+	if _, err := NewFileSystem("c", db, WithBatchWrites(time.Millisecond)); err == nil {
+		t.Error("expected a file system with another window to be refused")
+	}
+
+	if db.MaxBatchDelay != 5*time.Millisecond {
+		t.Errorf("expected the window of the database to be left alone, got: %s", db.MaxBatchDelay)
+	}
+}
+
+func BenchmarkSmallWrites(b *testing.B) {
+	for _, window := range []time.Duration{0, 2 * time.Millisecond} {
+		b.Run(map[time.Duration]string{0: "Unbatched", 2 * time.Millisecond: "Batched"}[window], func(b *testing.B) {
+			db, close := testdb(b)
+			defer close()
+
+			fs, err := NewFileSystem("bench", db, WithBatchWrites(window))
+			if err != nil {
+				b.Fatal(err)
+			}
+
+			n := 0
+			mu := sync.Mutex{}
+			data := []byte("small")
+			b.SetParallelism(16)
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					mu.Lock()
+					n++
+					p := P{fmt.Sprintf("%d.txt", n)}
+					mu.Unlock()
+
+					if err := WriteFileAtomic(fs, p, data, 0666); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		})
+	}
+}
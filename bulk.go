@@ -0,0 +1,85 @@
+package treedb
+
+import (
+	"bytes"
+	"os"
+
+	"github.com/boltdb/bolt"
+)
+
+//BulkEntry describes a file or directory that is created by BulkCreate
+type BulkEntry struct {
+	P    P           //path of the new entry
+	Mode os.FileMode //mode and permission bits, with ModeDir set a directory is created
+}
+
+//BulkCreate creates empty files and directories for all 'entries' in a single transaction, parents must already exist or be created by an earlier entry. When the entries are sorted by the database key of their paths, as is common when importing a tree, the files bucket is told to pack its pages completely: sequential inserts never land in the middle of a page, so leaving room for them would only waste space and cause more page splits. Once an entry is out of order the default fill is restored for the rest of the transaction, later transactions always use the default. If there is an error, it will be of type *PathError.
+func (fs *FileSystem) BulkCreate(entries []BulkEntry) (err error) {
+	for _, e := range entries {
+		if err = fs.validateNew(e.P); err != nil {
+			return e.P.Err("bulkcreate", err)
+		}
+
+		if e.P.IsRoot() {
+			return e.P.Err("bulkcreate", os.ErrExist)
+		}
+	}
+
+	var errp P
+	if err = fs.db.Update(func(tx Tx) error {
+		b := tx.Bucket(fs.fbucket)
+		f, sequential := b.(filler)
+		if sequential {
+			f.SetFillPercent(1.0)
+		}
+
+		var last []byte
+		for _, e := range entries {
+			errp = e.P
+			k := e.P.Key()
+			if sequential && bytes.Compare(k, last) <= 0 {
+				f.SetFillPercent(bolt.DefaultFillPercent)
+				sequential = false
+			}
+
+			last = k
+			pfi, err := fs.getfi(tx, e.P.Parent())
+			if err != nil {
+				errp = e.P.Parent()
+				return err
+			}
+
+			if !pfi.IsDir() {
+				errp = e.P.Parent()
+				return ErrNotDirectory
+			}
+
+			if b.Get(k) != nil {
+				return os.ErrExist
+			}
+
+			if _, err = fs.resolveCollision(tx, e.P, nil, false); err != nil {
+				return err
+			}
+
+			fi := &fileInfo{N: e.P.Base(), M: e.Mode, T: fs.clock.Now()}
+			if fi.IsDir() {
+				fi.C = new(int64)
+			}
+
+			if fi.I, err = fs.nextIno(tx); err != nil {
+				return err
+			}
+
+			if err = fs.putfi(tx, e.P, fi); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}); err != nil {
+		return pathErr("bulkcreate", errp, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,152 @@
+package treedb
+
+import (
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/boltdb/bolt"
+)
+
+//testentries returns 'n' files in directory "dir" sorted by key, preceded by the directory itself
+func testentries(n int) []BulkEntry {
+	entries := []BulkEntry{{P: P{"dir"}, Mode: os.ModeDir | 0777}}
+	for i := 0; i < n; i++ {
+		entries = append(entries, BulkEntry{P: P{"dir", fmt.Sprintf("%08d.txt", i)}, Mode: 0666})
+	}
+
+	return entries
+}
+
+//testleafpages returns the number of leaf pages and the bytes they take up in the files bucket of 'fs'
+func testleafpages(t testing.TB, db *bolt.DB, fs *FileSystem) (pages, alloc int) {
+	if err := db.View(func(tx *bolt.Tx) error {
+		stats := tx.Bucket(fs.fbucket).Stats()
+		pages, alloc = stats.LeafPageN, stats.LeafAlloc
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	return pages, alloc
+}
+
+func TestBulkCreate(t *testing.T) {
+	db, close := testdb(t)
+	defer close()
+
+	fs, err := NewFileSystem(t.Name(), db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	entries := testentries(5000)
+	if err = fs.BulkCreate(entries); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+
+	for _, e := range []BulkEntry{entries[0], entries[len(entries)-1]} {
+		fi, err := fs.Stat(e.P)
+		if err != nil || fi.Mode() != e.Mode {
+			t.Errorf("expected %v to be created with mode %v, got: %v, %v", e.P, e.Mode, fi, err)
+		}
+	}
+
+	//the same entries created one by one leave pages half full
+	other, err := NewFileSystem(t.Name()+"Other", db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = db.Update(func(btx *bolt.Tx) error {
+		tx := BoltTx(btx)
+		if err := other.MkdirTx(tx, entries[0].P, 0777); err != nil {
+			return err
+		}
+
+		for _, e := range entries[1:] {
+			if _, err := other.OpenFileTx(tx, e.P, os.O_CREATE, e.Mode); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	bulk, _ := testleafpages(t, db, fs)
+	oneByOne, _ := testleafpages(t, db, other)
+	if bulk >= oneByOne {
+		t.Errorf("expected sorted bulk create to use fewer leaf pages, got %d (one by one: %d)", bulk, oneByOne)
+	}
+
+	//entries out of order, existing entries and missing parents
+	if err = fs.BulkCreate([]BulkEntry{{P: P{"b"}}, {P: P{"a"}}}); err != nil {
+		t.Errorf("expected unsorted entries to be created, got: %v", err)
+	}
+
+	if err = fs.BulkCreate([]BulkEntry{{P: P{"c"}}, {P: P{"a"}}}); !os.IsExist(err) {
+		t.Errorf("expected os.ErrExist, got: %v", err)
+	}
+
+	if _, err = fs.Stat(P{"c"}); !os.IsNotExist(err) {
+		t.Errorf("expected a failed bulk create to create nothing, got: %v", err)
+	}
+
+	if err = fs.BulkCreate([]BulkEntry{{P: P{"x", "y"}}}); !os.IsNotExist(err) {
+		t.Errorf("expected missing parent to fail, got: %v", err)
+	}
+}
+
+func BenchmarkBulkCreate(b *testing.B) {
+	entries := testentries(100000)
+	for _, c := range []struct {
+		name   string
+		create func(fs *FileSystem, db *bolt.DB) error
+	}{
+		{"OneByOne", func(fs *FileSystem, db *bolt.DB) error {
+			return db.Update(func(btx *bolt.Tx) error {
+				tx := BoltTx(btx)
+				if err := fs.MkdirTx(tx, entries[0].P, 0777); err != nil {
+					return err
+				}
+
+				for _, e := range entries[1:] {
+					if _, err := fs.OpenFileTx(tx, e.P, os.O_CREATE, e.Mode); err != nil {
+						return err
+					}
+				}
+
+				return nil
+			})
+		}},
+		{"Sorted", func(fs *FileSystem, db *bolt.DB) error {
+			return fs.BulkCreate(entries)
+		}},
+	} {
+		b.Run(c.name, func(b *testing.B) {
+			pages, alloc := 0, 0
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				db, close := testdb(b)
+				fs, err := NewFileSystem("bench", db)
+				if err != nil {
+					b.Fatal(err)
+				}
+
+				b.StartTimer()
+				if err = c.create(fs, db); err != nil {
+					b.Fatal(err)
+				}
+
+				b.StopTimer()
+				pages, alloc = testleafpages(b, db, fs)
+				close()
+			}
+
+			b.ReportMetric(float64(pages), "leafpages")
+			b.ReportMetric(float64(alloc)/miB, "MiB")
+		})
+	}
+}
@@ -0,0 +1,116 @@
+package treedb
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+//ProblemKind classifies a problem found by Check
+type ProblemKind int
+
+const (
+	//ProblemMissingRoot is reported when there is no record for the root directory
+	ProblemMissingRoot ProblemKind = iota
+
+	//ProblemOrphan is reported for entries whose parent directory has no record
+	ProblemOrphan
+
+	//ProblemParentNotDirectory is reported for entries whose parent is not a directory
+	ProblemParentNotDirectory
+
+	//ProblemMissingChunk is reported for chunk ptrs of a file that reference a chunk which is not stored
+	ProblemMissingChunk
+)
+
+func (k ProblemKind) String() string {
+	switch k {
+	case ProblemMissingRoot:
+		return "missing root"
+	case ProblemOrphan:
+		return "orphan"
+	case ProblemParentNotDirectory:
+		return "parent not a directory"
+	case ProblemMissingChunk:
+		return "missing chunk"
+	default:
+		return fmt.Sprintf("problem(%d)", int(k))
+	}
+}
+
+//Problem describes a structural issue with the file system
+type Problem struct {
+	Kind ProblemKind
+	Path P //path of the entry that has the problem
+
+	Off   int64 //for missing chunks: file offset the chunk was written at
+	Chunk K     //for missing chunks: content key of the chunk
+}
+
+func (p Problem) String() string {
+	if p.Kind == ProblemMissingChunk {
+		return fmt.Sprintf("%s: %s at offset %d (%x)", p.Path, p.Kind, p.Off, p.Chunk[:8])
+	}
+
+	return fmt.Sprintf("%s: %s", p.Path, p.Kind)
+}
+
+//check returns the problems of the file system as seen by 'tx'
+func (fs *FileSystem) check(tx Tx) (problems []Problem, err error) {
+	if _, err = fs.getfi(tx, Root); err == os.ErrNotExist {
+		problems = append(problems, Problem{Kind: ProblemMissingRoot, Path: Root})
+	} else if err != nil {
+		return nil, err
+	}
+
+	root := string(Root.Key())
+	if err = tx.Bucket(fs.fbucket).ForEach(func(k, v []byte) error {
+		if string(k) == root {
+			return nil
+		}
+
+		fi := &fileInfo{}
+		if err := json.Unmarshal(v, fi); err != nil {
+			return fmt.Errorf("failed to deserialize: %v", err)
+		}
+
+		p := PathFromKey(k)
+		pfi, err := fs.getfi(tx, p.Parent())
+		if err == os.ErrNotExist {
+			problems = append(problems, Problem{Kind: ProblemOrphan, Path: p})
+		} else if err != nil {
+			return err
+		} else if !pfi.IsDir() {
+			problems = append(problems, Problem{Kind: ProblemParentNotDirectory, Path: p})
+		}
+
+		if fi.IsDir() {
+			return nil
+		}
+
+		cb := tx.Bucket(fs.cbucket)
+		return fs.getChunkPtrs(tx, fi, 0, func(ptr chunkPtr) error {
+			if cb.Get(ptr.k[:]) == nil {
+				problems = append(problems, Problem{Kind: ProblemMissingChunk, Path: p, Off: ptr.off, Chunk: ptr.k})
+			}
+
+			return nil
+		})
+	}); err != nil {
+		return nil, err
+	}
+
+	return problems, nil
+}
+
+//Check scans the file system for structural problems without changing anything: a missing root, entries without a parent or with a parent that is not a directory and files that reference chunks which are not stored
+func (fs *FileSystem) Check() (problems []Problem, err error) {
+	if err = fs.db.View(func(tx Tx) error {
+		problems, err = fs.check(tx)
+		return err
+	}); err != nil {
+		return nil, err
+	}
+
+	return problems, nil
+}
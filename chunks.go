@@ -0,0 +1,450 @@
+package treedb
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	"github.com/restic/chunker"
+)
+
+const kiB = 1024
+const miB = kiB * 1024
+
+var (
+	//ChunkBucketName is the name of the bucket that holds the content chunks of all filesystems in a database. Chunks are stored under the sha256 of their content such that equal content is only stored once
+	ChunkBucketName = []byte("chunks")
+)
+
+//ChunkConfig determines where content defined chunking places chunk boundaries
+type ChunkConfig struct {
+	Pol     chunker.Pol //irreducible polynomial for the rolling hash
+	MinSize uint        //smallest chunk, except for the last chunk of a region
+	MaxSize uint        //largest chunk
+}
+
+//DefaultChunkConfig is used by file systems unless configured otherwise
+var DefaultChunkConfig = ChunkConfig{
+	Pol:     chunker.Pol(0x3DA3358B4DC173),
+	MinSize: 256 * kiB,
+	MaxSize: 1 * miB,
+}
+
+//chunkPtr references a chunk that holds a file's bytes from offset 'off' onwards. Chunk ptrs are stored per inode, ordered by offset:
+//
+// |           Key      |       Data             |       Comment			 				 |
+// 00000002:00000000	  : 2511E0F94...979AF0F:len #chunk at file offset 0
+// 00000002:00051159	  : 2511E0F94...979AF0F:len #chunk at file offset 332121
+//
+//Regions of a file that are not covered by a chunk (holes) read as zeros.
+type chunkPtr struct {
+	off int64 //file offset of the first byte in the chunk
+	k   K     //content key of the chunk
+	n   int64 //length of the chunk in bytes
+}
+
+//end returns the file offset right after the chunk's last byte
+func (ptr chunkPtr) end() int64 { return ptr.off + ptr.n }
+
+// u64tob converts a uint64 into an 8-byte slice. From the author of bolt, @see https://github.com/boltdb/bolt/issues/338
+func u64tob(v uint64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, v)
+	return b
+}
+
+func btou64(b []byte) uint64 {
+	return binary.BigEndian.Uint64(b)
+}
+
+//format a database key for the chunk ptr of inode 'ino' at file offset 'offset'
+func chunkPtrKey(ino uint64, offset int64) []byte {
+	return append(u64tob(ino), u64tob(uint64(offset))...)
+}
+
+func decodeChunkPtr(k, v []byte) (ptr chunkPtr) {
+	ptr.off = int64(btou64(k[8:]))
+	copy(ptr.k[:], v)
+	ptr.n = int64(btou64(v[sha256.Size:]))
+	return ptr
+}
+
+//putChunk stores chunk 'data' under its content key, if a chunk with the same content already exists it is not written again
+func (fs *FileSystem) putChunk(tx Tx, data []byte) (k K, err error) {
+	k = sha256.Sum256(data)
+	if err = fs.putReplicas(tx, k, data); err != nil {
+		return k, err
+	}
+
+	b := tx.Bucket(fs.cbucket)
+	if b.Get(k[:]) != nil {
+		return k, nil //deduplicated
+	}
+
+	//the mirror is written first, if the transaction doesn't commit it is left with a chunk nobody references
+	if fs.mirror != nil && len(data) > fs.mirrorMin {
+		if err = fs.mirror.Put(k, data); err != nil {
+			return k, err
+		}
+	}
+
+	//bolt requires the value to remain valid for the life of the transaction
+	return k, b.Put(k[:], append([]byte{}, data...))
+}
+
+//ChunkCorruptError is returned when the content of a chunk no longer hashes to its key, it wraps ErrChunkCorrupt
+type ChunkCorruptError struct {
+	Off int64 //file offset of the chunk
+	K   K     //key of the chunk
+}
+
+func (e *ChunkCorruptError) Error() string {
+	return fmt.Sprintf("%v: chunk %x at offset %d", ErrChunkCorrupt, e.K, e.Off)
+}
+
+//Unwrap returns ErrChunkCorrupt
+func (e *ChunkCorruptError) Unwrap() error { return ErrChunkCorrupt }
+
+//getChunk returns the content of the chunk that 'ptr' references. Unless verification is disabled the content is checked against the chunk's key. When the chunk is missing or corrupt but one of its replicas or its copy in the mirror is intact, that copy is returned and the chunk is repaired
+func (fs *FileSystem) getChunk(tx Tx, ptr chunkPtr) (data []byte, err error) {
+	data = tx.Bucket(fs.cbucket).Get(ptr.k[:])
+	if data == nil {
+		err = fmt.Errorf("chunk %x doesn't exist", ptr.k)
+	} else if fs.verify && sha256.Sum256(data) != ptr.k {
+		err = &ChunkCorruptError{Off: ptr.off, K: ptr.k}
+	} else {
+		return data, nil
+	}
+
+	replica, ok := fs.getReplica(tx, ptr)
+	if !ok {
+		return nil, err
+	}
+
+	if err = fs.healChunk(tx, ptr.k, replica); err != nil {
+		return nil, err
+	}
+
+	return replica, nil
+}
+
+//putChunkPtr writes a ptr for file 'fi' that references chunk 'k' of length 'n' at file offset 'off'
+func (fs *FileSystem) putChunkPtr(tx Tx, fi *fileInfo, off int64, k K, n int64) (err error) {
+	//a ptr that is replaced releases its chunk
+	if err = fs.delChunkPtr(tx, fi, off); err != nil {
+		return err
+	}
+
+	if err = tx.Bucket(fs.pbucket).Put(chunkPtrKey(fi.I, off), append(k[:], u64tob(uint64(n))...)); err != nil {
+		return err
+	}
+
+	return fs.ref(tx, chunkPtr{off: off, k: k, n: n}, 1)
+}
+
+//delChunkPtr removes the ptr of file 'fi' at file offset 'off', if there is one
+func (fs *FileSystem) delChunkPtr(tx Tx, fi *fileInfo, off int64) (err error) {
+	b, k := tx.Bucket(fs.pbucket), chunkPtrKey(fi.I, off)
+	v := b.Get(k)
+	if v == nil {
+		return nil
+	}
+
+	ptr := decodeChunkPtr(k, v)
+	if err = b.Delete(k); err != nil {
+		return err
+	}
+
+	return fs.ref(tx, ptr, -1)
+}
+
+//delChunkPtrs removes all chunk ptrs of file 'fi', the chunks themselves are left alone as other files might still reference them
+func (fs *FileSystem) delChunkPtrs(tx Tx, fi *fileInfo) (err error) {
+	return fs.delChunkPtrsFrom(tx, fi, 0)
+}
+
+//delChunkPtrsFrom removes the chunk ptrs of file 'fi' that start at or after file offset 'off'
+func (fs *FileSystem) delChunkPtrsFrom(tx Tx, fi *fileInfo, off int64) (err error) {
+	prefix := u64tob(fi.I)
+	seek := chunkPtrKey(fi.I, off)
+	c := tx.Bucket(fs.pbucket).Cursor()
+	for k, v := c.Seek(seek); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Seek(seek) {
+		ptr := decodeChunkPtr(k, v)
+		if err = c.Delete(); err != nil {
+			return err
+		}
+
+		if err = fs.ref(tx, ptr, -1); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+//getChunkPtrs calls 'fn' for each chunk ptr of file 'fi' that holds bytes at or after offset 'off' in order of their file position, 'fn' can return errStopWalk to stop early
+func (fs *FileSystem) getChunkPtrs(tx Tx, fi *fileInfo, off int64, fn func(ptr chunkPtr) error) (err error) {
+	c := tx.Bucket(fs.pbucket).Cursor()
+	prefix := u64tob(fi.I)
+	seek := chunkPtrKey(fi.I, off)
+
+	k, v := c.Seek(seek)
+	if k == nil || !bytes.Equal(k, seek) {
+
+		//the chunk that holds the byte at 'off' might start before it
+		if k == nil {
+			k, v = c.Last()
+		} else {
+			k, v = c.Prev()
+		}
+
+		if k == nil || !bytes.HasPrefix(k, prefix) || decodeChunkPtr(k, v).end() <= off {
+			k, v = c.Seek(seek)
+		}
+	}
+
+	for ; k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+		if err = checkDeadline(tx); err != nil {
+			return err
+		}
+
+		err = fn(decodeChunkPtr(k, v))
+		if err != nil {
+			if err == errStopWalk {
+				return nil
+			}
+
+			return err
+		}
+	}
+
+	return nil
+}
+
+//readChunks reads bytes of file 'fi' from offset 'off' into 'b', regions of the file that are not covered by any chunk read as zeros. It returns the number of bytes read, at the end of the file io.EOF is returned
+func (fs *FileSystem) readChunks(tx Tx, fi *fileInfo, off int64, b []byte) (n int, err error) {
+	return fs.readChunksCached(tx, fi, off, b, nil)
+}
+
+//readChunksCached works like readChunks but takes the content of chunks from 'cache' when it holds them
+func (fs *FileSystem) readChunksCached(tx Tx, fi *fileInfo, off int64, b []byte, cache map[K][]byte) (n int, err error) {
+	if off >= fi.S {
+		return 0, io.EOF
+	}
+
+	if int64(len(b)) > fi.S-off {
+		b = b[:fi.S-off]
+	}
+
+	if fi.D != nil {
+		return copy(b, fi.D[off:]), nil
+	}
+
+	for i := range b {
+		b[i] = 0x00
+	}
+
+	end := off + int64(len(b))
+	if err = fs.getChunkPtrs(tx, fi, off, func(ptr chunkPtr) error {
+		if ptr.off >= end {
+			return errStopWalk
+		}
+
+		data, ok := cache[ptr.k]
+		if !ok {
+			if data, err = fs.getChunk(tx, ptr); err != nil {
+				return err
+			}
+		}
+
+		if ptr.off < off {
+			copy(b, data[off-ptr.off:])
+		} else {
+			copy(b[ptr.off-off:], data)
+		}
+
+		return nil
+	}); err != nil {
+		return 0, err
+	}
+
+	return len(b), nil
+}
+
+//zeros is written for holes when streaming chunks
+var zeros = make([]byte, 32*kiB)
+
+//streamChunks writes the bytes of file 'fi' from offset 'off' until the end to 'w' straight from the chunks, holes are written as zeros. It returns the number of bytes written. When 'damaged' is not nil chunks that can't be read are written as zeros as well and their regions are appended to it, instead of failing
+func (fs *FileSystem) streamChunks(tx Tx, fi *fileInfo, off int64, w io.Writer, damaged *[]DamagedRange) (n int64, err error) {
+	if off >= fi.S {
+		return 0, nil
+	}
+
+	if fi.D != nil {
+		m, err := writeOut(tx, w, fi.D[off:])
+		return int64(m), err
+	}
+
+	//writes zeros until file offset 'end'
+	fill := func(end int64) error {
+		for off+n < end {
+			z := zeros
+			if int64(len(z)) > end-off-n {
+				z = z[:end-off-n]
+			}
+
+			m, err := writeOut(tx, w, z)
+			n += int64(m)
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}
+
+	if err = fs.getChunkPtrs(tx, fi, off, func(ptr chunkPtr) error {
+		if ptr.off >= fi.S {
+			return errStopWalk
+		}
+
+		if err := fill(ptr.off); err != nil {
+			return err
+		}
+
+		data, err := fs.getChunk(tx, ptr)
+		if err != nil {
+			if damaged == nil {
+				return err
+			}
+
+			end := ptr.end()
+			if end > fi.S {
+				end = fi.S
+			}
+
+			*damaged = append(*damaged, DamagedRange{Off: off + n, Len: end - off - n, Err: err})
+			return fill(end)
+		}
+
+		pos := off + n
+		if ptr.end() > fi.S {
+			data = data[:fi.S-ptr.off]
+		}
+
+		m, err := writeOut(tx, w, data[pos-ptr.off:])
+		n += int64(m)
+		return err
+	}); err != nil {
+		return n, err
+	}
+
+	return n, fill(fi.S)
+}
+
+//writeChunks writes 'data' to file 'fi' at offset 'off'. Chunks that partially overlap the written range are merged with the new data and chunked again, chunks outside of the range are left untouched. Unless 'all' is true, the last chunk is not stored when it was cut by the end of the data instead of its content; it is returned together with its offset such that more data can be appended to it before it is written
+func (fs *FileSystem) writeChunks(tx Tx, fi *fileInfo, off int64, data []byte, all bool) (rest []byte, restOff int64, err error) {
+	if fi.D != nil || fi.S == 0 {
+		if end := off + int64(len(data)); end > fi.S && end > fs.inline {
+
+			//the file outgrows the inline threshold, its inline content is chunked together with the new data
+			if fi.D != nil {
+				data, off = writeInline(fi.D, off, data), 0
+				fi.D, fi.S = nil, 0
+			}
+		} else {
+			fi.D = writeInline(fi.D, off, data)
+			fi.S = int64(len(fi.D))
+			return nil, 0, nil
+		}
+	}
+
+	start, end := off, off+int64(len(data))
+	var head, tail []byte
+	var old []int64
+	if err = fs.getChunkPtrs(tx, fi, off, func(ptr chunkPtr) error {
+		if ptr.off >= end {
+			return errStopWalk
+		}
+
+		old = append(old, ptr.off)
+		if ptr.off >= off && ptr.end() <= end {
+			return nil //completely overwritten
+		}
+
+		d, err := fs.getChunk(tx, ptr)
+		if err != nil {
+			return err
+		}
+
+		if ptr.off < off {
+			head = append([]byte{}, d[:off-ptr.off]...)
+			start = ptr.off
+		}
+
+		if ptr.end() > end {
+			tail = append([]byte{}, d[end-ptr.off:]...)
+		}
+
+		return nil
+	}); err != nil {
+		return nil, 0, err
+	}
+
+	for _, off := range old {
+		if err = fs.delChunkPtr(tx, fi, off); err != nil {
+			return nil, 0, err
+		}
+	}
+
+	region := append(append(head, data...), tail...)
+	return fs.putRegion(tx, fi, start, region, fs.chunking, all || len(tail) > 0)
+}
+
+//putRegion chunks 'region' using 'cfg' and stores it for file 'fi' at offset 'start', there should be no chunk ptrs for the region. Unless 'all' is true the last chunk is not stored but returned together with its offset
+func (fs *FileSystem) putRegion(tx Tx, fi *fileInfo, start int64, region []byte, cfg ChunkConfig, all bool) (rest []byte, restOff int64, err error) {
+	chkr := chunker.NewWithBoundaries(bytes.NewReader(region), cfg.Pol, cfg.MinSize, cfg.MaxSize)
+	buf := make([]byte, chkr.MaxSize)
+	for {
+		chunk, err := chkr.Next(buf)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, 0, err
+		}
+
+		chunkOff := start + int64(chunk.Start)
+		if !all && int(chunk.Start+chunk.Length) == len(region) {
+			rest, restOff = region[chunk.Start:], chunkOff
+			break
+		}
+
+		k, err := fs.putChunk(tx, chunk.Data)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		if err = fs.putChunkPtr(tx, fi, chunkOff, k, int64(chunk.Length)); err != nil {
+			return nil, 0, err
+		}
+
+		if chunkOff+int64(chunk.Length) > fi.S {
+			fi.S = chunkOff + int64(chunk.Length)
+		}
+	}
+
+	return rest, restOff, nil
+}
+
+//writeInline returns the inline content 'd' with 'data' written at offset 'off', gaps are filled with zeros
+func writeInline(d []byte, off int64, data []byte) []byte {
+	end := off + int64(len(data))
+	if end > int64(len(d)) {
+		d = append(d, make([]byte, end-int64(len(d)))...)
+	}
+
+	copy(d[off:], data)
+	return d
+}
@@ -0,0 +1,17 @@
+package treedb
+
+import (
+	"time"
+)
+
+//Clock tells the time that is recorded when files are created or modified, a fake clock can be provided with WithClock to get deterministic modification times in tests or when importing with preserved times
+type Clock interface {
+	Now() time.Time
+}
+
+//WallClock is the default Clock, it tells the current local time
+var WallClock Clock = wallClock{}
+
+type wallClock struct{}
+
+func (wallClock) Now() time.Time { return time.Now() }
@@ -0,0 +1,94 @@
+package treedb
+
+import (
+	"os"
+	"path"
+	"strconv"
+	"strings"
+)
+
+//CollisionPolicy determines what happens when a new file or directory is created whose name only differs in case from that of an existing sibling, see WithCaseInsensitiveNames
+type CollisionPolicy int
+
+const (
+	//CollisionReject fails creating the entry with os.ErrExist
+	CollisionReject CollisionPolicy = iota
+
+	//CollisionReplace removes the existing sibling before the entry is created, a directory can only be replaced when it is empty
+	CollisionReplace
+
+	//CollisionRename creates the entry with a "~N" suffix before the extension of its name, using the lowest N that doesn't collide with anything. For example "readme.md" becomes "readme~1.md". Only OpenFile can report the new name through File.Path, all other operations fail with os.ErrExist as with CollisionReject
+	CollisionRename
+)
+
+//collision returns the sibling of new entry 'p' whose name equals its name when case is ignored, or nil if there is none. Entry 'self' is moved to 'p' and is no sibling, such that its name can change case
+func (fs *FileSystem) collision(tx Tx, p, self P) (other P, err error) {
+	if err = fs.walkdir(tx, p.Parent(), nil, func(sibp P, fi *fileInfo) error {
+		if sibp.Base() != p.Base() && strings.EqualFold(sibp.Base(), p.Base()) && !sibp.Equals(self) {
+			other = sibp
+			return errStopWalk
+		}
+
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	return other, nil
+}
+
+//withSuffix returns path 'p' with "~n" added to its name, before the extension
+func withSuffix(p P, n int) P {
+	ext := path.Ext(p.Base())
+	if ext == p.Base() {
+		ext = "" //dotfiles have no extension
+	}
+
+	return append(append(P{}, p.Parent()...), strings.TrimSuffix(p.Base(), ext)+"~"+strconv.Itoa(n)+ext)
+}
+
+//resolveCollision applies the collision policy to new entry 'p' when names are case-insensitive, it returns the path at which the entry is to be created. Entry 'self' is moved to 'p', if any. Callers that can't report another path to their caller don't 'rename', CollisionRename then rejects the entry
+func (fs *FileSystem) resolveCollision(tx Tx, p, self P, rename bool) (P, error) {
+	if !fs.nocase {
+		return p, nil
+	}
+
+	other, err := fs.collision(tx, p, self)
+	if err != nil || other == nil {
+		return p, err
+	}
+
+	switch fs.collide {
+	case CollisionReplace:
+		if err = fs.RemoveTx(tx, other); err != nil {
+			return nil, err
+		}
+
+		return p, nil
+	case CollisionRename:
+		if !rename {
+			return nil, os.ErrExist
+		}
+
+		for n := 1; ; n++ {
+			np := withSuffix(p, n)
+			if err = fs.validateLimits(np); err != nil {
+				return nil, err
+			}
+
+			if _, err = fs.getfi(tx, np); err == nil {
+				continue
+			} else if err != os.ErrNotExist {
+				return nil, err
+			}
+
+			if other, err = fs.collision(tx, np, self); err != nil {
+				return nil, err
+			} else if other == nil {
+				return np, nil
+			}
+		}
+	default:
+		return nil, os.ErrExist
+	}
+}
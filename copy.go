@@ -0,0 +1,444 @@
+package treedb
+
+import (
+	"bytes"
+	"os"
+)
+
+//copyBatchMax is the number of chunk bytes that are copied between file systems per transaction
+const copyBatchMax = 8 * miB
+
+//entry is a path together with its file info
+type entry struct {
+	p  P
+	fi *fileInfo
+}
+
+//tree returns the entry at 'p' followed by all entries below it in key order, which places directories before their content
+func (fs *FileSystem) tree(tx Tx, p P) (entries []entry, err error) {
+	fi, err := fs.getfi(tx, p)
+	if err != nil {
+		return nil, err
+	}
+
+	entries = append(entries, entry{p, fi})
+	if !fi.IsDir() {
+		return entries, nil
+	}
+
+	prefix := p.Key()
+	if !p.IsRoot() {
+		prefix = append(prefix, PathSeparator...)
+	}
+
+	c := tx.Bucket(fs.fbucket).Cursor()
+	for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+		if bytes.Equal(k, prefix) {
+			continue //the root itself
+		}
+
+		childp := PathFromKey(k)
+		childfi, err := fs.getfi(tx, childp)
+		if err != nil {
+			return nil, err
+		}
+
+		entries = append(entries, entry{childp, childfi})
+	}
+
+	return entries, nil
+}
+
+//mkdirAll creates the directory at 'p' and any parents that don't exist yet
+func (fs *FileSystem) mkdirAll(tx Tx, p P, perm os.FileMode) (err error) {
+	for i := 1; i <= len(p); i++ {
+		if err = fs.MkdirTx(tx, p[:i], perm); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+//copyEntry recreates the entry of another file system at 'p' without any content, other than the target of a symbolic link. An existing file is replaced while an existing directory is kept
+func (fs *FileSystem) copyEntry(tx Tx, p P, srcfi *fileInfo) (fi *fileInfo, err error) {
+	pfi, err := fs.getfi(tx, p.Parent())
+	if err != nil {
+		return nil, err
+	}
+
+	if !pfi.IsDir() {
+		return nil, ErrNotDirectory
+	}
+
+	fi, err = fs.getfi(tx, p)
+	if err == nil {
+		if fi.IsDir() != srcfi.IsDir() {
+			return nil, ErrNotDirectory
+		}
+
+		if !fi.IsDir() {
+			if err = fs.delChunkPtrs(tx, fi); err != nil {
+				return nil, err
+			}
+
+			fi.D, fi.E = nil, nil //inline content and expiry of the replaced file
+		}
+	} else if err == os.ErrNotExist {
+		if err = fs.validateLimits(p); err != nil {
+			return nil, err
+		}
+
+		if _, err = fs.resolveCollision(tx, p, nil, false); err != nil {
+			return nil, err
+		}
+
+		fi = &fileInfo{}
+		if fi.I, err = fs.nextIno(tx); err != nil {
+			return nil, err
+		}
+
+		if srcfi.IsDir() {
+			fi.C = new(int64) //entries are counted as they are copied
+		}
+	} else {
+		return nil, err
+	}
+
+	fi.N = p.Base()
+	fi.M = srcfi.M
+	fi.T = srcfi.T
+	if srcfi.M&os.ModeSymlink != 0 {
+		fi.D, fi.S = srcfi.D, srcfi.S //the target of a link is kept with its entry
+	} else if !fi.IsDir() {
+		fi.S = 0 //grows as content is copied
+	}
+
+	return fi, fs.putfi(tx, p, fi)
+}
+
+//copyContent streams the chunks of file 'srcfi' in 'src' to the file at 'p', chunks that are already stored in this file system's chunk bucket are not transferred again
+func (fs *FileSystem) copyContent(p P, src *FileSystem, srcfi *fileInfo) (err error) {
+	if srcfi.D != nil {
+		return fs.db.Update(func(tx Tx) error {
+			fi, err := fs.getfi(tx, p)
+			if err != nil {
+				return err
+			}
+
+			if _, _, err = fs.writeChunks(tx, fi, 0, srcfi.D, true); err != nil {
+				return err
+			}
+
+			return fs.putfi(tx, p, fi)
+		})
+	}
+
+	var ptrs []chunkPtr
+	if err = src.db.View(func(tx Tx) error {
+		return src.getChunkPtrs(tx, srcfi, 0, func(ptr chunkPtr) error {
+			ptrs = append(ptrs, ptr)
+			return nil
+		})
+	}); err != nil {
+		return err
+	}
+
+	for len(ptrs) > 0 {
+
+		//read a batch of chunks that the destination doesn't have yet
+		var batch []chunkPtr
+		datas := map[K][]byte{}
+		size := 0
+		if err = fs.db.View(func(dtx Tx) error {
+			return src.db.View(func(stx Tx) error {
+				for ; len(ptrs) > 0 && size < copyBatchMax; ptrs = ptrs[1:] {
+					ptr := ptrs[0]
+					batch = append(batch, ptr)
+					if _, ok := datas[ptr.k]; ok || dtx.Bucket(fs.cbucket).Get(ptr.k[:]) != nil {
+						continue
+					}
+
+					data, err := src.getChunk(stx, ptr)
+					if err != nil {
+						return err
+					}
+
+					datas[ptr.k] = append([]byte{}, data...)
+					size += len(data)
+				}
+
+				return nil
+			})
+		}); err != nil {
+			return err
+		}
+
+		if err = fs.db.Update(func(tx Tx) error {
+			fi, err := fs.getfi(tx, p)
+			if err != nil {
+				return err
+			}
+
+			for _, ptr := range batch {
+				if data, ok := datas[ptr.k]; ok {
+					if _, err = fs.putChunk(tx, data); err != nil {
+						return err
+					}
+				}
+
+				if err = fs.putChunkPtr(tx, fi, ptr.off, ptr.k, ptr.n); err != nil {
+					return err
+				}
+			}
+
+			return nil
+		}); err != nil {
+			return err
+		}
+	}
+
+	//the size is set last such that holes at the end are preserved
+	return fs.db.Update(func(tx Tx) error {
+		fi, err := fs.getfi(tx, p)
+		if err != nil {
+			return err
+		}
+
+		fi.S = srcfi.S
+		return fs.putfi(tx, p, fi)
+	})
+}
+
+//CopyTree copies the file or directory at 'srcRoot' in 'src' and everything below it to 'dstRoot' in 'dst', missing parents of 'dstRoot' are created. Modes and modification times are preserved and file content is streamed in batches such that both file systems can live in different databases. Existing files in 'dst' are replaced, existing directories are merged with the copied content. If there is an error, it will be of type *PathError.
+func CopyTree(dst *FileSystem, dstRoot P, src *FileSystem, srcRoot P) (err error) {
+	for _, p := range []P{dstRoot, srcRoot} {
+		if err = p.Validate(); err != nil {
+			return p.Err("copy", err)
+		}
+	}
+
+	var entries []entry
+	if err = src.db.View(func(tx Tx) (err error) {
+		entries, err = src.tree(tx, srcRoot)
+		return err
+	}); err != nil {
+		return srcRoot.Err("copy", err)
+	}
+
+	for _, e := range entries {
+		dstp := append(append(P{}, dstRoot...), e.p[len(srcRoot):]...)
+		if err = dst.db.Update(func(tx Tx) error {
+			if !dstp.IsRoot() && e.p.Equals(srcRoot) {
+				if err := dst.mkdirAll(tx, dstp.Parent(), 0777); err != nil {
+					return err
+				}
+			}
+
+			if dstp.IsRoot() {
+				return nil //the root directory is always there
+			}
+
+			_, err := dst.copyEntry(tx, dstp, e.fi)
+			return err
+		}); err != nil {
+			return pathErr("copy", dstp, err)
+		}
+
+		if e.fi.IsDir() || e.fi.M&os.ModeSymlink != 0 {
+			continue
+		}
+
+		if err = dst.copyContent(dstp, src, e.fi); err != nil {
+			return pathErr("copy", dstp, err)
+		}
+	}
+
+	return nil
+}
+
+//Reflink creates the file at 'dst' such that it shares the content of the file at 'src' by referencing the same chunks, no chunk is read or stored again so it takes time in the order of the number of chunks. Chunks are never changed once stored: writes to either file store new chunks for the regions they touch and leave the other file as it was. An existing file at 'dst' is replaced, its mode and modification time are taken from 'src'. If there is an error, it will be of type *PathError.
+func (fs *FileSystem) Reflink(src, dst P) (err error) {
+	for _, p := range []P{src, dst} {
+		if err = p.Validate(); err != nil {
+			return p.Err("reflink", err)
+		}
+	}
+
+	if src.Equals(dst) {
+		return nil
+	}
+
+	errp := dst
+	if err = fs.db.Update(func(tx Tx) error {
+		srcfi, err := fs.getfi(tx, src)
+		if err != nil {
+			errp = src
+			return err
+		}
+
+		if srcfi.IsDir() {
+			errp = src
+			return ErrIsDirectory
+		}
+
+		//the ptrs are collected first, the bucket can't be written while iterating it
+		var ptrs []chunkPtr
+		if err = fs.getChunkPtrs(tx, srcfi, 0, func(ptr chunkPtr) error {
+			ptrs = append(ptrs, ptr)
+			return nil
+		}); err != nil {
+			return err
+		}
+
+		fi, err := fs.copyEntry(tx, dst, srcfi)
+		if err != nil {
+			return err
+		}
+
+		for _, ptr := range ptrs {
+			if err = fs.putChunkPtr(tx, fi, ptr.off, ptr.k, ptr.n); err != nil {
+				return err
+			}
+		}
+
+		fi.S = srcfi.S
+		fi.D = srcfi.D
+		return fs.putfi(tx, dst, fi)
+	}); err != nil {
+		return pathErr("reflink", errp, err)
+	}
+
+	return nil
+}
+
+//sameContent reports whether files 'afi' and 'bfi' hold the same bytes. Content is compared by chunk keys first, only when the files are chunked differently, for example because they were written in other pieces, the bytes are read and compared
+func (fs *FileSystem) sameContent(tx Tx, afi, bfi *fileInfo) (same bool, err error) {
+	if afi.S != bfi.S {
+		return false, nil
+	}
+
+	if afi.D == nil && bfi.D == nil {
+		var aptrs, bptrs []chunkPtr
+		for _, c := range []struct {
+			fi   *fileInfo
+			ptrs *[]chunkPtr
+		}{{afi, &aptrs}, {bfi, &bptrs}} {
+			if err = fs.getChunkPtrs(tx, c.fi, 0, func(ptr chunkPtr) error {
+				*c.ptrs = append(*c.ptrs, ptr)
+				return nil
+			}); err != nil {
+				return false, err
+			}
+		}
+
+		if len(aptrs) == len(bptrs) {
+			same = true
+			for i := range aptrs {
+				if aptrs[i] != bptrs[i] {
+					same = false
+					break
+				}
+			}
+
+			if same {
+				return true, nil
+			}
+		}
+	}
+
+	abuf, bbuf := make([]byte, copyBatchMax), make([]byte, copyBatchMax)
+	for off := int64(0); off < afi.S; off += int64(len(abuf)) {
+		an, err := fs.readChunks(tx, afi, off, abuf)
+		if err != nil {
+			return false, err
+		}
+
+		bn, err := fs.readChunks(tx, bfi, off, bbuf)
+		if err != nil {
+			return false, err
+		}
+
+		if !bytes.Equal(abuf[:an], bbuf[:bn]) {
+			return false, nil
+		}
+	}
+
+	return true, nil
+}
+
+//Compare walks the subtrees at 'a' and 'b' side by side and reports whether they are equal: both have entries with the same relative paths, the same modes and, for files, the same content. Modification times and owners are not compared. On the first difference it stops and returns the path relative to both roots at which the subtrees diverge, such as a file that only exists in one of them. If there is an error, it will be of type *PathError.
+func (fs *FileSystem) Compare(a, b P) (equal bool, diverge P, err error) {
+	for _, p := range []P{a, b} {
+		if err = p.Validate(); err != nil {
+			return false, nil, p.Err("compare", err)
+		}
+	}
+
+	if err = fs.db.View(func(tx Tx) error {
+		aentries, err := fs.tree(tx, a)
+		if err != nil {
+			return err
+		}
+
+		bentries, err := fs.tree(tx, b)
+		if err != nil {
+			return err
+		}
+
+		//both trees are in key order, so the first relative path that differs is the first divergence
+		for i := 0; i < len(aentries) || i < len(bentries); i++ {
+			if i >= len(aentries) {
+				diverge = bentries[i].p[len(b):]
+				return nil
+			}
+
+			if i >= len(bentries) {
+				diverge = aentries[i].p[len(a):]
+				return nil
+			}
+
+			ae, be := aentries[i], bentries[i]
+			arel, brel := ae.p[len(a):], be.p[len(b):]
+			if !arel.Equals(brel) {
+				if bytes.Compare(arel.Key(), brel.Key()) < 0 {
+					diverge = arel
+				} else {
+					diverge = brel
+				}
+
+				return nil
+			}
+
+			if ae.fi.M != be.fi.M {
+				diverge = arel
+				return nil
+			}
+
+			if ae.fi.IsDir() {
+				continue
+			}
+
+			same, err := fs.sameContent(tx, ae.fi, be.fi)
+			if err != nil {
+				return err
+			} else if !same {
+				diverge = arel
+				return nil
+			}
+		}
+
+		equal = true
+		return nil
+	}); err != nil {
+		return false, nil, a.Err("compare", err)
+	}
+
+	return equal, diverge, nil
+}
+
+//Equal reports whether the subtrees at 'a' and 'b' are equal, see Compare. If there is an error, it will be of type *PathError.
+func (fs *FileSystem) Equal(a, b P) (equal bool, err error) {
+	equal, _, err = fs.Compare(a, b)
+	return equal, err
+}
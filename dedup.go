@@ -0,0 +1,118 @@
+package treedb
+
+//ChunkRef references a chunk that holds the bytes of a file from 'Offset' onwards
+type ChunkRef struct {
+	Offset int64 //file offset of the first byte in the chunk
+	Key    K     //content key of the chunk, the sha256 of its bytes
+	Len    int   //length of the chunk in bytes
+}
+
+//DedupReport counts the chunk references of all files: 'unique' is the number of distinct chunks that are referenced and 'total' the number of references. 'reclaimable' is the number of bytes that deduplication saves, which are the bytes of all references beyond the first to each chunk
+func (fs *FileSystem) DedupReport() (unique, total int, reclaimable int64, err error) {
+	if err = fs.db.View(func(tx Tx) error {
+		seen := map[K]struct{}{}
+		return tx.Bucket(fs.pbucket).ForEach(func(k, v []byte) error {
+			ptr := decodeChunkPtr(k, v)
+			total++
+			if _, ok := seen[ptr.k]; ok {
+				reclaimable += ptr.n
+				return nil
+			}
+
+			seen[ptr.k] = struct{}{}
+			unique++
+			return nil
+		})
+	}); err != nil {
+		return 0, 0, 0, err
+	}
+
+	return unique, total, reclaimable, nil
+}
+
+//FileChunks returns the chunks that hold the content of the file at 'p' ordered by offset, such that sync tools can transfer only the chunks a remote doesn't have yet. Holes are not covered by any chunk and small files that are stored inline have none at all. If there is an error, it will be of type *PathError.
+func (fs *FileSystem) FileChunks(p P) (refs []ChunkRef, err error) {
+	err = p.Validate()
+	if err != nil {
+		return nil, p.Err("filechunks", err)
+	}
+
+	if err = fs.db.View(func(tx Tx) error {
+		fi, err := fs.getfi(tx, p)
+		if err != nil {
+			return err
+		}
+
+		if fi.IsDir() {
+			return ErrIsDirectory
+		}
+
+		return fs.getChunkPtrs(tx, fi, 0, func(ptr chunkPtr) error {
+			refs = append(refs, ChunkRef{Offset: ptr.off, Key: ptr.k, Len: int(ptr.n)})
+			return nil
+		})
+	}); err != nil {
+		return nil, p.Err("filechunks", err)
+	}
+
+	return refs, nil
+}
+
+//Rechunk rewrites the content of the file at 'p' with the chunk boundaries of 'cfg' in a single transaction, for example after switching to a different polynomial. Holes are preserved. If there is an error, it will be of type *PathError.
+func (fs *FileSystem) Rechunk(p P, cfg ChunkConfig) (err error) {
+	err = p.Validate()
+	if err != nil {
+		return p.Err("rechunk", err)
+	}
+
+	if err = fs.db.Update(func(tx Tx) error {
+		fi, err := fs.getfi(tx, p)
+		if err != nil {
+			return err
+		}
+
+		if fi.IsDir() {
+			return ErrIsDirectory
+		}
+
+		//collect runs of adjacent chunks, the gaps between runs are holes
+		type run struct {
+			off  int64
+			data []byte
+		}
+
+		var runs []*run
+		if err = fs.getChunkPtrs(tx, fi, 0, func(ptr chunkPtr) error {
+			data, err := fs.getChunk(tx, ptr)
+			if err != nil {
+				return err
+			}
+
+			if len(runs) == 0 || runs[len(runs)-1].off+int64(len(runs[len(runs)-1].data)) != ptr.off {
+				runs = append(runs, &run{off: ptr.off})
+			}
+
+			runs[len(runs)-1].data = append(runs[len(runs)-1].data, data...)
+			return nil
+		}); err != nil {
+			return err
+		}
+
+		if err = fs.delChunkPtrs(tx, fi); err != nil {
+			return err
+		}
+
+		for _, r := range runs {
+			if _, _, err = fs.putRegion(tx, fi, r.off, r.data, cfg, true); err != nil {
+				return err
+			}
+		}
+
+		fi.T = fs.clock.Now()
+		return fs.putfi(tx, p, fi)
+	}); err != nil {
+		return p.Err("rechunk", err)
+	}
+
+	return nil
+}
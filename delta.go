@@ -0,0 +1,240 @@
+package treedb
+
+import (
+	"crypto/sha256"
+	"os"
+	"time"
+)
+
+//SyncFile describes the content of a file such that SyncReceive can recreate it on another file system, as returned by SyncSend
+type SyncFile struct {
+	Size   int64      //size of the file, bytes that no chunk covers are holes
+	Inline []byte     //content of a small file that is stored inline, such a file has no chunks
+	Chunks []ChunkRef //chunks that hold the content ordered by offset, as returned by FileChunks
+}
+
+//SyncSend describes the content of the file at 'p' for SyncReceive on another file system. If there is an error, it will be of type *PathError.
+func (fs *FileSystem) SyncSend(p P) (sf SyncFile, err error) {
+	err = p.Validate()
+	if err != nil {
+		return sf, p.Err("syncsend", err)
+	}
+
+	if err = fs.db.View(func(tx Tx) error {
+		fi, err := fs.getfi(tx, p)
+		if err != nil {
+			return err
+		}
+
+		if fi.IsDir() {
+			return ErrIsDirectory
+		}
+
+		sf.Size = fi.S
+		if fi.D != nil {
+			sf.Inline = append([]byte{}, fi.D...)
+			return nil
+		}
+
+		return fs.getChunkPtrs(tx, fi, 0, func(ptr chunkPtr) error {
+			sf.Chunks = append(sf.Chunks, ChunkRef{Offset: ptr.off, Key: ptr.k, Len: int(ptr.n)})
+			return nil
+		})
+	}); err != nil {
+		return SyncFile{}, p.Err("syncsend", err)
+	}
+
+	return sf, nil
+}
+
+//SyncReceive assembles the file at 'p' as described by 'sf', as returned by SyncSend on another file system. Inline content is written as is. Chunks that are already stored locally are reused and only the missing ones are obtained by calling 'fetch', at most once per key. Fetched bytes must hash to the requested key. The file gets the size of 'sf', such that holes at its end are kept. Chunks are fetched and stored in batches of a bounded size, in a temporary file that is renamed over 'p' at the end: when 'fetch' fails the temporary file is removed and 'p' is left untouched. If there is an error, it will be of type *PathError.
+func (fs *FileSystem) SyncReceive(p P, sf SyncFile, fetch func(K) ([]byte, error)) (err error) {
+	err = p.Validate()
+	if err != nil {
+		return p.Err("syncreceive", err)
+	}
+
+	//refs must be ordered by offset and may not overlap, holes are allowed. Inline content is all there is
+	end := int64(0)
+	for _, ref := range sf.Chunks {
+		if ref.Offset < end || ref.Len <= 0 {
+			return p.Err("syncreceive", os.ErrInvalid)
+		}
+
+		end = ref.Offset + int64(ref.Len)
+	}
+
+	if sf.Inline != nil && (len(sf.Chunks) > 0 || int64(len(sf.Inline)) != sf.Size) || sf.Size < 0 {
+		return p.Err("syncreceive", os.ErrInvalid)
+	}
+
+	f, err := fs.createTmp("syncreceive", p, 0666)
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		if err != nil {
+			fs.abortTmp(f)
+		}
+	}()
+
+	if sf.Inline != nil {
+		if _, err = f.Write(sf.Inline); err != nil {
+			f.Close()
+			return err
+		}
+	}
+
+	if err = f.Close(); err != nil {
+		return err
+	}
+
+	if sf.Inline == nil {
+		if err = fs.db.Update(func(tx Tx) error {
+			fi, err := fs.getfi(tx, f.tmpp)
+			if err != nil {
+				return err
+			}
+
+			fi.S = sf.Size
+			return fs.putfi(tx, f.tmpp, fi)
+		}); err != nil {
+			return p.Err("syncreceive", err)
+		}
+	}
+
+	refs := sf.Chunks
+	fetched := map[K]struct{}{}
+	for len(refs) > 0 {
+
+		//fetch a batch of chunks that are neither stored locally nor fetched before
+		var batch []ChunkRef
+		datas := map[K][]byte{}
+		var missing []ChunkRef
+		if err = fs.db.View(func(tx Tx) error {
+			n := 0
+			for ; len(refs) > 0 && n < copyBatchMax; refs = refs[1:] {
+				ref := refs[0]
+				batch = append(batch, ref)
+				if _, ok := fetched[ref.Key]; ok || tx.Bucket(fs.cbucket).Get(ref.Key[:]) != nil {
+					continue
+				}
+
+				fetched[ref.Key] = struct{}{}
+				missing = append(missing, ref)
+				n += ref.Len
+			}
+
+			return nil
+		}); err != nil {
+			return p.Err("syncreceive", err)
+		}
+
+		for _, ref := range missing {
+			data, err := fetch(ref.Key)
+			if err != nil {
+				return p.Err("syncreceive", err)
+			}
+
+			if len(data) != ref.Len || sha256.Sum256(data) != ref.Key {
+				return p.Err("syncreceive", &ChunkCorruptError{Off: ref.Offset, K: ref.Key})
+			}
+
+			datas[ref.Key] = data
+		}
+
+		if err = fs.db.Update(func(tx Tx) error {
+			fi, err := fs.getfi(tx, f.tmpp)
+			if err != nil {
+				return err
+			}
+
+			for _, ref := range batch {
+				if data, ok := datas[ref.Key]; ok {
+					if _, err = fs.putChunk(tx, data); err != nil {
+						return err
+					}
+				}
+
+				if err = fs.putChunkPtr(tx, fi, ref.Offset, ref.Key, int64(ref.Len)); err != nil {
+					return err
+				}
+			}
+
+			fi.T = fs.clock.Now()
+			return fs.putfi(tx, f.tmpp, fi)
+		}); err != nil {
+			return p.Err("syncreceive", err)
+		}
+	}
+
+	return fs.commitTmp(f)
+}
+
+//ReceiveEntry is a file, directory or symbolic link of another store that ReceiveTree recreates
+type ReceiveEntry struct {
+	P       P           //path at which the entry is created
+	Mode    os.FileMode //mode and permission bits, with ModeDir set a directory is created
+	ModTime time.Time   //modification time
+	File    SyncFile    //content of a file, unused for directories. The target of a symbolic link is its inline content
+}
+
+//ReceiveTree recreates 'entries' in tree order, directories before their content, as read from a store that keeps chunks under the same content keys. Missing parents of the first entry are created. Directories that already exist are merged with and existing files are replaced. Symbolic links are created with the target in their inline content, they aren't followed. File content is assembled with SyncReceive, chunks are obtained by calling 'fetch' unless they are already stored. Modes and modification times are set after all content was written, those of directories after those of their content
+func (fs *FileSystem) ReceiveTree(entries []ReceiveEntry, fetch func(K) ([]byte, error)) (err error) {
+	if len(entries) > 0 && !entries[0].P.IsRoot() {
+		top := entries[0].P
+		if err = fs.db.Update(func(tx Tx) error {
+			return fs.mkdirAll(tx, top.Parent(), 0777)
+		}); err != nil {
+			return pathErr("receivetree", top.Parent(), err)
+		}
+	}
+
+	for _, e := range entries {
+		if e.Mode&os.ModeSymlink != 0 {
+			if fi, err := fs.Lstat(e.P); err == nil && !fi.IsDir() {
+				if err = fs.Remove(e.P); err != nil {
+					return err
+				}
+			}
+
+			if err = fs.Symlink(string(e.File.Inline), e.P); err != nil {
+				return err
+			}
+
+			continue
+		}
+
+		if !e.Mode.IsDir() {
+			if err = fs.SyncReceive(e.P, e.File, fetch); err != nil {
+				return err
+			}
+
+			continue
+		}
+
+		if e.P.IsRoot() {
+			continue
+		}
+
+		if err = fs.Mkdir(e.P, e.Mode.Perm()); err != nil {
+			if fi, serr := fs.Stat(e.P); serr != nil || !fi.IsDir() {
+				return err
+			}
+		}
+	}
+
+	//entries are in tree order, so walking them backwards sets the attributes of directories after those of their content
+	for i := len(entries) - 1; i >= 0; i-- {
+		if err = fs.Chmod(entries[i].P, entries[i].Mode); err != nil {
+			return err
+		}
+
+		if err = fs.Chtimes(entries[i].P, entries[i].ModTime, entries[i].ModTime); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,209 @@
+package treedb
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestSyncReceive(t *testing.T) {
+	src, close := testfs(t)
+	defer close()
+
+	dst, close2 := testfs(t)
+	defer close2()
+
+	data := make([]byte, 5*miB)
+	rand.Read(data)
+	testwrite(src, t, P{"a.txt"}, data)
+
+	sf, err := src.SyncSend(P{"a.txt"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	refs := sf.Chunks
+
+	if len(refs) < 3 {
+		t.Fatalf("expected at least 3 chunks, got: %d", len(refs))
+	}
+
+	//the destination already has every other chunk
+	seeded := map[K]bool{}
+	if err = dst.db.Update(func(tx Tx) error {
+		for i := 0; i < len(refs); i += 2 {
+			ref := refs[i]
+			if _, err := dst.putChunk(tx, data[ref.Offset:ref.Offset+int64(ref.Len)]); err != nil {
+				return err
+			}
+
+			seeded[ref.Key] = true
+		}
+
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	blobs := map[K][]byte{}
+	for _, ref := range refs {
+		blobs[ref.Key] = data[ref.Offset : ref.Offset+int64(ref.Len)]
+	}
+
+	fetched := map[K]int{}
+	fetch := func(k K) ([]byte, error) {
+		fetched[k]++
+		return blobs[k], nil
+	}
+
+	if err = dst.SyncReceive(P{"b.txt"}, sf, fetch); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+
+	for _, ref := range refs {
+		if seeded[ref.Key] && fetched[ref.Key] > 0 {
+			t.Errorf("expected chunk %x that exists locally not to be fetched", ref.Key)
+		} else if !seeded[ref.Key] && fetched[ref.Key] != 1 {
+			t.Errorf("expected missing chunk %x to be fetched once, got: %d", ref.Key, fetched[ref.Key])
+		}
+	}
+
+	if output := testread(dst, t, P{"b.txt"}); !bytes.Equal(output, data) {
+		t.Error("expected synced content to equal the source")
+	}
+
+	//a failing fetch leaves the existing file and no temporary files behind
+	failed := errors.New("remote is gone")
+	other := make([]byte, 2*miB)
+	rand.Read(other)
+	testwrite(src, t, P{"c.txt"}, other)
+	if sf, err = src.SyncSend(P{"c.txt"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = dst.SyncReceive(P{"b.txt"}, sf, func(k K) ([]byte, error) { return nil, failed }); !errors.Is(err, failed) {
+		t.Errorf("expected fetch error, got: %v", err)
+	}
+
+	if output := testread(dst, t, P{"b.txt"}); !bytes.Equal(output, data) {
+		t.Error("expected file to be untouched by a failed sync")
+	}
+
+	if err = dst.SyncReceive(P{"b.txt"}, sf, func(k K) ([]byte, error) { return []byte("bogus"), nil }); !errors.Is(err, ErrChunkCorrupt) {
+		t.Errorf("expected corrupt chunk error, got: %v", err)
+	}
+
+	infos, err := dst.ReadDirSorted(Root, SortByName)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(infos) != 1 {
+		t.Errorf("expected only the synced file to exist, got: %d entries", len(infos))
+	}
+
+	if err = dst.SyncReceive(P{"d.txt"}, SyncFile{Size: sf.Size, Chunks: []ChunkRef{sf.Chunks[1], sf.Chunks[0]}}, fetch); !errors.Is(err, os.ErrInvalid) {
+		t.Errorf("expected unordered refs to be invalid, got: %v", err)
+	}
+}
+
+func TestSyncReceiveHoleAndInline(t *testing.T) {
+	db, close := testdb(t)
+	defer close()
+
+	src, err := NewFileSystem("src", db, WithInlineThreshold(64))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dst, err := NewFileSystem("dst", db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//a file that ends in a hole has no chunk that covers its last bytes
+	data := make([]byte, 2*miB)
+	rand.Read(data)
+	testwrite(src, t, P{"hole.bin"}, data)
+	if err = src.Allocate(P{"hole.bin"}, 3*miB); err != nil {
+		t.Fatal(err)
+	}
+
+	testwrite(src, t, P{"small.txt"}, []byte("inline"))
+	fetch := func(k K) ([]byte, error) {
+		var data []byte
+		err := src.db.View(func(tx Tx) error {
+			data = append([]byte{}, tx.Bucket(src.cbucket).Get(k[:])...)
+			return nil
+		})
+
+		return data, err
+	}
+
+	for _, p := range []P{{"hole.bin"}, {"small.txt"}} {
+		sf, err := src.SyncSend(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err = dst.SyncReceive(p, sf, fetch); err != nil {
+			t.Fatalf("expected %v to be synced, got: %v", p, err)
+		}
+
+		if expected, output := testread(src, t, p), testread(dst, t, p); !bytes.Equal(output, expected) {
+			t.Errorf("expected %v to equal the source, got %d bytes instead of %d", p, len(output), len(expected))
+		}
+	}
+
+	if sf, err := src.SyncSend(P{"small.txt"}); err != nil || len(sf.Chunks) != 0 || string(sf.Inline) != "inline" {
+		t.Errorf("expected an inline file to be sent with its content, got: %+v, %v", sf, err)
+	}
+
+	if err = dst.SyncReceive(P{"bad.txt"}, SyncFile{Size: 3, Inline: []byte("inline")}, fetch); !errors.Is(err, os.ErrInvalid) {
+		t.Errorf("expected inline content that doesn't match the size to be invalid, got: %v", err)
+	}
+}
+
+func TestReceiveTree(t *testing.T) {
+	fs, close := testfs(t)
+	defer close()
+
+	if err := fs.Mkdir(P{"dir"}, 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	data := []byte("hello chunk")
+	k := K(sha256.Sum256(data))
+	mtime := time.Date(2016, 8, 1, 12, 0, 0, 0, time.UTC)
+	entries := []ReceiveEntry{
+		{P: Root, Mode: os.ModeDir | 0777, ModTime: mtime},
+		{P: P{"dir"}, Mode: os.ModeDir | 0755, ModTime: mtime},
+		{P: P{"dir", "hole.bin"}, Mode: 0644, ModTime: mtime, File: SyncFile{Size: 100, Chunks: []ChunkRef{{Offset: 10, Key: k, Len: len(data)}}}},
+		{P: P{"dir", "sub"}, Mode: os.ModeDir | 0755, ModTime: mtime},
+	}
+
+	if err := fs.ReceiveTree(entries, func(K) ([]byte, error) { return data, nil }); err != nil {
+		t.Fatalf("expected the tree to be received, got: %v", err)
+	}
+
+	expected := make([]byte, 100)
+	copy(expected[10:], data)
+	if output := testread(fs, t, P{"dir", "hole.bin"}); !bytes.Equal(output, expected) {
+		t.Errorf("expected the file to keep its trailing hole, got %d bytes: %q", len(output), output)
+	}
+
+	for _, e := range entries {
+		fi, err := fs.Stat(e.P)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if fi.Mode() != e.Mode || !fi.ModTime().Equal(mtime) {
+			t.Errorf("expected %v to get mode %v and time %v, got: %v, %v", e.P, e.Mode, mtime, fi.Mode(), fi.ModTime())
+		}
+	}
+}
@@ -0,0 +1,64 @@
+package treedb
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"os"
+	"time"
+)
+
+//MetadataRecord describes a single file or directory in the output of ExportMetadata
+type MetadataRecord struct {
+	Path    P           `json:"path"`
+	Mode    os.FileMode `json:"mode"`
+	Size    int64       `json:"size"`
+	ModTime time.Time   `json:"modtime"`
+	Chunks  []string    `json:"chunks,omitempty"` //hex encoded content keys of the chunks of a file in file order, empty for directories and files that are stored inline
+}
+
+//ExportMetadata writes one JSON encoded MetadataRecord per line to 'w' for 'root' and everything below it, such that indexers can take in the namespace without reading file content. Directories are written before their entries, which are listed in order of their names and depth first. Records are written while the tree is walked in a single read transaction, memory use grows with the depth of the tree but not with its size. If there is an error, it will be of type *PathError
+func (fs *FileSystem) ExportMetadata(root P, w io.Writer) (err error) {
+	if err = root.Validate(); err != nil {
+		return pathErr("export", root, err)
+	}
+
+	enc := json.NewEncoder(w)
+	if err = fs.db.View(func(tx Tx) error {
+		fi, err := fs.getfi(tx, root)
+		if err != nil {
+			return err
+		}
+
+		return fs.exportMetadata(tx, root, fi, enc)
+	}); err != nil {
+		return pathErr("export", root, err)
+	}
+
+	return nil
+}
+
+//exportMetadata encodes the record of 'fi' at path 'p' and, for a directory, those of all its descendants
+func (fs *FileSystem) exportMetadata(tx Tx, p P, fi *fileInfo, enc *json.Encoder) (err error) {
+	rec := MetadataRecord{Path: p, Mode: fi.M, Size: fi.S, ModTime: fi.T}
+	if !fi.IsDir() && fi.D == nil {
+		if err = fs.getChunkPtrs(tx, fi, 0, func(ptr chunkPtr) error {
+			rec.Chunks = append(rec.Chunks, hex.EncodeToString(ptr.k[:]))
+			return nil
+		}); err != nil {
+			return err
+		}
+	}
+
+	if err = enc.Encode(rec); err != nil {
+		return err
+	}
+
+	if !fi.IsDir() {
+		return nil
+	}
+
+	return fs.walkdir(tx, p, nil, func(cp P, cfi *fileInfo) error {
+		return fs.exportMetadata(tx, cp, cfi, enc)
+	})
+}
@@ -0,0 +1,71 @@
+package treedb
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/json"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestExportMetadata(t *testing.T) {
+	db, close := testdb(t)
+	defer close()
+
+	fs, err := NewFileSystem(t.Name(), db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testfiles(fs, t)
+	data := make([]byte, 3*miB)
+	rand.Read(data)
+	testwrite(fs, t, P{"bar", "d.bin"}, data)
+
+	buf := bytes.NewBuffer(nil)
+	if err = fs.ExportMetadata(Root, buf); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+
+	paths := []string{}
+	s := bufio.NewScanner(buf)
+	for s.Scan() {
+		rec := MetadataRecord{}
+		if err = json.Unmarshal(s.Bytes(), &rec); err != nil {
+			t.Fatalf("expected each line to be a record, got: %v", err)
+		}
+
+		paths = append(paths, rec.Path.String())
+		if rec.Path.Equals(P{"bar", "d.bin"}) && (rec.Size != int64(len(data)) || len(rec.Chunks) < 2) {
+			t.Errorf("expected the large file to list its chunks, got: %d bytes in %d chunks", rec.Size, len(rec.Chunks))
+		}
+
+		if rec.Path.Equals(P{"bar"}) && !rec.Mode.IsDir() {
+			t.Errorf("expected bar to be exported as a directory, got: %v", rec.Mode)
+		}
+	}
+
+	if err = s.Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{"/", "/a.txt", "/b.txt", "/bar", "/bar/c.txt", "/bar/d.bin", "/bar\uFFFEc.txt"}
+	if !reflect.DeepEqual(paths, expected) {
+		t.Errorf("expected paths %q in tree order, got: %q", expected, paths)
+	}
+
+	buf.Reset()
+	if err = fs.ExportMetadata(P{"bar"}, buf); err != nil {
+		t.Fatal(err)
+	}
+
+	if n := bytes.Count(buf.Bytes(), []byte("\n")); n != 3 {
+		t.Errorf("expected a subtree to export 3 records, got: %d", n)
+	}
+
+	if err = fs.ExportMetadata(P{"nope"}, buf); !os.IsNotExist(err) {
+		t.Errorf("expected exporting a missing path to fail, got: %v", err)
+	}
+}
@@ -4,8 +4,8 @@ import (
 	"crypto/sha256"
 	"io"
 	"os"
-
-	"github.com/boltdb/bolt"
+	"sync"
+	"time"
 )
 
 //K is the content hash of a file chunk
@@ -33,20 +33,36 @@ type K [sha256.Size]byte
 // - fs.HandleWriter
 // - fs.HandleFlusher
 type File struct {
-	p      P           //path as passed to open
-	fs     *FileSystem //file system this file is part of
-	chunks map[int64]K //maps chunk file position (bytes) to chunk k
+	p    P           //path as passed to open
+	fs   *FileSystem //file system this file is part of
+	flag int         //flags as passed to open
+	pos  int64       //position of the cursor for reading and writing
+	open bool        //whether the handle is registered as open with the file system
+	tx   Tx          //transaction managed by the caller that io is performed in, if any
+
+	wbuf []byte //written bytes that are not yet chunked
+	woff int64  //file offset of the first byte in wbuf
+
+	readdirStartP P   //internal state kept for readdir consecutive callse
+	readdirSnap   []P //children of the directory as they were at the first paged readdir call, in snapshot mode
 
-	readdirStartP P //internal state kept for readdir consecutive callse
+	ra readahead //chunks that were prefetched for sequential reads
 
-	//TODO rq: how do we handle db transactions for long reads (cant block the whole db)
 	//TODO rq: how do we update modtimes
-	//TODO rq: how to do appending
-	//TODO implement: read dir
 	//TODO what to do if two threads opens same file?
 }
 
-//NewFile sets up a file on filesystem 'fs' at path 'p'
+//File is used wherever the standard io interfaces are expected
+var (
+	_ io.ReadWriteSeeker = (*File)(nil)
+	_ io.ReaderAt        = (*File)(nil)
+	_ io.WriterAt        = (*File)(nil)
+	_ io.Closer          = (*File)(nil)
+	_ io.WriterTo        = (*File)(nil)
+	_ io.ReaderFrom      = (*File)(nil)
+)
+
+//NewFile sets up a file on filesystem 'fs' at path 'p', without open flags the handle can only be read from
 func NewFile(fs *FileSystem, p P) *File {
 	return &File{
 		fs: fs,
@@ -54,17 +70,123 @@ func NewFile(fs *FileSystem, p P) *File {
 	}
 }
 
+//Path returns the path of the file, which differs from the path it was opened with when its name collided with that of a sibling and CollisionRename applied
+func (f *File) Path() P { return f.p }
+
+//view runs 'fn' in the caller's transaction if the file was opened with one, or else in a new read-only transaction after which chunks that were recovered from a replica are repaired. With a read timeout the new transaction is watched and rolled back once its deadline has passed
+func (f *File) view(fn func(tx Tx) error) error {
+	if f.tx != nil {
+		return fn(f.tx)
+	}
+
+	defer f.fs.heal()
+	if f.fs.rtimeout <= 0 {
+		return f.fs.db.View(fn)
+	}
+
+	tx, err := f.fs.db.Begin(false)
+	if err != nil {
+		return err
+	}
+
+	dtx := watch(tx, f.fs.rtimeout)
+	defer dtx.end()
+	return fn(dtx)
+}
+
+//deadlineTx is a read transaction with a watchdog that rolls it back once its deadline has passed. The reader holds its lock while it uses the transaction and only releases it while it waits for a consumer in writeOut, which is when the watchdog can step in. A consumer that stalls therefore doesn't keep the transaction open, while a transaction is never rolled back underneath a reader that uses it
+type deadlineTx struct {
+	Tx
+	mu       sync.Mutex
+	deadline time.Time
+	timer    *time.Timer
+	done     bool //whether the transaction was rolled back
+}
+
+//watch starts the watchdog of read transaction 'tx' that rolls it back after 'd', the caller holds the lock until it calls end
+func watch(tx Tx, d time.Duration) *deadlineTx {
+	dtx := &deadlineTx{Tx: tx, deadline: time.Now().Add(d)}
+	dtx.mu.Lock()
+	dtx.timer = time.AfterFunc(d, dtx.expire)
+	return dtx
+}
+
+//expire is called by the watchdog, it rolls the transaction back unless the reader ended it
+func (tx *deadlineTx) expire() {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+	if !tx.done {
+		tx.done = true
+		tx.Tx.Rollback()
+	}
+}
+
+//end stops the watchdog and rolls the transaction back, unless the watchdog already did
+func (tx *deadlineTx) end() {
+	tx.timer.Stop()
+	if !tx.done {
+		tx.done = true
+		tx.Tx.Rollback()
+	}
+
+	tx.mu.Unlock()
+}
+
+//checkDeadline returns ErrReadTimeout when 'tx' has a deadline that has passed
+func checkDeadline(tx Tx) error {
+	if dtx, ok := tx.(*deadlineTx); ok && (dtx.done || time.Now().After(dtx.deadline)) {
+		return ErrReadTimeout
+	}
+
+	return nil
+}
+
+//writeOut writes 'b' to consumer 'w'. When 'tx' has a deadline its watchdog may roll it back while the consumer takes its time, 'b' is copied first since the memory of the transaction can be unmapped after that and ErrReadTimeout is returned when it happened
+func writeOut(tx Tx, w io.Writer, b []byte) (n int, err error) {
+	dtx, ok := tx.(*deadlineTx)
+	if !ok {
+		return w.Write(b)
+	}
+
+	b = append([]byte{}, b...)
+	dtx.mu.Unlock()
+	n, err = w.Write(b)
+	dtx.mu.Lock()
+	if err == nil && dtx.done {
+		err = ErrReadTimeout
+	}
+
+	return n, err
+}
+
+//update runs 'fn' in the caller's transaction if the file was opened with one, or else in a new read-write transaction
+func (f *File) update(fn func(tx Tx) error) error {
+	if f.tx != nil {
+		return fn(f.tx)
+	}
+
+	return f.fs.db.Update(fn)
+}
+
 func (f *File) readdir(n int, fn walkFn) (err error) {
 	if n <= 0 {
 		f.readdirStartP = nil //reset if n <= 0
+		f.readdirSnap = nil
+	} else if f.fs.rdsnap {
+		return f.readdirSnapshot(n, fn)
 	}
 
 	i := 0
-	if err = f.fs.db.View(func(tx *bolt.Tx) error {
+	if err = f.view(func(tx Tx) error {
 
 		//streamed readdir is not atomic, files can be added to the db between consecutive database calls. A nice confirmation of this problem: http://yarchive.net/comp/linux/readdir_nonatomicity.html , the kernel cannot provide a snapshot of a directory for atom operations
 
 		return f.fs.walkdir(tx, f.p, f.readdirStartP, func(p P, fi *fileInfo) error {
+			if n <= 0 && f.fs.rdmax > 0 && i >= f.fs.rdmax {
+				return ErrDirectoryTooLarge //the entry after the last that is allowed
+			}
+
+			f.fs.inodes.track(fi.I, p)
 			err = fn(p, fi)
 			if err != nil {
 				return err
@@ -78,7 +200,6 @@ func (f *File) readdir(n int, fn walkFn) (err error) {
 			if i == n {
 				return errStopWalk
 			}
-
 			return nil
 		})
 	}); err != nil {
@@ -93,6 +214,50 @@ func (f *File) readdir(n int, fn walkFn) (err error) {
 	return nil
 }
 
+//readdirSnapshot pages over the children of the directory as they were when the first page was read, such that consecutive calls neither miss nor repeat entries when the directory changes in between. Children that were removed since are skipped, those that were added are never listed
+func (f *File) readdirSnapshot(n int, fn walkFn) (err error) {
+	i := 0
+	if err = f.view(func(tx Tx) error {
+		if f.readdirSnap == nil {
+			f.readdirSnap = []P{}
+			if err := f.fs.walkdir(tx, f.p, nil, func(p P, fi *fileInfo) error {
+				f.readdirSnap = append(f.readdirSnap, p)
+				return nil
+			}); err != nil {
+				f.readdirSnap = nil
+				return err
+			}
+		}
+
+		for ; len(f.readdirSnap) > 0 && i < n; f.readdirSnap = f.readdirSnap[1:] {
+			p := f.readdirSnap[0]
+			fi, err := f.fs.getfi(tx, p)
+			if err == os.ErrNotExist || (err == nil && f.fs.expired(fi)) {
+				continue
+			} else if err != nil {
+				return err
+			}
+
+			f.fs.inodes.track(fi.I, p)
+			if err = fn(p, fi); err != nil {
+				return err
+			}
+
+			i++
+		}
+
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	if i == 0 {
+		return io.EOF
+	}
+
+	return nil
+}
+
 // Readdirnames reads and returns a slice of names from the directory f.
 //
 // If n > 0, Readdirnames returns at most n names. In this case, if Readdirnames returns an empty slice, it will return a non-nil error explaining why. At the end of a directory, the error is io.EOF.
@@ -126,3 +291,320 @@ func (f *File) Readdir(n int) (fis []os.FileInfo, err error) {
 
 	return fis, nil
 }
+
+//DirEntry is an entry read from a directory, it implements the fs.DirEntry interface without requiring another lookup for the entry's type
+type DirEntry struct {
+	fi *fileInfo
+}
+
+//Name returns the name of the file (or subdirectory) described by the entry
+func (de DirEntry) Name() string { return de.fi.Name() }
+
+//IsDir reports whether the entry describes a directory
+func (de DirEntry) IsDir() bool { return de.fi.IsDir() }
+
+//Type returns the type bits for the entry
+func (de DirEntry) Type() os.FileMode { return de.fi.Mode().Type() }
+
+//Info returns the FileInfo for the file or subdirectory described by the entry, as it was read from the directory
+func (de DirEntry) Info() (os.FileInfo, error) { return de.fi, nil }
+
+//Ino returns the inode number of the entry
+func (de DirEntry) Ino() uint64 { return de.fi.I }
+
+// ReaddirTypes reads the contents of the directory associated with file and returns a slice of up to n DirEntry values in directory order, such that bindings like FUSE can report the type of each entry without an additional stat. Paging and the returned errors work the same as for Readdir
+func (f *File) ReaddirTypes(n int) (entries []DirEntry, err error) {
+	err = f.readdir(n, func(p P, fi *fileInfo) error {
+		entries = append(entries, DirEntry{fi: fi})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return entries, nil
+}
+
+//wbufMax is the number of written bytes that are buffered before they are chunked and stored
+const wbufMax = 8 * miB
+
+//flush chunks and stores buffered writes. Unless 'all' is true the last chunk is kept in the buffer such that subsequent writes can be appended to it
+func (f *File) flush(all bool) (err error) {
+	if len(f.wbuf) == 0 {
+		return nil
+	}
+
+	//the buffer is only replaced by what remains once the transaction committed, a batched transaction might run again
+	var rest []byte
+	var restOff int64
+	if err = f.update(func(tx Tx) error {
+		fi, err := f.fs.getfi(tx, f.p)
+		if err != nil {
+			return err
+		}
+
+		rest, restOff, err = f.fs.writeChunks(tx, fi, f.woff, f.wbuf, all)
+		if err != nil {
+			return err
+		}
+
+		fi.T = f.fs.clock.Now()
+		return f.fs.putfi(tx, f.p, fi)
+	}); err != nil {
+		return err
+	}
+
+	f.wbuf, f.woff = rest, restOff
+	return nil
+}
+
+//size returns the size of the file including writes that are still buffered
+func (f *File) size() (size int64, err error) {
+	if err = f.view(func(tx Tx) error {
+		fi, err := f.fs.getfi(tx, f.p)
+		if err != nil {
+			return err
+		}
+
+		size = fi.S
+		return nil
+	}); err != nil {
+		return 0, err
+	}
+
+	if f.woff+int64(len(f.wbuf)) > size {
+		size = f.woff + int64(len(f.wbuf))
+	}
+
+	return size, nil
+}
+
+// Write writes len(b) bytes to the File. It returns the number of bytes written and an error, if any. Write returns a non-nil error when n != len(b). Handles that were opened without O_WRONLY or O_RDWR fail with os.ErrPermission.
+func (f *File) Write(b []byte) (n int, err error) {
+	if !writable(f.flag) {
+		return 0, f.p.Err("write", os.ErrPermission)
+	}
+
+	if f.flag&os.O_APPEND != 0 {
+		if f.pos, err = f.size(); err != nil {
+			return 0, f.p.Err("write", err)
+		}
+	}
+
+	//only writes that continue the buffered bytes are buffered together
+	if f.woff+int64(len(f.wbuf)) != f.pos {
+		if err = f.flush(true); err != nil {
+			return 0, f.p.Err("write", err)
+		}
+
+		f.woff = f.pos
+	}
+
+	f.wbuf = append(f.wbuf, b...)
+	f.pos = f.pos + int64(len(b))
+	if len(f.wbuf) >= wbufMax {
+		if err = f.flush(false); err != nil {
+			return 0, f.p.Err("write", err)
+		}
+	}
+
+	return len(b), nil
+}
+
+// WriteAt writes len(b) bytes to the File starting at byte offset off. It returns the number of bytes written and an error, if any. The cursor that Write and Read use is left where it was. Handles that were opened with O_APPEND fail with os.ErrInvalid, like those of the os package, since their writes always go to the end.
+func (f *File) WriteAt(b []byte, off int64) (n int, err error) {
+	if f.flag&os.O_APPEND != 0 {
+		return 0, f.p.Err("write", os.ErrInvalid)
+	}
+
+	if off < 0 {
+		return 0, f.p.Err("write", os.ErrInvalid)
+	}
+
+	//the write is buffered like any other, only the cursor is moved back afterwards
+	pos := f.pos
+	f.pos = off
+	n, err = f.Write(b)
+	f.pos = pos
+	return n, err
+}
+
+// Read reads up to len(b) bytes from the File. It returns the number of bytes read and an error, if any. EOF is signaled by a zero count with err set to io.EOF. Handles that were opened with O_WRONLY fail with os.ErrPermission.
+func (f *File) Read(b []byte) (n int, err error) {
+	if !readable(f.flag) {
+		return 0, f.p.Err("read", os.ErrPermission)
+	}
+
+	if err = f.flush(true); err != nil {
+		return 0, f.p.Err("read", err)
+	}
+
+	if err = f.view(func(tx Tx) error {
+		fi, err := f.fs.getfi(tx, f.p)
+		if err != nil {
+			return err
+		}
+
+		if fi.IsDir() {
+			return ErrIsDirectory
+		}
+
+		if f.fs.readahead > 0 {
+			n, err = f.readAhead(tx, fi, b)
+			return err
+		}
+
+		n, err = f.fs.readChunks(tx, fi, f.pos, b)
+		return err
+	}); err != nil {
+		if err == io.EOF {
+			return 0, io.EOF
+		}
+
+		return 0, f.p.Err("read", err)
+	}
+
+	f.pos = f.pos + int64(n)
+	return n, nil
+}
+
+//WriteTo writes the content of the file from the current offset until the end to 'w', it implements io.WriterTo such that io.Copy streams chunks directly instead of copying them through an intermediate buffer. Since all chunks are written from a single read transaction, slow writers will keep it open for longer
+func (f *File) WriteTo(w io.Writer) (n int64, err error) {
+	if !readable(f.flag) {
+		return 0, f.p.Err("read", os.ErrPermission)
+	}
+
+	if err = f.flush(true); err != nil {
+		return 0, f.p.Err("read", err)
+	}
+
+	err = f.view(func(tx Tx) error {
+		fi, err := f.fs.getfi(tx, f.p)
+		if err != nil {
+			return err
+		}
+
+		if fi.IsDir() {
+			return ErrIsDirectory
+		}
+
+		n, err = f.fs.streamChunks(tx, fi, f.pos, w, nil)
+		return err
+	})
+
+	f.pos = f.pos + n
+	if err != nil {
+		return n, f.p.Err("read", err)
+	}
+
+	return n, nil
+}
+
+//DamagedRange is a region of a file that couldn't be read because its chunk is missing or corrupt
+type DamagedRange struct {
+	Off int64 //file offset of the first damaged byte
+	Len int64 //number of damaged bytes
+	Err error //why the chunk couldn't be read
+}
+
+//ReadResilient writes the content of the file from the current offset until the end to 'w' like WriteTo, but a chunk that is missing or corrupt (and can't be recovered from a replica) doesn't fail the read: its region is written as zeros and reported as damaged, after which the rest of the file is read. It is meant for recovering what is left of a partially corrupted file
+func (f *File) ReadResilient(w io.Writer) (n int64, damaged []DamagedRange, err error) {
+	if !readable(f.flag) {
+		return 0, nil, f.p.Err("read", os.ErrPermission)
+	}
+
+	if err = f.flush(true); err != nil {
+		return 0, nil, f.p.Err("read", err)
+	}
+
+	err = f.view(func(tx Tx) error {
+		fi, err := f.fs.getfi(tx, f.p)
+		if err != nil {
+			return err
+		}
+
+		if fi.IsDir() {
+			return ErrIsDirectory
+		}
+
+		n, err = f.fs.streamChunks(tx, fi, f.pos, w, &damaged)
+		return err
+	})
+
+	f.pos = f.pos + n
+	if err != nil {
+		return n, damaged, f.p.Err("read", err)
+	}
+
+	return n, damaged, nil
+}
+
+//ReadFrom writes everything that is read from 'r' to the file until io.EOF, it implements io.ReaderFrom such that io.Copy reads large pieces that are chunked as they arrive
+func (f *File) ReadFrom(r io.Reader) (n int64, err error) {
+	buf := make([]byte, wbufMax)
+	for {
+		m, rerr := io.ReadFull(r, buf)
+		if m > 0 {
+			if _, err = f.Write(buf[:m]); err != nil {
+				return n, err
+			}
+
+			n += int64(m)
+		}
+
+		if rerr == io.EOF || rerr == io.ErrUnexpectedEOF {
+			return n, nil
+		} else if rerr != nil {
+			return n, rerr
+		}
+	}
+}
+
+// Seek sets the offset for the next Read or Write on file to offset, interpreted according to whence: 0 means relative to the origin of the file, 1 means relative to the current offset, and 2 means relative to the end. It returns the new offset and an error, if any. The behavior of Seek on a file opened with O_APPEND is not specified. Seeking past the end of the file and writing leaves a hole that reads as zeros, holes are not stored.
+func (f *File) Seek(offset int64, whence int) (ret int64, err error) {
+	switch whence {
+	case io.SeekStart:
+		ret = offset
+	case io.SeekCurrent:
+		ret = f.pos + offset
+	case io.SeekEnd:
+		size, err := f.size()
+		if err != nil {
+			return 0, f.p.Err("seek", err)
+		}
+
+		ret = size + offset
+	default:
+		return 0, f.p.Err("seek", os.ErrInvalid)
+	}
+
+	if ret < 0 {
+		return 0, f.p.Err("seek", os.ErrInvalid)
+	}
+
+	f.pos = ret
+	return ret, nil
+}
+
+//Sync will commit buffered writes to the database, from there its up to the OS and disk hardware to make sure it arrives on the actual medium
+func (f *File) Sync() (err error) {
+	if err = f.flush(true); err != nil {
+		return f.p.Err("sync", err)
+	}
+
+	return nil
+}
+
+// Close closes the File, rendering it unusable for I/O. Buffered writes are committed to the database first.
+func (f *File) Close() (err error) {
+	if f.open {
+		defer f.fs.handles.close(f.p, f.flag)
+		f.open = false
+	}
+
+	if err = f.flush(true); err != nil {
+		return f.p.Err("close", err)
+	}
+
+	return nil
+}
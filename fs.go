@@ -6,6 +6,7 @@ import (
 	"errors"
 	"fmt"
 	"os"
+	"strings"
 	"time"
 
 	"github.com/boltdb/bolt"
@@ -16,16 +17,68 @@ var (
 	ErrNotDirectory = errors.New("not a directory")
 	//ErrNotEmptyDirectory tells us the directory was not empty
 	ErrNotEmptyDirectory = errors.New("directory is not empty")
+	//ErrIsDirectory is returned when a file was expected but a directory was found
+	ErrIsDirectory = errors.New("is a directory")
+	//ErrFileBusy is returned when a file cannot be removed because it is still opened for writing
+	ErrFileBusy = errors.New("file is busy")
+	//ErrInvalidID is returned when a file system id is empty, too long or starts with a bucket prefix
+	ErrInvalidID = errors.New("invalid file system id")
+	//ErrBucketConflict is returned when the bucket of a file system is already used for something else
+	ErrBucketConflict = errors.New("bucket is not used by a file system")
+	//ErrInvalidFlag is returned when a file is opened with a combination of flags that makes no sense, such as truncating a read-only file
+	ErrInvalidFlag = errors.New("invalid combination of open flags")
+	//ErrChunkCorrupt is returned when stored content doesn't match its checksum
+	ErrChunkCorrupt = errors.New("chunk is corrupt")
+	//ErrReadTimeout is returned when a read transaction was open for longer than the file system allows
+	ErrReadTimeout = errors.New("read transaction timed out")
+	//ErrTooManyLinks is returned when resolving a path follows more than MaxLinkHops symbolic links, which usually means they form a loop
+	ErrTooManyLinks = errors.New("too many levels of symbolic links")
+	//ErrReadOnly is returned when a file system that was opened read-only is asked to change
+	ErrReadOnly = errors.New("read-only file system")
+	//ErrDirectoryTooLarge is returned when all entries of a directory are read at once while it holds more than the file system allows, the entries should be read in pages or with EachEntry instead
+	ErrDirectoryTooLarge = errors.New("directory has too many entries to read at once")
+	//ErrTxNotWritable is returned when an operation that might change the file system is passed a read-only transaction
+	ErrTxNotWritable = errors.New("transaction is not writable")
 )
 
 //fileInfo holds our specific file information
 //and implements the os.FileInfo interface, the fields
-//are public for easier JSON (un)marshalling
+//are public for easier JSON (un)marshalling. Their
+//names in JSON are pinned with tags because they are
+//stored, they must match those of FileInfoJSON
 type fileInfo struct {
-	N string      // base name of the file
-	M os.FileMode // file mode bits
-	T time.Time   // modification time
-	S int64       // length in bytes for regular files; system-dependent for others
+	N string      `json:"N"`           // base name of the file
+	M os.FileMode `json:"M"`           // file mode bits
+	T time.Time   `json:"T"`           // modification time
+	S int64       `json:"S"`           // length in bytes for regular files; system-dependent for others
+	I uint64      `json:"I"`           // inode number, identifies the chunk ptrs of a file
+	U uint32      `json:"U,omitempty"` // user id of the owner
+	G uint32      `json:"G,omitempty"` // group id of the owner
+	D []byte      `json:"D,omitempty"` // content of small files that are stored inline instead of in chunks
+	C *int64      `json:"C,omitempty"` // number of entries of a directory, nil for records that don't count them
+	H []byte      `json:"H,omitempty"` // cached tree hash, dropped when the file or anything below it changes
+	E *time.Time  `json:"E,omitempty"` // time at which a temporary file expires, see OpenFileTTL
+}
+
+//FileInfoJSON is the JSON form in which file info is stored in the files bucket, keyed by the database key of its path. Tools can unmarshal values into it to read metadata without opening a file system. The layout belongs to format version CurrentVersion, the version of a file system is recorded in MetaBucketName. Records of version 1 decode with a zero Ino
+type FileInfoJSON struct {
+	Name    string      `json:"N"`
+	Mode    os.FileMode `json:"M"`
+	ModTime time.Time   `json:"T"`
+	Size    int64       `json:"S"`
+	Ino     uint64      `json:"I"`
+	UID     uint32      `json:"U,omitempty"`
+	GID     uint32      `json:"G,omitempty"`
+	Data    []byte      `json:"D,omitempty"` //content of small files that are stored inline, other files are chunked
+	Entries *int64      `json:"C,omitempty"` //number of entries of a directory, absent for records that were written before they were counted
+	Hash    []byte      `json:"H,omitempty"` //tree hash as returned by TreeHash, absent when it wasn't computed since the file or anything below it changed
+	Expires *time.Time  `json:"E,omitempty"` //time at which a file that was opened with OpenFileTTL expires, absent for other files
+}
+
+//Owner describes who owns a file, it is returned by the Sys() method of file info such that bindings like FUSE can report it
+type Owner struct {
+	UID uint32
+	GID uint32
 }
 
 //Name of the file
@@ -46,14 +99,42 @@ func (fi *fileInfo) ModTime() time.Time { return fi.T }
 //IsDir reports whether m describes a directory. That is, it tests for the ModeDir bit being set in m.
 func (fi *fileInfo) IsDir() bool { return fi.Mode().IsDir() }
 
-//Sys returns underlying system values
-func (fi *fileInfo) Sys() interface{} { return nil }
+//Sys returns underlying system values, which is the *Owner of the file
+func (fi *fileInfo) Sys() interface{} { return &Owner{UID: fi.U, GID: fi.G} }
 
 //FileSystem holds file information
 type FileSystem struct {
 	fbucket []byte //name of the files bucket
-
-	db *bolt.DB
+	pbucket []byte //name of the bucket with chunk ptrs
+	cbucket []byte //name of the bucket with chunks
+	jbucket []byte //name of the bucket with the journal of operations that span multiple commits
+	rbucket []byte //name of the bucket with the number of references to each chunk and the space usage they add up to
+
+	rmpol     RemovePolicy    //what to do when removing files that are open
+	rootfi    fileInfo        //info of the root directory when it is created
+	inline    int64           //files up to this size are stored inline in their file info
+	chunking  ChunkConfig     //how file content is split into chunks
+	handles   handles         //registry of open file handles
+	maxName   int             //maximum length of a path component
+	maxPath   int             //maximum length of a path's key
+	maxDepth  int             //maximum number of components in a path
+	migrate   bool            //whether an older on-disk format is upgraded when opened
+	verify    bool            //whether chunks are checked against their key when read
+	replicas  [][]byte        //names of the buckets that hold extra copies of every chunk
+	heals     heals           //recovered chunks that await repair
+	inodes    inodes          //paths of the inodes that were handed out
+	mirror    ChunkBackend    //backend that keeps a backup of large chunks, if any
+	mirrorMin int             //chunks up to this size are not mirrored
+	rtimeout  time.Duration   //read transactions of file handles that are open for longer are aborted, zero means never
+	rdsnap    bool            //whether paged readdir calls work on a snapshot of the directory
+	nocase    bool            //whether new names may not equal those of their siblings when case is ignored
+	collide   CollisionPolicy //what happens when they do
+	clock     Clock           //tells the modification time of files
+	readahead int             //number of chunks that handles prefetch while they are read sequentially, zero disables it
+	rdmax     int             //maximum number of entries that are read from a directory at once, zero means no limit
+	batch     time.Duration   //how long writes wait to be committed together with those of other callers, zero disables batching
+
+	db Store
 }
 
 //walkFn can be provided t
@@ -62,40 +143,257 @@ type walkFn func(p P, fi *fileInfo) (err error)
 //errStopWalk can be returned  by the walkFn to stop iterating a directory
 var errStopWalk = errors.New("stop walk")
 
+//MaxIDLen is the maximum number of bytes in a file system id
+const MaxIDLen = 255
+
+//bucketPrefixes are put in front of the id to name the buckets of a file system
+var bucketPrefixes = []string{"f_", "p_", "j_", "r_"}
+
+//laterPrefixes are the bucket prefixes that were added after file systems could already be created with an id that starts with them. Since all prefixes have the same length such ids can't make bucket names collide, they are only refused for new file systems
+var laterPrefixes = []string{"j_", "r_"}
+
+//validateID checks that a file system id can be used to name its buckets without them being confused with those of another file system, an id that starts with one of the laterPrefixes stays valid for a file system that exists in store 's'
+func validateID(s Store, id string) error {
+	if id == "" || len(id) > MaxIDLen {
+		return ErrInvalidID
+	}
+
+	for _, prefix := range laterPrefixes {
+		if strings.HasPrefix(id, prefix) && s.View(func(tx Tx) error {
+			if tx.Bucket([]byte("f_"+id)) == nil {
+				return os.ErrNotExist
+			}
+
+			return nil
+		}) == nil {
+			return nil
+		}
+	}
+
+	for _, prefix := range bucketPrefixes {
+		if strings.HasPrefix(id, prefix) {
+			return ErrInvalidID
+		}
+	}
+
+	return nil
+}
+
+//validateChunkBucket checks that the chunk bucket can't be confused with the buckets of a file system or the meta bucket
+func validateChunkBucket(name []byte) error {
+	if len(name) == 0 || bytes.Equal(name, MetaBucketName) {
+		return ErrBucketConflict
+	}
+
+	for _, prefix := range bucketPrefixes {
+		if bytes.HasPrefix(name, []byte(prefix)) {
+			return ErrBucketConflict
+		}
+	}
+
+	return nil
+}
+
+//checkBuckets returns ErrBucketConflict if the buckets of the file system already exist but don't hold a file system, for example because another tool created them
+func (fs *FileSystem) checkBuckets(tx Tx) error {
+	fb, pb := tx.Bucket(fs.fbucket), tx.Bucket(fs.pbucket)
+	if fb != nil {
+		v := fb.Get(Root.Key())
+		if v == nil {
+			if k, _ := fb.Cursor().First(); k != nil {
+				return ErrBucketConflict //entries without a root
+			}
+		} else {
+			fi := &fileInfo{}
+			if err := json.Unmarshal(v, fi); err != nil || !fi.IsDir() {
+				return ErrBucketConflict
+			}
+		}
+	}
+
+	if pb != nil && fb == nil {
+		if k, _ := pb.Cursor().First(); k != nil {
+			return ErrBucketConflict //chunk ptrs without any files
+		}
+	}
+
+	return nil
+}
+
+//checkReadOnly checks that a file system that is opened read-only can be served as is, since nothing can be created or migrated
+func (fs *FileSystem) checkReadOnly(tx Tx) (err error) {
+	if err = fs.checkBuckets(tx); err != nil {
+		return err
+	}
+
+	if v := version(tx, fs.fbucket, fs.pbucket); v > CurrentVersion {
+		return ErrUnsupportedVersion
+	} else if v < CurrentVersion {
+		return ErrNeedsMigration
+	}
+
+	for _, name := range append([][]byte{fs.fbucket, fs.pbucket, fs.cbucket}, fs.replicas...) {
+		if tx.Bucket(name) == nil {
+			return os.ErrNotExist
+		}
+	}
+
+	_, err = fs.getfi(tx, Root)
+	return err
+}
+
 //NewFileSystem sets up a new file system in a bolt database with
-//an unique id that allows multiple filesystems per database
-func NewFileSystem(id string, db *bolt.DB) (fs *FileSystem, err error) {
+//an unique id that allows multiple filesystems per database. The id must
+//not be empty, be at most MaxIDLen bytes and not start with "f_", "p_", "j_" or "r_".
+//File systems that were created before "j_" and "r_" were reserved keep opening
+func NewFileSystem(id string, db *bolt.DB, opts ...Option) (fs *FileSystem, err error) {
+	return NewFileSystemWithStore(id, NewBoltStore(db), opts...)
+}
+
+//NewReadOnlyFileSystem opens the existing file system with id 'id' in bolt database 'db' without ever starting a writable transaction, such that 'db' can be opened with bolt's ReadOnly option and several processes can serve the same database file. All operations that would change the file system fail with ErrReadOnly. The file system must exist and be of the current format, operations that were interrupted by a crash are not recovered
+func NewReadOnlyFileSystem(id string, db *bolt.DB, opts ...Option) (fs *FileSystem, err error) {
+	return NewFileSystemWithStore(id, readOnlyStore{NewBoltStore(db)}, opts...)
+}
+
+//NewFileSystemWithStore sets up a new file system with an unique id in store 's', such as one returned by NewMemStore
+func NewFileSystemWithStore(id string, s Store, opts ...Option) (fs *FileSystem, err error) {
+	if err = validateID(s, id); err != nil {
+		return nil, err
+	}
+
 	fs = &FileSystem{
-		fbucket: []byte("f_" + id),
-		db:      db,
+		fbucket:  []byte("f_" + id),
+		pbucket:  []byte("p_" + id),
+		jbucket:  []byte("j_" + id),
+		rbucket:  []byte("r_" + id),
+		cbucket:  ChunkBucketName,
+		rootfi:   fileInfo{M: os.ModeDir | 0777},
+		chunking: DefaultChunkConfig,
+		maxName:  DefaultMaxNameLen,
+		maxPath:  DefaultMaxPathLen,
+		maxDepth: DefaultMaxDepth,
+		verify:   true,
+		clock:    WallClock,
+		db:       s,
+	}
+
+	for _, opt := range opts {
+		opt(fs)
+	}
+
+	if err = validateChunkBucket(fs.cbucket); err != nil {
+		return nil, err
+	}
+
+	//chunks are mirrored inside the write transaction, a mirror in the same database would wait for that transaction forever
+	if mb, ok := fs.mirror.(*boltChunkBackend); ok {
+		if bs, ok := s.(boltStore); ok && bs.db == mb.db {
+			return nil, fmt.Errorf("the chunk mirror can't be kept in the database of the file system")
+		}
 	}
 
-	if err = fs.db.Update(func(tx *bolt.Tx) (err error) {
-		if _, err = tx.CreateBucketIfNotExists(fs.fbucket); err != nil {
+	if bs, ok := s.(boltStore); ok && fs.batch > 0 {
+
+		//the window is a setting of the whole database, a window that another user chose is left alone
+		if bs.db.MaxBatchDelay != fs.batch {
+			if bs.db.MaxBatchDelay != bolt.DefaultMaxBatchDelay {
+				return nil, fmt.Errorf("batching writes with a window of %s, the database already batches with a window of %s", fs.batch, bs.db.MaxBatchDelay)
+			}
+
+			bs.db.MaxBatchDelay = fs.batch
+		}
+
+		fs.db = batchStore{bs}
+	} else if fs.batch > 0 {
+		return nil, fmt.Errorf("batching writes requires a bolt database")
+	}
+
+	if _, ok := s.(readOnlyStore); ok {
+		if err = fs.db.View(fs.checkReadOnly); err != nil {
+			return nil, fmt.Errorf("failed to open database: %w", err)
+		}
+
+		return fs, nil
+	}
+
+	if err = fs.db.Update(func(tx Tx) (err error) {
+		if err = fs.checkBuckets(tx); err != nil {
+			return err
+		}
+
+		if v := version(tx, fs.fbucket, fs.pbucket); v > CurrentVersion {
+			return ErrUnsupportedVersion
+		} else if v < CurrentVersion && !fs.migrate {
+			return ErrNeedsMigration
+		}
+
+		if err = migrate(tx, fs.fbucket, fs.pbucket); err != nil {
 			return err
 		}
 
+		recount := tx.Bucket(fs.rbucket) == nil
+		for _, name := range append([][]byte{fs.fbucket, fs.pbucket, fs.jbucket, fs.rbucket, fs.cbucket}, fs.replicas...) {
+			if _, err = tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+
+		//references are counted as of this version, those of existing content are counted once
+		if recount {
+			if err = fs.countRefs(tx); err != nil {
+				return err
+			}
+		}
+
 		//create root (if its not yet created)
 		_, err = fs.getfi(tx, Root)
 		if err == os.ErrNotExist {
+			ino, err := fs.nextIno(tx)
+			if err != nil {
+				return err
+			}
+
 			if err = fs.putfi(tx, Root, &fileInfo{
 				N: Root.Base(),
-				M: os.ModeDir | 0777,
-				T: time.Now(),
+				M: fs.rootfi.M,
+				T: fs.clock.Now(),
+				I: ino,
+				U: fs.rootfi.U,
+				G: fs.rootfi.G,
+				C: new(int64),
 				//@TODO setup size
 			}); err != nil {
 				return err
 			}
 		}
 
-		return nil
+		//operations that were interrupted by a crash are completed or rolled back
+		return fs.recoverIntents(tx)
 	}); err != nil {
-		return nil, fmt.Errorf("failed to prepare database: %v", err)
+		return nil, fmt.Errorf("failed to prepare database: %w", err)
 	}
 
 	return fs, nil
 }
 
+//validateFlag checks that the access mode and other flags passed to open can be combined. O_RDONLY is zero, so it is implied whenever neither O_WRONLY nor O_RDWR is set
+func validateFlag(flag int) error {
+	if flag&os.O_WRONLY != 0 && flag&os.O_RDWR != 0 {
+		return ErrInvalidFlag //conflicting access modes
+	}
+
+	if flag&(os.O_WRONLY|os.O_RDWR) == 0 && flag&os.O_TRUNC != 0 {
+		return ErrInvalidFlag //truncating requires write access, like EINVAL in posix
+	}
+
+	return nil
+}
+
+//Begin starts a transaction on the store of the filesystem that can be passed to its *Tx methods, the caller is responsible for committing or rolling it back. Filesystems in a bolt database can also be passed transactions that were started on the database directly, using BoltTx
+func (fs *FileSystem) Begin(writable bool) (Tx, error) {
+	return fs.db.Begin(writable)
+}
+
 func (fs *FileSystem) mightwrite(flag int) bool {
 	//return whether the open() call might require a writeable transaction
 	//@TODO figure out if file writes still cause the transaction to be writeable
@@ -108,9 +406,38 @@ func (fs *FileSystem) mightwrite(flag int) bool {
 	return false
 }
 
-func (fs *FileSystem) walkdir(tx *bolt.Tx, p P, startp P, fn walkFn) (err error) {
+//validateNew checks whether path 'p' is valid for creating a new entry, which also requires it to stay within the configured limits
+func (fs *FileSystem) validateNew(p P) error {
+	if err := p.Validate(); err != nil {
+		return err
+	}
+
+	return fs.validateLimits(p)
+}
+
+//validateLimits checks that path 'p' stays within the configured length and depth limits
+func (fs *FileSystem) validateLimits(p P) error {
+	if p.Depth() > fs.maxDepth {
+		return ErrInvalidPath
+	}
+
+	return p.ValidateLen(fs.maxName, fs.maxPath)
+}
+
+//nextIno returns a new inode number
+func (fs *FileSystem) nextIno(tx Tx) (ino uint64, err error) {
+	return tx.Bucket(fs.fbucket).NextSequence()
+}
+
+func (fs *FileSystem) walkdir(tx Tx, p P, startp P, fn walkFn) (err error) {
 	c := tx.Bucket(fs.fbucket).Cursor()
+	sep := []byte(PathSeparator)
+
+	//all entries of the directory share a prefix that ends with a separator
 	prefix := p.Key()
+	if !p.IsRoot() {
+		prefix = append(prefix, sep...)
+	}
 
 	//we can start walking from a different item if startp is not nitl, this
 	//is used by readdir to continue from a path it left off
@@ -119,44 +446,128 @@ func (fs *FileSystem) walkdir(tx *bolt.Tx, p P, startp P, fn walkFn) (err error)
 		start = startp.Key()
 	}
 
-	for k, v := c.Seek(start); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+	k, v := c.Seek(start)
+	for ; k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
 		if bytes.Equal(start, k) {
 			continue
 		}
 
-		_ = v
-		fmt.Println(string(k))
-
-		// parts := bytes.SplitN(bytes.TrimPrefix(k, prefix), []byte(PathSeparator), 2)
-		// if len(parts) > 1 {
-		// 	break //end of the directory
-		// }
-		//
-		// fi := &fileInfo{}
-		// err = json.Unmarshal(v, fi)
-		// if err != nil {
-		// 	return fmt.Errorf("failed to deserialize: %v", err)
-		// }
-		//
-		// childp := PathFromKey(k)
-		// err = fn(childp, fi)
-		// if err != nil {
-		// 	if err == errStopWalk {
-		// 		return nil
-		// 	}
-		//
-		// 	return err
-		// }
+		//a key deeper in the tree. Because the separator is the largest code point of its length, the entries of a subdirectory are ordered after all its siblings that share its name as a prefix, except for siblings that continue with a code point of a longer encoding. We skip the subdirectory by seeking just past its separator, such that entries are always listed in byte-order of their names (see checkSeparator)
+		for i := bytes.Index(k[len(prefix):], sep); i > -1; i = bytes.Index(k[len(prefix):], sep) {
+			skip := append([]byte{}, k[:len(prefix)+i+len(sep)]...)
+			skip[len(skip)-1]++
+			if k, v = c.Seek(skip); k == nil || !bytes.HasPrefix(k, prefix) {
+				return nil
+			}
+		}
+
+		fi := &fileInfo{}
+		err = json.Unmarshal(v, fi)
+		if err != nil {
+			return fmt.Errorf("failed to deserialize: %v", err)
+		}
+
+		//files that expired don't exist anymore, they are left for the reaper
+		if fs.expired(fi) {
+			continue
+		}
+
+		childp := PathFromKey(k)
+		err = fn(childp, fi)
+		if err != nil {
+			if err == errStopWalk {
+				return nil
+			}
+
+			return err
+		}
 	}
 
 	return nil
 }
 
-func (fs *FileSystem) delfi(tx *bolt.Tx, p P) (err error) {
-	return tx.Bucket(fs.fbucket).Delete(p.Key())
+//delfi deletes the info of the file at 'p', the entry count of its parent is decremented
+func (fs *FileSystem) delfi(tx Tx, p P) (err error) {
+	b := tx.Bucket(fs.fbucket)
+	if b.Get(p.Key()) != nil && !p.IsRoot() {
+		if err = fs.countEntries(tx, p.Parent(), -1); err != nil {
+			return err
+		}
+	}
+
+	if err = fs.dropHashes(tx, p); err != nil {
+		return err
+	}
+
+	return b.Delete(p.Key())
+}
+
+//countEntries adds 'delta' to the entry count of the directory at 'p'. Directories that don't count their entries, such as those written by older versions, and the missing parents of orphans are left alone
+func (fs *FileSystem) countEntries(tx Tx, p P, delta int64) (err error) {
+	fi, err := fs.getfi(tx, p)
+	if err == os.ErrNotExist {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	if fi.C == nil {
+		return nil
+	}
+
+	*fi.C += delta
+	return fs.putfi(tx, p, fi)
+}
+
+//rmfi removes the file at 'p' with info 'fi' and frees its chunk ptrs
+func (fs *FileSystem) rmfi(tx Tx, p P, fi *fileInfo) (err error) {
+	if !fi.IsDir() {
+		if err = fs.delChunkPtrs(tx, fi); err != nil {
+			return err
+		}
+	}
+
+	return fs.delfi(tx, p)
+}
+
+//isEmptyDir returns whether the directory at 'p' with info 'fi' has no entries, directories that don't count their entries are scanned for the first one
+func (fs *FileSystem) isEmptyDir(tx Tx, p P, fi *fileInfo) (empty bool, err error) {
+	if fi.C != nil {
+		return *fi.C == 0, nil
+	}
+
+	empty = true
+	if err = fs.walkdir(tx, p, nil, func(pp P, childfi *fileInfo) error {
+		//if this is called at least one time, the dir is not empty, we dont need to know more
+		empty = false
+		return errStopWalk
+	}); err != nil {
+		return false, err //error while walking
+	}
+
+	return empty, nil
+}
+
+//putfi writes the info of the file at 'p', when it is a new entry the entry count of its parent is incremented
+func (fs *FileSystem) putfi(tx Tx, p P, fi *fileInfo) (err error) {
+	b := tx.Bucket(fs.fbucket)
+	if b.Get(p.Key()) == nil && !p.IsRoot() {
+		if err = fs.countEntries(tx, p.Parent(), 1); err != nil {
+			return err
+		}
+	}
+
+	//the file changed, and with it the tree hashes of its ancestors
+	fi.H = nil
+	if err = fs.dropHashes(tx, p); err != nil {
+		return err
+	}
+
+	return fs.writefi(tx, p, fi)
 }
 
-func (fs *FileSystem) putfi(tx *bolt.Tx, p P, fi *fileInfo) (err error) {
+//writefi stores 'fi' at 'p' as is, without counting entries or dropping tree hashes
+func (fs *FileSystem) writefi(tx Tx, p P, fi *fileInfo) (err error) {
 	v, err := json.Marshal(fi)
 	if err != nil {
 		return fmt.Errorf("failed to serialize: %v", err)
@@ -165,7 +576,7 @@ func (fs *FileSystem) putfi(tx *bolt.Tx, p P, fi *fileInfo) (err error) {
 	return tx.Bucket(fs.fbucket).Put(p.Key(), v)
 }
 
-func (fs *FileSystem) getfi(tx *bolt.Tx, p P) (fi *fileInfo, err error) {
+func (fs *FileSystem) getfi(tx Tx, p P) (fi *fileInfo, err error) {
 	v := tx.Bucket(fs.fbucket).Get(p.Key())
 	if v == nil {
 		return nil, os.ErrNotExist
@@ -187,7 +598,7 @@ func (fs *FileSystem) RemoveAll(p P) (err error) {
 		return p.Err("removeall", err)
 	}
 
-	if err = fs.db.Update(func(tx *bolt.Tx) error {
+	if err = fs.db.Update(func(tx Tx) error {
 
 		//@TODO walkdir (deep) and remove all keys
 
@@ -199,31 +610,106 @@ func (fs *FileSystem) RemoveAll(p P) (err error) {
 	return nil
 }
 
+//pathErr wraps 'err' in a PathError for 'p' unless it already is one, such that errors of the transaction itself are reported the same as errors of the operation
+func pathErr(op string, p P, err error) error {
+	if _, ok := err.(*os.PathError); ok {
+		return err
+	}
+
+	return p.Err(op, err)
+}
+
 // Remove removes the named file or directory.
 // If there is an error, it will be of type *PathError.
 func (fs *FileSystem) Remove(p P) (err error) {
+	if err = fs.db.Update(func(tx Tx) error {
+		return fs.RemoveTx(tx, p)
+	}); err != nil {
+		return pathErr("remove", p, err)
+	}
+
+	fs.inodes.removed(p)
+	return nil
+}
+
+//RemoveTx removes the named file or directory as part of transaction 'tx' that is managed by the caller. If there is an error, it will be of type *PathError.
+func (fs *FileSystem) RemoveTx(tx Tx, p P) (err error) {
 	err = p.Validate()
 	if err != nil {
 		return p.Err("remove", err)
 	}
 
-	if err = fs.db.Update(func(tx *bolt.Tx) error {
+	//must exist for remove to succeed
+	fi, err := fs.getfi(tx, p)
+	if err != nil {
+		return p.Err("remove", err)
+	}
 
-		//must exist for remove to succeed
-		fi, err := fs.getfi(tx, p)
+	//depending on the policy, files that are still being written cannot be removed
+	if fs.rmpol == RemoveUnlessBusy && fs.handles.busy(p) {
+		return p.Err("remove", ErrFileBusy)
+	}
+
+	//if its a directory, its must be empty
+	if fi.IsDir() {
+		empty, err := fs.isEmptyDir(tx, p, fi)
 		if err != nil {
-			return err
+			return p.Err("remove", err)
 		}
 
-		//if its a directory, its must be empty
-		if fi.IsDir() {
-			empty := true
-			if err = fs.walkdir(tx, p, nil, func(pp P, childfi *fileInfo) error {
-				//if this is called at least one time, the dir is not empty, we dont need to know more
-				empty = false
-				return errStopWalk
-			}); err != nil {
-				return err //error while walking
+		if !empty {
+			return p.Err("remove", ErrNotEmptyDirectory)
+		}
+	}
+
+	//actually remove the item, with the default policy open file handles might still perform io
+	if err = fs.rmfi(tx, p, fi); err != nil {
+		return p.Err("remove", err)
+	}
+
+	return nil
+}
+
+func (fs *FileSystem) rename(tx Tx, oldp, newp P) (err error) {
+	fi, err := fs.getlive(tx, oldp)
+	if err != nil {
+		return err
+	}
+
+	if oldp.Equals(newp) {
+		return nil
+	}
+
+	if err = fs.validateLimits(newp); err != nil {
+		return err
+	}
+
+	//a directory cannot be moved into itself
+	if len(newp) > len(oldp) && newp[:len(oldp)].Equals(oldp) {
+		return os.ErrInvalid
+	}
+
+	//new parent must exist and be a directory
+	pfi, err := fs.getfi(tx, newp.Parent())
+	if err != nil {
+		return err
+	}
+
+	if !pfi.IsDir() {
+		return ErrNotDirectory
+	}
+
+	//an existing destination is replaced, but only by the same type of file and only if its an empty directory
+	dfi, err := fs.getlive(tx, newp)
+	if err == nil {
+		if fi.IsDir() != dfi.IsDir() {
+			return ErrNotDirectory
+		}
+
+		if dfi.IsDir() {
+			empty, err := fs.isEmptyDir(tx, newp, dfi)
+			if err != nil {
+				return err
 			}
 
 			if !empty {
@@ -231,35 +717,180 @@ func (fs *FileSystem) Remove(p P) (err error) {
 			}
 		}
 
-		//actually remove the item, open file handles might still perform io
-		return fs.delfi(tx, p)
+		if err = fs.rmfi(tx, newp, dfi); err != nil {
+			return err
+		}
+
+	} else if err != os.ErrNotExist {
+		return err
+	} else if _, err = fs.resolveCollision(tx, newp, oldp, false); err != nil {
+		return err //a new name in the destination directory, that may only differ in case from that of the entry itself
+	}
+
+	//move all entries of a directory, keys are collected first since writing invalidates the cursor
+	if fi.IsDir() {
+		oldprefix := append(oldp.Key(), PathSeparator...)
+		newprefix := append(newp.Key(), PathSeparator...)
+		b := tx.Bucket(fs.fbucket)
+		ks, vs := [][]byte{}, [][]byte{}
+		c := b.Cursor()
+		for k, v := c.Seek(oldprefix); k != nil && bytes.HasPrefix(k, oldprefix); k, v = c.Next() {
+			ks = append(ks, append([]byte{}, k...))
+			vs = append(vs, append([]byte{}, v...))
+		}
+
+		for i, k := range ks {
+			if len(newprefix)+len(k)-len(oldprefix) > fs.maxPath {
+				return ErrPathTooLong //descendants are moved along, their paths grow too
+			}
+
+			if newp.Depth()+PathFromKey(k).Depth()-oldp.Depth() > fs.maxDepth {
+				return ErrInvalidPath
+			}
+
+			if err = b.Delete(k); err != nil {
+				return err
+			}
+
+			if err = b.Put(append(append([]byte{}, newprefix...), k[len(oldprefix):]...), vs[i]); err != nil {
+				return err
+			}
+		}
+	}
+
+	if err = fs.delfi(tx, oldp); err != nil {
+		return err
+	}
+
+	fi.N = newp.Base()
+	return fs.putfi(tx, newp, fi)
+}
+
+//Rename renames (moves) oldpath to newpath. If newpath already exists and is not a directory, Rename replaces it. A directory can only replace an empty directory. If there is an error, it will be of type *PathError.
+func (fs *FileSystem) Rename(oldp, newp P) (err error) {
+	for _, p := range []P{oldp, newp} {
+		if err = p.Validate(); err != nil {
+			return p.Err("rename", err)
+		}
+	}
+
+	if err = fs.db.Update(func(tx Tx) error {
+		return fs.rename(tx, oldp, newp)
 	}); err != nil {
-		return p.Err("remove", err)
+		return oldp.Err("rename", err)
 	}
 
+	fs.inodes.moved(oldp, newp)
 	return nil
 }
 
-// Mkdir creates a new directory with the specified name and permission bits. If
-// there is an error, it will be of type *PathError.
-func (fs *FileSystem) Mkdir(p P, perm os.FileMode) (err error) {
-	err = p.Validate()
+//exchange swaps the entries at 'a' and 'b' together with the entries below them, the parents keep their entry counts. Keys are collected first since writing invalidates the cursor
+func (fs *FileSystem) exchange(tx Tx, a, b P) (err error) {
+	afi, err := fs.getfi(tx, a)
 	if err != nil {
-		return p.Err("mkdir", err)
+		return err
 	}
 
-	//begin the transaction
-	tx, err := fs.db.Begin(true)
+	bfi, err := fs.getfi(tx, b)
 	if err != nil {
 		return err
 	}
 
-	//always end the transaction
-	defer func() {
-		if cerr := tx.Commit(); cerr != nil {
-			err = cerr //commit errors will take precedence
+	if a.Equals(b) {
+		return nil
+	}
+
+	//a directory cannot be swapped with something inside of it
+	if under(a, b) || under(b, a) {
+		return os.ErrInvalid
+	}
+
+	bkt := tx.Bucket(fs.fbucket)
+	descendants := func(p P) (ks, vs [][]byte) {
+		prefix := append(p.Key(), PathSeparator...)
+		c := bkt.Cursor()
+		for k, v := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+			ks = append(ks, append([]byte{}, k...))
+			vs = append(vs, append([]byte{}, v...))
+		}
+
+		return ks, vs
+	}
+
+	aks, avs := descendants(a)
+	bks, bvs := descendants(b)
+	for _, k := range append(aks, bks...) {
+		if err = bkt.Delete(k); err != nil {
+			return err
+		}
+	}
+
+	for _, m := range []struct {
+		from, to P
+		ks, vs   [][]byte
+	}{{a, b, aks, avs}, {b, a, bks, bvs}} {
+		oldprefix := append(m.from.Key(), PathSeparator...)
+		newprefix := append(m.to.Key(), PathSeparator...)
+		for i, k := range m.ks {
+			if len(newprefix)+len(k)-len(oldprefix) > fs.maxPath {
+				return ErrPathTooLong //descendants are moved along, their paths might grow
+			}
+
+			if m.to.Depth()+PathFromKey(k).Depth()-m.from.Depth() > fs.maxDepth {
+				return ErrInvalidPath
+			}
+
+			if err = bkt.Put(append(append([]byte{}, newprefix...), k[len(oldprefix):]...), m.vs[i]); err != nil {
+				return err
+			}
+		}
+	}
+
+	//both paths exist, so writing their info doesn't change the counts of their parents. Neither do the names in either directory change, so no new collisions arise when names are case-insensitive
+	afi.N, bfi.N = b.Base(), a.Base()
+	if err = fs.putfi(tx, b, afi); err != nil {
+		return err
+	}
+
+	return fs.putfi(tx, a, bfi)
+}
+
+//Exchange atomically swaps the files or directories at 'a' and 'b', directories take everything below them along. Both must exist and neither may contain the other, like renameat2 with RENAME_EXCHANGE on Linux. If there is an error, it will be of type *PathError.
+func (fs *FileSystem) Exchange(a, b P) (err error) {
+	for _, p := range []P{a, b} {
+		if err = p.Validate(); err != nil {
+			return p.Err("exchange", err)
 		}
-	}()
+	}
+
+	if err = fs.db.Update(func(tx Tx) error {
+		return fs.exchange(tx, a, b)
+	}); err != nil {
+		return a.Err("exchange", err)
+	}
+
+	fs.inodes.exchanged(a, b)
+	return nil
+}
+
+// Mkdir creates a new directory with the specified name and permission bits. If
+// there is an error, it will be of type *PathError.
+func (fs *FileSystem) Mkdir(p P, perm os.FileMode) (err error) {
+	if err = fs.db.Update(func(tx Tx) error {
+		return fs.MkdirTx(tx, p, perm)
+	}); err != nil {
+		return pathErr("mkdir", p, err)
+	}
+
+	return nil
+}
+
+//MkdirTx creates a new directory as part of transaction 'tx' that is managed by the caller. If there is an error, it will be of type *PathError.
+func (fs *FileSystem) MkdirTx(tx Tx, p P, perm os.FileMode) (err error) {
+	err = fs.validateNew(p)
+	if err != nil {
+		return p.Err("mkdir", err)
+	}
 
 	//check if parent exists
 	pp := p.Parent()
@@ -274,17 +905,28 @@ func (fs *FileSystem) Mkdir(p P, perm os.FileMode) (err error) {
 	}
 
 	//check if the directory already exists
-	fi, err := fs.getfi(tx, p)
+	fi, err := fs.getlive(tx, p)
 	if err != nil {
 		if err != os.ErrNotExist {
 			return p.Err("mkdir", err)
 		}
 
-		//dir doesnt exist; create it
+		//dir doesnt exist; create it, unless its name only differs in case from a sibling's
+		if _, err = fs.resolveCollision(tx, p, nil, false); err != nil {
+			return pathErr("mkdir", p, err)
+		}
+
+		ino, err := fs.nextIno(tx)
+		if err != nil {
+			return p.Err("mkdir", err)
+		}
+
 		fi = &fileInfo{
 			N: p.Base(),
 			M: os.ModeDir | perm,
-			T: time.Now(),
+			T: fs.clock.Now(),
+			I: ino,
+			C: new(int64),
 			//@TODO complete information
 		}
 
@@ -325,27 +967,49 @@ func (fs *FileSystem) Open(p P) (*File, error) {
 //   O_CREATE int = syscall.O_CREATE  // create a new file if none exists.
 //   O_EXCL   int = syscall.O_EXCL   // used with O_CREATE, file must not exist
 func (fs *FileSystem) OpenFile(p P, flag int, perm os.FileMode) (f *File, err error) {
+	open := fs.db.View
+	if fs.mightwrite(flag) {
+		open = fs.db.Update
+	}
+
+	if err = open(func(tx Tx) (err error) {
+		if f != nil {
+			f.Close() //opened by a batched run that was rolled back
+		}
+
+		f, err = fs.OpenFileTx(tx, p, flag, perm)
+		return err
+	}); err != nil {
+		if f != nil {
+			f.Close() //opened, but the transaction failed to commit
+		}
+
+		return nil, pathErr("open", p, err)
+	}
+
+	//the transaction has ended, io will use transactions of its own
+	f.tx = nil
+	return f, nil
+}
+
+//OpenFileTx opens the named file as part of transaction 'tx' that is managed by the caller, symbolic links are followed to the file they lead to. IO on the returned File is performed in the same transaction, as such the file must be synced or closed before the transaction is committed and it shouldn't be used after the transaction ended. If there is an error, it will be of type *PathError.
+func (fs *FileSystem) OpenFileTx(tx Tx, p P, flag int, perm os.FileMode) (f *File, err error) {
 	err = p.Validate()
 	if err != nil {
 		return nil, p.Err("open", err)
 	}
 
-	//begin the transaction
-	tx, err := fs.db.Begin(fs.mightwrite(flag))
-	if err != nil {
-		return nil, err
+	if err = validateFlag(flag); err != nil {
+		return nil, p.Err("open", err)
 	}
 
-	//always end the transaction
-	defer func() {
-		if !tx.Writable() {
-			return
-		}
+	//content is read and written at the end of symbolic links, the handle is on the file they lead to
+	rp, err := fs.followContent(tx, p)
+	if err != nil {
+		return nil, p.Err("open", err)
+	}
 
-		if cerr := tx.Commit(); cerr != nil {
-			err = cerr //commit errors will take precedence
-		}
-	}()
+	p = rp
 
 	//attempt to get existing file
 	fi, err := fs.getfi(tx, p)
@@ -355,9 +1019,28 @@ func (fs *FileSystem) OpenFile(p P, flag int, perm os.FileMode) (f *File, err er
 		}
 	}
 
+	//an expired file doesn't exist anymore, it is reaped before a new one takes its place
+	if fi != nil && fs.expired(fi) {
+		if flag&os.O_CREATE != 0 && tx.Writable() {
+			if err = fs.rmfi(tx, p, fi); err != nil {
+				return nil, p.Err("open", err)
+			}
+		}
+
+		fi = nil
+	}
+
+	//whether the file exists is checked in the transaction that creates it, only a writable transaction keeps other writers from creating it in between. Existing files open with O_CREATE in any transaction
+	if fi == nil && flag&os.O_CREATE != 0 && !tx.Writable() {
+		return nil, p.Err("open", ErrTxNotWritable)
+	}
+
 	//do we want to create (if it doesnt exist)
 	if flag&os.O_CREATE != 0 {
 		if fi == nil {
+			if err = fs.validateLimits(p); err != nil {
+				return nil, p.Err("open", err)
+			}
 
 			//make sure parent exists
 			pp := p.Parent()
@@ -371,12 +1054,25 @@ func (fs *FileSystem) OpenFile(p P, flag int, perm os.FileMode) (f *File, err er
 				return nil, pp.Err("open", ErrNotDirectory)
 			}
 
+			//a name that only differs in case from a sibling's might be created elsewhere
+			np, err := fs.resolveCollision(tx, p, nil, true)
+			if err != nil {
+				return nil, pathErr("open", p, err)
+			}
+
+			p = np
+
 			//setup new file
+			ino, err := fs.nextIno(tx)
+			if err != nil {
+				return nil, p.Err("open", err)
+			}
+
 			fi = &fileInfo{
 				N: p.Base(),
 				M: perm,
-				T: time.Now(),
-				//@TODO setup determine size
+				T: fs.clock.Now(),
+				I: ino,
 			}
 
 			//insert it
@@ -387,6 +1083,8 @@ func (fs *FileSystem) OpenFile(p P, flag int, perm os.FileMode) (f *File, err er
 		} else if flag&os.O_EXCL != 0 {
 			return nil, p.Err("open", os.ErrExist) //it existed, but user wants exclusive access
 		}
+
+		//otherwise the existing file is opened as is: like POSIX open, 'perm' only applies to new files
 	}
 
 	//at this point we expect a file to exist
@@ -394,27 +1092,164 @@ func (fs *FileSystem) OpenFile(p P, flag int, perm os.FileMode) (f *File, err er
 		return nil, p.Err("open", os.ErrNotExist)
 	}
 
+	//directories can only be opened for reading their entries, like EISDIR
+	if fi.IsDir() && writable(flag) {
+		return nil, p.Err("open", ErrIsDirectory)
+	}
+
+	//existing content is discarded when truncating, which counts as a modification even if the file was empty already
+	if flag&os.O_TRUNC != 0 {
+		if fi.S > 0 {
+			if err = fs.delChunkPtrs(tx, fi); err != nil {
+				return nil, p.Err("open", err)
+			}
+		}
+
+		fi.S = 0
+		fi.D = nil
+		fi.T = fs.clock.Now()
+		if err = fs.putfi(tx, p, fi); err != nil {
+			return nil, p.Err("open", err)
+		}
+	}
+
 	//finally set up the file (handle) with available info
-	return NewFile(fs, p), nil
+	f = NewFile(fs, p)
+	f.flag = flag
+	f.tx = tx
+	f.open = true
+	fs.handles.open(p, flag)
+	fs.inodes.track(fi.I, p)
+	return f, nil
 }
 
-//Stat returns a FileInfo describing the named file
+//Stat returns a FileInfo describing the named file, symbolic links are followed. Use Lstat to describe a link itself
 func (fs *FileSystem) Stat(p P) (fi os.FileInfo, err error) {
+	if err = fs.db.View(func(tx Tx) error {
+		fi, err = fs.StatTx(tx, p)
+		return err
+	}); err != nil {
+		return nil, pathErr("stat", p, err)
+	}
+
+	return fi, nil
+}
+
+//StatTx returns a FileInfo describing the named file as seen by transaction 'tx' that is managed by the caller, symbolic links are followed. If there is an error, it will be of type *PathError.
+func (fs *FileSystem) StatTx(tx Tx, p P) (fi os.FileInfo, err error) {
 	err = p.Validate()
 	if err != nil {
 		return nil, p.Err("stat", err)
 	}
 
-	if err = fs.db.View(func(tx *bolt.Tx) error {
-		fi, err = fs.getfi(tx, p)
+	rp, err := fs.followLinks(tx, p)
+	if err != nil {
+		return nil, p.Err("stat", err)
+	}
+
+	ifi, err := fs.getfi(tx, rp)
+	if err != nil {
+		return nil, p.Err("stat", err)
+	}
+
+	if fs.expired(ifi) {
+		return nil, p.Err("stat", os.ErrNotExist)
+	}
+
+	fs.inodes.track(ifi.I, rp)
+	return ifi, nil
+}
+
+//Chmod changes the permission bits of the named file to those of 'mode', its file type and modification time are preserved. If there is an error, it will be of type *PathError.
+func (fs *FileSystem) Chmod(p P, mode os.FileMode) (err error) {
+	err = p.Validate()
+	if err != nil {
+		return p.Err("chmod", err)
+	}
+
+	if err = fs.db.Update(func(tx Tx) error {
+		fi, err := fs.getfi(tx, p)
 		if err != nil {
 			return err
 		}
 
-		return nil
+		fi.M = fi.M&os.ModeType | mode.Perm()
+		return fs.putfi(tx, p, fi)
 	}); err != nil {
-		return nil, p.Err("stat", err)
+		return pathErr("chmod", p, err)
 	}
 
-	return fi, nil
+	return nil
+}
+
+//Allocate grows the named file to 'size' bytes without storing any content, like fallocate without keeping the size. The added bytes read as zeros until they are written, files that are already at least as large are left as they are. Content that was stored inline moves to chunks when the file outgrows the inline threshold, symbolic links are followed. If there is an error, it will be of type *PathError.
+func (fs *FileSystem) Allocate(p P, size int64) (err error) {
+	err = p.Validate()
+	if err != nil {
+		return p.Err("allocate", err)
+	}
+
+	if size < 0 {
+		return p.Err("allocate", os.ErrInvalid)
+	}
+
+	if err = fs.db.Update(func(tx Tx) error {
+		rp, err := fs.followContent(tx, p)
+		if err != nil {
+			return err
+		}
+
+		fi, err := fs.getfi(tx, rp)
+		if err != nil {
+			return err
+		}
+
+		if fi.IsDir() {
+			return ErrIsDirectory
+		}
+
+		if size <= fi.S {
+			return nil
+		}
+
+		if fi.D != nil && size <= fs.inline {
+			fi.D = writeInline(fi.D, size, nil)
+		} else if fi.D != nil {
+			data := fi.D
+			fi.D, fi.S = nil, 0
+			if _, _, err = fs.putRegion(tx, fi, 0, data, fs.chunking, true); err != nil {
+				return err
+			}
+		}
+
+		fi.S = size
+		fi.T = fs.clock.Now()
+		return fs.putfi(tx, rp, fi)
+	}); err != nil {
+		return pathErr("allocate", p, err)
+	}
+
+	return nil
+}
+
+//Chtimes changes the modification time of the named file, the access time is accepted for compatibility with os.Chtimes but not stored. If there is an error, it will be of type *PathError.
+func (fs *FileSystem) Chtimes(p P, atime time.Time, mtime time.Time) (err error) {
+	err = p.Validate()
+	if err != nil {
+		return p.Err("chtimes", err)
+	}
+
+	if err = fs.db.Update(func(tx Tx) error {
+		fi, err := fs.getfi(tx, p)
+		if err != nil {
+			return err
+		}
+
+		fi.T = mtime
+		return fs.putfi(tx, p, fi)
+	}); err != nil {
+		return pathErr("chtimes", p, err)
+	}
+
+	return nil
 }
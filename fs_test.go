@@ -1,18 +1,27 @@
 package treedb
 
 import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
 	"path/filepath"
 	"reflect"
+	"runtime"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/boltdb/bolt"
+	"github.com/restic/chunker"
 )
 
-func testdb(t *testing.T) (db *bolt.DB, close func()) {
+func testdb(t testing.TB) (db *bolt.DB, close func()) {
 	tmpdir, err := ioutil.TempDir("", "dfs_test_")
 	if err != nil {
 		t.Fatalf("failed to create temp dir: %v", err)
@@ -49,10 +58,8 @@ func testfiles(fs *FileSystem, t *testing.T) {
 		t.Fatal(err)
 	}
 
-	_, err = fs.OpenFile(P{"cccc"}, os.O_CREATE, 0777)
-
 	//the one-to last unicode char is still valid and should be ordered before the next dir
-	_, err = fs.OpenFile(P{"darsssc.txt"}, os.O_CREATE, 0777)
+	_, err = fs.OpenFile(P{"bar\uFFFEc.txt"}, os.O_CREATE, 0777)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -73,7 +80,7 @@ func TestGetFileInfoNonExisting(t *testing.T) {
 	fs, close := testfs(t)
 	defer close()
 
-	err := fs.db.View(func(tx *bolt.Tx) error {
+	err := fs.db.View(func(tx Tx) error {
 		_, err := fs.getfi(tx, P{"foo.txt"})
 		return err
 	})
@@ -88,7 +95,7 @@ func TestPutFileInfo(t *testing.T) {
 	defer close()
 
 	fiA := &fileInfo{N: "foo.txt"}
-	err := fs.db.Update(func(tx *bolt.Tx) error {
+	err := fs.db.Update(func(tx Tx) error {
 		return fs.putfi(tx, P{"foo.txt"}, fiA)
 	})
 
@@ -97,7 +104,7 @@ func TestPutFileInfo(t *testing.T) {
 	}
 
 	var fiB *fileInfo
-	err = fs.db.View(func(tx *bolt.Tx) error {
+	err = fs.db.View(func(tx Tx) error {
 		fiB, err = fs.getfi(tx, P{"foo.txt"})
 		return err
 	})
@@ -246,6 +253,54 @@ func CaseOpenFileExclusive(fs *FileSystem, t *testing.T) {
 	}
 }
 
+func CaseOpenFileExclusiveRace(fs *FileSystem, t *testing.T) {
+	const n = 50
+	errs := make(chan error, n)
+	start := make(chan struct{})
+	for i := 0; i < n; i++ {
+		go func() {
+			<-start
+			f, err := fs.OpenFile(P{"foo.txt"}, os.O_CREATE|os.O_RDWR|os.O_EXCL, 0777)
+			if err == nil {
+				err = f.Close()
+			}
+
+			errs <- err
+		}()
+	}
+
+	close(start)
+	created := 0
+	for i := 0; i < n; i++ {
+		err := <-errs
+		if err == nil {
+			created++
+		} else if !os.IsExist(err) {
+			t.Errorf("expected losers of the race to get os.ErrExist, got: %v", err)
+		}
+	}
+
+	if created != 1 {
+		t.Errorf("expected exactly one exclusive create to succeed, got: %d", created)
+	}
+
+	//a read-only transaction cannot guarantee that the file is created exclusively
+	if err := fs.db.View(func(tx Tx) error {
+		_, err := fs.OpenFileTx(tx, P{"bar.txt"}, os.O_CREATE|os.O_RDWR|os.O_EXCL, 0777)
+		return err
+	}); !errors.Is(err, ErrTxNotWritable) {
+		t.Errorf("expected creating in a read-only transaction to fail, got: %v", err)
+	}
+
+	//nothing is created when the file exists already, so any transaction will do
+	if err := fs.db.View(func(tx Tx) error {
+		_, err := fs.OpenFileTx(tx, P{"foo.txt"}, os.O_CREATE|os.O_RDONLY, 0777)
+		return err
+	}); err != nil {
+		t.Errorf("expected opening an existing file with O_CREATE in a read-only transaction to succeed, got: %v", err)
+	}
+}
+
 func CaseOpenFileReadOnly(fs *FileSystem, t *testing.T) {
 	_, err := fs.OpenFile(Root, os.O_RDONLY, 0777)
 	if err != nil {
@@ -253,6 +308,129 @@ func CaseOpenFileReadOnly(fs *FileSystem, t *testing.T) {
 	}
 }
 
+func CaseOpenFileAccessMode(fs *FileSystem, t *testing.T) {
+	testwrite(fs, t, P{"a.txt"}, []byte("hello"))
+
+	rf, err := fs.OpenFile(P{"a.txt"}, os.O_RDONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer rf.Close()
+	if _, err = rf.Write([]byte("x")); !os.IsPermission(err) {
+		t.Errorf("expected permission error writing a read-only handle, got: %v", err)
+	}
+
+	if _, err = rf.ReadFrom(strings.NewReader("x")); !os.IsPermission(err) {
+		t.Errorf("expected permission error reading into a read-only handle, got: %v", err)
+	}
+
+	wf, err := fs.OpenFile(P{"a.txt"}, os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer wf.Close()
+	if _, err = wf.Read(make([]byte, 5)); !os.IsPermission(err) {
+		t.Errorf("expected permission error reading a write-only handle, got: %v", err)
+	}
+
+	if _, ok := err.(*os.PathError); !ok {
+		t.Errorf("expected a *os.PathError, got: %T", err)
+	}
+
+	if _, err = wf.WriteTo(ioutil.Discard); !os.IsPermission(err) {
+		t.Errorf("expected permission error streaming a write-only handle, got: %v", err)
+	}
+
+	if data := testread(fs, t, P{"a.txt"}); string(data) != "hello" {
+		t.Errorf("expected content to be unchanged, got: %q", data)
+	}
+}
+
+func CaseOpenFileDirectory(fs *FileSystem, t *testing.T) {
+	testfiles(fs, t)
+	for _, flag := range []int{os.O_WRONLY, os.O_RDWR, os.O_RDWR | os.O_CREATE, os.O_WRONLY | os.O_TRUNC} {
+		_, err := fs.OpenFile(P{"bar"}, flag, 0)
+		if perr, ok := err.(*os.PathError); !ok || perr.Err != ErrIsDirectory {
+			t.Errorf("expected ErrIsDirectory opening a directory with flag %d, got: %v", flag, err)
+		}
+	}
+
+	f, err := fs.OpenFile(P{"bar"}, os.O_RDONLY, 0)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+
+	defer f.Close()
+	names, err := f.Readdirnames(0)
+	if err != nil || len(names) != 1 || names[0] != "c.txt" {
+		t.Errorf("expected directory entries to be read, got: %v, %v", names, err)
+	}
+
+	if _, err = f.Read(make([]byte, 1)); !errors.Is(err, ErrIsDirectory) {
+		t.Errorf("expected ErrIsDirectory reading a directory, got: %v", err)
+	}
+}
+
+func CaseOpenFileCreateExisting(fs *FileSystem, t *testing.T) {
+	p := P{"a.txt"}
+	f, err := fs.OpenFile(p, os.O_CREATE|os.O_WRONLY, 0640)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = f.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	before, err := fs.Stat(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//without O_EXCL the existing file is opened, its mode is left alone
+	f, err = fs.OpenFile(p, os.O_CREATE|os.O_RDWR, 0777)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+
+	f.Close()
+	fi, err := fs.Stat(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if fi.Mode() != 0640 || fi.Size() != 5 || !fi.ModTime().Equal(before.ModTime()) {
+		t.Errorf("expected file to be unchanged, got mode: %v, size: %d", fi.Mode(), fi.Size())
+	}
+
+	//with O_TRUNC its content is discarded and it counts as modified, empty or not
+	for i := 0; i < 2; i++ {
+		time.Sleep(time.Millisecond)
+		f, err = fs.OpenFile(p, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0777)
+		if err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+
+		f.Close()
+		fi, err = fs.Stat(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if fi.Mode() != 0640 || fi.Size() != 0 || !fi.ModTime().After(before.ModTime()) {
+			t.Errorf("expected file to be truncated, got mode: %v, size: %d", fi.Mode(), fi.Size())
+		}
+
+		before = fi
+	}
+}
+
 func CaseOpenFileNonExisting(fs *FileSystem, t *testing.T) {
 	_, err := fs.OpenFile(P{"foo.txt"}, os.O_RDWR, 0777)
 	if err == os.ErrNotExist {
@@ -260,6 +438,93 @@ func CaseOpenFileNonExisting(fs *FileSystem, t *testing.T) {
 	}
 }
 
+func CaseOpenFileFlags(fs *FileSystem, t *testing.T) {
+	content := bytes.Repeat([]byte{'a'}, 2*miB)
+	for i, c := range []struct {
+		flag   int
+		exists bool
+		err    error
+		size   int64
+	}{
+		{os.O_RDONLY, true, nil, 2 * miB},
+		{os.O_RDONLY | os.O_CREATE, true, nil, 2 * miB},
+		{os.O_RDONLY | os.O_CREATE, false, nil, 0},
+		{os.O_WRONLY, true, nil, 2 * miB},
+		{os.O_RDWR, true, nil, 2 * miB},
+		{os.O_WRONLY | os.O_TRUNC, true, nil, 0},
+		{os.O_RDWR | os.O_TRUNC, true, nil, 0},
+		{os.O_WRONLY | os.O_CREATE | os.O_TRUNC, false, nil, 0},
+		{os.O_WRONLY | os.O_APPEND | os.O_TRUNC, true, nil, 0},
+		{os.O_RDONLY | os.O_TRUNC, true, ErrInvalidFlag, 2 * miB},
+		{os.O_RDONLY | os.O_CREATE | os.O_TRUNC, false, ErrInvalidFlag, -1},
+		{os.O_WRONLY | os.O_RDWR, true, ErrInvalidFlag, 2 * miB},
+	} {
+		p := P{fmt.Sprintf("%d.txt", i)}
+		if c.exists {
+			testwrite(fs, t, p, content)
+		}
+
+		f, err := fs.OpenFile(p, c.flag, 0666)
+		if c.err != nil {
+			if err == nil || err.(*os.PathError).Err != c.err {
+				t.Errorf("case %d: expected %v, got: %v", i, c.err, err)
+			}
+		} else if err != nil {
+			t.Errorf("case %d: expected no error, got: %v", i, err)
+			continue
+		} else {
+			f.Close()
+		}
+
+		fi, err := fs.Stat(p)
+		if c.size < 0 {
+			if !os.IsNotExist(err) {
+				t.Errorf("case %d: expected file not to be created, got: %v", i, err)
+			}
+
+			continue
+		}
+
+		if err != nil {
+			t.Fatalf("case %d: %v", i, err)
+		}
+
+		if fi.Size() != c.size {
+			t.Errorf("case %d: expected size %d, got: %d", i, c.size, fi.Size())
+		}
+	}
+
+	//truncated files can be written again
+	p := P{"again.txt"}
+	testwrite(fs, t, p, content)
+	f, err := fs.OpenFile(p, os.O_WRONLY|os.O_TRUNC, 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = f.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if data := testread(fs, t, p); string(data) != "hello" {
+		t.Errorf("expected only the new content, got %d bytes", len(data))
+	}
+
+	//directories cannot be truncated
+	if err = fs.Mkdir(P{"dir"}, 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = fs.OpenFile(P{"dir"}, os.O_WRONLY|os.O_TRUNC, 0)
+	if err == nil || err.(*os.PathError).Err != ErrIsDirectory {
+		t.Errorf("expected ErrIsDirectory, got: %v", err)
+	}
+}
+
 func CaseMkdirInvalidPath(fs *FileSystem, t *testing.T) {
 	err := fs.Mkdir(P{"fo\uFFFFo.txt"}, 0)
 	if err == nil {
@@ -271,6 +536,228 @@ func CaseMkdirInvalidPath(fs *FileSystem, t *testing.T) {
 	}
 }
 
+func CasePathLimits(fs *FileSystem, t *testing.T) {
+	long := strings.Repeat("x", DefaultMaxNameLen+1)
+	_, err := fs.OpenFile(P{long}, os.O_CREATE|os.O_WRONLY, 0666)
+	if err == nil || err.(*os.PathError).Err != ErrNameTooLong {
+		t.Errorf("expected ErrNameTooLong when creating a file, got: %v", err)
+	}
+
+	err = fs.Mkdir(P{long}, 0777)
+	if err == nil || err.(*os.PathError).Err != ErrNameTooLong {
+		t.Errorf("expected ErrNameTooLong when creating a directory, got: %v", err)
+	}
+
+	//a deep path that stays within the limits is fine
+	p := P{}
+	for i := 0; i < 100; i++ {
+		p = append(p, fmt.Sprintf("dir%d", i))
+		if err = fs.Mkdir(p, 0777); err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+	}
+
+	testwrite(fs, t, append(p, "a.txt"), []byte("hello"))
+}
+
+func TestPathLimits(t *testing.T) {
+	db, close := testdb(t)
+	defer close()
+
+	fs, err := NewFileSystem(t.Name(), db, WithPathLimits(8, 16))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = fs.Mkdir(P{"aaaaaaa"}, 0777)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+
+	_, err = fs.OpenFile(P{"aaaaaaa", "bbbbbbbb"}, os.O_CREATE|os.O_WRONLY, 0666)
+	if err == nil || err.(*os.PathError).Err != ErrPathTooLong {
+		t.Errorf("expected ErrPathTooLong, got: %v", err)
+	}
+
+	_, err = fs.OpenFile(P{"bbbbbbbb"}, os.O_CREATE|os.O_WRONLY, 0666)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+
+	err = fs.Rename(P{"bbbbbbbb"}, P{"aaaaaaa", "bbbbbbbb"})
+	if err == nil || err.(*os.PathError).Err != ErrPathTooLong {
+		t.Errorf("expected ErrPathTooLong when renaming, got: %v", err)
+	}
+}
+
+func TestFileSystemID(t *testing.T) {
+	db, close := testdb(t)
+	defer close()
+
+	for _, id := range []string{"", strings.Repeat("x", MaxIDLen+1), "f_foo", "p_foo", "r_foo"} {
+		_, err := NewFileSystem(id, db)
+		if err != ErrInvalidID {
+			t.Errorf("expected ErrInvalidID for %q, got: %v", id, err)
+		}
+	}
+
+	//ids that start with a prefix that was reserved later are valid for file systems that already exist
+	err := db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucket([]byte("f_j_old"))
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = NewFileSystem("j_old", db, WithAutoMigrate()); err != nil {
+		t.Errorf("expected an existing file system with a later prefix to open, got: %v", err)
+	}
+
+	if _, err = NewFileSystem("j_new", db); err != ErrInvalidID {
+		t.Errorf("expected ErrInvalidID for a new file system with a later prefix, got: %v", err)
+	}
+
+	//buckets that another tool created are not taken over
+	err = db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucket([]byte("f_other"))
+		if err != nil {
+			return err
+		}
+
+		return b.Put([]byte("foo"), []byte("bar"))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = NewFileSystem("other", db)
+	if !errors.Is(err, ErrBucketConflict) {
+		t.Errorf("expected ErrBucketConflict, got: %v", err)
+	}
+
+	//while an existing file system is opened again
+	fs, err := NewFileSystem("mine", db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = fs.Mkdir(P{"foo"}, 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	fs, err = NewFileSystem("mine", db)
+	if err != nil {
+		t.Fatalf("expected no error when reopening, got: %v", err)
+	}
+
+	if _, err = fs.Stat(P{"foo"}); err != nil {
+		t.Errorf("expected reopened file system to hold the directory, got: %v", err)
+	}
+}
+
+func TestChunkBucket(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "dfs_test_")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(tmpdir)
+	path := filepath.Join(tmpdir, "fs.bolt")
+	db, err := bolt.Open(path, 0666, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"", "f_blobs", "p_blobs", string(MetaBucketName)} {
+		if _, err = NewFileSystem(t.Name(), db, WithChunkBucket([]byte(name))); !errors.Is(err, ErrBucketConflict) {
+			t.Errorf("expected ErrBucketConflict for chunk bucket %q, got: %v", name, err)
+		}
+	}
+
+	opts := []Option{WithChunkReplicas(2), WithChunkBucket([]byte("blobs"))}
+	fs, err := NewFileSystem(t.Name(), db, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := make([]byte, 3*miB)
+	rand.Read(data)
+	testwrite(fs, t, P{"a.txt"}, data)
+	if err = db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	//chunks survive a restart in the configured bucket and its replica
+	db, err = bolt.Open(path, 0666, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer db.Close()
+	if err = db.View(func(tx *bolt.Tx) error {
+		for name, expected := range map[string]bool{"blobs": true, "blobs_r1": true, string(ChunkBucketName): false} {
+			b := tx.Bucket([]byte(name))
+			if has := b != nil && b.Stats().KeyN > 0; has != expected {
+				t.Errorf("expected bucket %q to hold chunks: %v, got: %v", name, expected, has)
+			}
+		}
+
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if fs, err = NewFileSystem(t.Name(), db, opts...); err != nil {
+		t.Fatal(err)
+	}
+
+	if output := testread(fs, t, P{"a.txt"}); !bytes.Equal(output, data) {
+		t.Error("expected content to be read back after reopening")
+	}
+}
+
+func TestMaxDepth(t *testing.T) {
+	db, close := testdb(t)
+	defer close()
+
+	fs, err := NewFileSystem(t.Name(), db, WithMaxDepth(3))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, p := range []P{{"a"}, {"a", "b"}} {
+		if err = fs.Mkdir(p, 0777); err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+	}
+
+	_, err = fs.OpenFile(P{"a", "b", "c"}, os.O_CREATE|os.O_WRONLY, 0666)
+	if err != nil {
+		t.Fatalf("expected file at the limit to be created, got: %v", err)
+	}
+
+	_, err = fs.OpenFile(P{"a", "b", "c", "d"}, os.O_CREATE|os.O_WRONLY, 0666)
+	if err == nil || err.(*os.PathError).Err != ErrInvalidPath {
+		t.Errorf("expected ErrInvalidPath, got: %v", err)
+	}
+
+	err = fs.Mkdir(P{"a", "b", "d", "e"}, 0777)
+	if err == nil || err.(*os.PathError).Err != ErrInvalidPath {
+		t.Errorf("expected ErrInvalidPath, got: %v", err)
+	}
+
+	//moving a directory deeper moves its descendants past the limit
+	if err = fs.Mkdir(P{"x"}, 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	err = fs.Rename(P{"a"}, P{"x", "a"})
+	if err == nil || err.(*os.PathError).Err != ErrInvalidPath {
+		t.Errorf("expected ErrInvalidPath when renaming, got: %v", err)
+	}
+}
+
 func CaseMkdirNonExisting(fs *FileSystem, t *testing.T) {
 	err := fs.Mkdir(P{"bar"}, 777)
 	if err != nil {
@@ -436,7 +923,7 @@ func CaseFileReaddirLimitN(fs *FileSystem, t *testing.T) {
 	}
 }
 
-func CaseFileReaddirNamesAll(fs *FileSystem, t *testing.T) {
+func CaseFileReaddirTypes(fs *FileSystem, t *testing.T) {
 	testfiles(fs, t)
 
 	f, err := fs.Open(Root)
@@ -444,145 +931,2764 @@ func CaseFileReaddirNamesAll(fs *FileSystem, t *testing.T) {
 		t.Fatalf("expected no error, got: %v", err)
 	}
 
-	//in <= 0 mode, readdir returns all without an EOF error
-	names, err := f.Readdirnames(0)
+	entries, err := f.ReaddirTypes(2)
 	if err != nil {
 		t.Fatalf("expected no error, got: %v", err)
 	}
 
-	fmt.Println(names)
+	if len(entries) != 2 {
+		t.Fatalf("expected 2 entries, got: %d", len(entries))
+	}
 
-	if len(names) != 4 {
-		t.Fatal("expected this many directory names")
+	//second call should also succeed, we have 4 entries
+	rest, err := f.ReaddirTypes(2)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
 	}
 
-	if names[0] != "a.txt" {
-		t.Error("expected this name")
+	entries = append(entries, rest...)
+	if len(entries) != 4 {
+		t.Fatalf("expected 4 entries in total, got: %d", len(entries))
 	}
 
-	if names[1] != "b.txt" {
-		t.Error("expected this name")
+	_, err = f.ReaddirTypes(2)
+	if err != io.EOF {
+		t.Errorf("expected EOF after the last page, got: %v", err)
 	}
 
-	if names[2] != "bar" {
-		t.Error("expected this name")
+	types := map[string]os.FileMode{}
+	for _, de := range entries {
+		types[de.Name()] = de.Type()
+		if de.Ino() == 0 {
+			t.Errorf("expected entry '%s' to have an inode", de.Name())
+		}
 	}
 
-	if names[3] != "bar\uFFFEc.txt" {
-		t.Error("expected this name")
+	if types["bar"] != os.ModeDir {
+		t.Errorf("expected 'bar' to be a directory, got: %v", types["bar"])
+	}
+
+	if types["a.txt"] != 0 {
+		t.Errorf("expected 'a.txt' to be a regular file, got: %v", types["a.txt"])
 	}
 }
 
-func CaseRemoveInvalidPath(fs *FileSystem, t *testing.T) {
-	testfiles(fs, t)
-	err := fs.Remove(P{"bar\uFFFF.txt"})
-	if err == nil {
-		t.Error("expected error")
+func CaseFileReaddirSeparatorOrder(fs *FileSystem, t *testing.T) {
+	if err := fs.Mkdir(P{"bar"}, 0777); err != nil {
+		t.Fatal(err)
 	}
 
-}
+	//siblings of "bar" whose names bracket the separator, and entries inside "bar" that sort in between
+	siblings := []string{"bar!", "bar\uFFFE", "bar\U0001F600"}
+	for _, name := range siblings {
+		testwrite(fs, t, P{name}, nil)
+	}
 
-func CaseRemoveNonExisting(fs *FileSystem, t *testing.T) {
-	testfiles(fs, t)
-	err := fs.Remove(P{"c.txt"})
-	if err == nil {
-		t.Fatalf("expected err")
+	for _, name := range []string{"a.txt", "\uFFFE", "\U0001F600"} {
+		testwrite(fs, t, P{"bar", name}, nil)
 	}
 
-	perr := err.(*os.PathError)
-	if perr.Err != os.ErrNotExist {
-		t.Fatalf("expected os.ErrNotExist, got: %v", err)
+	for _, n := range []int{-1, 1} {
+		f, err := fs.Open(Root)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var names []string
+		for {
+			batch, err := f.Readdirnames(n)
+			names = append(names, batch...)
+			if err == io.EOF || n <= 0 {
+				break
+			} else if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		//entries are listed in byte-order of their names, without the entries of "bar"
+		expected := append([]string{"bar"}, siblings...)
+		if !reflect.DeepEqual(names, expected) {
+			t.Errorf("readdir(%d): expected %q, got: %q", n, expected, names)
+		}
 	}
 }
 
-func CaseRemoveNonEmptyDir(fs *FileSystem, t *testing.T) {
+func CaseReadDirSorted(fs *FileSystem, t *testing.T) {
 	testfiles(fs, t)
-	err := fs.Remove(P{"bar"})
-	if err == nil {
-		t.Fatalf("expected err")
+	testwrite(fs, t, P{"a.txt"}, []byte("foo"))
+	testwrite(fs, t, P{"Z.txt"}, []byte("zzzz"))
+
+	names := func(infos []os.FileInfo) (names []string) {
+		for _, fi := range infos {
+			names = append(names, fi.Name())
+		}
+
+		return names
 	}
 
-	perr := err.(*os.PathError)
-	if perr.Err != ErrNotEmptyDirectory {
-		t.Fatalf("expected os.ErrNotExist, got: %v", err)
+	f, err := fs.Open(Root)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	raw, err := f.Readdir(-1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if expected := []string{"Z.txt", "a.txt", "b.txt", "bar", "bar\uFFFEc.txt"}; !reflect.DeepEqual(names(raw), expected) {
+		t.Errorf("expected raw order %q, got: %q", expected, names(raw))
+	}
+
+	for by, expected := range map[SortKey][]string{
+		SortByName:    {"a.txt", "b.txt", "bar", "bar\uFFFEc.txt", "Z.txt"},
+		SortBySize:    {"b.txt", "bar", "bar\uFFFEc.txt", "a.txt", "Z.txt"},
+		SortByModTime: {"b.txt", "bar\uFFFEc.txt", "bar", "a.txt", "Z.txt"},
+	} {
+		infos, err := fs.ReadDirSorted(Root, by)
+		if err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+
+		if !reflect.DeepEqual(names(infos), expected) {
+			t.Errorf("expected order %q for sort key %d, got: %q", expected, by, names(infos))
+		}
+
+		//raw order lists the upper case name first
+		if reflect.DeepEqual(names(infos), names(raw)) {
+			t.Errorf("expected the order for sort key %d to differ from the raw order, got: %q", by, names(infos))
+		}
 	}
 
+	_, err = fs.ReadDirSorted(P{"a.txt"}, SortByName)
+	if err == nil || err.(*os.PathError).Err != ErrNotDirectory {
+		t.Errorf("expected ErrNotDirectory, got: %v", err)
+	}
 }
 
-func CaseRemoveEmptyDir(fs *FileSystem, t *testing.T) {
+func CaseFileReaddirNamesAll(fs *FileSystem, t *testing.T) {
 	testfiles(fs, t)
-	err := fs.Mkdir(P{"empty-dir"}, 0777)
+
+	f, err := fs.Open(Root)
 	if err != nil {
-		t.Errorf("expected no error, got: %+v", err)
+		t.Fatalf("expected no error, got: %v", err)
 	}
 
-	err = fs.Remove(P{"empty-dir"})
+	//in <= 0 mode, readdir returns all without an EOF error
+	names, err := f.Readdirnames(0)
 	if err != nil {
-		t.Errorf("expected no error, got: %+v", err)
+		t.Fatalf("expected no error, got: %v", err)
 	}
 
-	_, err = fs.Stat(P{"empty-dir"})
-	if !os.IsNotExist(err) {
-		t.Error("deleted directory should no longer exist")
+	if len(names) != 4 {
+		t.Fatal("expected this many directory names")
+	}
+
+	if names[0] != "a.txt" {
+		t.Error("expected this name")
+	}
+
+	if names[1] != "b.txt" {
+		t.Error("expected this name")
+	}
+
+	if names[2] != "bar" {
+		t.Error("expected this name")
+	}
+
+	if names[3] != "bar\uFFFEc.txt" {
+		t.Error("expected this name")
 	}
 }
 
-func CaseRemoveAllInvalidPath(fs *FileSystem, t *testing.T) {
-	testfiles(fs, t)
-	err := fs.RemoveAll(P{"bar\uFFFF.txt"})
-	if err == nil {
-		t.Error("expected error")
+func CaseFileWriteRead(fs *FileSystem, t *testing.T) {
+	f, err := fs.OpenFile(P{"foo.txt"}, os.O_CREATE|os.O_RDWR, 0777)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+
+	input := make([]byte, 10*miB)
+	rand.Read(input)
+
+	n, err := f.Write(input)
+	if err != nil || n != len(input) {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+
+	//overwrite a small region in the middle
+	_, err = f.Seek(3*miB, io.SeekStart)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+
+	_, err = f.Write([]byte("hello"))
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+
+	copy(input[3*miB:], []byte("hello"))
+	err = f.Close()
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+
+	fi, err := fs.Stat(P{"foo.txt"})
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+
+	if fi.Size() != int64(len(input)) {
+		t.Errorf("expected size to equal written bytes, got: %d", fi.Size())
+	}
+
+	f, err = fs.Open(P{"foo.txt"})
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+
+	output, err := ioutil.ReadAll(f)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+
+	if !bytes.Equal(input, output) {
+		t.Error("expected read bytes to equal written bytes")
 	}
 }
 
-func TestCases(t *testing.T) {
-	cases := []struct {
-		Name string
-		Case func(fs *FileSystem, t *testing.T)
-	}{
-		{Name: "StatNonExisting", Case: CaseStatNonExisting},
-		{Name: "StatNonExisting", Case: CaseStatExisting},
-		{Name: "StatInvalidPath", Case: CaseStatInvalidPath},
+func CaseFileWriteSparse(fs *FileSystem, t *testing.T) {
+	f, err := fs.OpenFile(P{"foo.txt"}, os.O_CREATE|os.O_RDWR, 0777)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
 
-		{Name: "OpenFileInvalidPath", Case: CaseOpenFileInvalidPath},
-		{Name: "OpenFileCreateNonExisting", Case: CaseOpenFileCreateNonExisting},
-		{Name: "OpenFileParentNotDirectory", Case: CaseOpenFileParentNotDirectory},
-		{Name: "OpenFileParentNotExist", Case: CaseOpenFileParentNotExist},
+	_, err = f.Seek(1*miB, io.SeekStart)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
 
-		{Name: "OpenFileReadOnly", Case: CaseOpenFileReadOnly},
-		{Name: "OpenFileExclusive", Case: CaseOpenFileExclusive},
-		{Name: "OpenFileNonExisting", Case: CaseOpenFileNonExisting},
+	_, err = f.Write([]byte("x"))
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
 
-		{Name: "MkdirInvalidPath", Case: CaseMkdirInvalidPath},
-		{Name: "MkdirNonExisting", Case: CaseMkdirNonExisting},
-		{Name: "MkdirExistingFile", Case: CaseMkdirExistingFile},
-		{Name: "MkdirParentNotDirectory", Case: CaseMkdirParentNotDirectory},
-		{Name: "MkdirParentNotExist", Case: CaseMkdirParentNotExist},
+	_, err = f.Seek(0, io.SeekStart)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
 
-		{Name: "FileReaddirAll", Case: CaseFileReaddirAll},
-		// {Name: "FileReaddirLimitN", Case: CaseFileReaddirLimitN},
-		//
-		// {Name: "FileReaddirNamesAll", Case: CaseFileReaddirNamesAll},
-		//
-		// {Name: "RemoveInvalidPath", Case: CaseRemoveInvalidPath},
-		// {Name: "RemoveNonExisting", Case: CaseRemoveNonExisting},
-		// {Name: "RemoveNonEmptyDir", Case: CaseRemoveNonEmptyDir},
-		// {Name: "RemoveEmptyDir", Case: CaseRemoveEmptyDir},
-		//
-		// {Name: "RemoveAllInvalidPath", Case: CaseRemoveAllInvalidPath},
+	output, err := ioutil.ReadAll(f)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
 	}
 
-	for _, c := range cases {
-		t.Run(c.Name, func(t *testing.T) {
-			db, close := testdb(t)
-			defer close()
+	if len(output) != 1*miB+1 || output[1*miB] != 'x' || !bytes.Equal(output[:1*miB], make([]byte, 1*miB)) {
+		t.Errorf("expected skipped region to read as zeros, got %d bytes", len(output))
+	}
 
-			fs, err := NewFileSystem(t.Name(), db)
-			if err != nil {
-				t.Fatal(err)
-			}
+	fi, err := fs.Stat(P{"foo.txt"})
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
 
-			c.Case(fs, t)
-		})
+	if fi.Size() != 1*miB+1 {
+		t.Errorf("expected size to include the hole, got: %d", fi.Size())
+	}
+}
+
+func CaseFileWriteSparseLarge(fs *FileSystem, t *testing.T) {
+	f, err := fs.OpenFile(P{"foo.txt"}, os.O_CREATE|os.O_RDWR, 0777)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+
+	_, err = f.Seek(1024*miB, io.SeekStart)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+
+	_, err = f.Write([]byte("x"))
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+
+	_, err = f.Seek(-10, io.SeekEnd)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+
+	output, err := ioutil.ReadAll(f)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+
+	if !bytes.Equal(output, append(make([]byte, 9), 'x')) {
+		t.Errorf("expected end of the hole to read as zeros, got: %v", output)
+	}
+
+	//only the written byte is stored
+	err = fs.db.View(func(tx Tx) error {
+		n := 0
+		tx.Bucket(fs.pbucket).ForEach(func(k, v []byte) error { n++; return nil })
+		if n != 1 {
+			t.Errorf("expected a single chunk ptr, got: %d", n)
+		}
+
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func testwrite(fs *FileSystem, t testing.TB, p P, data []byte) {
+	f, err := fs.OpenFile(p, os.O_CREATE|os.O_WRONLY, 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = f.Write(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func testread(fs *FileSystem, t *testing.T, p P) []byte {
+	f, err := fs.Open(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := ioutil.ReadAll(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return data
+}
+
+//countWriter counts the bytes written to it
+type countWriter struct{ n int64 }
+
+func (w *countWriter) Write(b []byte) (int, error) {
+	w.n += int64(len(b))
+	return len(b), nil
+}
+
+func CaseFileCopy(fs *FileSystem, t *testing.T) {
+	input := make([]byte, 20*miB+10)
+	rand.Read(input)
+
+	f, err := fs.OpenFile(P{"foo.txt"}, os.O_CREATE|os.O_RDWR, 0777)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+
+	//io.Copy uses ReaderFrom, the reader is wrapped to hide its own WriterTo
+	n, err := io.Copy(f, struct{ io.Reader }{bytes.NewReader(input)})
+	if err != nil || n != int64(len(input)) {
+		t.Fatalf("expected to copy all bytes without error, got: %d, %v", n, err)
+	}
+
+	//and WriterTo for copying out, which includes a hole
+	_, err = f.Seek(1*miB, io.SeekCurrent)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+
+	_, err = f.Write([]byte("x"))
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+
+	_, err = f.Seek(0, io.SeekStart)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+
+	w := &countWriter{}
+	n, err = io.Copy(w, f)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+
+	if n != int64(len(input))+1*miB+1 || w.n != n {
+		t.Errorf("expected byte count to equal the file size, got: %d (%d written)", n, w.n)
+	}
+
+	_, err = f.Seek(0, io.SeekStart)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+
+	buf := bytes.NewBuffer(nil)
+	_, err = f.WriteTo(buf)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+
+	if !bytes.Equal(buf.Bytes()[:len(input)], input) || !bytes.Equal(buf.Bytes()[len(input):], append(make([]byte, 1*miB), 'x')) {
+		t.Error("expected streamed content to equal the file content")
+	}
+}
+
+func CaseFileAt(fs *FileSystem, t *testing.T) {
+	input := make([]byte, 3*miB+10)
+	rand.Read(input)
+
+	f, err := fs.OpenFile(P{"foo.txt"}, os.O_CREATE|os.O_RDWR, 0777)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+
+	defer f.Close()
+	if _, err = f.Write(input); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+
+	//reads at an offset are interleaved with reads from the cursor, which carry on where they left off
+	if _, err = f.Seek(miB, io.SeekStart); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+
+	for i, off := range []int64{0, 2 * miB, 3*miB - 5} {
+		b := make([]byte, 10)
+		if n, err := f.ReadAt(b, off); err != nil || n != len(b) || !bytes.Equal(b, input[off:off+10]) {
+			t.Errorf("expected to read at %d, got: %d, %v", off, n, err)
+		}
+
+		if n, err := f.Read(b); err != nil || n != len(b) || !bytes.Equal(b, input[miB+int64(i)*10:miB+int64(i+1)*10]) {
+			t.Errorf("expected read %d to continue at the cursor, got: %d, %v", i, n, err)
+		}
+	}
+
+	if pos, _ := f.Seek(0, io.SeekCurrent); pos != miB+30 {
+		t.Errorf("expected the cursor to be moved by reads only, got: %d", pos)
+	}
+
+	//reading past the end returns what is left together with io.EOF
+	b := make([]byte, 20)
+	if n, err := f.ReadAt(b, int64(len(input))-10); err != io.EOF || n != 10 || !bytes.Equal(b[:n], input[len(input)-10:]) {
+		t.Errorf("expected a short read at the end to return io.EOF, got: %d, %v", n, err)
+	}
+
+	//writes at an offset don't move the cursor either
+	if n, err := f.WriteAt([]byte("hello"), 2*miB); err != nil || n != 5 {
+		t.Fatalf("expected to write at offset, got: %d, %v", n, err)
+	}
+
+	if n, err := f.Read(b[:5]); err != nil || n != 5 || !bytes.Equal(b[:5], input[miB+30:miB+35]) {
+		t.Errorf("expected the cursor to be preserved across WriteAt, got: %d, %v", n, err)
+	}
+
+	if n, err := f.ReadAt(b[:5], 2*miB); err != nil || n != 5 || string(b[:5]) != "hello" {
+		t.Errorf("expected to read the write at offset back, got: %q, %v", b[:n], err)
+	}
+
+	if _, err = f.ReadAt(b, -1); err == nil {
+		t.Error("expected a negative offset to be refused")
+	}
+}
+
+func CaseRenameFile(fs *FileSystem, t *testing.T) {
+	testfiles(fs, t)
+	testwrite(fs, t, P{"a.txt"}, []byte("hello"))
+
+	err := fs.Rename(P{"a.txt"}, P{"bar", "d.txt"})
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+
+	_, err = fs.Stat(P{"a.txt"})
+	if !os.IsNotExist(err) {
+		t.Error("expected old path to no longer exist")
+	}
+
+	fi, err := fs.Stat(P{"bar", "d.txt"})
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+
+	if fi.Name() != "d.txt" {
+		t.Errorf("expected renamed file to have new name, got: %v", fi.Name())
+	}
+
+	if data := testread(fs, t, P{"bar", "d.txt"}); string(data) != "hello" {
+		t.Errorf("expected content to move along, got: %s", data)
+	}
+}
+
+func CaseRenameDir(fs *FileSystem, t *testing.T) {
+	testfiles(fs, t)
+	err := fs.Rename(P{"bar"}, P{"foo"})
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+
+	_, err = fs.Stat(P{"foo", "c.txt"})
+	if err != nil {
+		t.Errorf("expected child to move along, got: %v", err)
+	}
+
+	_, err = fs.Stat(P{"bar\uFFFEc.txt"})
+	if err != nil {
+		t.Errorf("expected sibling to stay, got: %v", err)
+	}
+
+	err = fs.Rename(P{"foo"}, P{"foo", "baz"})
+	if err == nil || err.(*os.PathError).Err != os.ErrInvalid {
+		t.Errorf("expected moving dir into itself to fail, got: %v", err)
+	}
+}
+
+func CaseRenameOverwriteFile(fs *FileSystem, t *testing.T) {
+	testfiles(fs, t)
+	testwrite(fs, t, P{"a.txt"}, []byte("hello"))
+	testwrite(fs, t, P{"b.txt"}, []byte("world"))
+
+	err := fs.Rename(P{"a.txt"}, P{"b.txt"})
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+
+	if data := testread(fs, t, P{"b.txt"}); string(data) != "hello" {
+		t.Errorf("expected destination to be replaced, got: %s", data)
+	}
+
+	if err = fs.db.View(func(tx Tx) error {
+		n := 0
+		tx.Bucket(fs.pbucket).ForEach(func(k, v []byte) error { n++; return nil })
+		if n != 1 {
+			t.Errorf("expected chunk ptrs of replaced file to be freed, got: %d ptrs", n)
+		}
+
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func CaseRenameNonEmptyDir(fs *FileSystem, t *testing.T) {
+	testfiles(fs, t)
+	err := fs.Mkdir(P{"foo"}, 0777)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = fs.Rename(P{"foo"}, P{"bar"})
+	if err == nil || err.(*os.PathError).Err != ErrNotEmptyDirectory {
+		t.Fatalf("expected ErrNotEmptyDirectory, got: %v", err)
+	}
+
+	//an empty directory can be replaced
+	err = fs.Mkdir(P{"empty"}, 0777)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = fs.Rename(P{"bar"}, P{"empty"})
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+}
+
+func CaseRenameTypeMismatch(fs *FileSystem, t *testing.T) {
+	testfiles(fs, t)
+	err := fs.Mkdir(P{"foo"}, 0777)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = fs.Rename(P{"a.txt"}, P{"foo"})
+	if err == nil || err.(*os.PathError).Err != ErrNotDirectory {
+		t.Errorf("expected ErrNotDirectory when replacing dir with file, got: %v", err)
+	}
+
+	err = fs.Rename(P{"foo"}, P{"a.txt"})
+	if err == nil || err.(*os.PathError).Err != ErrNotDirectory {
+		t.Errorf("expected ErrNotDirectory when replacing file with dir, got: %v", err)
+	}
+}
+
+func CaseExchange(fs *FileSystem, t *testing.T) {
+	testwrite(fs, t, P{"a.conf"}, []byte("aaa"))
+	testwrite(fs, t, P{"b.conf"}, []byte("bbbbb"))
+	if err := fs.Exchange(P{"a.conf"}, P{"b.conf"}); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+
+	if output := testread(fs, t, P{"a.conf"}); string(output) != "bbbbb" {
+		t.Errorf("expected a.conf to hold the content of b.conf, got: %q", output)
+	}
+
+	if output := testread(fs, t, P{"b.conf"}); string(output) != "aaa" {
+		t.Errorf("expected b.conf to hold the content of a.conf, got: %q", output)
+	}
+
+	fi, err := fs.Stat(P{"a.conf"})
+	if err != nil || fi.Name() != "a.conf" || fi.Size() != 5 {
+		t.Errorf("expected info to follow the exchanged file, got: %v, %v", fi, err)
+	}
+
+	//a directory and a file swap, the subtree moves along
+	if err = fs.Mkdir(P{"dir"}, 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	testwrite(fs, t, P{"dir", "c.txt"}, []byte("c"))
+	if err = fs.Exchange(P{"dir"}, P{"a.conf"}); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+
+	if output := testread(fs, t, P{"a.conf", "c.txt"}); string(output) != "c" {
+		t.Errorf("expected the subtree to move along, got: %q", output)
+	}
+
+	if output := testread(fs, t, P{"dir"}); string(output) != "bbbbb" {
+		t.Errorf("expected dir to hold the file, got: %q", output)
+	}
+
+	if _, err = fs.Stat(P{"dir", "c.txt"}); !os.IsNotExist(err) {
+		t.Errorf("expected the old subtree to be gone, got: %v", err)
+	}
+
+	if err = fs.Exchange(P{"a.conf"}, P{"a.conf", "c.txt"}); !errors.Is(err, os.ErrInvalid) {
+		t.Errorf("expected a directory not to be exchanged with its content, got: %v", err)
+	}
+
+	if err = fs.Exchange(P{"b.conf"}, P{"x.conf"}); !os.IsNotExist(err) {
+		t.Errorf("expected both paths to have to exist, got: %v", err)
+	}
+
+	if problems, err := fs.Check(); err != nil || len(problems) > 0 {
+		t.Errorf("expected a consistent tree, got: %v, %v", problems, err)
+	}
+}
+
+func CaseSymlink(fs *FileSystem, t *testing.T) {
+	testwrite(fs, t, P{"a.txt"}, []byte("hello"))
+	if err := fs.Symlink("/a.txt", P{"link"}); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+
+	fi, err := fs.Stat(P{"link"})
+	if err != nil || fi.Mode().IsDir() || fi.Mode()&os.ModeSymlink != 0 || fi.Size() != 5 {
+		t.Errorf("expected stat to follow the link to the file, got: %v, %v", fi, err)
+	}
+
+	lfi, err := fs.Lstat(P{"link"})
+	if err != nil || lfi.Mode()&os.ModeSymlink == 0 {
+		t.Errorf("expected lstat to describe the link itself, got: %v, %v", lfi, err)
+	}
+
+	if target, err := fs.Readlink(P{"link"}); err != nil || target != "/a.txt" {
+		t.Errorf("expected link target, got: %q, %v", target, err)
+	}
+
+	if _, err = fs.Readlink(P{"a.txt"}); !errors.Is(err, os.ErrInvalid) {
+		t.Errorf("expected readlink of a file to be invalid, got: %v", err)
+	}
+
+	//relative targets resolve against the directory of the link, also for links in the middle of a path
+	for _, p := range []P{{"dir"}, {"dir", "sub"}} {
+		if err = fs.Mkdir(p, 0777); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	testwrite(fs, t, P{"dir", "b.txt"}, []byte("bb"))
+	if err = fs.Symlink("../b.txt", P{"dir", "sub", "up"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = fs.Symlink("dir/sub", P{"sublink"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if fi, err = fs.Stat(P{"sublink", "up"}); err != nil || fi.Size() != 2 {
+		t.Errorf("expected relative link to resolve to dir/b.txt, got: %v, %v", fi, err)
+	}
+
+	if lfi, err = fs.Lstat(P{"sublink", "up"}); err != nil || lfi.Mode()&os.ModeSymlink == 0 {
+		t.Errorf("expected lstat to follow the links in the directories only, got: %v, %v", lfi, err)
+	}
+
+	//links that point at each other are given up on
+	if err = fs.Symlink("b", P{"a"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = fs.Symlink("/a", P{"b"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = fs.Stat(P{"a"}); !errors.Is(err, ErrTooManyLinks) {
+		t.Errorf("expected too many links, got: %v", err)
+	}
+
+	if _, err = fs.Lstat(P{"a"}); err != nil {
+		t.Errorf("expected lstat of a link in a loop to succeed, got: %v", err)
+	}
+
+	if err = fs.Symlink("/a.txt", P{"link"}); !os.IsExist(err) {
+		t.Errorf("expected existing link error, got: %v", err)
+	}
+}
+
+func CaseSymlinkContent(fs *FileSystem, t *testing.T) {
+	if err := fs.Mkdir(P{"dir"}, 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	testwrite(fs, t, P{"dir", "a.txt"}, []byte("hello"))
+	if err := fs.Symlink("dir/a.txt", P{"link"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if data := testread(fs, t, P{"link"}); string(data) != "hello" {
+		t.Errorf("expected to read the content of the target through the link, got: %q", data)
+	}
+
+	f, err := fs.OpenFile(P{"link"}, os.O_WRONLY|os.O_TRUNC, 0)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+
+	if _, err = f.Write([]byte("bye")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if data := testread(fs, t, P{"dir", "a.txt"}); string(data) != "bye" {
+		t.Errorf("expected truncate and write to act on the target, got: %q", data)
+	}
+
+	if target, err := fs.Readlink(P{"link"}); err != nil || target != "dir/a.txt" {
+		t.Errorf("expected the link to survive truncation, got: %q, %v", target, err)
+	}
+
+	if err = fs.Allocate(P{"link"}, 10); err != nil {
+		t.Fatal(err)
+	}
+
+	if fi, err := fs.Stat(P{"dir", "a.txt"}); err != nil || fi.Size() != 10 {
+		t.Errorf("expected allocate to grow the target, got: %v, %v", fi, err)
+	}
+
+	if err = WriteFileAtomic(fs, P{"link"}, []byte("atomic"), 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	if data := testread(fs, t, P{"dir", "a.txt"}); string(data) != "atomic" {
+		t.Errorf("expected atomic write to replace the target, got: %q", data)
+	}
+
+	if lfi, err := fs.Lstat(P{"link"}); err != nil || lfi.Mode()&os.ModeSymlink == 0 {
+		t.Errorf("expected the link to survive an atomic write, got: %v, %v", lfi, err)
+	}
+
+	//creating through a dangling link creates its target
+	if err = fs.Symlink("dir/new.txt", P{"dangling"}); err != nil {
+		t.Fatal(err)
+	}
+
+	testwrite(fs, t, P{"dangling"}, []byte("new"))
+	if data := testread(fs, t, P{"dir", "new.txt"}); string(data) != "new" {
+		t.Errorf("expected create through a dangling link to create its target, got: %q", data)
+	}
+}
+
+func CaseStats(fs *FileSystem, t *testing.T) {
+	testfiles(fs, t)
+	stats, err := fs.Stats()
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+
+	if stats.Files != 4 || stats.Dirs != 1 {
+		t.Errorf("expected 4 files and 1 dir, got: %+v", stats)
+	}
+
+	if stats.Chunks != 0 || stats.DedupRatio != 0 {
+		t.Errorf("expected no chunks for empty files, got: %+v", stats)
+	}
+
+	//the same content twice is stored once
+	data := make([]byte, 2*miB)
+	rand.Read(data)
+	testwrite(fs, t, P{"a.txt"}, data)
+	testwrite(fs, t, P{"bar", "c.txt"}, data)
+
+	stats, err = fs.Stats()
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+
+	if stats.Bytes != int64(2*len(data)) || stats.ChunkBytes != int64(len(data)) {
+		t.Errorf("expected content to be stored once, got: %+v", stats)
+	}
+
+	if stats.DedupRatio != 2 {
+		t.Errorf("expected dedup ratio of 2, got: %v", stats.DedupRatio)
+	}
+	//links are counted apart from files, their targets add no bytes
+	if err = fs.Symlink("a.txt", P{"l"}); err != nil {
+		t.Fatal(err)
+	}
+
+	linked, err := fs.Stats()
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+
+	if linked.Links != 1 || linked.Files != stats.Files || linked.Bytes != stats.Bytes {
+		t.Errorf("expected a link to be counted apart from files, got: %+v", linked)
+	}
+}
+
+func CaseUniqueBytes(fs *FileSystem, t *testing.T) {
+	//the bytes of the distinct chunks that files reference
+	expected := func() (n int64) {
+		seen := map[K]bool{}
+		for _, p := range []P{{"a.txt"}, {"b.txt"}} {
+			refs, err := fs.FileChunks(p)
+			if os.IsNotExist(err) {
+				continue
+			} else if err != nil {
+				t.Fatal(err)
+			}
+
+			for _, ref := range refs {
+				if !seen[ref.Key] {
+					seen[ref.Key] = true
+					n += int64(ref.Len)
+				}
+			}
+		}
+
+		return n
+	}
+
+	check := func(when string) {
+		n, err := fs.UniqueBytes()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if e := expected(); n != e {
+			t.Errorf("expected %d unique bytes %s, got: %d", e, when, n)
+		}
+	}
+
+	data := make([]byte, 3*miB)
+	rand.Read(data)
+	testwrite(fs, t, P{"a.txt"}, data)
+	testwrite(fs, t, P{"b.txt"}, data)
+	if n, err := fs.UniqueBytes(); err != nil || n != int64(len(data)) {
+		t.Errorf("expected shared chunks to be counted once, got: %d, %v", n, err)
+	}
+
+	//overwriting part of one copy releases the chunks it no longer shares
+	f, err := fs.OpenFile(P{"b.txt"}, os.O_WRONLY, 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = f.WriteAt(bytes.Repeat([]byte("x"), miB), miB); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	check("after overwriting")
+	if err = fs.Remove(P{"a.txt"}); err != nil {
+		t.Fatal(err)
+	}
+
+	check("after removing one file")
+	if err = fs.Remove(P{"b.txt"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if n, err := fs.UniqueBytes(); err != nil || n != 0 {
+		t.Errorf("expected no unique bytes once both files were removed, got: %d, %v", n, err)
+	}
+}
+
+func TestUniqueBytesRecount(t *testing.T) {
+	db, close := testdb(t)
+	defer close()
+
+	fs, err := NewFileSystem(t.Name(), db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := make([]byte, 2*miB)
+	rand.Read(data)
+	testwrite(fs, t, P{"a.txt"}, data)
+	testwrite(fs, t, P{"b.txt"}, data)
+	before, err := fs.Stats()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//file systems that were created before references were counted have no refs bucket, they are counted when opened
+	if err = db.Update(func(tx *bolt.Tx) error {
+		return tx.DeleteBucket(fs.rbucket)
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if fs, err = NewFileSystem(t.Name(), db); err != nil {
+		t.Fatal(err)
+	}
+
+	after, err := fs.Stats()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if before != after || after.ChunkBytes != int64(len(data)) || after.DedupRatio != 2 {
+		t.Errorf("expected recounted stats to equal %+v, got: %+v", before, after)
+	}
+}
+
+func CaseTxRollback(fs *FileSystem, t *testing.T) {
+	tx, err := fs.Begin(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = fs.MkdirTx(tx, P{"foo"}, 0777)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+
+	f, err := fs.OpenFileTx(tx, P{"foo", "a.txt"}, os.O_CREATE|os.O_WRONLY, 0666)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+
+	_, err = f.Write([]byte("hello"))
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+
+	err = f.Close()
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+
+	//changes are visible inside the transaction
+	fi, err := fs.StatTx(tx, P{"foo", "a.txt"})
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+
+	if fi.Size() != 5 {
+		t.Errorf("expected written bytes to be visible in the transaction, got size: %d", fi.Size())
+	}
+
+	err = tx.Rollback()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//but all of it is gone after rolling back
+	_, err = fs.Stat(P{"foo"})
+	if !os.IsNotExist(err) {
+		t.Errorf("expected directory to not exist after rollback, got: %v", err)
+	}
+
+	err = fs.db.View(func(tx Tx) error {
+		k, _ := tx.Bucket(fs.pbucket).Cursor().First()
+		if k != nil {
+			t.Error("expected no chunk ptrs after rollback")
+		}
+
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func CaseCheck(fs *FileSystem, t *testing.T) {
+	testfiles(fs, t)
+	data := make([]byte, 2*miB)
+	rand.Read(data)
+	testwrite(fs, t, P{"a.txt"}, data)
+
+	problems, err := fs.Check()
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+
+	if len(problems) != 0 {
+		t.Fatalf("expected no problems, got: %v", problems)
+	}
+
+	//remove the parent record and a chunk of a file behind the file system's back
+	var firstk K
+	err = fs.db.Update(func(tx Tx) error {
+		if err := fs.delfi(tx, P{"bar"}); err != nil {
+			return err
+		}
+
+		_, v := tx.Bucket(fs.pbucket).Cursor().First()
+		copy(firstk[:], v)
+		return tx.Bucket(fs.cbucket).Delete(firstk[:])
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	problems, err = fs.Check()
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+
+	expected := []Problem{
+		{Kind: ProblemMissingChunk, Path: P{"a.txt"}, Chunk: firstk},
+		{Kind: ProblemOrphan, Path: P{"bar", "c.txt"}},
+	}
+
+	if !reflect.DeepEqual(problems, expected) {
+		t.Errorf("expected problems %v, got: %v", expected, problems)
+	}
+}
+
+func CaseRepairOrphanToLostFound(fs *FileSystem, t *testing.T) {
+	testfiles(fs, t)
+	err := fs.Mkdir(P{"bar", "baz"}, 0777)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testwrite(fs, t, P{"bar", "baz", "d.txt"}, []byte("hello"))
+	fi, err := fs.Stat(P{"bar", "baz"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = fs.db.Update(func(tx Tx) error {
+		return fs.delfi(tx, P{"bar"})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fixed, err := fs.Repair(RepairPolicy{Orphans: OrphanToLostFound})
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+
+	if len(fixed) != 2 {
+		t.Errorf("expected both orphans to be fixed, got: %v", fixed)
+	}
+
+	//the orphaned directory is moved including its content
+	lostp := P{"lost+found", fmt.Sprintf("#%d", fi.(*fileInfo).I)}
+	if data := testread(fs, t, append(lostp, "d.txt")); string(data) != "hello" {
+		t.Errorf("expected orphaned file to be moved along, got: %s", data)
+	}
+
+	problems, err := fs.Check()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(problems) != 0 {
+		t.Errorf("expected no problems after repair, got: %v", problems)
+	}
+}
+
+func CaseRepairTruncateMissingChunk(fs *FileSystem, t *testing.T) {
+	testfiles(fs, t)
+	data := make([]byte, 4*miB)
+	rand.Read(data)
+	testwrite(fs, t, P{"a.txt"}, data)
+
+	//remove the second chunk of the file
+	var ptr chunkPtr
+	err := fs.db.Update(func(tx Tx) error {
+		c := tx.Bucket(fs.pbucket).Cursor()
+		c.First()
+		ptr = decodeChunkPtr(c.Next())
+		return tx.Bucket(fs.cbucket).Delete(ptr.k[:])
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fixed, err := fs.Repair(RepairPolicy{MissingChunks: MissingChunkTruncate})
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+
+	if len(fixed) != 1 || fixed[0].Kind != ProblemMissingChunk {
+		t.Errorf("expected missing chunk to be fixed, got: %v", fixed)
+	}
+
+	if output := testread(fs, t, P{"a.txt"}); !bytes.Equal(output, data[:ptr.off]) {
+		t.Errorf("expected file to be truncated before the missing chunk, got %d bytes", len(output))
+	}
+}
+
+func CaseRepairZeroFillMissingChunk(fs *FileSystem, t *testing.T) {
+	testfiles(fs, t)
+	data := make([]byte, 4*miB)
+	rand.Read(data)
+	testwrite(fs, t, P{"a.txt"}, data)
+	before, err := fs.TreeHash(Root)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//remove the second chunk of the file
+	var ptr chunkPtr
+	err = fs.db.Update(func(tx Tx) error {
+		c := tx.Bucket(fs.pbucket).Cursor()
+		c.First()
+		ptr = decodeChunkPtr(c.Next())
+		return tx.Bucket(fs.cbucket).Delete(ptr.k[:])
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fixed, err := fs.Repair(RepairPolicy{MissingChunks: MissingChunkZeroFill})
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+
+	if len(fixed) != 1 || fixed[0].Kind != ProblemMissingChunk {
+		t.Errorf("expected missing chunk to be fixed, got: %v", fixed)
+	}
+
+	expected := append([]byte{}, data...)
+	for i := ptr.off; i < ptr.off+int64(ptr.n); i++ {
+		expected[i] = 0
+	}
+
+	if output := testread(fs, t, P{"a.txt"}); !bytes.Equal(output, expected) {
+		t.Errorf("expected the missing chunk to read as zeros")
+	}
+
+	if after, err := fs.TreeHash(Root); err != nil || after == before {
+		t.Errorf("expected the repair to change the tree hash, got: %x, %v", after, err)
+	}
+}
+
+//testwalk returns the content of all files below 'p' by their path relative to 'p', directories are included with nil content
+func testwalk(fs *FileSystem, t *testing.T, p P) map[string][]byte {
+	files := map[string][]byte{}
+	var walk func(dirp P, rel string)
+	walk = func(dirp P, rel string) {
+		f, err := fs.Open(dirp)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		defer f.Close()
+		fis, err := f.Readdir(0)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, fi := range fis {
+			childp := append(append(P{}, dirp...), fi.Name())
+			if fi.IsDir() {
+				files[rel+fi.Name()+"/"] = nil
+				walk(childp, rel+fi.Name()+"/")
+				continue
+			}
+
+			files[rel+fi.Name()] = testread(fs, t, childp)
+		}
+	}
+
+	walk(p, "")
+	return files
+}
+
+func CaseCopyTree(fs *FileSystem, t *testing.T) {
+	testfiles(fs, t)
+	err := fs.Mkdir(P{"bar", "baz"}, 0750)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := make([]byte, 3*miB)
+	rand.Read(data)
+	testwrite(fs, t, P{"bar", "c.txt"}, data)
+	testwrite(fs, t, P{"bar", "baz", "d.txt"}, []byte("hello"))
+
+	db, close := testdb(t)
+	defer close()
+
+	dst, err := NewFileSystem(t.Name(), db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = CopyTree(dst, P{"x", "y"}, fs, P{"bar"})
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+
+	expected := testwalk(fs, t, P{"bar"})
+	if len(expected) != 3 {
+		t.Fatalf("expected source to have 3 entries, got: %d", len(expected))
+	}
+
+	if actual := testwalk(dst, t, P{"x", "y"}); !reflect.DeepEqual(expected, actual) {
+		t.Error("expected copied tree to equal the source tree")
+	}
+
+	for _, p := range []P{{"bar", "baz"}, {"bar", "c.txt"}} {
+		srcfi, err := fs.Stat(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		dstfi, err := dst.Stat(append(P{"x", "y"}, p[1:]...))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if srcfi.Mode() != dstfi.Mode() || !srcfi.ModTime().Equal(dstfi.ModTime()) {
+			t.Errorf("expected mode and modtime of '%s' to be preserved", p)
+		}
+	}
+}
+
+func TestInlineFiles(t *testing.T) {
+	db, close := testdb(t)
+	defer close()
+
+	fs, err := NewFileSystem(t.Name(), db, WithInlineThreshold(512))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	inlined := func() (inline bool, nptrs int) {
+		err := fs.db.View(func(tx Tx) error {
+			fi, err := fs.getfi(tx, P{"a.txt"})
+			if err != nil {
+				return err
+			}
+
+			inline = fi.D != nil
+			return tx.Bucket(fs.pbucket).ForEach(func(k, v []byte) error { nptrs++; return nil })
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return inline, nptrs
+	}
+
+	input := []byte("0123456789")
+	testwrite(fs, t, P{"a.txt"}, input)
+	if inline, nptrs := inlined(); !inline || nptrs != 0 {
+		t.Fatalf("expected small file to be stored inline, got inline: %v, ptrs: %d", inline, nptrs)
+	}
+
+	if output := testread(fs, t, P{"a.txt"}); !bytes.Equal(input, output) {
+		t.Fatalf("expected inline content to be read back, got: %s", output)
+	}
+
+	//growing past the threshold moves all content into chunks
+	more := make([]byte, 2*miB)
+	rand.Read(more)
+	f, err := fs.OpenFile(P{"a.txt"}, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = f.Write(more); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if inline, nptrs := inlined(); inline || nptrs == 0 {
+		t.Fatalf("expected grown file to be chunked, got inline: %v, ptrs: %d", inline, nptrs)
+	}
+
+	if output := testread(fs, t, P{"a.txt"}); !bytes.Equal(append(input, more...), output) {
+		t.Error("expected content to be unchanged after moving to chunks")
+	}
+}
+
+func TestCopyTreeOverInline(t *testing.T) {
+	db, close := testdb(t)
+	defer close()
+
+	src, err := NewFileSystem("src", db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dst, err := NewFileSystem("dst", db, WithInlineThreshold(16))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := make([]byte, 32*kiB)
+	rand.Read(data)
+	testwrite(src, t, P{"a.txt"}, data)
+	testwrite(dst, t, P{"a.txt"}, []byte("abcd"))
+
+	//chunked content replaces the inline content of the existing file
+	if err = CopyTree(dst, P{"a.txt"}, src, P{"a.txt"}); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+
+	if output := testread(dst, t, P{"a.txt"}); !bytes.Equal(data, output) {
+		t.Errorf("expected copied content to replace the inline content, got %d bytes", len(output))
+	}
+}
+
+func TestCopyTreeSymlink(t *testing.T) {
+	db, close := testdb(t)
+	defer close()
+
+	src, err := NewFileSystem("src", db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dst, err := NewFileSystem("dst", db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = src.Mkdir(P{"d"}, 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	testwrite(src, t, P{"d", "f"}, []byte("hello"))
+	if err = src.Symlink("f", P{"d", "l"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = CopyTree(dst, P{"d"}, src, P{"d"}); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+
+	if target, err := dst.Readlink(P{"d", "l"}); err != nil || target != "f" {
+		t.Errorf("expected the link to keep its target, got: %q, %v", target, err)
+	}
+
+	if output := testread(dst, t, P{"d", "l"}); string(output) != "hello" {
+		t.Errorf("expected the copied link to lead to the copied file, got: %s", output)
+	}
+}
+
+func CaseDedupRechunk(fs *FileSystem, t *testing.T) {
+	testfiles(fs, t)
+	data := make([]byte, 3*miB)
+	rand.Read(data)
+	testwrite(fs, t, P{"a.txt"}, data)
+	testwrite(fs, t, P{"b.txt"}, data)
+
+	unique, total, reclaimable, err := fs.DedupReport()
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+
+	if total != 2*unique || reclaimable != int64(len(data)) {
+		t.Errorf("expected all chunks to be shared, got unique: %d, total: %d, reclaimable: %d", unique, total, reclaimable)
+	}
+
+	cfg := DefaultChunkConfig
+	cfg.Pol = chunker.Pol(0x3FDC7A1F9C2C43)
+	err = fs.Rechunk(P{"a.txt"}, cfg)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+
+	if output := testread(fs, t, P{"a.txt"}); !bytes.Equal(output, data) {
+		t.Error("expected content to be unchanged by rechunking")
+	}
+
+	_, _, reclaimable, err = fs.DedupReport()
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+
+	if reclaimable == int64(len(data)) {
+		t.Error("expected different chunk boundaries after rechunking")
+	}
+}
+
+func CaseFileChunks(fs *FileSystem, t *testing.T) {
+	testfiles(fs, t)
+	data := make([]byte, 3*miB)
+	rand.Read(data)
+	testwrite(fs, t, P{"a.txt"}, data)
+
+	refs, err := fs.FileChunks(P{"a.txt"})
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+
+	if len(refs) < 2 {
+		t.Fatalf("expected multiple chunks, got: %d", len(refs))
+	}
+
+	off := int64(0)
+	for _, ref := range refs {
+		if ref.Offset != off {
+			t.Fatalf("expected chunk at offset %d, got: %d", off, ref.Offset)
+		}
+
+		if K(sha256.Sum256(data[ref.Offset:ref.Offset+int64(ref.Len)])) != ref.Key {
+			t.Errorf("expected key of chunk at %d to hash its bytes", ref.Offset)
+		}
+
+		off += int64(ref.Len)
+	}
+
+	if off != int64(len(data)) {
+		t.Errorf("expected chunks to cover %d bytes, got: %d", len(data), off)
+	}
+
+	if _, err = fs.FileChunks(P{"nonexisting.txt"}); !os.IsNotExist(err) {
+		t.Errorf("expected not exist error, got: %v", err)
+	}
+}
+
+func CaseCompare(fs *FileSystem, t *testing.T) {
+	for _, p := range []P{{"src"}, {"src", "baz"}} {
+		if err := fs.Mkdir(p, 0750); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	data := make([]byte, 3*miB)
+	rand.Read(data)
+	testwrite(fs, t, P{"src", "c.txt"}, data)
+	testwrite(fs, t, P{"src", "baz", "d.txt"}, []byte("hello"))
+
+	err := CopyTree(fs, P{"copy"}, fs, P{"src"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	equal, err := fs.Equal(P{"src"}, P{"copy"})
+	if err != nil || !equal {
+		t.Fatalf("expected copy to equal its source, got: %v, %v", equal, err)
+	}
+
+	//the same content written in other pieces may be chunked differently
+	f, err := fs.OpenFile(P{"copy", "c.txt"}, os.O_WRONLY|os.O_TRUNC, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, piece := range [][]byte{data[:miB+miB/2], data[miB+miB/2:]} {
+		if _, err = f.Write(piece); err != nil {
+			t.Fatal(err)
+		}
+
+		if err = f.Sync(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err = f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if equal, err = fs.Equal(P{"src"}, P{"copy"}); err != nil || !equal {
+		t.Errorf("expected rewritten copy to equal its source, got: %v, %v", equal, err)
+	}
+
+	testwrite(fs, t, P{"copy", "baz", "d.txt"}, []byte("hallo"))
+	equal, diverge, err := fs.Compare(P{"src"}, P{"copy"})
+	if err != nil || equal || !diverge.Equals(P{"baz", "d.txt"}) {
+		t.Errorf("expected subtrees to diverge at /baz/d.txt, got: %v, %v, %v", equal, diverge, err)
+	}
+
+	testwrite(fs, t, P{"copy", "baz", "d.txt"}, []byte("hello"))
+	testwrite(fs, t, P{"copy", "b.txt"}, nil)
+	equal, diverge, err = fs.Compare(P{"src"}, P{"copy"})
+	if err != nil || equal || !diverge.Equals(P{"b.txt"}) {
+		t.Errorf("expected subtrees to diverge at /b.txt, got: %v, %v, %v", equal, diverge, err)
+	}
+
+	if _, err = fs.Equal(P{"src"}, P{"nonexisting"}); !os.IsNotExist(err) {
+		t.Errorf("expected not exist error, got: %v", err)
+	}
+}
+
+func CaseReflink(fs *FileSystem, t *testing.T) {
+	data := make([]byte, 5*miB)
+	rand.Read(data)
+	testwrite(fs, t, P{"a.txt"}, data)
+
+	_, before, _, err := fs.DedupReport()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = fs.Reflink(P{"a.txt"}, P{"b.txt"}); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+
+	arefs, err := fs.FileChunks(P{"a.txt"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	brefs, err := fs.FileChunks(P{"b.txt"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(arefs, brefs) {
+		t.Fatal("expected reflinked file to reference the same chunks")
+	}
+
+	unique, total, _, err := fs.DedupReport()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if total != 2*before || unique != before {
+		t.Errorf("expected no chunks to be duplicated, got unique: %d, total: %d", unique, total)
+	}
+
+	//writing to the reflink stores new chunks for the written region only
+	off := int64(2 * miB)
+	f, err := fs.OpenFile(P{"b.txt"}, os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = f.Seek(off, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = f.Write(bytes.Repeat([]byte{'x'}, 100)); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if output := testread(fs, t, P{"a.txt"}); !bytes.Equal(output, data) {
+		t.Error("expected source to be unchanged by writing its reflink")
+	}
+
+	if refs, err := fs.FileChunks(P{"a.txt"}); err != nil || !reflect.DeepEqual(refs, arefs) {
+		t.Errorf("expected chunks of the source to be unchanged, got: %v", err)
+	}
+
+	if brefs, err = fs.FileChunks(P{"b.txt"}); err != nil {
+		t.Fatal(err)
+	}
+
+	shared := map[ChunkRef]bool{}
+	for _, ref := range brefs {
+		shared[ref] = true
+	}
+
+	for _, ref := range arefs {
+		overlaps := ref.Offset < off+100 && ref.Offset+int64(ref.Len) > off
+		if overlaps == shared[ref] {
+			t.Errorf("expected only chunks that overlap the write to diverge, chunk at %d overlaps: %v", ref.Offset, overlaps)
+		}
+	}
+
+	if err = fs.Reflink(Root, P{"c.txt"}); !errors.Is(err, ErrIsDirectory) {
+		t.Errorf("expected ErrIsDirectory, got: %v", err)
+	}
+}
+
+func CaseSeed(fs *FileSystem, t *testing.T) {
+	spec := map[string][]byte{
+		"a.txt":           []byte("a"),
+		"foo/b.txt":       []byte("b"),
+		"foo/bar/c.txt":   []byte("c"),
+		"foo/bar/baz/":    nil,
+		"/foo/empty.txt":  {},
+		"foo/bar/d/e.txt": []byte("e"),
+	}
+
+	err := Seed(fs, spec)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+
+	for name, content := range spec {
+		fi, err := fs.Stat(ParsePath(name))
+		if err != nil {
+			t.Errorf("expected '%s' to exist, got: %v", name, err)
+			continue
+		}
+
+		if strings.HasSuffix(name, "/") {
+			if !fi.IsDir() {
+				t.Errorf("expected '%s' to be a directory", name)
+			}
+
+			continue
+		}
+
+		if data := testread(fs, t, ParsePath(name)); !bytes.Equal(data, content) {
+			t.Errorf("expected '%s' to contain '%s', got: '%s'", name, content, data)
+		}
+	}
+
+	err = Seed(fs, map[string][]byte{"a.txt/x.txt": nil})
+	if !os.IsExist(err) {
+		t.Errorf("expected exist error when seeding below a file, got: %v", err)
+	}
+}
+
+func CaseRemoveInvalidPath(fs *FileSystem, t *testing.T) {
+	testfiles(fs, t)
+	err := fs.Remove(P{"bar\uFFFF.txt"})
+	if err == nil {
+		t.Error("expected error")
+	}
+
+}
+
+func CaseRemoveNonExisting(fs *FileSystem, t *testing.T) {
+	testfiles(fs, t)
+	err := fs.Remove(P{"c.txt"})
+	if err == nil {
+		t.Fatalf("expected err")
+	}
+
+	perr := err.(*os.PathError)
+	if perr.Err != os.ErrNotExist {
+		t.Fatalf("expected os.ErrNotExist, got: %v", err)
+	}
+}
+
+func CaseRemoveNonEmptyDir(fs *FileSystem, t *testing.T) {
+	testfiles(fs, t)
+	err := fs.Remove(P{"bar"})
+	if err == nil {
+		t.Fatalf("expected err")
+	}
+
+	perr := err.(*os.PathError)
+	if perr.Err != ErrNotEmptyDirectory {
+		t.Fatalf("expected os.ErrNotExist, got: %v", err)
+	}
+
+}
+
+func CaseRemoveEmptyDir(fs *FileSystem, t *testing.T) {
+	testfiles(fs, t)
+	err := fs.Mkdir(P{"empty-dir"}, 0777)
+	if err != nil {
+		t.Errorf("expected no error, got: %+v", err)
+	}
+
+	err = fs.Remove(P{"empty-dir"})
+	if err != nil {
+		t.Errorf("expected no error, got: %+v", err)
+	}
+
+	_, err = fs.Stat(P{"empty-dir"})
+	if !os.IsNotExist(err) {
+		t.Error("deleted directory should no longer exist")
+	}
+}
+
+func CaseRemoveCountedDir(fs *FileSystem, t *testing.T) {
+	count := func(p P) int64 {
+		var fi *fileInfo
+		if err := fs.db.View(func(tx Tx) (err error) {
+			fi, err = fs.getfi(tx, p)
+			return err
+		}); err != nil {
+			t.Fatal(err)
+		}
+
+		if fi.C == nil {
+			t.Fatalf("expected %s to count its entries", p)
+		}
+
+		return *fi.C
+	}
+
+	if err := fs.Mkdir(P{"dir"}, 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := fs.Mkdir(P{"dir", "sub"}, 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	testwrite(fs, t, P{"dir", "a.txt"}, []byte("a"))
+	testwrite(fs, t, P{"dir", "b.txt"}, []byte("b"))
+	testwrite(fs, t, P{"dir", "b.txt"}, []byte("bb")) //rewriting is not a new entry
+	if n := count(P{"dir"}); n != 3 {
+		t.Errorf("expected 3 entries, got: %d", n)
+	}
+
+	if n := count(Root); n != 1 {
+		t.Errorf("expected root to have 1 entry, got: %d", n)
+	}
+
+	//renames move an entry from one count to the other, replacing doesn't add one
+	if err := fs.Rename(P{"dir", "a.txt"}, P{"a.txt"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := fs.Rename(P{"a.txt"}, P{"dir", "b.txt"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if n := count(P{"dir"}); n != 2 {
+		t.Errorf("expected 2 entries after renames, got: %d", n)
+	}
+
+	if n := count(Root); n != 1 {
+		t.Errorf("expected root to have 1 entry after renames, got: %d", n)
+	}
+
+	if err := fs.Remove(P{"dir"}); !errors.Is(err, ErrNotEmptyDirectory) {
+		t.Errorf("expected not empty error, got: %v", err)
+	}
+
+	for _, p := range []P{{"dir", "b.txt"}, {"dir", "sub"}} {
+		if err := fs.Remove(p); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if n := count(P{"dir"}); n != 0 {
+		t.Errorf("expected no entries, got: %d", n)
+	}
+
+	if err := fs.Remove(P{"dir"}); err != nil {
+		t.Errorf("expected no error, got: %v", err)
+	}
+
+	if n := count(Root); n != 0 {
+		t.Errorf("expected root to have no entries, got: %d", n)
+	}
+
+	//directories that were written before entries were counted are scanned
+	if err := fs.db.Update(func(tx Tx) error {
+		return fs.putfi(tx, P{"old"}, &fileInfo{N: "old", M: os.ModeDir | 0777})
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	testwrite(fs, t, P{"old", "c.txt"}, []byte("c"))
+	if err := fs.Remove(P{"old"}); !errors.Is(err, ErrNotEmptyDirectory) {
+		t.Errorf("expected not empty error for uncounted directory, got: %v", err)
+	}
+
+	if err := fs.Remove(P{"old", "c.txt"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := fs.Remove(P{"old"}); err != nil {
+		t.Errorf("expected no error for uncounted directory, got: %v", err)
+	}
+}
+
+func CaseRemoveWhileOpen(fs *FileSystem, t *testing.T) {
+	testfiles(fs, t)
+	f, err := fs.OpenFile(P{"a.txt"}, os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer f.Close()
+	err = fs.Remove(P{"a.txt"})
+	if err != nil {
+		t.Errorf("expected no error, got: %+v", err)
+	}
+
+	_, err = fs.Stat(P{"a.txt"})
+	if !os.IsNotExist(err) {
+		t.Error("removed file should no longer exist")
+	}
+}
+
+func TestRemoveUnlessBusy(t *testing.T) {
+	db, close := testdb(t)
+	defer close()
+
+	fs, err := NewFileSystem(t.Name(), db, WithRemovePolicy(RemoveUnlessBusy))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testfiles(fs, t)
+	f, err := fs.OpenFile(P{"a.txt"}, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//read only handles don't keep a file busy
+	rf, err := fs.Open(P{"b.txt"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer rf.Close()
+	err = fs.Remove(P{"a.txt"})
+	if err == nil || err.(*os.PathError).Err != ErrFileBusy {
+		t.Errorf("expected ErrFileBusy, got: %v", err)
+	}
+
+	err = fs.Remove(P{"b.txt"})
+	if err != nil {
+		t.Errorf("expected no error, got: %+v", err)
+	}
+
+	//closing twice shouldn't unregister other handles
+	f2, err := fs.OpenFile(P{"a.txt"}, os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	f.Close()
+	err = fs.Remove(P{"a.txt"})
+	if err == nil || err.(*os.PathError).Err != ErrFileBusy {
+		t.Errorf("expected ErrFileBusy while second handle is open, got: %v", err)
+	}
+
+	if err = f2.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	err = fs.Remove(P{"a.txt"})
+	if err != nil {
+		t.Errorf("expected no error after closing, got: %+v", err)
+	}
+}
+
+func TestRootModeAndOwner(t *testing.T) {
+	db, close := testdb(t)
+	defer close()
+
+	fs, err := NewFileSystem(t.Name(), db, WithRootMode(0755), WithRootOwner(1000, 100))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fi, err := fs.Stat(Root)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if fi.Mode() != os.ModeDir|0755 {
+		t.Errorf("expected root mode to be configured, got: %v", fi.Mode())
+	}
+
+	if owner, ok := fi.Sys().(*Owner); !ok || owner.UID != 1000 || owner.GID != 100 {
+		t.Errorf("expected owner to round-trip, got: %+v", fi.Sys())
+	}
+
+	//options don't change an existing root
+	fs, err = NewFileSystem(t.Name(), db, WithRootMode(0700))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fi, err = fs.Stat(Root)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if fi.Mode() != os.ModeDir|0755 {
+		t.Errorf("expected root mode to be unchanged, got: %v", fi.Mode())
+	}
+}
+
+func CaseRemoveAllInvalidPath(fs *FileSystem, t *testing.T) {
+	testfiles(fs, t)
+	err := fs.RemoveAll(P{"bar\uFFFF.txt"})
+	if err == nil {
+		t.Error("expected error")
+	}
+}
+
+func TestCases(t *testing.T) {
+	cases := []struct {
+		Name string
+		Case func(fs *FileSystem, t *testing.T)
+	}{
+		{Name: "StatNonExisting", Case: CaseStatNonExisting},
+		{Name: "StatNonExisting", Case: CaseStatExisting},
+		{Name: "StatInvalidPath", Case: CaseStatInvalidPath},
+
+		{Name: "OpenFileInvalidPath", Case: CaseOpenFileInvalidPath},
+		{Name: "OpenFileCreateNonExisting", Case: CaseOpenFileCreateNonExisting},
+		{Name: "OpenFileParentNotDirectory", Case: CaseOpenFileParentNotDirectory},
+		{Name: "OpenFileParentNotExist", Case: CaseOpenFileParentNotExist},
+
+		{Name: "OpenFileReadOnly", Case: CaseOpenFileReadOnly},
+		{Name: "OpenFileAccessMode", Case: CaseOpenFileAccessMode},
+		{Name: "OpenFileDirectory", Case: CaseOpenFileDirectory},
+		{Name: "OpenFileCreateExisting", Case: CaseOpenFileCreateExisting},
+		{Name: "OpenFileExclusive", Case: CaseOpenFileExclusive},
+		{Name: "OpenFileExclusiveRace", Case: CaseOpenFileExclusiveRace},
+		{Name: "OpenFileNonExisting", Case: CaseOpenFileNonExisting},
+		{Name: "OpenFileFlags", Case: CaseOpenFileFlags},
+
+		{Name: "MkdirInvalidPath", Case: CaseMkdirInvalidPath},
+		{Name: "MkdirNonExisting", Case: CaseMkdirNonExisting},
+		{Name: "PathLimits", Case: CasePathLimits},
+		{Name: "MkdirExistingFile", Case: CaseMkdirExistingFile},
+		{Name: "MkdirParentNotDirectory", Case: CaseMkdirParentNotDirectory},
+		{Name: "MkdirParentNotExist", Case: CaseMkdirParentNotExist},
+
+		{Name: "FileReaddirAll", Case: CaseFileReaddirAll},
+		{Name: "FileReaddirLimitN", Case: CaseFileReaddirLimitN},
+
+		{Name: "FileReaddirTypes", Case: CaseFileReaddirTypes},
+		{Name: "FileReaddirNamesAll", Case: CaseFileReaddirNamesAll},
+		{Name: "ReadDirSorted", Case: CaseReadDirSorted},
+		{Name: "FileReaddirSeparatorOrder", Case: CaseFileReaddirSeparatorOrder},
+
+		{Name: "FileWriteRead", Case: CaseFileWriteRead},
+		{Name: "FileWriteSparse", Case: CaseFileWriteSparse},
+		{Name: "FileWriteSparseLarge", Case: CaseFileWriteSparseLarge},
+		{Name: "FileCopy", Case: CaseFileCopy},
+		{Name: "FileAt", Case: CaseFileAt},
+
+		{Name: "RenameFile", Case: CaseRenameFile},
+		{Name: "RenameDir", Case: CaseRenameDir},
+		{Name: "RenameOverwriteFile", Case: CaseRenameOverwriteFile},
+		{Name: "RenameNonEmptyDir", Case: CaseRenameNonEmptyDir},
+		{Name: "RenameTypeMismatch", Case: CaseRenameTypeMismatch},
+		{Name: "Exchange", Case: CaseExchange},
+		{Name: "Symlink", Case: CaseSymlink},
+		{Name: "SymlinkContent", Case: CaseSymlinkContent},
+
+		{Name: "Stats", Case: CaseStats},
+		{Name: "UniqueBytes", Case: CaseUniqueBytes},
+
+		{Name: "TxRollback", Case: CaseTxRollback},
+
+		{Name: "Check", Case: CaseCheck},
+
+		{Name: "RepairOrphanToLostFound", Case: CaseRepairOrphanToLostFound},
+		{Name: "RepairTruncateMissingChunk", Case: CaseRepairTruncateMissingChunk},
+		{Name: "RepairZeroFillMissingChunk", Case: CaseRepairZeroFillMissingChunk},
+
+		{Name: "CopyTree", Case: CaseCopyTree},
+
+		{Name: "DedupRechunk", Case: CaseDedupRechunk},
+		{Name: "FileChunks", Case: CaseFileChunks},
+		{Name: "Compare", Case: CaseCompare},
+		{Name: "Reflink", Case: CaseReflink},
+
+		{Name: "Seed", Case: CaseSeed},
+
+		{Name: "RemoveInvalidPath", Case: CaseRemoveInvalidPath},
+		{Name: "RemoveNonExisting", Case: CaseRemoveNonExisting},
+		{Name: "RemoveNonEmptyDir", Case: CaseRemoveNonEmptyDir},
+		{Name: "RemoveWhileOpen", Case: CaseRemoveWhileOpen},
+		{Name: "RemoveEmptyDir", Case: CaseRemoveEmptyDir},
+		{Name: "RemoveCountedDir", Case: CaseRemoveCountedDir},
+
+		{Name: "RemoveAllInvalidPath", Case: CaseRemoveAllInvalidPath},
+	}
+
+	for _, c := range cases {
+		t.Run(c.Name, func(t *testing.T) {
+			db, close := testdb(t)
+			defer close()
+
+			fs, err := NewFileSystem(t.Name(), db)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			c.Case(fs, t)
+		})
+	}
+
+	//the in-memory store should behave the same
+	for _, c := range cases {
+		t.Run("Mem"+c.Name, func(t *testing.T) {
+			fs, err := NewFileSystemWithStore(t.Name(), NewMemStore())
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			c.Case(fs, t)
+		})
+	}
+}
+
+func TestChunkVerification(t *testing.T) {
+	db, close := testdb(t)
+	defer close()
+
+	fs, err := NewFileSystem(t.Name(), db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := make([]byte, 300*kiB)
+	rand.Read(data)
+	testwrite(fs, t, P{"a.txt"}, data)
+
+	testcorrupt(t, db, ChunkBucketName)
+
+	f, err := fs.Open(P{"a.txt"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = ioutil.ReadAll(f)
+	if !errors.Is(err, ErrChunkCorrupt) {
+		t.Fatalf("expected ErrChunkCorrupt, got: %v", err)
+	}
+
+	var cerr *ChunkCorruptError
+	if !errors.As(err, &cerr) || cerr.Off != 0 {
+		t.Errorf("expected corrupt chunk at offset 0, got: %v", err)
+	}
+
+	if perr, ok := err.(*os.PathError); !ok || perr.Path != (P{"a.txt"}).String() {
+		t.Errorf("expected error to carry the path, got: %v", err)
+	}
+
+	//without verification the corrupt content is returned as is
+	unverified, err := NewFileSystem(t.Name(), db, WithChunkVerification(false))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	garbage := testread(unverified, t, P{"a.txt"})
+	if len(garbage) != len(data) || bytes.Equal(garbage, data) {
+		t.Errorf("expected corrupt content of the same size, got %d bytes", len(garbage))
+	}
+}
+
+func TestReadResilient(t *testing.T) {
+	db, close := testdb(t)
+	defer close()
+
+	cfg := DefaultChunkConfig
+	cfg.MinSize, cfg.MaxSize = 64*kiB, 64*kiB
+	fs, err := NewFileSystem(t.Name(), db, WithChunkConfig(cfg))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := make([]byte, 3*64*kiB)
+	rand.Read(data)
+	testwrite(fs, t, P{"a.txt"}, data)
+
+	refs, err := fs.FileChunks(P{"a.txt"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(refs) != 3 {
+		t.Fatalf("expected 3 chunks, got: %d", len(refs))
+	}
+
+	//the middle chunk is corrupted
+	mid := refs[1]
+	if err = db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(ChunkBucketName).Put(mid.Key[:], bytes.Repeat([]byte{0xFF}, mid.Len))
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := fs.Open(P{"a.txt"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer f.Close()
+	buf := bytes.NewBuffer(nil)
+	n, damaged, err := f.ReadResilient(buf)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+
+	if n != int64(len(data)) || buf.Len() != len(data) {
+		t.Fatalf("expected the whole file to be read, got: %d bytes", n)
+	}
+
+	if len(damaged) != 1 || damaged[0].Off != mid.Offset || damaged[0].Len != int64(mid.Len) || !errors.Is(damaged[0].Err, ErrChunkCorrupt) {
+		t.Fatalf("expected the middle chunk to be reported as damaged, got: %+v", damaged)
+	}
+
+	output := buf.Bytes()
+	end := mid.Offset + int64(mid.Len)
+	if !bytes.Equal(output[:mid.Offset], data[:mid.Offset]) || !bytes.Equal(output[end:], data[end:]) {
+		t.Error("expected the data around the damaged range to be intact")
+	}
+
+	if !bytes.Equal(output[mid.Offset:end], make([]byte, mid.Len)) {
+		t.Error("expected the damaged range to read as zeros")
+	}
+}
+
+//stallWriter sleeps before every write, like a consumer on a slow connection
+type stallWriter struct {
+	d time.Duration
+	n int64
+}
+
+func (w *stallWriter) Write(b []byte) (int, error) {
+	time.Sleep(w.d)
+	w.n += int64(len(b))
+	return len(b), nil
+}
+
+func TestReadTimeout(t *testing.T) {
+	db, close := testdb(t)
+	defer close()
+
+	fs, err := NewFileSystem(t.Name(), db, WithReadTimeout(50*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := make([]byte, 5*miB)
+	rand.Read(data)
+	testwrite(fs, t, P{"a.txt"}, data)
+
+	f, err := fs.Open(P{"a.txt"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer f.Close()
+	w := &stallWriter{d: 100 * time.Millisecond}
+	n, err := f.WriteTo(w)
+	if !errors.Is(err, ErrReadTimeout) {
+		t.Fatalf("expected ErrReadTimeout, got: %v", err)
+	}
+
+	if n == 0 || n >= int64(len(data)) {
+		t.Errorf("expected the read to be aborted halfway, got %d bytes", n)
+	}
+
+	//the transaction is rolled back, writes go through and reads that are fast enough succeed
+	testwrite(fs, t, P{"b.txt"}, data[:1*miB])
+	if output := testread(fs, t, P{"a.txt"}); !bytes.Equal(output, data) {
+		t.Error("expected a fast read to succeed")
+	}
+}
+
+//stuckWriter blocks every write until it is released, like a consumer whose connection hangs
+type stuckWriter struct {
+	once    sync.Once
+	writing chan struct{}
+	release chan struct{}
+}
+
+func (w *stuckWriter) Write(b []byte) (int, error) {
+	w.once.Do(func() { close(w.writing) })
+	<-w.release
+	return len(b), nil
+}
+
+func TestReadTimeoutStuckReader(t *testing.T) {
+	db, closedb := testdb(t)
+	defer closedb()
+
+	fs, err := NewFileSystem(t.Name(), db, WithReadTimeout(50*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := make([]byte, 5*miB)
+	rand.Read(data)
+	testwrite(fs, t, P{"a.txt"}, data)
+
+	f, err := fs.Open(P{"a.txt"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer f.Close()
+	w := &stuckWriter{writing: make(chan struct{}), release: make(chan struct{})}
+	read := make(chan error, 1)
+	go func() {
+		_, err := f.WriteTo(w)
+		read <- err
+	}()
+
+	<-w.writing
+
+	//growing the database remaps it, which waits for all read transactions to end
+	written := make(chan struct{})
+	go func() {
+		defer close(written)
+		big := make([]byte, 32*miB)
+		rand.Read(big)
+		testwrite(fs, t, P{"b.txt"}, big)
+	}()
+
+	select {
+	case <-written:
+	case <-time.After(10 * time.Second):
+		close(w.release)
+		<-read
+		t.Fatal("expected a write to go through while a reader is stuck")
+	}
+
+	close(w.release)
+	if err = <-read; !errors.Is(err, ErrReadTimeout) {
+		t.Errorf("expected the stuck reader to time out, got: %v", err)
+	}
+}
+
+func TestInodesAfterRename(t *testing.T) {
+	db, close := testdb(t)
+	defer close()
+
+	fs, err := NewFileSystem(t.Name(), db, WithInodeTracking())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, p := range []P{{"a"}, {"a", "dir"}, {"b"}} {
+		if err := fs.Mkdir(p, 0777); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	testwrite(fs, t, P{"a", "dir", "x.txt"}, []byte("x"))
+
+	//the binding learns about the inodes through stat
+	ino := func(p P) uint64 {
+		fi, err := fs.Stat(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return fi.(*fileInfo).I
+	}
+
+	xino, dirino, bino := ino(P{"a", "dir", "x.txt"}), ino(P{"a", "dir"}), ino(P{"b"})
+	if err := fs.Rename(P{"a", "dir"}, P{"b", "dir"}); err != nil {
+		t.Fatal(err)
+	}
+
+	p, err := fs.PathOf(xino)
+	if err != nil || !p.Equals(P{"b", "dir", "x.txt"}) {
+		t.Fatalf("expected child to be found at its new path, got: %v, %v", p, err)
+	}
+
+	if parent, err := fs.ParentIno(xino); err != nil || parent != dirino {
+		t.Errorf("expected parent of child to be the moved directory %d, got: %d, %v", dirino, parent, err)
+	}
+
+	if parent, err := fs.ParentIno(dirino); err != nil || parent != bino {
+		t.Errorf("expected parent of moved directory to be its new parent %d, got: %d, %v", bino, parent, err)
+	}
+
+	if ino(p) != xino {
+		t.Error("expected re-stat at the new path to return the same inode")
+	}
+
+	//removed files can no longer be found
+	if err = fs.Remove(P{"b", "dir", "x.txt"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = fs.PathOf(xino); err != os.ErrNotExist {
+		t.Errorf("expected removed inode to be unknown, got: %v", err)
+	}
+
+	//without tracking no inodes are remembered
+	untracked, err := NewFileSystem(t.Name()+"_untracked", db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = untracked.Mkdir(P{"dir"}, 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	fi, err := untracked.Stat(P{"dir"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = untracked.PathOf(fi.(*fileInfo).I); err != os.ErrNotExist {
+		t.Errorf("expected inodes not to be tracked by default, got: %v", err)
+	}
+}
+
+func TestReaddirSnapshot(t *testing.T) {
+	db, close := testdb(t)
+	defer close()
+
+	for _, snapshot := range []bool{false, true} {
+		opts := []Option{}
+		if snapshot {
+			opts = append(opts, WithReaddirSnapshot())
+		}
+
+		fs, err := NewFileSystem(fmt.Sprintf("%s%v", t.Name(), snapshot), db, opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for i := 0; i < 10; i++ {
+			testwrite(fs, t, P{fmt.Sprintf("%02d.txt", i)}, nil)
+		}
+
+		f, err := fs.Open(Root)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		names, err := f.Readdirnames(4)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		//add an entry after the current position and remove one that wasn't listed yet
+		testwrite(fs, t, P{"99.txt"}, nil)
+		if err = fs.Remove(P{"05.txt"}); err != nil {
+			t.Fatal(err)
+		}
+
+		//pages are filled completely, a page that is cut short by the end of the directory reports io.EOF
+		for {
+			more, err := f.Readdirnames(3)
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				t.Fatal(err)
+			}
+
+			names = append(names, more...)
+		}
+
+		added := false
+		for _, name := range names {
+			if name == "05.txt" {
+				t.Errorf("expected removed entry not to be listed (snapshot: %v)", snapshot)
+			}
+
+			added = added || name == "99.txt"
+		}
+
+		if snapshot && (added || len(names) != 9) {
+			t.Errorf("expected the 9 entries of the snapshot, got: %v", names)
+		} else if !snapshot && !added {
+			t.Errorf("expected streaming readdir to list the added entry, got: %v", names)
+		}
+	}
+}
+
+func TestCollisionPolicy(t *testing.T) {
+	db, close := testdb(t)
+	defer close()
+
+	for _, c := range []struct {
+		policy CollisionPolicy
+		file   P //where a file named "readme" is created, if at all
+		dir    P //where a directory named "ReadMe" is created, if at all
+		names  []string
+	}{
+		{CollisionReject, nil, nil, []string{"README"}},
+		{CollisionReplace, P{"readme"}, P{"ReadMe"}, []string{"ReadMe"}},
+		{CollisionRename, P{"readme~1"}, nil, []string{"README", "readme~1"}},
+	} {
+		fs, err := NewFileSystem(fmt.Sprintf("%s%d", t.Name(), c.policy), db, WithCaseInsensitiveNames(c.policy))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		testwrite(fs, t, P{"README"}, []byte("hello"))
+
+		//opening the exact name is no collision
+		testwrite(fs, t, P{"README"}, []byte("hello"))
+
+		f, err := fs.OpenFile(P{"readme"}, os.O_CREATE|os.O_WRONLY, 0666)
+		if c.file == nil {
+			if !os.IsExist(err) {
+				t.Errorf("policy %d: expected os.ErrExist creating a file, got: %v", c.policy, err)
+			}
+		} else if err != nil {
+			t.Errorf("policy %d: expected no error creating a file, got: %v", c.policy, err)
+		} else {
+			if !f.Path().Equals(c.file) {
+				t.Errorf("policy %d: expected file to be created at %v, got: %v", c.policy, c.file, f.Path())
+			}
+
+			f.Close()
+		}
+
+		err = fs.Mkdir(P{"ReadMe"}, 0777)
+		if c.dir == nil {
+			if !os.IsExist(err) {
+				t.Errorf("policy %d: expected os.ErrExist creating a directory, got: %v", c.policy, err)
+			}
+		} else if err != nil {
+			t.Errorf("policy %d: expected no error creating a directory, got: %v", c.policy, err)
+		} else if fi, err := fs.Stat(c.dir); err != nil || !fi.IsDir() {
+			t.Errorf("policy %d: expected directory at %v, got: %v", c.policy, c.dir, err)
+		}
+
+		f, err = fs.Open(Root)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		names, err := f.Readdirnames(0)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !reflect.DeepEqual(names, c.names) {
+			t.Errorf("policy %d: expected root to hold %v, got: %v", c.policy, c.names, names)
+		}
+	}
+}
+
+func TestCollisionPolicyOperations(t *testing.T) {
+	db, close := testdb(t)
+	defer close()
+
+	fs, err := NewFileSystem(t.Name(), db, WithCaseInsensitiveNames(CollisionReject))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testwrite(fs, t, P{"README"}, []byte("hello"))
+	testwrite(fs, t, P{"other.txt"}, []byte("other"))
+	if err = fs.Mkdir(P{"dir"}, 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, fn := range map[string]func() error{
+		"rename":    func() error { return fs.Rename(P{"other.txt"}, P{"readme"}) },
+		"reflink":   func() error { return fs.Reflink(P{"other.txt"}, P{"readme"}) },
+		"copytree":  func() error { return CopyTree(fs, P{"Dir"}, fs, P{"dir"}) },
+		"bulk":      func() error { return fs.BulkCreate([]BulkEntry{{P: P{"Readme"}, Mode: 0666}}) },
+		"atomic":    func() error { return WriteFileAtomic(fs, P{"readMe"}, []byte("atomic"), 0666) },
+		"symlink":   func() error { return fs.Symlink("README", P{"readme"}) },
+		"mkdir":     func() error { return fs.Mkdir(P{"DIR"}, 0777) },
+		"renamedir": func() error { return fs.Rename(P{"dir"}, P{"Readme"}) },
+	} {
+		if err = fn(); !os.IsExist(err) {
+			t.Errorf("%s: expected os.ErrExist, got: %v", name, err)
+		}
+	}
+
+	//changing only the case of an entry's own name is no collision
+	if err = fs.Rename(P{"README"}, P{"ReadMe"}); err != nil {
+		t.Errorf("expected an entry to be renamed to another case of its name, got: %v", err)
+	}
+
+	f, err := fs.Open(Root)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer f.Close()
+	names, err := f.Readdirnames(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if expected := []string{"ReadMe", "dir", "other.txt"}; !reflect.DeepEqual(names, expected) {
+		t.Errorf("expected root to hold %v, got: %v", expected, names)
+	}
+}
+
+//testClock is a fake clock that tells the time it was set to
+type testClock struct{ t time.Time }
+
+func (c *testClock) Now() time.Time { return c.t }
+
+func TestClock(t *testing.T) {
+	db, close := testdb(t)
+	defer close()
+
+	clock := &testClock{}
+	fs, err := NewFileSystem(t.Name(), db, WithClock(clock))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t1 := time.Date(2016, 8, 1, 12, 0, 0, 0, time.UTC)
+	t2 := t1.Add(time.Hour)
+	for p, now := range map[string]time.Time{"a.txt": t1, "b.txt": t2} {
+		clock.t = now
+		testwrite(fs, t, P{p}, []byte(p))
+	}
+
+	for p, now := range map[string]time.Time{"a.txt": t1, "b.txt": t2} {
+		fi, err := fs.Stat(P{p})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !fi.ModTime().Equal(now) {
+			t.Errorf("expected %s to be modified at %v, got: %v", p, now, fi.ModTime())
+		}
+	}
+}
+
+func TestReadOnlyFileSystem(t *testing.T) {
+	db, close := testdb(t)
+	defer close()
+
+	if _, err := NewReadOnlyFileSystem(t.Name(), db); err == nil {
+		t.Error("expected opening a file system that doesn't exist read-only to fail")
+	}
+
+	fs, err := NewFileSystem(t.Name(), db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testfiles(fs, t)
+	testwrite(fs, t, P{"bar", "d.txt"}, []byte("hello"))
+
+	//reopen the database read-only, in which bolt panics on writable transactions
+	path := db.Path()
+	if err = db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	rodb, err := bolt.Open(path, 0666, &bolt.Options{ReadOnly: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer rodb.Close()
+	if fs, err = NewReadOnlyFileSystem(t.Name(), rodb); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+
+	if output := testread(fs, t, P{"bar", "d.txt"}); string(output) != "hello" {
+		t.Errorf("expected to read the file, got: %q", output)
+	}
+
+	if fis, err := fs.ReadDirSorted(Root, SortByName); err != nil || len(fis) != 4 {
+		t.Errorf("expected to list 4 entries, got: %d, %v", len(fis), err)
+	}
+
+	if err = fs.Mkdir(P{"foo"}, 0777); err == nil || err.(*os.PathError).Err != ErrReadOnly {
+		t.Errorf("expected mkdir to fail with ErrReadOnly, got: %v", err)
+	}
+
+	if _, err = fs.OpenFile(P{"a.txt"}, os.O_WRONLY, 0); err == nil || err.(*os.PathError).Err != ErrReadOnly {
+		t.Errorf("expected opening for writing to fail with ErrReadOnly, got: %v", err)
+	}
+
+	if err = fs.Remove(P{"a.txt"}); err == nil || err.(*os.PathError).Err != ErrReadOnly {
+		t.Errorf("expected remove to fail with ErrReadOnly, got: %v", err)
+	}
+}
+
+func TestMaxReaddirAll(t *testing.T) {
+	db, close := testdb(t)
+	defer close()
+
+	fs, err := NewFileSystem(t.Name(), db, WithMaxReaddirAll(10))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = fs.BulkCreate(testentries(11)); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := fs.Open(P{"dir"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer f.Close()
+	if _, err = f.Readdir(-1); err != ErrDirectoryTooLarge {
+		t.Errorf("expected reading all entries to fail with ErrDirectoryTooLarge, got: %v", err)
+	}
+
+	if _, err = fs.ReadDirSorted(P{"dir"}, SortBySize); err == nil || err.(*os.PathError).Err != ErrDirectoryTooLarge {
+		t.Errorf("expected sorting all entries to fail with ErrDirectoryTooLarge, got: %v", err)
+	}
+
+	//pages are not limited, not even by a page that is larger than the limit
+	n := 0
+	for {
+		fis, err := f.Readdir(11)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+
+		n += len(fis)
+	}
+
+	if n != 11 {
+		t.Errorf("expected to page over 11 entries, got: %d", n)
+	}
+
+	if err = fs.Remove(P{"dir", "00000000.txt"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if fis, err := f.Readdir(0); err != nil || len(fis) != 10 {
+		t.Errorf("expected to read 10 entries at once, got: %d, %v", len(fis), err)
+	}
+}
+
+func TestEachEntry(t *testing.T) {
+	db, close := testdb(t)
+	defer close()
+
+	fs, err := NewFileSystem(t.Name(), db, WithMaxReaddirAll(1000))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	entries := testentries(100000)
+	if err = fs.BulkCreate(entries); err != nil {
+		t.Fatal(err)
+	}
+
+	//the listing doesn't hold on to the entries it has passed, such that the heap doesn't grow with the directory
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+
+	n := 0
+	last := ""
+	if err = fs.EachEntry(P{"dir"}, func(fi os.FileInfo) error {
+		if fi.Name() <= last {
+			t.Errorf("expected entries in order of their names, got %q after %q", fi.Name(), last)
+		}
+
+		last = fi.Name()
+		n++
+		if n == len(entries)-1 {
+			runtime.GC()
+			runtime.ReadMemStats(&after)
+		}
+
+		return nil
+	}); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+
+	if n != len(entries)-1 {
+		t.Errorf("expected %d entries, got: %d", len(entries)-1, n)
+	}
+
+	if growth := int64(after.HeapAlloc) - int64(before.HeapAlloc); growth > 1*miB {
+		t.Errorf("expected the heap to stay bounded, it grew by %d bytes", growth)
+	}
+
+	//errors of the callback stop the listing
+	stop := errors.New("stop")
+	n = 0
+	if err = fs.EachEntry(P{"dir"}, func(fi os.FileInfo) error {
+		n++
+		return stop
+	}); err != stop || n != 1 {
+		t.Errorf("expected the callback's error after one entry, got: %v after %d", err, n)
+	}
+
+	if err = fs.EachEntry(P{"dir", "00000000.txt"}, func(fi os.FileInfo) error { return nil }); err == nil || err.(*os.PathError).Err != ErrNotDirectory {
+		t.Errorf("expected listing a file to fail, got: %v", err)
+	}
+}
+
+func TestAllocate(t *testing.T) {
+	db, close := testdb(t)
+	defer close()
+
+	fs, err := NewFileSystem(t.Name(), db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testwrite(fs, t, P{"a.bin"}, []byte("hello"))
+	if err = fs.Allocate(P{"a.bin"}, miB); err != nil {
+		t.Fatal(err)
+	}
+
+	if fi, err := fs.Stat(P{"a.bin"}); err != nil || fi.Size() != miB {
+		t.Fatalf("expected allocated size, got: %v, %v", fi, err)
+	}
+
+	f, err := fs.OpenFile(P{"a.bin"}, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer f.Close()
+	b := make([]byte, 4096)
+	if n, err := f.ReadAt(b, miB/2); err != nil || n != len(b) || !bytes.Equal(b, make([]byte, len(b))) {
+		t.Errorf("expected to read zeros from the middle, got: %d, %v", n, err)
+	}
+
+	if n, err := f.ReadAt(b[:5], 0); err != nil || n != 5 || string(b[:5]) != "hello" {
+		t.Errorf("expected to keep the content, got: %q, %v", b[:n], err)
+	}
+
+	data := make([]byte, 100*kiB)
+	rand.Read(data)
+	if _, err = f.Seek(miB/2, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = f.Write(data); err != nil {
+		t.Fatal(err)
+	}
+
+	b = make([]byte, len(data))
+	if n, err := f.ReadAt(b, miB/2); err != nil || n != len(b) || !bytes.Equal(b, data) {
+		t.Errorf("expected to read back the written data, got: %d, %v", n, err)
+	}
+
+	if fi, err := fs.Stat(P{"a.bin"}); err != nil || fi.Size() != miB {
+		t.Errorf("expected writing inside to keep the size, got: %v, %v", fi, err)
+	}
+
+	if err = fs.Allocate(P{"a.bin"}, 10); err != nil {
+		t.Fatal(err)
+	}
+
+	if fi, err := fs.Stat(P{"a.bin"}); err != nil || fi.Size() != miB {
+		t.Errorf("expected allocating less not to shrink, got: %v, %v", fi, err)
+	}
+
+	if err = fs.Allocate(Root, miB); !errors.Is(err, ErrIsDirectory) {
+		t.Errorf("expected allocating a directory to fail, got: %v", err)
 	}
 }
@@ -0,0 +1,75 @@
+package treedb
+
+import (
+	"os"
+	"sync"
+)
+
+//openCount holds the number of handles that are open for a path
+type openCount struct {
+	n int //all open handles
+	w int //handles opened for writing
+}
+
+//handles keeps track of the open file handles of a file system
+type handles struct {
+	mu     sync.Mutex
+	counts map[string]*openCount
+}
+
+//writable returns whether the open flags allow writing
+func writable(flag int) bool {
+	return flag&os.O_WRONLY != 0 || flag&os.O_RDWR != 0
+}
+
+//readable returns whether the open flags allow reading, which is the case unless the file was opened write-only
+func readable(flag int) bool {
+	return flag&os.O_WRONLY == 0
+}
+
+//open registers a handle for path 'p' opened with 'flag'
+func (h *handles) open(p P, flag int) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.counts == nil {
+		h.counts = map[string]*openCount{}
+	}
+
+	c, ok := h.counts[string(p.Key())]
+	if !ok {
+		c = &openCount{}
+		h.counts[string(p.Key())] = c
+	}
+
+	c.n++
+	if writable(flag) {
+		c.w++
+	}
+}
+
+//close unregisters a handle for path 'p' that was opened with 'flag'
+func (h *handles) close(p P, flag int) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	c, ok := h.counts[string(p.Key())]
+	if !ok {
+		return
+	}
+
+	c.n--
+	if writable(flag) {
+		c.w--
+	}
+
+	if c.n <= 0 {
+		delete(h.counts, string(p.Key()))
+	}
+}
+
+//busy returns whether path 'p' has handles that are open for writing
+func (h *handles) busy(p P) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	c, ok := h.counts[string(p.Key())]
+	return ok && c.w > 0
+}
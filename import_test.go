@@ -0,0 +1,111 @@
+package treedb
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"io"
+	"math/rand"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+//heapReader reads from 'r' and records the live heap size once, when the reading passes offset 'at'
+type heapReader struct {
+	r    io.Reader
+	at   int64
+	n    int64
+	heap uint64
+}
+
+func (hr *heapReader) Read(b []byte) (n int, err error) {
+	if hr.n >= hr.at && hr.heap == 0 {
+		runtime.GC()
+		ms := runtime.MemStats{}
+		runtime.ReadMemStats(&ms)
+		hr.heap = ms.HeapAlloc
+	}
+
+	n, err = hr.r.Read(b)
+	hr.n += int64(n)
+	return n, err
+}
+
+//failingReader returns an error once 'n' bytes were read
+type failingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (fr *failingReader) Read(b []byte) (n int, err error) {
+	if fr.n <= 0 {
+		return 0, errors.New("source failed")
+	}
+
+	if int64(len(b)) > fr.n {
+		b = b[:fr.n]
+	}
+
+	n, err = fr.r.Read(b)
+	fr.n -= int64(n)
+	return n, err
+}
+
+func TestImportFile(t *testing.T) {
+	fs, closefs := testfs(t)
+	defer closefs()
+
+	size := int64(100 * miB)
+	src := &heapReader{r: io.LimitReader(rand.New(rand.NewSource(1)), size), at: size / 2}
+	n, err := fs.ImportFile(P{"big.bin"}, src)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+
+	if n != size {
+		t.Errorf("expected %d bytes to be imported, got: %d", size, n)
+	}
+
+	if src.heap > 4*wbufMax {
+		t.Errorf("expected import to use bounded memory, heap grew to %d MiB", src.heap/miB)
+	}
+
+	expected := sha256.New()
+	io.Copy(expected, io.LimitReader(rand.New(rand.NewSource(1)), size))
+
+	f, err := fs.Open(P{"big.bin"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer f.Close()
+	actual := sha256.New()
+	if n, err = io.Copy(actual, f); err != nil || n != size {
+		t.Fatalf("expected to read back %d bytes, got: %d, %v", size, n, err)
+	}
+
+	if !bytes.Equal(actual.Sum(nil), expected.Sum(nil)) {
+		t.Error("expected imported content to read back identically")
+	}
+
+	//a failing source leaves the existing file and no temporary files behind
+	_, err = fs.ImportFile(P{"big.bin"}, &failingReader{r: rand.New(rand.NewSource(2)), n: 20 * miB})
+	if err == nil || !strings.Contains(err.Error(), "source failed") {
+		t.Fatalf("expected source error, got: %v", err)
+	}
+
+	names, err := fs.ReadDirSorted(Root, SortByName)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(names) != 1 || names[0].Name() != "big.bin" {
+		t.Errorf("expected only the imported file to remain, got: %v", names)
+	}
+
+	fi, err := fs.Stat(P{"big.bin"})
+	if err != nil || fi.Size() != size {
+		t.Errorf("expected the existing file to be untouched, got: %v, %v", fi, err)
+	}
+}
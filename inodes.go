@@ -0,0 +1,147 @@
+package treedb
+
+import (
+	"os"
+	"sync"
+)
+
+//inodes remembers the path of each inode that was handed out through stat, open or readdir. Bindings such as FUSE address files by inode for as long as the kernel caches them, the paths are kept up-to-date when entries are moved such that those inodes keep resolving to the right file and parent. Tracking is only enabled WithInodeTracking, it is left alone otherwise such that stats don't contend on its lock
+type inodes struct {
+	enabled bool
+	mu      sync.Mutex
+	paths   map[uint64]P
+}
+
+//track records that inode 'ino' lives at path 'p'
+func (in *inodes) track(ino uint64, p P) {
+	if !in.enabled {
+		return
+	}
+
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	if in.paths == nil {
+		in.paths = map[uint64]P{}
+	}
+
+	in.paths[ino] = append(P{}, p...)
+}
+
+//under returns whether 'p' equals 'dir' or lies below it
+func under(p, dir P) bool {
+	return len(p) >= len(dir) && p[:len(dir)].Equals(dir)
+}
+
+//moved updates the paths of inodes at or below 'oldp' to be below 'newp' instead, inodes that lived at 'newp' were replaced and are forgotten
+func (in *inodes) moved(oldp, newp P) {
+	if !in.enabled {
+		return
+	}
+
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	for ino, p := range in.paths {
+		if under(p, newp) && !under(p, oldp) {
+			delete(in.paths, ino)
+		}
+	}
+
+	for ino, p := range in.paths {
+		if under(p, oldp) {
+			in.paths[ino] = append(append(P{}, newp...), p[len(oldp):]...)
+		}
+	}
+}
+
+//exchanged swaps the paths of inodes at or below 'a' with those of inodes at or below 'b'
+func (in *inodes) exchanged(a, b P) {
+	if !in.enabled {
+		return
+	}
+
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	for ino, p := range in.paths {
+		if under(p, a) {
+			in.paths[ino] = append(append(P{}, b...), p[len(a):]...)
+		} else if under(p, b) {
+			in.paths[ino] = append(append(P{}, a...), p[len(b):]...)
+		}
+	}
+}
+
+//removed forgets the inodes at or below 'p'
+func (in *inodes) removed(p P) {
+	if !in.enabled {
+		return
+	}
+
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	for ino, ip := range in.paths {
+		if under(ip, p) {
+			delete(in.paths, ino)
+		}
+	}
+}
+
+//path returns where inode 'ino' was last seen
+func (in *inodes) path(ino uint64) (p P, ok bool) {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	p, ok = in.paths[ino]
+	return p, ok
+}
+
+//resolve returns the current path and file info of inode 'ino', it returns os.ErrNotExist when the inode was never handed out or its file no longer exists
+func (fs *FileSystem) resolve(tx Tx, ino uint64) (p P, fi *fileInfo, err error) {
+	p, ok := fs.inodes.path(ino)
+	if !ok {
+		return nil, nil, os.ErrNotExist
+	}
+
+	fi, err = fs.getfi(tx, p)
+	if err == os.ErrNotExist || (err == nil && fi.I != ino) {
+		return nil, nil, os.ErrNotExist //removed, or replaced by another file
+	} else if err != nil {
+		return nil, nil, err
+	}
+
+	return p, fi, nil
+}
+
+//PathOf returns the current path of the file with inode number 'ino', following any renames of the file or its parents since it was handed out. Only inodes that were returned through Stat, Open or Readdir of a file system created WithInodeTracking are known, others result in os.ErrNotExist
+func (fs *FileSystem) PathOf(ino uint64) (p P, err error) {
+	if err = fs.db.View(func(tx Tx) (err error) {
+		p, _, err = fs.resolve(tx, ino)
+		return err
+	}); err != nil {
+		return nil, err
+	}
+
+	return p, nil
+}
+
+//ParentIno returns the inode number of the directory that currently holds the file with inode number 'ino', the root is its own parent. Only inodes that were returned through Stat, Open or Readdir of a file system created WithInodeTracking are known, others result in os.ErrNotExist
+func (fs *FileSystem) ParentIno(ino uint64) (parent uint64, err error) {
+	if err = fs.db.View(func(tx Tx) error {
+		p, fi, err := fs.resolve(tx, ino)
+		if err != nil {
+			return err
+		}
+
+		if !p.IsRoot() {
+			if fi, err = fs.getfi(tx, p.Parent()); err != nil {
+				return err
+			}
+		}
+
+		fs.inodes.track(fi.I, p.Parent())
+		parent = fi.I
+		return nil
+	}); err != nil {
+		return 0, err
+	}
+
+	return parent, nil
+}
@@ -0,0 +1,183 @@
+package treedb
+
+import (
+	"bytes"
+	"io"
+	iofs "io/fs"
+	"os"
+)
+
+//IOFS adapts a FileSystem to the io/fs interfaces of the standard library. Names are unrooted and slash-separated as described by fs.ValidPath, with "." referring to the root
+type IOFS struct {
+	fs *FileSystem
+}
+
+//NewIOFS creates an io/fs adapter for filesystem 'fs'
+func NewIOFS(fs *FileSystem) *IOFS {
+	return &IOFS{fs: fs}
+}
+
+//ioPathErr converts errors returned by the filesystem into path errors that carry the io/fs name
+func ioPathErr(op, name string, err error) error {
+	if perr, ok := err.(*os.PathError); ok {
+		err = perr.Err
+	}
+
+	return &iofs.PathError{Op: op, Path: name, Err: err}
+}
+
+//ioReadDirPage is the number of entries that ReadDir reads at a time when it lists the rest of a directory
+const ioReadDirPage = 256
+
+//ioFile adapts a File to the fs.File and fs.ReadDirFile interfaces
+type ioFile struct {
+	*File
+	eof bool //all entries of the directory were returned
+}
+
+//Stat returns a FileInfo describing the file
+func (f *ioFile) Stat() (iofs.FileInfo, error) {
+	return f.fs.Stat(f.p)
+}
+
+//ReadDir reads the contents of the directory and returns a slice of up to n DirEntry values in directory order. Unlike Readdir it continues where the previous call stopped also when n <= 0, such that the entries after the last call are returned and none at the end of the directory
+func (f *ioFile) ReadDir(n int) (entries []iofs.DirEntry, err error) {
+	if f.eof {
+		if n > 0 {
+			return nil, io.EOF
+		}
+
+		return nil, nil
+	}
+
+	collect := func(p P, fi *fileInfo) error {
+		entries = append(entries, DirEntry{fi: fi})
+		return nil
+	}
+
+	if n > 0 {
+		if err = f.readdir(n, collect); err == io.EOF {
+			f.eof = true
+			if len(entries) > 0 {
+				err = nil //the end is reported by the next call
+			}
+		}
+
+		return entries, err
+	}
+
+	//reading all entries starts over, so once entries were returned the rest is read in pages
+	if f.readdirStartP == nil && f.readdirSnap == nil {
+		err = f.readdir(-1, collect)
+	} else {
+		for err == nil {
+			err = f.readdir(ioReadDirPage, collect)
+		}
+
+		if err == io.EOF {
+			err = nil
+		}
+	}
+
+	if err != nil {
+		return entries, err
+	}
+
+	f.eof = true
+	return entries, nil
+}
+
+//Open opens the named file for reading
+func (a *IOFS) Open(name string) (iofs.File, error) {
+	if !iofs.ValidPath(name) {
+		return nil, &iofs.PathError{Op: "open", Path: name, Err: iofs.ErrInvalid}
+	}
+
+	f, err := a.fs.Open(ParsePath(name))
+	if err != nil {
+		return nil, ioPathErr("open", name, err)
+	}
+
+	return &ioFile{File: f}, nil
+}
+
+//ReadFile reads the named file and returns its contents, symbolic links are followed like Open follows them. All chunks are read in a single transaction without opening a file handle
+func (a *IOFS) ReadFile(name string) (data []byte, err error) {
+	if !iofs.ValidPath(name) {
+		return nil, &iofs.PathError{Op: "readfile", Path: name, Err: iofs.ErrInvalid}
+	}
+
+	p := ParsePath(name)
+	if err = p.Validate(); err != nil {
+		return nil, ioPathErr("readfile", name, err)
+	}
+
+	defer a.fs.heal()
+	if err = a.fs.db.View(func(tx Tx) error {
+		rp, err := a.fs.followLinks(tx, p)
+		if err != nil {
+			return err
+		}
+
+		fi, err := a.fs.getfi(tx, rp)
+		if err != nil {
+			return err
+		}
+
+		if a.fs.expired(fi) {
+			return os.ErrNotExist
+		}
+
+		if fi.IsDir() {
+			return ErrIsDirectory
+		}
+
+		if fi.D != nil {
+			data = append([]byte{}, fi.D...)
+			return nil
+		}
+
+		buf := bytes.NewBuffer(make([]byte, 0, fi.S))
+		if err = a.fs.getChunkPtrs(tx, fi, 0, func(ptr chunkPtr) error {
+			if ptr.off >= fi.S {
+				return errStopWalk
+			}
+
+			chunk, err := a.fs.getChunk(tx, ptr)
+			if err != nil {
+				return err
+			}
+
+			//regions without chunks read as zeros
+			if hole := ptr.off - int64(buf.Len()); hole > 0 {
+				buf.Write(make([]byte, hole))
+			}
+
+			if ptr.end() > fi.S {
+				chunk = chunk[:fi.S-ptr.off]
+			}
+
+			_, err = buf.Write(chunk)
+			return err
+		}); err != nil {
+			return err
+		}
+
+		if hole := fi.S - int64(buf.Len()); hole > 0 {
+			buf.Write(make([]byte, hole))
+		}
+
+		data = buf.Bytes()
+		return nil
+	}); err != nil {
+		return nil, ioPathErr("readfile", name, err)
+	}
+
+	return data, nil
+}
+
+var (
+	_ iofs.ReadFileFS  = &IOFS{}
+	_ iofs.ReadDirFile = &ioFile{}
+	_ iofs.DirEntry    = DirEntry{}
+)
@@ -0,0 +1,76 @@
+package treedb
+
+import (
+	"bytes"
+	"crypto/rand"
+	iofs "io/fs"
+	"os"
+	"testing"
+	"testing/fstest"
+)
+
+func TestIOFSReadFile(t *testing.T) {
+	fs, close := testfs(t)
+	defer close()
+
+	err := fs.Mkdir(P{"a"}, 0777)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := fs.OpenFile(P{"a", "b.txt"}, os.O_CREATE|os.O_WRONLY, 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	input := make([]byte, 3*miB)
+	rand.Read(input)
+	_, err = f.Write(input)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	output, err := iofs.ReadFile(NewIOFS(fs), "a/b.txt")
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+
+	if !bytes.Equal(input, output) {
+		t.Error("expected read file to equal written content")
+	}
+
+	_, err = iofs.ReadFile(NewIOFS(fs), "a/c.txt")
+	perr, ok := err.(*iofs.PathError)
+	if !ok || perr.Path != "a/c.txt" || perr.Err != os.ErrNotExist {
+		t.Errorf("expected path error for non existing file, got: %v", err)
+	}
+	//links are followed like Open follows them
+	if err = fs.Symlink("b.txt", P{"a", "l"}); err != nil {
+		t.Fatal(err)
+	}
+
+	output, err = iofs.ReadFile(NewIOFS(fs), "a/l")
+	if err != nil || !bytes.Equal(input, output) {
+		t.Errorf("expected reading a link to read the file it leads to, got %d bytes, %v", len(output), err)
+	}
+}
+
+func TestIOFSConformance(t *testing.T) {
+	fs, close := testfs(t)
+	defer close()
+
+	if err := fs.Mkdir(P{"d"}, 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	testwrite(fs, t, P{"d", "f"}, []byte("hello"))
+	testwrite(fs, t, P{"g"}, nil)
+	if err := fstest.TestFS(NewIOFS(fs), "d/f", "g"); err != nil {
+		t.Error(err)
+	}
+}
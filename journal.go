@@ -0,0 +1,132 @@
+package treedb
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+)
+
+//intent is recorded in the journal of a file system before an operation that spans multiple commits begins, such that it can be completed or rolled back when the process crashes halfway. Operations that stage content in a temporary file record the file and where it goes:
+//
+// |  Key  |       Data                                              |
+// 00000001: {"Op":"import","Tmp":["a",".b.x1y2.tmp"],"Dst":["a","b"]}
+//
+//Until the intent is staged the temporary file is removed on recovery, once it is staged the rename is completed.
+type intent struct {
+	Op     string   //operation that records the intent
+	Tmp    []string //temporary file that content is written to
+	Dst    []string //path that the temporary file is renamed to at the end
+	Staged bool     //whether all content was written to the temporary file
+}
+
+//running holds the intents of operations that are in progress in this process, they are skipped by recovery when another FileSystem for the same database is opened in the meantime
+var running = struct {
+	mu  sync.Mutex
+	ids map[runningKey]bool
+}{ids: map[runningKey]bool{}}
+
+//runningKey identifies an intent by the journal it is recorded in
+type runningKey struct {
+	db      Store
+	jbucket string
+	id      uint64
+}
+
+func (fs *FileSystem) getIntent(tx Tx, id uint64) (in *intent, err error) {
+	v := tx.Bucket(fs.jbucket).Get(u64tob(id))
+	if v == nil {
+		return nil, os.ErrNotExist
+	}
+
+	in = &intent{}
+	if err = json.Unmarshal(v, in); err != nil {
+		return nil, fmt.Errorf("failed to deserialize: %v", err)
+	}
+
+	return in, nil
+}
+
+func (fs *FileSystem) putIntent(tx Tx, id uint64, in *intent) error {
+	v, err := json.Marshal(in)
+	if err != nil {
+		return fmt.Errorf("failed to serialize: %v", err)
+	}
+
+	return tx.Bucket(fs.jbucket).Put(u64tob(id), v)
+}
+
+//beginIntent records intent 'in' and returns the id it is journaled under
+func (fs *FileSystem) beginIntent(tx Tx, in *intent) (id uint64, err error) {
+	if id, err = tx.Bucket(fs.jbucket).NextSequence(); err != nil {
+		return 0, err
+	}
+
+	running.mu.Lock()
+	running.ids[runningKey{baseStore(fs.db), string(fs.jbucket), id}] = true
+	running.mu.Unlock()
+	return id, fs.putIntent(tx, id, in)
+}
+
+//stageIntent records that all content of intent 'id' was written
+func (fs *FileSystem) stageIntent(tx Tx, id uint64) error {
+	in, err := fs.getIntent(tx, id)
+	if err != nil {
+		return err
+	}
+
+	in.Staged = true
+	return fs.putIntent(tx, id, in)
+}
+
+//endIntent removes intent 'id' from the journal, it must be called in the transaction that completes or rolls back the operation
+func (fs *FileSystem) endIntent(tx Tx, id uint64) error {
+	return tx.Bucket(fs.jbucket).Delete(u64tob(id))
+}
+
+//doneIntent forgets that the operation of intent 'id' is running, it is called once the operation returned whether or not its intent was ended
+func (fs *FileSystem) doneIntent(id uint64) {
+	running.mu.Lock()
+	delete(running.ids, runningKey{baseStore(fs.db), string(fs.jbucket), id})
+	running.mu.Unlock()
+}
+
+//recoverIntents completes or rolls back operations that were interrupted, it runs when a file system is opened. Operations that are still running in this process are left alone. A staged file whose rename fails, for example because a directory took its place, is removed instead
+func (fs *FileSystem) recoverIntents(tx Tx) (err error) {
+	ids, ins := []uint64{}, []*intent{}
+	if err = tx.Bucket(fs.jbucket).ForEach(func(k, v []byte) error {
+		in := &intent{}
+		if err := json.Unmarshal(v, in); err != nil {
+			return fmt.Errorf("failed to deserialize: %v", err)
+		}
+
+		running.mu.Lock()
+		defer running.mu.Unlock()
+		if !running.ids[runningKey{baseStore(fs.db), string(fs.jbucket), btou64(k)}] {
+			ids, ins = append(ids, btou64(k)), append(ins, in)
+		}
+
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	for i, in := range ins {
+		tmpp, dst := P(in.Tmp), P(in.Dst)
+		if _, err = fs.getfi(tx, tmpp); err == nil {
+			if !in.Staged || fs.rename(tx, tmpp, dst) != nil {
+				if err = fs.RemoveTx(tx, tmpp); err != nil {
+					return err
+				}
+			}
+		} else if err != os.ErrNotExist {
+			return err
+		}
+
+		if err = fs.endIntent(tx, ids[i]); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
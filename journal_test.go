@@ -0,0 +1,117 @@
+package treedb
+
+import (
+	"bytes"
+	"crypto/rand"
+	"testing"
+
+	"github.com/boltdb/bolt"
+)
+
+//testcrash stages 'data' for 'p' in a temporary file like an import does, but stops before the rename as if the process died. With 'staged' all content is marked as written
+func testcrash(t *testing.T, fs *FileSystem, p P, data []byte, staged bool) P {
+	f, err := fs.createTmp("import", p, 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = f.Write(data); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if staged {
+		if err = fs.db.Update(func(tx Tx) error { return fs.stageIntent(tx, f.id) }); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	fs.doneIntent(f.id) //the process is gone, so is its memory
+	return f.tmpp
+}
+
+func TestJournalRecovery(t *testing.T) {
+	db, close := testdb(t)
+	defer close()
+
+	fs, err := NewFileSystem(t.Name(), db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testwrite(fs, t, P{"a.txt"}, []byte("old"))
+	data := make([]byte, 3*miB)
+	rand.Read(data)
+
+	//recovery runs when the file system is opened again
+	reopen := func() {
+		if fs, err = NewFileSystem(t.Name(), db); err != nil {
+			t.Fatal(err)
+		}
+
+		if problems, err := fs.Check(); err != nil || len(problems) > 0 {
+			t.Errorf("expected a consistent tree after recovery, got: %v, %v", problems, err)
+		}
+
+		if err = db.View(func(tx *bolt.Tx) error {
+			if k, _ := tx.Bucket(fs.jbucket).Cursor().First(); k != nil {
+				t.Error("expected the journal to be empty after recovery")
+			}
+
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	//content that wasn't staged completely is rolled back
+	tmpp := testcrash(t, fs, P{"a.txt"}, data, false)
+	reopen()
+	if _, err = fs.Stat(tmpp); err == nil {
+		t.Error("expected the temporary file to be removed")
+	}
+
+	if output := testread(fs, t, P{"a.txt"}); string(output) != "old" {
+		t.Errorf("expected the old content to be kept, got %d bytes", len(output))
+	}
+
+	//staged content is moved in place
+	tmpp = testcrash(t, fs, P{"a.txt"}, data, true)
+	reopen()
+	if _, err = fs.Stat(tmpp); err == nil {
+		t.Error("expected the temporary file to be renamed")
+	}
+
+	if output := testread(fs, t, P{"a.txt"}); !bytes.Equal(output, data) {
+		t.Error("expected the staged content to be completed")
+	}
+
+	//operations that are still running are left alone by another file system on the database
+	f, err := fs.createTmp("import", P{"b.txt"}, 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = NewFileSystem(t.Name(), db); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = f.Write([]byte("b")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = fs.commitTmp(f); err != nil {
+		t.Fatalf("expected a running operation to complete, got: %v", err)
+	}
+
+	if output := testread(fs, t, P{"b.txt"}); string(output) != "b" {
+		t.Errorf("expected running import to be written, got: %q", output)
+	}
+}
@@ -0,0 +1,78 @@
+package layerfs
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"os"
+
+	"github.com/boltdb/bolt"
+	"github.com/cellstate/treedb"
+)
+
+//Checkout writes the tree of layer 'layerk' into treedb file system 'dst' below directory 'dstRoot', which is created if it doesn't exist. Directories are created before their content and existing directories are merged with, existing files are replaced. File content is assembled from the chunks that the layer stores under the same content keys, chunks that 'dst' already stores are not copied again. Symbolic links are recreated with the target that was committed as their content. Modes and modification times of the nodes are preserved, those of directories are set after their content was written. The tree is read in a single transaction, content is copied file by file
+func (fs *LayerFS) Checkout(layerk K, dst *treedb.FileSystem, dstRoot treedb.P) (err error) {
+	var entries []treedb.ReceiveEntry
+	if err = fs.db.View(func(tx *bolt.Tx) error {
+		l, err := fs.getLayer(tx, layerk)
+		if err != nil {
+			return err
+		}
+
+		return fs.checkouts(tx, l.Root, dstRoot, &entries)
+	}); err != nil {
+		return fmt.Errorf("failed to walk layer: %v", err)
+	}
+
+	return dst.ReceiveTree(entries, treedb.NewBoltChunkBackend(fs.db, ChunkBucketName).Get)
+}
+
+//checkouts appends the node at key 'k' that is written to path 'p' and all nodes below it to 'entries', depth first
+func (fs *LayerFS) checkouts(tx *bolt.Tx, k []byte, p treedb.P, entries *[]treedb.ReceiveEntry) (err error) {
+	n, err := fs.readNode(tx, k)
+	if err != nil {
+		return fmt.Errorf("failed to read node %x: %v", k, err)
+	}
+
+	e := treedb.ReceiveEntry{P: p, Mode: n.M, ModTime: n.T, File: treedb.SyncFile{Size: n.S}}
+	c := tx.Bucket(NodeBucketName).Cursor()
+	if !n.IsDir() {
+
+		//offsets are big endian, so chunk ptrs are iterated in file order
+		prefix := append(append([]byte{}, k...), ChunkOffsetSeparator...)
+		for kk, v := c.Seek(prefix); kk != nil && bytes.HasPrefix(kk, prefix); kk, v = c.Next() {
+			ck := treedb.K{}
+			copy(ck[:], v)
+			if ck == treedb.K(ZeroKey) {
+				continue //the eof marker carries no content
+			}
+
+			data := tx.Bucket(ChunkBucketName).Get(v)
+			if data == nil {
+				return fmt.Errorf("chunk %x of node %x doesn't exist", v, k)
+			}
+
+			//the target of a link is its content, it is passed along as a whole
+			if n.M&os.ModeSymlink != 0 {
+				e.File.Inline = append(e.File.Inline, data...)
+				continue
+			}
+
+			e.File.Chunks = append(e.File.Chunks, treedb.ChunkRef{Offset: int64(binary.BigEndian.Uint64(kk[len(prefix):])), Key: ck, Len: len(data)})
+		}
+
+		*entries = append(*entries, e)
+		return nil
+	}
+
+	*entries = append(*entries, e)
+	prefix := childPtrKey(k, "")
+	for kk, v := c.Seek(prefix); kk != nil && bytes.HasPrefix(kk, prefix); kk, v = c.Next() {
+		name := string(kk[len(prefix):])
+		if err = fs.checkouts(tx, v, append(append(treedb.P{}, p...), name), entries); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,195 @@
+package layerfs
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/cellstate/treedb"
+)
+
+func TestCheckout(t *testing.T) {
+	fs, close := testfs(t)
+	defer close()
+
+	db, close2 := testdb(t)
+	defer close2()
+
+	src, err := treedb.NewFileSystem("src", db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	large := make([]byte, 3*miB)
+	rand.Read(large)
+	files := map[string][]byte{"/a/x.txt": []byte("foo"), "/b/c/y.bin": large, "/z.txt": nil}
+	for _, p := range []treedb.P{{"a"}, {"b"}, {"b", "c"}} {
+		if err = src.Mkdir(p, 0750); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for name, data := range files {
+		f, err := src.OpenFile(treedb.ParsePath(name), os.O_CREATE|os.O_WRONLY, 0640)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err = f.Write(data); err != nil {
+			t.Fatal(err)
+		}
+
+		if err = f.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	mtime := time.Date(2016, 8, 1, 12, 0, 0, 0, time.UTC)
+	if err = src.Chtimes(treedb.P{"z.txt"}, mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+
+	layerk, err := CommitToLayer(src, fs)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dst, err := treedb.NewFileSystem("dst", db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = fs.Checkout(layerk, dst, treedb.P{"out"}); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+
+	//walking the destination yields the same paths with the modes and times of the layer's nodes, and files of the same size and content as the source
+	seen := 0
+	var walk func(p treedb.P)
+	walk = func(p treedb.P) {
+		infos, err := dst.ReadDirSorted(append(treedb.P{"out"}, p...), treedb.SortByName)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, dfi := range infos {
+			cp := append(append(treedb.P{}, p...), dfi.Name())
+			sfi, err := src.Stat(cp)
+			if err != nil {
+				t.Errorf("expected %s to exist in the source, got: %v", cp, err)
+				continue
+			}
+
+			var n *Node
+			if err = fs.db.View(func(tx *bolt.Tx) (err error) {
+				n, err = fs.getNode(tx, P(cp))
+				return err
+			}); err != nil {
+				t.Fatal(err)
+			}
+
+			seen++
+			if dfi.Mode() != n.Mode() || !dfi.ModTime().Equal(n.ModTime()) {
+				t.Errorf("expected %s to be checked out as %v %v, got: %v %v", cp, n.Mode(), n.ModTime(), dfi.Mode(), dfi.ModTime())
+			}
+
+			if !dfi.ModTime().Equal(sfi.ModTime()) {
+				t.Errorf("expected %s to keep its modification time in the source %v, got: %v", cp, sfi.ModTime(), dfi.ModTime())
+			}
+
+			if dfi.IsDir() {
+				walk(cp)
+				continue
+			}
+
+			f, err := dst.Open(append(treedb.P{"out"}, cp...))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			data, err := ioutil.ReadAll(f)
+			f.Close()
+			if err != nil || dfi.Size() != sfi.Size() || !bytes.Equal(data, files[cp.String()]) {
+				t.Errorf("expected %s to be checked out with %d bytes, got: %d, %v", cp, sfi.Size(), dfi.Size(), err)
+			}
+		}
+	}
+
+	walk(treedb.Root)
+	if seen != 6 {
+		t.Errorf("expected 6 entries to be checked out, got: %d", seen)
+	}
+
+	//missing parents of the destination are created
+	if err = fs.Checkout(layerk, dst, treedb.P{"deep", "out"}); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+
+	if fi, err := dst.Stat(treedb.P{"deep", "out", "a", "x.txt"}); err != nil || fi.Size() != 3 {
+		t.Errorf("expected the layer to be checked out below missing parents, got: %v", err)
+	}
+
+	if err = fs.Checkout(K{0x01}, dst, treedb.Root); err == nil {
+		t.Error("expected checking out a layer that doesn't exist to fail")
+	}
+}
+
+func TestCheckoutSymlinks(t *testing.T) {
+	fs, close := testfs(t)
+	defer close()
+
+	db, close2 := testdb(t)
+	defer close2()
+
+	src, err := treedb.NewFileSystem("src", db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = src.Mkdir(treedb.P{"d"}, 0750); err != nil {
+		t.Fatal(err)
+	}
+
+	//links are committed as they are, not as the file or directory they lead to
+	links := map[string]string{"dir": "d", "dangling": "/missing"}
+	for name, target := range links {
+		if err = src.Symlink(target, treedb.P{name}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	layerk, err := CommitToLayer(src, fs)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+
+	dst, err := treedb.NewFileSystem("dst", db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = fs.Checkout(layerk, dst, treedb.P{"out"}); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+
+	for name, target := range links {
+		p := treedb.P{"out", name}
+		fi, err := dst.Lstat(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if fi.Mode()&os.ModeSymlink == 0 {
+			t.Errorf("expected %s to be checked out as a link, got mode: %v", name, fi.Mode())
+			continue
+		}
+
+		if actual, err := dst.Readlink(p); err != nil || actual != target {
+			t.Errorf("expected %s to link to %s, got: %s, %v", name, target, actual, err)
+		}
+	}
+}
@@ -0,0 +1,153 @@
+package layerfs
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/cellstate/treedb"
+)
+
+//CommitToLayer writes the tree of treedb file system 'src' as a new layer on top of the current layer of 'layer' and returns its key. The tree is read in a single read-only transaction such that the layer is a point-in-time snapshot, 'layer' should therefore be kept in another database than 'src'. Each node is indexed by a content key over its mode, modification time and either its chunks or the keys of its children: a node with the same content as one that was committed before is reused instead of written again, also under another name, such that repeated commits of a mostly unchanged tree share most of their nodes. File content is chunked like a LayerFile chunks it, symbolic links aren't followed but committed with their target as content. If the tree didn't change at all the current layer is returned as is
+func CommitToLayer(src *treedb.FileSystem, layer *LayerFS) (layerk K, err error) {
+	tx, err := src.Begin(false)
+	if err != nil {
+		return ZeroKey, fmt.Errorf("failed to begin source tx: %v", err)
+	}
+
+	defer tx.Rollback()
+	rootk, err := layer.commitTree(src, tx, treedb.Root)
+	if err != nil {
+		return ZeroKey, err
+	}
+
+	if err = layer.db.Update(func(btx *bolt.Tx) error {
+		l, err := layer.getLayer(btx, layer.layerk)
+		if err == nil && bytes.Equal(l.Root, rootk) {
+			layerk = layer.layerk
+			return nil
+		} else if err != nil && err != os.ErrNotExist {
+			return err
+		}
+
+		layerk, err = layer.putLayer(btx, &Layer{Root: rootk, Parent: layer.layerk, T: layer.clock.Now()})
+		return err
+	}); err != nil {
+		return ZeroKey, fmt.Errorf("failed to put layer: %v", err)
+	}
+
+	layer.layerk = layerk
+	return layerk, nil
+}
+
+//commitTree commits the node at path 'p' of 'src' as seen by transaction 'tx', children are committed before their parent. It returns the key of the node
+func (fs *LayerFS) commitTree(src *treedb.FileSystem, tx treedb.Tx, p treedb.P) (k []byte, err error) {
+	fi, err := src.LstatTx(tx, p)
+	if err != nil {
+		return nil, err
+	}
+
+	n := &Node{N: P(p).Base(), M: fi.Mode(), T: fi.ModTime()}
+	var f *treedb.File
+	var r io.Reader
+	if fi.Mode()&os.ModeSymlink != 0 {
+
+		//a link isn't followed, its target is committed as its content
+		target, err := src.ReadlinkTx(tx, p)
+		if err != nil {
+			return nil, err
+		}
+
+		r = strings.NewReader(target)
+	} else {
+		if f, err = src.OpenFileTx(tx, p, os.O_RDONLY, 0); err != nil {
+			return nil, err
+		}
+
+		defer f.Close()
+		r = f
+	}
+
+	if !fi.IsDir() {
+		lf, err := fs.Create(P(p))
+		if err != nil {
+			return nil, err
+		}
+
+		if _, err = io.Copy(lf, r); err != nil {
+			return nil, err
+		}
+
+		if err = lf.flush(true); err != nil {
+			return nil, p.Err("commit", err)
+		}
+
+		//the end of the file is marked with a chunk at a zero key
+		lf.chunks[lf.off] = ZeroKey
+		return fs.commitNode(n, lf.chunks, nil)
+	}
+
+	fis, err := f.Readdir(0)
+	if err != nil {
+		return nil, err
+	}
+
+	children := map[string][]byte{}
+	for _, cfi := range fis {
+		if children[cfi.Name()], err = fs.commitTree(src, tx, append(append(treedb.P{}, p...), cfi.Name())); err != nil {
+			return nil, err
+		}
+	}
+
+	return fs.commitNode(n, nil, children)
+}
+
+//commitNode writes node 'n' with 'chunks' as a file or with 'children' as a directory, unless a node with the same content key was committed before in which case the key of that node is returned instead
+func (fs *LayerFS) commitNode(n *Node, chunks map[int64]K, children map[string][]byte) (k []byte, err error) {
+	//the name is left out, nodes are named by the link in their parent
+	data, err := json.Marshal(struct {
+		M        os.FileMode
+		T        time.Time
+		Chunks   map[int64]K
+		Children map[string][]byte
+	}{n.M, n.T, chunks, children})
+	if err != nil {
+		return nil, ErrSerialize
+	}
+
+	ck := sha256.Sum256(data)
+	if err = fs.db.Update(func(tx *bolt.Tx) (err error) {
+		if v := tx.Bucket(IndexBucketName).Get(ck[:]); v != nil {
+			k = append([]byte{}, v...)
+			return nil //committed before
+		}
+
+		if n.IsDir() {
+			bw, err := NewBranchWriter(nil, tx, children)
+			if err != nil {
+				return err
+			}
+
+			//the directory keeps its time in the source, which is part of its content key
+			if err = bw.CommitWithTime(tx, n, n.T); err != nil {
+				return err
+			}
+
+			k = bw.Key()
+		} else if k, err = fs.cow(tx, n, nil, nil, chunks); err != nil {
+			return err
+		}
+
+		return tx.Bucket(IndexBucketName).Put(ck[:], k)
+	}); err != nil {
+		return nil, err
+	}
+
+	return k, nil
+}
@@ -0,0 +1,190 @@
+package layerfs
+
+import (
+	"bytes"
+	"crypto/rand"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/cellstate/treedb"
+)
+
+func TestCommitToLayer(t *testing.T) {
+	fs, close := testfs(t)
+	defer close()
+
+	db, close2 := testdb(t)
+	defer close2()
+
+	src, err := treedb.NewFileSystem(t.Name(), db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	write := func(p treedb.P, data []byte) {
+		f, err := src.OpenFile(p, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0666)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err = f.Write(data); err != nil {
+			t.Fatal(err)
+		}
+
+		if err = f.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, p := range []treedb.P{{"a"}, {"b"}, {"b", "c"}} {
+		if err = src.Mkdir(p, 0777); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	large := make([]byte, 3*miB)
+	rand.Read(large)
+	write(treedb.P{"a", "x.txt"}, []byte("foo"))
+	write(treedb.P{"b", "c", "y.bin"}, large)
+
+	layerk1, err := CommitToLayer(src, fs)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+
+	write(treedb.P{"a", "x.txt"}, []byte("bar"))
+	layerk2, err := CommitToLayer(src, fs)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+
+	if layerk1 == layerk2 {
+		t.Fatal("expected a changed tree to be committed as another layer")
+	}
+
+	//the unchanged subtree is shared by both layers, the changed path is not
+	child := func(layerk K, p P) (k []byte) {
+		if err = fs.db.View(func(tx *bolt.Tx) error {
+			l, err := fs.getLayer(tx, layerk)
+			if err != nil {
+				return err
+			}
+
+			k = l.Root
+			for _, comp := range p {
+				k = append([]byte{}, tx.Bucket(NodeBucketName).Get(childPtrKey(k, comp))...)
+			}
+
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+
+		return k
+	}
+
+	for _, p := range []P{{"b"}, {"b", "c"}, {"b", "c", "y.bin"}} {
+		if !bytes.Equal(child(layerk1, p), child(layerk2, p)) {
+			t.Errorf("expected unchanged %s to share its node key", p)
+		}
+	}
+
+	for _, p := range []P{Root, {"a"}, {"a", "x.txt"}} {
+		if bytes.Equal(child(layerk1, p), child(layerk2, p)) {
+			t.Errorf("expected changed %s to get another node key", p)
+		}
+	}
+
+	if err = fs.db.View(func(tx *bolt.Tx) error {
+		n, err := fs.getNode(tx, P{"b", "c", "y.bin"})
+		if err != nil {
+			return err
+		}
+
+		if n.Size() != int64(len(large)) {
+			t.Errorf("expected committed file to keep its size, got: %d", n.Size())
+		}
+
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	//committing an unchanged tree keeps the current layer
+	layerk3, err := CommitToLayer(src, fs)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+
+	if layerk3 != layerk2 {
+		t.Error("expected an unchanged tree to keep the current layer")
+	}
+}
+
+func TestCommitNodeNames(t *testing.T) {
+	fs, close := testfs(t)
+	defer close()
+
+	db, close2 := testdb(t)
+	defer close2()
+
+	src, err := treedb.NewFileSystem(t.Name(), db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//files with the same content and time share a node, but each is resolved by its own name
+	mtime := time.Date(2016, 8, 1, 12, 0, 0, 0, time.UTC)
+	for _, name := range []string{"a.txt", "b.txt"} {
+		f, err := src.OpenFile(treedb.P{name}, os.O_CREATE|os.O_WRONLY, 0666)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err = f.Write([]byte("same")); err != nil {
+			t.Fatal(err)
+		}
+
+		if err = f.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		if err = src.Chtimes(treedb.P{name}, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, err = CommitToLayer(src, fs); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = fs.db.View(func(tx *bolt.Tx) error {
+		keys := map[string][]byte{}
+		for _, name := range []string{"a.txt", "b.txt"} {
+			nodeks, err := fs.getNodeKeys(tx, P{name})
+			if err != nil {
+				return err
+			}
+
+			keys[name] = nodeks[len(nodeks)-1]
+			n, err := fs.getNode(tx, P{name})
+			if err != nil {
+				return err
+			}
+
+			if n.Name() != name {
+				t.Errorf("expected node at %s to be named after its link, got: %q", name, n.Name())
+			}
+		}
+
+		if !bytes.Equal(keys["a.txt"], keys["b.txt"]) {
+			t.Error("expected files with the same content to share their node")
+		}
+
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
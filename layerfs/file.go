@@ -0,0 +1,113 @@
+package layerfs
+
+import (
+	"bytes"
+	"io"
+
+	"github.com/boltdb/bolt"
+	"github.com/restic/chunker"
+)
+
+const kiB = 1024
+const miB = kiB * 1024
+
+//LayerFile is a handle for writing a new file into the top layer. Written bytes are chunked and stored as they come in, upon closing a new node is placed at the file's path which results in a new layer
+type LayerFile struct {
+	p      P           //path as passed to create
+	fs     *LayerFS    //file system this file is part of
+	pol    chunker.Pol //polynomial used for content defined chunking
+	buf    []byte      //written bytes that are not yet chunked
+	off    int64       //file offset of the first byte in buf
+	chunks map[int64]K //maps chunk file position (bytes) to chunk k
+}
+
+//Create sets up a handle for writing a file at path 'p', missing directories along the path will be created when the file is closed
+func (fs *LayerFS) Create(p P) (f *LayerFile, err error) {
+	err = p.Validate()
+	if err != nil {
+		return nil, p.Err("create", err)
+	}
+
+	if p.IsRoot() {
+		return nil, p.Err("create", ErrInvalidPath) //root is always a directory
+	}
+
+	return &LayerFile{
+		p:      p,
+		fs:     fs,
+		pol:    chunker.Pol(0x3DA3358B4DC173),
+		chunks: map[int64]K{},
+	}, nil
+}
+
+//flush chunks the buffered bytes and stores them. Unless 'all' is true, the last chunk is kept in the buffer as it was cut at the end of the buffer instead of by its content
+func (f *LayerFile) flush(all bool) (err error) {
+	return f.fs.db.Update(func(tx *bolt.Tx) error {
+		chkr := chunker.NewWithBoundaries(bytes.NewReader(f.buf), f.pol, (256 * kiB), (1 * miB))
+		b := make([]byte, chkr.MaxSize)
+		var rest int
+		for {
+			chunk, err := chkr.Next(b)
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				return err
+			}
+
+			if !all && int(chunk.Start+chunk.Length) == len(f.buf) {
+				rest = int(chunk.Start)
+				break
+			}
+
+			k, err := f.fs.putChunk(tx, chunk.Data)
+			if err != nil {
+				return err
+			}
+
+			f.chunks[f.off+int64(chunk.Start)] = k
+			rest = int(chunk.Start + chunk.Length)
+		}
+
+		f.off = f.off + int64(rest)
+		f.buf = append(f.buf[:0], f.buf[rest:]...)
+		return nil
+	})
+}
+
+// Write writes len(b) bytes to the File. It returns the number of bytes written and an error, if any. Write returns a non-nil error when n != len(b).
+func (f *LayerFile) Write(b []byte) (n int, err error) {
+	f.buf = append(f.buf, b...)
+	if len(f.buf) >= 4*miB {
+		if err = f.flush(false); err != nil {
+			return 0, f.p.Err("write", err)
+		}
+	}
+
+	return len(b), nil
+}
+
+//Close stores the remaining bytes and writes a new node for the file, all nodes up to the root are copied-on-write resulting in a new top layer for the filesystem
+func (f *LayerFile) Close() (err error) {
+	if err = f.flush(true); err != nil {
+		return f.p.Err("close", err)
+	}
+
+	//the end of the file is marked with a chunk at a zero key
+	f.chunks[f.off] = ZeroKey
+
+	var layerk K
+	if err = f.fs.db.Update(func(tx *bolt.Tx) error {
+		k, err := f.fs.cow(tx, &Node{N: f.p.Base(), M: 0666, T: f.fs.clock.Now()}, nil, nil, f.chunks)
+		if err != nil {
+			return err
+		}
+
+		layerk, err = f.fs.putNode(tx, f.p, k)
+		return err
+	}); err != nil {
+		return f.p.Err("close", err)
+	}
+
+	f.fs.layerk = layerk
+	return nil
+}
@@ -1,6 +1,13 @@
 package layerfs
 
+import (
+	"time"
+)
+
 //A Layer represents a point-in-time snapshot of a node tree with file chunks. The fileystem is always created with a specific "top" layer to which new data can be written.
 type Layer struct {
-	Root *Node //the top node
+	Root   []byte    //key of the top node
+	Parent K         //key of the layer this layer was created on, ZeroKey for the first layer
+	T      time.Time //creation time
+	I      uint64    //sequence number that orders layers by creation
 }
@@ -7,8 +7,12 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"os"
+	"sort"
+	"time"
 
 	"github.com/boltdb/bolt"
+	"github.com/cellstate/treedb"
 )
 
 var (
@@ -23,6 +27,8 @@ var (
 	NodeBucketName = []byte("Node")
 	//ChunkBucketName is the name of the bucket that will hold the chunks
 	ChunkBucketName = []byte("Chunk")
+	//IndexBucketName is the name of the bucket that maps the content key of committed nodes to their node key
+	IndexBucketName = []byte("Index")
 )
 
 var (
@@ -36,27 +42,38 @@ var (
 
 	//ErrDeserialize is returned when we couldnt deserialize
 	ErrDeserialize = errors.New("failed to deserialize")
+
+	//ErrNotDirectory is returned when a directory was expected
+	ErrNotDirectory = errors.New("not a directory")
 )
 
 //LayerFS is an userland, append only, deduplicated filesystem build on top of boltdb
 type LayerFS struct {
-	layerk K        //key of the current layer
-	db     *bolt.DB //the key-value database
+	layerk K            //key of the current layer
+	db     *bolt.DB     //the key-value database
+	clock  treedb.Clock //tells the modification time of nodes and the creation time of layers
 }
 
 //K is used as the database key for content addressing
 type K [sha256.Size]byte
 
 //New sets up a new filesystem at the specified layer, if the provided layer is a ZeroKey key, writes will be played in a new layer. If the layer is not the latest layer the filesystem will be read-only, else writes will be added to the top layer
-func New(layerk K, db *bolt.DB) (fs *LayerFS, err error) {
+func New(layerk K, db *bolt.DB, opts ...Option) (fs *LayerFS, err error) {
 	fs = &LayerFS{
 		layerk: layerk,
 		db:     db,
+		clock:  treedb.WallClock,
+	}
+
+	for _, opt := range opts {
+		opt(fs)
 	}
 
 	if err = db.Update(func(tx *bolt.Tx) error {
-		if _, err = tx.CreateBucketIfNotExists(NodeBucketName); err != nil {
-			return err
+		for _, name := range [][]byte{LayerBucketName, NodeBucketName, ChunkBucketName, IndexBucketName} {
+			if _, err = tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
 		}
 
 		return nil
@@ -74,15 +91,25 @@ func u64tob(v uint64) []byte {
 	return b
 }
 
+//format a database key for a node's chunk ptr
+func chunkPtrKey(k []byte, offset int64) []byte {
+	return bytes.Join([][]byte{k, u64tob(uint64(offset))}, []byte(ChunkOffsetSeparator))
+}
+
+//format a database key for a node's child ptr
+func childPtrKey(k []byte, name string) []byte {
+	return bytes.Join([][]byte{k, []byte(name)}, []byte(PathSeparator))
+}
+
 func v64tob(v int64) []byte {
 	b := make([]byte, binary.MaxVarintLen64)
 	binary.PutVarint(b, v)
 	return b
 }
 
-//cow will copy-on-write a new node while merging children 'mChildren' and  chunks 'mChunks' with the existing node at key 'nodeK'.
+//cow will copy-on-write a new node while merging children 'mChildren' and  chunks 'mChunks' with the existing node at key 'nodek'. The existing node's children are copied one by one using a cursor such that large directories dont have to be loaded into memory.
 //
-//When the node's key 'nodeK' is a ZeroKey a new node is instead created with just the provided children 'mChildren' and chunks 'mChunks'
+//When the node's key 'nodek' is nil a new node is instead created with just the provided children 'mChildren' and chunks 'mChunks'
 //
 //When the key of a merged child is a ZeroKey the child acts as a tombstone and is removed from the new node instead.
 //
@@ -92,6 +119,7 @@ func v64tob(v int64) []byte {
 func (fs *LayerFS) cow(
 	tx *bolt.Tx,
 	node *Node,
+	nodek []byte,
 	mChildren map[string][]byte,
 	mChunks map[int64]K,
 ) (k []byte, err error) {
@@ -113,32 +141,42 @@ func (fs *LayerFS) cow(
 			continue
 		}
 
-		if err = b.Put(bytes.Join([][]byte{k, []byte(name)}, []byte(PathSeparator)), childk); err != nil {
+		if err = b.Put(childPtrKey(k, name), childk); err != nil {
 			return nil, err
 		}
 	}
 
-	//@TODO write chunks, make sure ordering based on offset is correct
-	//@TODO support truncation, appending and partial differences
-	// for offset, chunkk := range mChunks {}
-	//@TODO copy over old children, unless tombstones
+	//other children of the existing node are copied over, unless merged or tombstoned above
+	if nodek != nil {
+		bw := &BranchWriter{k: k, mChildren: mChildren}
+		if err = bw.CopyChildren(tx, nodek); err != nil {
+			return nil, err
+		}
+	}
 
-	//we now read back everything we wrote (all stuff prefixed with key 'k') to compute the node's checksum, boltdb makes sure everything is ordered consistently
-	c := b.Cursor()
-	h := sha256.New()
-	for kk, v := c.Seek(k); kk != nil && bytes.HasPrefix(kk, k); kk, v = c.Next() {
+	//write chunks, offsets are encoded big endian such that bolt orders them by file position. A chunk with a zerokey marks the end of the file and thereby its size
+	for offset, chunkk := range mChunks {
+		if chunkk == ZeroKey {
+			node.S = offset
+		}
 
-		n, err := h.Write(v)
-		if err != nil || n != len(v) {
-			return nil, fmt.Errorf("failed to hash new node's content: %v", err)
+		//bolt requires the value to remain valid for the life of the transaction, the loop variable is reused
+		chunkk := chunkk
+		if err = b.Put(chunkPtrKey(k, offset), chunkk[:]); err != nil {
+			return nil, err
 		}
+	}
 
-		//@TODO update the nodes size, handle file sizes by counting chunk offsets
-		// node.S = node.S + n
+	//@TODO support truncation, appending and partial differences
 
-		fmt.Println(kk, v)
+	//a file's size is set by its EOF marker above, the checksum only covers the chunk ptrs
+	sum, _, err := contentChecksum(tx, k)
+	if err != nil {
+		return nil, err
 	}
 
+	logger.Printf("cow node %x: %d bytes, checksum %x", k, node.S, sum)
+
 	//serialize the node
 	data, err := json.Marshal(node)
 	if err != nil {
@@ -146,7 +184,7 @@ func (fs *LayerFS) cow(
 	}
 
 	//write checksum and data to a buffer
-	buf := bytes.NewBuffer(h.Sum(data))
+	buf := bytes.NewBuffer(append([]byte{}, sum[:]...))
 	n, err := buf.Write(data)
 	if err != nil || n != len(data) {
 		return nil, fmt.Errorf("failed to write serialized to buf: %v", err)
@@ -162,69 +200,213 @@ func (fs *LayerFS) cow(
 }
 
 //getLayer fetches a layer using layer key 'layerk' return os.ErrNotExist if it couldnt be found
-// func (fs *LayerFS) getLayer(tx *bolt.Tx, layerk K) (l *Layer, err error) {
-// 	data := tx.Bucket(LayerBucketName).Get(layerk[:])
-// 	if data == nil {
-// 		return nil, os.ErrNotExist
-// 	}
-//
-// 	l = &Layer{}
-// 	err = json.Unmarshal(data, &l)
-// 	if err != nil {
-// 		return nil, ErrDeserialize
-// 	}
-//
-// 	return nil, nil
-// }
+func (fs *LayerFS) getLayer(tx *bolt.Tx, layerk K) (l *Layer, err error) {
+	data := tx.Bucket(LayerBucketName).Get(layerk[:])
+	if data == nil {
+		return nil, os.ErrNotExist
+	}
 
-//putNode updates or inserts node 'n' at path 'p', rehashing all nodes up the tree until finally the current layer key is updated version
-// func (fs *LayerFS) putNode(tx *bolt.Tx, n *Node, p P) (err error) {
-//
-// 	//serialize new node
-// 	data, err := json.Marshal(n)
-// 	if err != nil {
-// 		return ErrSerialize
-// 	}
-//
-// 	//key of the node is its sha checksum
-// 	k := sha256.Sum256(data)
-// 	err = tx.Bucket(NodeBucketName).Put(k[:], data)
-// 	if err != nil {
-// 		return err
-// 	}
-//
-// 	//unless this is the root, update the parent
-// 	if !p.Equals(Root) {
-// 		//we want to update the parent
-// 		parent, err := fs.getNode(tx, p.Parent())
-// 		if err != nil {
-// 			return err //failed to get parent node
-// 		}
-//
-// 		//update the parent with its new key
-// 		//@TODO how to cascade the rehashing up the tree
-// 		//@TODO how to not load all children keys into memory
-// 		err = parent.putChild(tx, k)
-// 		if err != nil {
-// 			return err //failed to write parent's new child
-// 		}
-// 	}
-//
-// 	return nil
-// }
+	l = &Layer{}
+	err = json.Unmarshal(data, l)
+	if err != nil {
+		return nil, ErrDeserialize
+	}
+
+	return l, nil
+}
+
+//putLayer assigns layer 'l' the next sequence number and stores it under the checksum of its serialized form, the checksum is returned as the layer key
+func (fs *LayerFS) putLayer(tx *bolt.Tx, l *Layer) (layerk K, err error) {
+	l.I, err = tx.Bucket(LayerBucketName).NextSequence()
+	if err != nil {
+		return ZeroKey, err
+	}
+
+	data, err := json.Marshal(l)
+	if err != nil {
+		return ZeroKey, ErrSerialize
+	}
+
+	layerk = sha256.Sum256(data)
+	err = tx.Bucket(LayerBucketName).Put(layerk[:], data)
+	if err != nil {
+		return ZeroKey, err
+	}
+
+	return layerk, nil
+}
+
+//Layers returns the keys of all layers in the database in the order they were created
+func (fs *LayerFS) Layers() (layerks []K, err error) {
+	layers := []*Layer{}
+	if err = fs.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(LayerBucketName).ForEach(func(k, v []byte) error {
+			l := &Layer{}
+			err := json.Unmarshal(v, l)
+			if err != nil {
+				return ErrDeserialize
+			}
+
+			layers = append(layers, l)
+			layerk := K{}
+			copy(layerk[:], k)
+			layerks = append(layerks, layerk)
+			return nil
+		})
+	}); err != nil {
+		return nil, err
+	}
+
+	sort.Sort(&layersByCreation{layers, layerks})
+	return layerks, nil
+}
+
+//LayerInfo returns the layer stored at key 'layerk' together with the key of the layer it was created on and when it was created
+func (fs *LayerFS) LayerInfo(layerk K) (l *Layer, parent K, createdAt time.Time, err error) {
+	if err = fs.db.View(func(tx *bolt.Tx) error {
+		l, err = fs.getLayer(tx, layerk)
+		return err
+	}); err != nil {
+		return nil, ZeroKey, time.Time{}, err
+	}
+
+	return l, l.Parent, l.T, nil
+}
+
+//layersByCreation sorts layers and their keys by sequence number
+type layersByCreation struct {
+	layers  []*Layer
+	layerks []K
+}
 
-//getNode returns the node at path 'p' and return it
+func (s *layersByCreation) Len() int           { return len(s.layers) }
+func (s *layersByCreation) Less(i, j int) bool { return s.layers[i].I < s.layers[j].I }
+func (s *layersByCreation) Swap(i, j int) {
+	s.layers[i], s.layers[j] = s.layers[j], s.layers[i]
+	s.layerks[i], s.layerks[j] = s.layerks[j], s.layerks[i]
+}
+
+//putChunk stores chunk 'data' under its checksum, if a chunk with the same content already exists it is not written again
+func (fs *LayerFS) putChunk(tx *bolt.Tx, data []byte) (k K, err error) {
+	k = sha256.Sum256(data)
+	b := tx.Bucket(ChunkBucketName)
+	if b.Get(k[:]) != nil {
+		return k, nil //deduplicated
+	}
+
+	//bolt requires the value to remain valid for the life of the transaction
+	return k, b.Put(k[:], append([]byte{}, data...))
+}
+
+//getNodeKeys descends from the root node of the current layer following path 'p' and returns the key of each node it passes, starting with the root. If a node along the path doesnt exist the returned keys are cut short
+func (fs *LayerFS) getNodeKeys(tx *bolt.Tx, p P) (keys [][]byte, err error) {
+	l, err := fs.getLayer(tx, fs.layerk)
+	if err != nil {
+		if err == os.ErrNotExist {
+			return nil, nil //empty filesystem, not even a root
+		}
+
+		return nil, err
+	}
+
+	b := tx.Bucket(NodeBucketName)
+	keys = append(keys, l.Root)
+	for _, comp := range p {
+		k := b.Get(childPtrKey(keys[len(keys)-1], comp))
+		if k == nil {
+			break
+		}
+
+		keys = append(keys, k)
+	}
+
+	return keys, nil
+}
+
+//readNode deserializes the node stored at key 'k' by stripping its checksum prefix, returns os.ErrNotExist if it couldnt be found
+func (fs *LayerFS) readNode(tx *bolt.Tx, k []byte) (n *Node, err error) {
+	v := tx.Bucket(NodeBucketName).Get(k)
+	if v == nil {
+		return nil, os.ErrNotExist
+	}
+
+	n, _, err = decodeNode(v)
+	return n, err
+}
+
+//putNode places the node at key 'k' at path 'p', since nodes are never changed in place all nodes up the tree are copied-on-write to point to their new child until finally a new root node is committed. Directories along the path that dont exist yet are created. The key of the new layer that holds the new root is returned
+func (fs *LayerFS) putNode(tx *bolt.Tx, p P, k []byte) (layerk K, err error) {
+	keys, err := fs.getNodeKeys(tx, p)
+	if err != nil {
+		return ZeroKey, err
+	}
+
+	for i := len(p); i > 0; i-- {
+		pp := p[:i-1]
+		parent := &Node{N: pp.Base(), M: os.ModeDir | 0777}
+
+		//a new branch for the parent only replaces the single changed child, no children are held in memory
+		bw, err := NewBranchWriter(nil, tx, nil)
+		if err != nil {
+			return ZeroKey, err
+		}
+
+		bw.clock = fs.clock
+
+		//if the parent already exists its mode and other children are copied over
+		if i-1 < len(keys) {
+			existing, err := fs.readNode(tx, keys[i-1])
+			if err != nil {
+				return ZeroKey, err
+			}
+
+			if !existing.IsDir() {
+				return ZeroKey, ErrNotDirectory
+			}
+
+			parent.M = existing.M
+			if err = bw.CopyChildren(tx, keys[i-1]); err != nil {
+				return ZeroKey, err
+			}
+		}
+
+		//written after copying such that it replaces the existing child of the same name
+		if err = bw.WriteChild(tx, p[i-1], k); err != nil {
+			return ZeroKey, err
+		}
+
+		if err = bw.Commit(tx, parent); err != nil {
+			return ZeroKey, err
+		}
+
+		k = bw.Key()
+	}
+
+	return fs.putLayer(tx, &Layer{Root: k, Parent: fs.layerk, T: fs.clock.Now()})
+}
+
+//getNode returns the node at path 'p' and return it. A node can be linked under another name than the one it was written with, for example when a committed node with the same content is reused, so the name of the link in its parent is authoritative: the returned node is named after the last component of 'p'
 //@TODO some redundancy options https://github.com/borgbackup/borg/issues/225
 //http://serverfault.com/questions/696216/hard-disk-ssds-detection-and-handling-of-errors-is-silent-data-corruption
 //@TODO can we automatically recover from corruption (bit rot)
 //@TODO can do brute force redundancy in a (redundant) bolt db
 //@TODO can we do autorecover on a read-only database? transaction?
 //@TODO we should setup a boltdb abstraction that can automatically recover data from backup interface, configure a local copy, size > N bytes
-// func (fs *LayerFS) getNode(tx *bolt.Tx, p P) (n *Node, err error) {
-// 	l, err := fs.getLayer(tx, fs.layerk)
-// 	if err != nil {
-// 		return nil, err
-// 	}
-//
-// 	return l.Root.getDescendant(tx, p)
-// }
+func (fs *LayerFS) getNode(tx *bolt.Tx, p P) (n *Node, err error) {
+	keys, err := fs.getNodeKeys(tx, p)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(keys) != len(p)+1 {
+		return nil, os.ErrNotExist
+	}
+
+	n, err = fs.readNode(tx, keys[len(keys)-1])
+	if err != nil {
+		return nil, err
+	}
+
+	n.N = p.Base()
+	return n, nil
+}
@@ -1,9 +1,13 @@
 package layerfs
 
 import (
+	"bytes"
+	"crypto/rand"
+	"fmt"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
 
 	"github.com/boltdb/bolt"
@@ -71,3 +75,477 @@ func TestWriteNewBranch(t *testing.T) {
 	}
 
 }
+
+func TestDecodeNode(t *testing.T) {
+	fs, close := testfs(t)
+	defer close()
+
+	if err := fs.db.Update(func(tx *bolt.Tx) error {
+		bw, err := NewBranchWriter(nil, tx, map[string][]byte{
+			"a.txt": []byte("1"),
+			"b.txt": []byte("22"),
+		})
+		if err != nil {
+			return err
+		}
+
+		if err = bw.Commit(tx, &Node{N: "dir", M: os.ModeDir | 0777}); err != nil {
+			return err
+		}
+
+		n, checksum, err := decodeNode(tx.Bucket(NodeBucketName).Get(bw.Key()))
+		if err != nil {
+			return err
+		}
+
+		if n.Name() != "dir" || !n.IsDir() {
+			t.Errorf("expected decoded node to be the committed directory, got: %+v", n)
+		}
+
+		sum, _, err := contentChecksum(tx, bw.Key())
+		if err != nil {
+			return err
+		}
+
+		if checksum != sum {
+			t.Errorf("expected checksum %x, got: %x", sum, checksum)
+		}
+
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, err := decodeNode([]byte("short")); err != ErrDeserialize {
+		t.Errorf("expected ErrDeserialize for a value without checksum, got: %v", err)
+	}
+}
+
+func TestCommitChecksumStable(t *testing.T) {
+	fs, close := testfs(t)
+	defer close()
+
+	children := map[string][]byte{"a.txt": []byte("1"), "b.txt": []byte("22")}
+	if err := fs.db.Update(func(tx *bolt.Tx) error {
+		sums := []K{}
+		n := &Node{N: "dir", M: os.ModeDir | 0777}
+		bw, err := NewBranchWriter(nil, tx, children)
+		if err != nil {
+			return err
+		}
+
+		//committing the same branch again must not count its own header
+		for i := 0; i < 2; i++ {
+			if err = bw.Commit(tx, n); err != nil {
+				return err
+			}
+
+			if n.Size() != 3 {
+				t.Errorf("expected size to be the sum of child key values, got: %d", n.Size())
+			}
+
+			_, sum, err := decodeNode(tx.Bucket(NodeBucketName).Get(bw.Key()))
+			if err != nil {
+				return err
+			}
+
+			sums = append(sums, sum)
+		}
+
+		//a different branch with identical children
+		bw2, err := NewBranchWriter(nil, tx, children)
+		if err != nil {
+			return err
+		}
+
+		if err = bw2.Commit(tx, &Node{N: "dir", M: os.ModeDir | 0777}); err != nil {
+			return err
+		}
+
+		_, sum, err := decodeNode(tx.Bucket(NodeBucketName).Get(bw2.Key()))
+		if err != nil {
+			return err
+		}
+
+		sums = append(sums, sum)
+		for _, sum := range sums[1:] {
+			if sum != sums[0] {
+				t.Errorf("expected identical children to result in the same checksum, got: %x", sums)
+			}
+		}
+
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCreateFile(t *testing.T) {
+	fs, close := testfs(t)
+	defer close()
+
+	f, err := fs.Create(P{"a", "b", "c.txt"})
+	if err != nil {
+		t.Fatalf("didn't expect error, got: %v", err)
+	}
+
+	input := make([]byte, 5*miB)
+	rand.Read(input)
+
+	n, err := f.Write(input)
+	if err != nil || n != len(input) {
+		t.Fatalf("failed to write: %v", err)
+	}
+
+	err = f.Close()
+	if err != nil {
+		t.Fatalf("failed to close: %v", err)
+	}
+
+	if fs.layerk == ZeroKey {
+		t.Fatal("expected closing the file to result in a new layer")
+	}
+
+	if err = fs.db.View(func(tx *bolt.Tx) error {
+		n, err := fs.getNode(tx, P{"a", "b", "c.txt"})
+		if err != nil {
+			return err
+		}
+
+		if n.Size() != int64(len(input)) {
+			t.Errorf("expected node size to equal written bytes, got: %d", n.Size())
+		}
+
+		if n.IsDir() {
+			t.Error("expected file node to not be a directory")
+		}
+
+		for _, p := range []P{Root, {"a"}, {"a", "b"}} {
+			n, err = fs.getNode(tx, p)
+			if err != nil {
+				return err
+			}
+
+			if !n.IsDir() {
+				t.Errorf("expected node at '%s' to be a directory", p)
+			}
+		}
+
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func testcreate(fs *LayerFS, t *testing.T, p P, data []byte) {
+	f, err := fs.Create(p)
+	if err != nil {
+		t.Fatalf("failed to create: %v", err)
+	}
+
+	_, err = f.Write(data)
+	if err != nil {
+		t.Fatalf("failed to write: %v", err)
+	}
+
+	err = f.Close()
+	if err != nil {
+		t.Fatalf("failed to close: %v", err)
+	}
+}
+
+func TestPutNodeOnlyChangesPath(t *testing.T) {
+	fs, close := testfs(t)
+	defer close()
+
+	testcreate(fs, t, P{"a", "b", "c.txt"}, []byte("hello"))
+	testcreate(fs, t, P{"a", "d.txt"}, []byte("foo"))
+	testcreate(fs, t, P{"x", "y.txt"}, []byte("bar"))
+
+	getkeys := func(p P) (keys [][]byte) {
+		if err := fs.db.View(func(tx *bolt.Tx) (err error) {
+			keys, err = fs.getNodeKeys(tx, p)
+			return err
+		}); err != nil {
+			t.Fatal(err)
+		}
+
+		if len(keys) != len(p)+1 {
+			t.Fatalf("expected a key for each node along '%s', got: %v", p, keys)
+		}
+
+		return keys
+	}
+
+	before1 := getkeys(P{"a", "b", "c.txt"})
+	before2 := getkeys(P{"a", "d.txt"})
+	before3 := getkeys(P{"x", "y.txt"})
+
+	testcreate(fs, t, P{"a", "b", "c.txt"}, []byte("hello world"))
+
+	after1 := getkeys(P{"a", "b", "c.txt"})
+	after2 := getkeys(P{"a", "d.txt"})
+	after3 := getkeys(P{"x", "y.txt"})
+
+	for i := range before1 {
+		if bytes.Equal(before1[i], after1[i]) {
+			t.Errorf("expected node %d along the edited path to have a new key", i)
+		}
+	}
+
+	if !bytes.Equal(before2[2], after2[2]) {
+		t.Error("expected sibling file to keep its key")
+	}
+
+	if !bytes.Equal(before3[1], after3[1]) || !bytes.Equal(before3[2], after3[2]) {
+		t.Error("expected unrelated subtree to keep its keys")
+	}
+
+	if err := fs.db.View(func(tx *bolt.Tx) error {
+		n, err := fs.getNode(tx, P{"a", "d.txt"})
+		if err != nil {
+			return err
+		}
+
+		if n.Size() != 3 {
+			t.Errorf("expected sibling to still be readable, got size: %d", n.Size())
+		}
+
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLayerHistory(t *testing.T) {
+	fs, close := testfs(t)
+	defer close()
+
+	created := []K{}
+	for _, name := range []string{"a.txt", "b.txt", "c.txt"} {
+		testcreate(fs, t, P{name}, []byte(name))
+		created = append(created, fs.layerk)
+	}
+
+	layerks, err := fs.Layers()
+	if err != nil {
+		t.Fatalf("didn't expect error, got: %v", err)
+	}
+
+	if len(layerks) != 3 {
+		t.Fatalf("expected this many layers, got: %d", len(layerks))
+	}
+
+	parent := ZeroKey
+	for i, layerk := range layerks {
+		if layerk != created[i] {
+			t.Errorf("expected layer %d to be in creation order", i)
+		}
+
+		l, p, createdAt, err := fs.LayerInfo(layerk)
+		if err != nil {
+			t.Fatalf("didn't expect error, got: %v", err)
+		}
+
+		if l == nil || len(l.Root) == 0 {
+			t.Errorf("expected layer %d to have a root node", i)
+		}
+
+		if p != parent {
+			t.Errorf("expected layer %d to have the previous layer as parent", i)
+		}
+
+		if createdAt.IsZero() {
+			t.Errorf("expected layer %d to have a creation time", i)
+		}
+
+		parent = layerk
+	}
+
+	_, _, _, err = fs.LayerInfo(ZeroKey)
+	if err != os.ErrNotExist {
+		t.Errorf("expected os.ErrNotExist for unknown layer, got: %v", err)
+	}
+}
+
+//testLogger records all lines that are logged
+type testLogger struct{ lines []string }
+
+func (l *testLogger) Printf(format string, v ...interface{}) {
+	l.lines = append(l.lines, fmt.Sprintf(format, v...))
+}
+
+func TestLogger(t *testing.T) {
+	fs, close := testfs(t)
+	defer close()
+
+	commit := func() {
+		if err := fs.db.Update(func(tx *bolt.Tx) error {
+			bw, err := NewBranchWriter(nil, tx, map[string][]byte{"a.txt": []byte("1")})
+			if err != nil {
+				return err
+			}
+
+			return bw.Commit(tx, &Node{N: "dir", M: os.ModeDir | 0777})
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	//the default discards everything
+	if _, ok := logger.(nopLogger); !ok {
+		t.Fatalf("expected default logger to be a no-op, got: %T", logger)
+	}
+
+	commit()
+
+	l := &testLogger{}
+	SetLogger(l)
+	defer SetLogger(nil)
+	commit()
+	if len(l.lines) != 1 || !strings.HasPrefix(l.lines[0], "commit branch") {
+		t.Errorf("expected commit to be logged, got: %v", l.lines)
+	}
+
+	SetLogger(nil)
+	commit()
+	if len(l.lines) != 1 {
+		t.Errorf("expected nothing to be logged after resetting the logger, got: %v", l.lines)
+	}
+}
+
+func TestLargeBranch(t *testing.T) {
+	fs, close := testfs(t)
+	defer close()
+
+	const n = 100000
+	name := func(i int) string { return fmt.Sprintf("%08d.txt", i) }
+	filek := []byte("1")
+
+	//writes a branch with all 'n' children plus 'extra' ones and returns its key
+	branch := func(tx *bolt.Tx, extra ...string) (k []byte, err error) {
+		bw, err := NewBranchWriter(nil, tx, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		for i := 0; i < n; i++ {
+			if err = bw.WriteChild(tx, name(i), filek); err != nil {
+				return nil, err
+			}
+		}
+
+		for _, name := range extra {
+			if err = bw.WriteChild(tx, name, filek); err != nil {
+				return nil, err
+			}
+		}
+
+		return bw.Key(), bw.Commit(tx, &Node{N: "big", M: os.ModeDir | 0777})
+	}
+
+	//runs 'fn' in a transaction and reports how many allocations it takes, 'fn' is run once before to warm up
+	measure := func(fn func(tx *bolt.Tx) error) (allocs float64) {
+		if err := fs.db.Update(func(tx *bolt.Tx) (err error) {
+			allocs = testing.AllocsPerRun(1, func() {
+				if err == nil {
+					err = fn(tx)
+				}
+			})
+
+			return err
+		}); err != nil {
+			t.Fatal(err)
+		}
+
+		return allocs
+	}
+
+	if err := fs.db.Update(func(tx *bolt.Tx) error {
+		k, err := branch(tx)
+		if err != nil {
+			return err
+		}
+
+		fs.layerk, err = fs.putNode(tx, P{"big"}, k)
+		return err
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	//copying children should take hardly more allocations than writing them, holding them in memory as well would take at least one more per child
+	bound := measure(func(tx *bolt.Tx) error {
+		_, err := branch(tx)
+		return err
+	}) + n/2
+
+	//adding a child copies all others over, both children are added to the same base
+	roots := map[string][]byte{}
+	if err := fs.db.View(func(tx *bolt.Tx) error {
+		l, err := fs.getLayer(tx, fs.layerk)
+		if err != nil {
+			return err
+		}
+
+		roots["base"] = l.Root
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"ours.txt", "theirs.txt"} {
+		if allocs := measure(func(tx *bolt.Tx) error {
+			layerk, err := fs.putNode(tx, P{"big", name}, filek)
+			if err != nil {
+				return err
+			}
+
+			l, err := fs.getLayer(tx, layerk)
+			roots[name] = l.Root
+			return err
+		}); allocs > bound {
+			t.Errorf("expected copying children to take a bounded number of allocations, took %.0f", allocs)
+		}
+	}
+
+	//merging both walks all children of the three versions with a new cursor for every step, that takes a constant number of allocations per child
+	var rootk []byte
+	if allocs := measure(func(tx *bolt.Tx) (err error) {
+		conflicts := []Conflict{}
+		rootk, err = fs.merge(tx, Root, roots["base"], roots["ours.txt"], roots["theirs.txt"], &conflicts)
+		if len(conflicts) > 0 {
+			t.Errorf("expected a clean merge, got: %v", conflicts)
+		}
+
+		return err
+	}); allocs > 64*n {
+		t.Errorf("expected merging children to take a bounded number of allocations, took %.0f", allocs)
+	}
+
+	//the merged branch has the same checksum as one that is written with the same children directly
+	if err := fs.db.Update(func(tx *bolt.Tx) error {
+		mergedk := tx.Bucket(NodeBucketName).Get(childPtrKey(rootk, "big"))
+		k, err := branch(tx, "theirs.txt", "ours.txt")
+		if err != nil {
+			return err
+		}
+
+		_, sum1, err := decodeNode(tx.Bucket(NodeBucketName).Get(mergedk))
+		if err != nil {
+			return err
+		}
+
+		_, sum2, err := decodeNode(tx.Bucket(NodeBucketName).Get(k))
+		if err != nil {
+			return err
+		}
+
+		if sum1 != sum2 {
+			t.Error("expected the merged branch to have a deterministic checksum")
+		}
+
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,153 @@
+package layerfs
+
+import (
+	"bytes"
+	"os"
+
+	"github.com/boltdb/bolt"
+)
+
+//Conflict describes a path that was changed differently in both layers that were merged
+type Conflict struct {
+	Path   P      //path at which both layers diverged
+	Ours   []byte //key of the node in our layer, nil if we removed it
+	Theirs []byte //key of the node in their layer, nil if they removed it
+}
+
+//nextChild returns the name and key of the first child of the branch node at key 'k' whose name sorts after 'after', children are looked up with a new cursor such that the bucket can be written to in between calls. A nil key has no children
+func (fs *LayerFS) nextChild(tx *bolt.Tx, k []byte, after string) (name string, childk []byte, ok bool) {
+	if k == nil {
+		return "", nil, false
+	}
+
+	prefix := childPtrKey(k, "")
+	c := tx.Bucket(NodeBucketName).Cursor()
+	kk, v := c.Seek(childPtrKey(k, after))
+	if kk != nil && after != "" && bytes.Equal(kk, childPtrKey(k, after)) {
+		kk, v = c.Next()
+	}
+
+	if kk == nil || !bytes.HasPrefix(kk, prefix) {
+		return "", nil, false
+	}
+
+	return string(kk[len(prefix):]), append([]byte{}, v...), true
+}
+
+//getChild returns the key of child 'name' of the branch node at key 'k', or nil if it has no such child
+func (fs *LayerFS) getChild(tx *bolt.Tx, k []byte, name string) (childk []byte) {
+	if k == nil {
+		return nil
+	}
+
+	if v := tx.Bucket(NodeBucketName).Get(childPtrKey(k, name)); v != nil {
+		return append([]byte{}, v...)
+	}
+
+	return nil
+}
+
+//merge three-way merges the nodes at key 'ours' and 'theirs' that are both derived from node 'base' at path 'p'. Since unchanged nodes keep their key, a subtree that only changed on one side can be taken over wholesale. Only directories that changed on both sides are merged child-by-child, anything else that changed on both sides is a conflict for which our version is kept. A nil key represents a node that doesnt exist (anymore)
+func (fs *LayerFS) merge(tx *bolt.Tx, p P, base, ours, theirs []byte, conflicts *[]Conflict) (k []byte, err error) {
+	if bytes.Equal(ours, theirs) || bytes.Equal(base, theirs) {
+		return ours, nil //no changes, or only changes on our side
+	}
+
+	if bytes.Equal(base, ours) {
+		return theirs, nil //only changes on their side
+	}
+
+	var on, tn *Node
+	if ours != nil {
+		if on, err = fs.readNode(tx, ours); err != nil {
+			return nil, err
+		}
+	}
+
+	if theirs != nil {
+		if tn, err = fs.readNode(tx, theirs); err != nil {
+			return nil, err
+		}
+	}
+
+	//both changed, unless both are still directories this cannot be merged
+	if on == nil || tn == nil || !on.IsDir() || !tn.IsDir() {
+		*conflicts = append(*conflicts, Conflict{Path: p, Ours: ours, Theirs: theirs})
+		return ours, nil
+	}
+
+	//children of the three versions are walked by name in lockstep, such that directories of any size are merged without holding their children in memory
+	bw, err := NewBranchWriter(nil, tx, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	bw.clock = fs.clock
+	for name := ""; ; {
+		next, found := "", false
+		for _, k := range [][]byte{base, ours, theirs} {
+			if cname, _, ok := fs.nextChild(tx, k, name); ok && (!found || cname < next) {
+				next, found = cname, true
+			}
+		}
+
+		if !found {
+			break
+		}
+
+		name = next
+		childk, err := fs.merge(tx, append(append(P{}, p...), name), fs.getChild(tx, base, name), fs.getChild(tx, ours, name), fs.getChild(tx, theirs, name), conflicts)
+		if err != nil {
+			return nil, err
+		}
+
+		if childk != nil {
+			if err = bw.WriteChild(tx, name, childk); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if err = bw.Commit(tx, &Node{N: p.Base(), M: on.M}); err != nil {
+		return nil, err
+	}
+
+	return bw.Key(), nil
+}
+
+//Merge three-way merges the current layer with layer 'theirs' using their common ancestor layer 'base'. Changes that were made on only one side are combined into a new layer that becomes the current layer, paths that were changed on both sides are reported as conflicts and keep the version of the current layer. If nothing had to be merged the current layer is returned as is.
+func (fs *LayerFS) Merge(base, theirs K) (layerk K, conflicts []Conflict, err error) {
+	if err = fs.db.Update(func(tx *bolt.Tx) error {
+		roots := [3][]byte{}
+		for i, k := range []K{base, fs.layerk, theirs} {
+			l, err := fs.getLayer(tx, k)
+			if err != nil {
+				if err == os.ErrNotExist && k == ZeroKey {
+					continue //empty layer
+				}
+
+				return err
+			}
+
+			roots[i] = l.Root
+		}
+
+		rootk, err := fs.merge(tx, Root, roots[0], roots[1], roots[2], &conflicts)
+		if err != nil {
+			return err
+		}
+
+		if bytes.Equal(rootk, roots[1]) {
+			layerk = fs.layerk
+			return nil
+		}
+
+		layerk, err = fs.putLayer(tx, &Layer{Root: rootk, Parent: fs.layerk, T: fs.clock.Now()})
+		return err
+	}); err != nil {
+		return ZeroKey, nil, err
+	}
+
+	fs.layerk = layerk
+	return layerk, conflicts, nil
+}
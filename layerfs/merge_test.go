@@ -0,0 +1,101 @@
+package layerfs
+
+import (
+	"testing"
+
+	"github.com/boltdb/bolt"
+)
+
+func TestMergeClean(t *testing.T) {
+	fs, close := testfs(t)
+	defer close()
+
+	testcreate(fs, t, P{"dir", "a.txt"}, []byte("a"))
+	base := fs.layerk
+
+	//our side adds a file
+	testcreate(fs, t, P{"dir", "b.txt"}, []byte("bb"))
+
+	//their side adds another file on top of the same base
+	fs2, err := New(base, fs.db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testcreate(fs2, t, P{"dir", "c.txt"}, []byte("ccc"))
+
+	layerk, conflicts, err := fs.Merge(base, fs2.layerk)
+	if err != nil {
+		t.Fatalf("didn't expect error, got: %v", err)
+	}
+
+	if len(conflicts) != 0 {
+		t.Errorf("expected no conflicts, got: %+v", conflicts)
+	}
+
+	if layerk != fs.layerk {
+		t.Error("expected merged layer to become the current layer")
+	}
+
+	if err = fs.db.View(func(tx *bolt.Tx) error {
+		for p, size := range map[string]int64{"a.txt": 1, "b.txt": 2, "c.txt": 3} {
+			n, err := fs.getNode(tx, P{"dir", p})
+			if err != nil {
+				return err
+			}
+
+			if n.Size() != size {
+				t.Errorf("expected '%s' to have size %d, got: %d", p, size, n.Size())
+			}
+		}
+
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMergeConflict(t *testing.T) {
+	fs, close := testfs(t)
+	defer close()
+
+	testcreate(fs, t, P{"dir", "a.txt"}, []byte("a"))
+	base := fs.layerk
+
+	testcreate(fs, t, P{"dir", "a.txt"}, []byte("ours"))
+
+	fs2, err := New(base, fs.db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testcreate(fs2, t, P{"dir", "a.txt"}, []byte("their version"))
+
+	_, conflicts, err := fs.Merge(base, fs2.layerk)
+	if err != nil {
+		t.Fatalf("didn't expect error, got: %v", err)
+	}
+
+	if len(conflicts) != 1 {
+		t.Fatalf("expected one conflict, got: %+v", conflicts)
+	}
+
+	if !conflicts[0].Path.Equals(P{"dir", "a.txt"}) {
+		t.Errorf("expected conflict for edited file, got: %s", conflicts[0].Path)
+	}
+
+	if err = fs.db.View(func(tx *bolt.Tx) error {
+		n, err := fs.getNode(tx, P{"dir", "a.txt"})
+		if err != nil {
+			return err
+		}
+
+		if n.Size() != 4 {
+			t.Errorf("expected our version to be kept, got size: %d", n.Size())
+		}
+
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
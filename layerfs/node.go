@@ -9,12 +9,14 @@ import (
 	"time"
 
 	"github.com/boltdb/bolt"
+	"github.com/cellstate/treedb"
 )
 
 //BranchWriter acts as a handle for modifying a branch Node in our hierarchy. Upon initiating, the key of the node will be determined although an actual value for this key will only be written upon committing. Operations on the node can span different database transactions.
 type BranchWriter struct {
 	k         []byte
 	mChildren map[string][]byte
+	clock     treedb.Clock //tells the modification time that is set on commit
 }
 
 //NewBranchWriter allow writing a (new) branch node while merging children 'mChildren' and chunks 'mChunks' with the existing node at key 'nodeK'.
@@ -39,6 +41,7 @@ func NewBranchWriter(k []byte, tx *bolt.Tx, mChildren map[string][]byte) (*Branc
 	return &BranchWriter{
 		k:         k,
 		mChildren: mChildren,
+		clock:     treedb.WallClock,
 	}, nil
 }
 
@@ -46,15 +49,51 @@ func NewBranchWriter(k []byte, tx *bolt.Tx, mChildren map[string][]byte) (*Branc
 func (nw *BranchWriter) WriteChild(tx *bolt.Tx, name string, k []byte) error {
 	return tx.
 		Bucket(NodeBucketName).
-		Put(bytes.Join([][]byte{nw.k, []byte(name)}, []byte(PathSeparator)), k)
+		Put(childPtrKey(nw.k, name), k)
+}
+
+//CopyChildren copies the references to all children of the existing branch node at key 'k' into this branch, children that are merged into this branch take precedence and are not copied. References are copied one by one using a cursor such that large directories dont have to be loaded into memory. It must be called before committing the branch.
+func (nw *BranchWriter) CopyChildren(tx *bolt.Tx, k []byte) (err error) {
+	prefix := childPtrKey(k, "")
+	c := tx.Bucket(NodeBucketName).Cursor()
+	for kk, v := c.Seek(prefix); kk != nil && bytes.HasPrefix(kk, prefix); kk, v = c.Next() {
+		name := string(kk[len(prefix):])
+		if _, ok := nw.mChildren[name]; ok {
+			continue //merged child (or tombstone) takes precedence
+		}
+
+		//writing to the bucket invalidates the cursor, we reposition it afterwards
+		kk = append([]byte{}, kk...)
+		if err = nw.WriteChild(tx, name, append([]byte{}, v...)); err != nil {
+			return err
+		}
+
+		c.Seek(kk)
+	}
+
+	return nil
+}
+
+//Key returns the key at which the branch node will be stored upon committing
+func (nw *BranchWriter) Key() []byte {
+	return nw.k
 }
 
 //Commit the branch node with its, merged children while serialize file information and calculate the final checksum, the size field 'S' and modTime filed 'T' will be set by the commit.
 func (nw *BranchWriter) Commit(tx *bolt.Tx, n *Node) (err error) {
+	return nw.CommitWithTime(tx, n, nw.clock.Now())
+}
+
+//CommitWithTime commits the branch node like Commit does, but sets its modification time 'T' to 't' instead of the time of the commit, for example to keep the time of a directory that is committed from another file system
+func (nw *BranchWriter) CommitWithTime(tx *bolt.Tx, n *Node, t time.Time) (err error) {
 	b := tx.Bucket(NodeBucketName)
 
 	//start writing child keys, prefixed with this new keys such that seeks can easily traverse down the tree.
 	for name, childk := range nw.mChildren {
+		if len(childk) == 0 {
+			continue //tombstone
+		}
+
 		if err = nw.WriteChild(tx, name, childk); err != nil {
 			return err
 		}
@@ -65,31 +104,24 @@ func (nw *BranchWriter) Commit(tx *bolt.Tx, n *Node) (err error) {
 	// for offset, chunkk := range mChunks {}
 	//@TODO copy over old children, unless tombstones
 
-	//we now read back everything we wrote (all stuff prefixed with key 'k') to compute the node's checksum, boltdb makes sure everything is ordered consistently
-	c := b.Cursor()
-	h := sha256.New()
-	for kk, v := c.Seek(nw.k); kk != nil && bytes.HasPrefix(kk, nw.k); kk, v = c.Next() {
-
-		nwritten, err := h.Write(v)
-		if err != nil || nwritten != len(v) {
-			return fmt.Errorf("failed to hash new node's content: %v", err)
-		}
-
-		//a branch's size is sum of all keys
-		n.S = n.S + int64(nwritten)
-
-		fmt.Println(kk, v)
+	//the checksum and size only cover the children, such that committing identical children results in the same checksum
+	sum, size, err := contentChecksum(tx, nw.k)
+	if err != nil {
+		return err
 	}
 
-	//serialize the node with the latest modification time
-	n.T = time.Now()
+	n.S = size
+	logger.Printf("commit branch %x: %d bytes of children, checksum %x", nw.k, size, sum)
+
+	//serialize the node with its modification time
+	n.T = t
 	data, err := json.Marshal(n)
 	if err != nil {
 		return ErrSerialize
 	}
 
 	//write checksum and data to a buffer
-	buf := bytes.NewBuffer(h.Sum(data))
+	buf := bytes.NewBuffer(append([]byte{}, sum[:]...))
 	nwritten, err := buf.Write(data)
 	if err != nil || nwritten != len(data) {
 		return fmt.Errorf("failed to write serialized to buf: %v", err)
@@ -107,12 +139,54 @@ func (nw *BranchWriter) Commit(tx *bolt.Tx, n *Node) (err error) {
 // 00000001:0						: 2511E0F94...979AF0F    #chunk at file offset 0
 // 00000001:332111			: 2511E0F94...979AF0F  	 #chunk at offset 332111
 type Node struct {
-	N string      //base name
+	N string      //base name the node was written with, the name of the link in its parent takes precedence
 	T time.Time   //mod time
 	S int64       //size
 	M os.FileMode //portable mode bits
 }
 
+//contentChecksum hashes the child and chunk ptrs stored below the node at key 'k' in key order, each as the length-prefixed remainder of its key followed by its length-prefixed value. The node's own header is left out such that its size and modification time dont influence the checksum. The returned size is the number of value bytes, which is the size of a branch node
+func contentChecksum(tx *bolt.Tx, k []byte) (sum K, size int64, err error) {
+	h := sha256.New()
+	c := tx.Bucket(NodeBucketName).Cursor()
+	for kk, v := c.Seek(k); kk != nil && bytes.HasPrefix(kk, k); kk, v = c.Next() {
+		if len(kk) == len(k) {
+			continue //the node's own header
+		}
+
+		for _, field := range [][]byte{kk[len(k):], v} {
+			if _, err = h.Write(u64tob(uint64(len(field)))); err != nil {
+				return sum, 0, fmt.Errorf("failed to hash node's content: %v", err)
+			}
+
+			if _, err = h.Write(field); err != nil {
+				return sum, 0, fmt.Errorf("failed to hash node's content: %v", err)
+			}
+		}
+
+		size = size + int64(len(v))
+	}
+
+	copy(sum[:], h.Sum(nil))
+	return sum, size, nil
+}
+
+//decodeNode splits a stored node value 'v' into the checksum it is prefixed with and the node that follows
+func decodeNode(v []byte) (n *Node, checksum [sha256.Size]byte, err error) {
+	if len(v) < sha256.Size {
+		return nil, checksum, ErrDeserialize
+	}
+
+	copy(checksum[:], v)
+	n = &Node{}
+	err = json.Unmarshal(v[sha256.Size:], n)
+	if err != nil {
+		return nil, checksum, ErrDeserialize
+	}
+
+	return n, checksum, nil
+}
+
 //Name of the file
 func (n *Node) Name() string { return n.N }
 
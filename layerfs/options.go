@@ -0,0 +1,15 @@
+package layerfs
+
+import (
+	"github.com/cellstate/treedb"
+)
+
+//Option configures a LayerFS when it is created
+type Option func(fs *LayerFS)
+
+//WithClock sets the clock that tells the modification time of nodes and the creation time of layers, by default treedb.WallClock is used
+func WithClock(c treedb.Clock) Option {
+	return func(fs *LayerFS) {
+		fs.clock = c
+	}
+}
@@ -0,0 +1,291 @@
+package treedb
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/boltdb/bolt"
+)
+
+//NewMemStore returns a Store that keeps all buckets in memory, it is useful for tests and ephemeral filesystems. Write transactions work on copies of the buckets they change which replace the originals on commit, such that readers keep seeing the state from when they started
+func NewMemStore() Store {
+	return &memStore{buckets: map[string]*memBucket{}}
+}
+
+type memStore struct {
+	wmu     sync.Mutex   //held by the single write transaction
+	mu      sync.RWMutex //protects the buckets map
+	buckets map[string]*memBucket
+}
+
+//memBucket holds sorted keys next to their values, it is never changed once committed
+type memBucket struct {
+	keys []string
+	vals map[string][]byte
+	seq  uint64
+}
+
+func (b *memBucket) clone() *memBucket {
+	c := &memBucket{
+		keys: append([]string{}, b.keys...),
+		vals: make(map[string][]byte, len(b.vals)),
+		seq:  b.seq,
+	}
+
+	for k, v := range b.vals {
+		c.vals[k] = v
+	}
+
+	return c
+}
+
+func (s *memStore) Begin(writable bool) (Tx, error) {
+	if writable {
+		s.wmu.Lock()
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	tx := &memTx{s: s, writable: writable, buckets: make(map[string]*memBucket, len(s.buckets)), dirty: map[string]bool{}}
+	for name, b := range s.buckets {
+		tx.buckets[name] = b
+	}
+
+	return tx, nil
+}
+
+func (s *memStore) View(fn func(tx Tx) error) error {
+	tx, _ := s.Begin(false)
+	defer tx.Rollback()
+	return fn(tx)
+}
+
+func (s *memStore) Update(fn func(tx Tx) error) error {
+	tx, _ := s.Begin(true)
+	if err := fn(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+type memTx struct {
+	s        *memStore
+	writable bool
+	closed   bool
+	buckets  map[string]*memBucket
+	dirty    map[string]bool //buckets that were copied by this transaction
+}
+
+func (tx *memTx) Writable() bool { return tx.writable }
+
+func (tx *memTx) Bucket(name []byte) Bucket {
+	b, ok := tx.buckets[string(name)]
+	if !ok {
+		return nil
+	}
+
+	return &memTxBucket{tx: tx, name: string(name), b: b}
+}
+
+func (tx *memTx) CreateBucketIfNotExists(name []byte) (Bucket, error) {
+	if !tx.writable {
+		return nil, bolt.ErrTxNotWritable
+	}
+
+	if _, ok := tx.buckets[string(name)]; !ok {
+		tx.buckets[string(name)] = &memBucket{vals: map[string][]byte{}}
+		tx.dirty[string(name)] = true
+	}
+
+	return tx.Bucket(name), nil
+}
+
+func (tx *memTx) ForEachBucket(fn func(name []byte) error) error {
+	names := make([]string, 0, len(tx.buckets))
+	for name := range tx.buckets {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+	for _, name := range names {
+		if err := fn([]byte(name)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (tx *memTx) Commit() error {
+	if tx.closed {
+		return bolt.ErrTxClosed
+	}
+
+	if !tx.writable {
+		return bolt.ErrTxNotWritable
+	}
+
+	tx.s.mu.Lock()
+	tx.s.buckets = tx.buckets
+	tx.s.mu.Unlock()
+	return tx.Rollback()
+}
+
+func (tx *memTx) Rollback() error {
+	if tx.closed {
+		return bolt.ErrTxClosed
+	}
+
+	tx.closed = true
+	if tx.writable {
+		tx.s.wmu.Unlock()
+	}
+
+	return nil
+}
+
+//memTxBucket is a bucket as seen by a transaction, it is copied on the first write
+type memTxBucket struct {
+	tx   *memTx
+	name string
+	b    *memBucket
+}
+
+//writable returns the copy of the bucket that this transaction may change
+func (tb *memTxBucket) writable() (*memBucket, error) {
+	if tb.tx.closed {
+		return nil, bolt.ErrTxClosed
+	}
+
+	if !tb.tx.writable {
+		return nil, bolt.ErrTxNotWritable
+	}
+
+	if !tb.tx.dirty[tb.name] {
+		tb.tx.buckets[tb.name] = tb.tx.buckets[tb.name].clone()
+		tb.tx.dirty[tb.name] = true
+	}
+
+	tb.b = tb.tx.buckets[tb.name]
+	return tb.b, nil
+}
+
+//current returns the bucket including changes made through other handles in the same transaction
+func (tb *memTxBucket) current() *memBucket {
+	tb.b = tb.tx.buckets[tb.name]
+	return tb.b
+}
+
+func (tb *memTxBucket) Get(k []byte) []byte {
+	return tb.current().vals[string(k)]
+}
+
+func (tb *memTxBucket) Put(k []byte, v []byte) error {
+	b, err := tb.writable()
+	if err != nil {
+		return err
+	}
+
+	if len(k) == 0 {
+		return bolt.ErrKeyRequired
+	}
+
+	key := string(k)
+	if _, ok := b.vals[key]; !ok {
+		i := sort.SearchStrings(b.keys, key)
+		b.keys = append(b.keys, "")
+		copy(b.keys[i+1:], b.keys[i:])
+		b.keys[i] = key
+	}
+
+	b.vals[key] = append([]byte{}, v...)
+	return nil
+}
+
+func (tb *memTxBucket) Delete(k []byte) error {
+	b, err := tb.writable()
+	if err != nil {
+		return err
+	}
+
+	key := string(k)
+	if _, ok := b.vals[key]; !ok {
+		return nil
+	}
+
+	i := sort.SearchStrings(b.keys, key)
+	b.keys = append(b.keys[:i], b.keys[i+1:]...)
+	delete(b.vals, key)
+	return nil
+}
+
+func (tb *memTxBucket) ForEach(fn func(k, v []byte) error) error {
+	b := tb.current()
+	for _, k := range b.keys {
+		if err := fn([]byte(k), b.vals[k]); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (tb *memTxBucket) NextSequence() (uint64, error) {
+	b, err := tb.writable()
+	if err != nil {
+		return 0, err
+	}
+
+	b.seq++
+	return b.seq, nil
+}
+
+func (tb *memTxBucket) Cursor() Cursor {
+	return &memCursor{tb: tb}
+}
+
+//memCursor remembers the key it is at rather than an index, such that it keeps working when the bucket changes underneath it
+type memCursor struct {
+	tb  *memTxBucket
+	key string
+}
+
+//at positions the cursor at key index 'i' of the bucket
+func (c *memCursor) at(b *memBucket, i int) (k []byte, v []byte) {
+	if i < 0 || i >= len(b.keys) {
+		return nil, nil
+	}
+
+	c.key = b.keys[i]
+	return []byte(c.key), b.vals[c.key]
+}
+
+func (c *memCursor) First() (k []byte, v []byte) {
+	return c.at(c.tb.current(), 0)
+}
+
+func (c *memCursor) Last() (k []byte, v []byte) {
+	b := c.tb.current()
+	return c.at(b, len(b.keys)-1)
+}
+
+func (c *memCursor) Seek(seek []byte) (k []byte, v []byte) {
+	b := c.tb.current()
+	return c.at(b, sort.SearchStrings(b.keys, string(seek)))
+}
+
+func (c *memCursor) Next() (k []byte, v []byte) {
+	b := c.tb.current()
+	return c.at(b, sort.Search(len(b.keys), func(i int) bool { return b.keys[i] > c.key }))
+}
+
+func (c *memCursor) Prev() (k []byte, v []byte) {
+	b := c.tb.current()
+	return c.at(b, sort.SearchStrings(b.keys, c.key)-1)
+}
+
+func (c *memCursor) Delete() error {
+	return c.tb.Delete([]byte(c.key))
+}
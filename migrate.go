@@ -0,0 +1,138 @@
+package treedb
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+//CurrentVersion is the version of the on-disk format that this package reads and writes
+//
+// 1: file infos in the files bucket only, files have no content
+// 2: file infos carry inode numbers, content is stored in chunks
+const CurrentVersion = 2
+
+//MetaBucketName is the name of the bucket that records the format version of each file system in a database, under the name of its files bucket
+var MetaBucketName = []byte("meta")
+
+var (
+	//ErrNeedsMigration is returned when a file system uses an older format, it can be upgraded using Migrate or WithAutoMigrate
+	ErrNeedsMigration = errors.New("file system needs to be migrated")
+	//ErrUnsupportedVersion is returned when a file system uses a newer format than this package supports
+	ErrUnsupportedVersion = errors.New("unsupported file system version")
+)
+
+//migrations upgrade a file system from version i+1 to version i+2, each must be safe to apply more than once
+var migrations = []func(tx Tx, fbucket, pbucket []byte) error{
+	migrateInodes,
+}
+
+//migrateInodes assigns inode numbers to file infos that don't have one, and creates the buckets for content
+func migrateInodes(tx Tx, fbucket, pbucket []byte) (err error) {
+	for _, name := range [][]byte{pbucket, ChunkBucketName} {
+		if _, err = tx.CreateBucketIfNotExists(name); err != nil {
+			return err
+		}
+	}
+
+	b := tx.Bucket(fbucket)
+	ks, fis := [][]byte{}, []*fileInfo{}
+	if err = b.ForEach(func(k, v []byte) error {
+		fi := &fileInfo{}
+		if err := json.Unmarshal(v, fi); err != nil {
+			return fmt.Errorf("failed to deserialize: %v", err)
+		}
+
+		if fi.I == 0 {
+			ks, fis = append(ks, append([]byte{}, k...)), append(fis, fi)
+		}
+
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	for i, fi := range fis {
+		if fi.I, err = b.NextSequence(); err != nil {
+			return err
+		}
+
+		v, err := json.Marshal(fi)
+		if err != nil {
+			return fmt.Errorf("failed to serialize: %v", err)
+		}
+
+		if err = b.Put(ks[i], v); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+//version returns the format version of the file system with files bucket 'fbucket' and chunk pointer bucket 'pbucket'. File systems that existed before versions were recorded are of version 1 only when they have no bucket for content yet, new ones and those that do are of the current version
+func version(tx Tx, fbucket, pbucket []byte) uint64 {
+	if mb := tx.Bucket(MetaBucketName); mb != nil {
+		if v := mb.Get(fbucket); v != nil {
+			return btou64(v)
+		}
+	}
+
+	if tx.Bucket(fbucket) != nil && tx.Bucket(pbucket) == nil {
+		return 1
+	}
+
+	return CurrentVersion
+}
+
+//migrate upgrades the file system with files bucket 'fbucket' to the current version
+func migrate(tx Tx, fbucket, pbucket []byte) (err error) {
+	v := version(tx, fbucket, pbucket)
+	if v > CurrentVersion {
+		return ErrUnsupportedVersion
+	}
+
+	for ; v < CurrentVersion; v++ {
+		if err = migrations[v-1](tx, fbucket, pbucket); err != nil {
+			return fmt.Errorf("failed to migrate from version %d: %v", v, err)
+		}
+	}
+
+	return putVersion(tx, fbucket)
+}
+
+//putVersion records that the file system with files bucket 'fbucket' uses the current version
+func putVersion(tx Tx, fbucket []byte) error {
+	mb, err := tx.CreateBucketIfNotExists(MetaBucketName)
+	if err != nil {
+		return err
+	}
+
+	return mb.Put(fbucket, u64tob(CurrentVersion))
+}
+
+//Migrate upgrades all file systems in store 's' to the current version in a single transaction, file systems that are up-to-date are left as they are. It fails with ErrUnsupportedVersion if one of them uses a newer version, and with ErrReadOnly for a read-only store
+func Migrate(s Store) error {
+	return s.Update(func(tx Tx) error {
+		names := [][]byte{}
+		if err := tx.ForEachBucket(func(name []byte) error {
+			if bytes.HasPrefix(name, []byte(bucketPrefixes[0])) {
+				names = append(names, append([]byte{}, name...))
+			}
+
+			return nil
+		}); err != nil {
+			return err
+		}
+
+		for _, fbucket := range names {
+			pbucket := append([]byte(bucketPrefixes[1]), fbucket[len(bucketPrefixes[0]):]...)
+			if err := migrate(tx, fbucket, pbucket); err != nil {
+				return fmt.Errorf("%s: %w", fbucket, err)
+			}
+		}
+
+		return nil
+	})
+}
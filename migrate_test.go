@@ -0,0 +1,207 @@
+package treedb
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+//testv1 writes a file system in the version 1 format: file infos without inodes in the files bucket only
+func testv1(t *testing.T, s Store, id string) {
+	if err := s.Update(func(tx Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte("f_" + id))
+		if err != nil {
+			return err
+		}
+
+		for p, fi := range map[string]map[string]interface{}{
+			string(Root.Key()):              {"N": RootBasename, "M": os.ModeDir | 0777, "T": time.Now()},
+			string(P{"dir"}.Key()):          {"N": "dir", "M": os.ModeDir | 0755, "T": time.Now()},
+			string(P{"dir", "a.txt"}.Key()): {"N": "a.txt", "M": 0644, "T": time.Now()},
+		} {
+			v, err := json.Marshal(fi)
+			if err != nil {
+				return err
+			}
+
+			if err = b.Put([]byte(p), v); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMigrate(t *testing.T) {
+	db, close := testdb(t)
+	defer close()
+
+	testv1(t, NewBoltStore(db), "old")
+	_, err := NewFileSystem("old", db)
+	if !errors.Is(err, ErrNeedsMigration) {
+		t.Fatalf("expected ErrNeedsMigration, got: %v", err)
+	}
+
+	for i := 0; i < 2; i++ {
+		if err = Migrate(NewBoltStore(db)); err != nil {
+			t.Fatalf("expected migrating to succeed (%d), got: %v", i, err)
+		}
+	}
+
+	fs, err := NewFileSystem("old", db)
+	if err != nil {
+		t.Fatalf("expected migrated file system to open, got: %v", err)
+	}
+
+	fi, err := fs.Stat(P{"dir"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if fi.Mode() != os.ModeDir|0755 {
+		t.Errorf("expected mode to survive migration, got: %v", fi.Mode())
+	}
+
+	//files can be written now that they have an inode
+	testwrite(fs, t, P{"dir", "a.txt"}, []byte("hello"))
+	testwrite(fs, t, P{"dir", "b.txt"}, []byte("world"))
+	if data := testread(fs, t, P{"dir", "a.txt"}); string(data) != "hello" {
+		t.Errorf("expected written content, got: %q", data)
+	}
+
+	if problems, err := fs.Check(); err != nil || len(problems) != 0 {
+		t.Errorf("expected a consistent file system, got: %v, %v", problems, err)
+	}
+}
+
+func TestAutoMigrate(t *testing.T) {
+	db, close := testdb(t)
+	defer close()
+
+	testv1(t, NewBoltStore(db), "old")
+	fs, err := NewFileSystem("old", db, WithAutoMigrate())
+	if err != nil {
+		t.Fatalf("expected file system to be migrated, got: %v", err)
+	}
+
+	testwrite(fs, t, P{"dir", "a.txt"}, []byte("hello"))
+	if data := testread(fs, t, P{"dir", "a.txt"}); string(data) != "hello" {
+		t.Errorf("expected written content, got: %q", data)
+	}
+
+	//newer versions are refused
+	if err = db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(MetaBucketName).Put([]byte("f_old"), u64tob(CurrentVersion+1))
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = NewFileSystem("old", db, WithAutoMigrate())
+	if !errors.Is(err, ErrUnsupportedVersion) {
+		t.Errorf("expected ErrUnsupportedVersion, got: %v", err)
+	}
+
+	if err = Migrate(NewBoltStore(db)); !errors.Is(err, ErrUnsupportedVersion) {
+		t.Errorf("expected ErrUnsupportedVersion from Migrate, got: %v", err)
+	}
+}
+
+func TestMigrateStore(t *testing.T) {
+	s := NewMemStore()
+	testv1(t, s, "old")
+	if _, err := NewFileSystemWithStore("old", s); !errors.Is(err, ErrNeedsMigration) {
+		t.Fatalf("expected ErrNeedsMigration, got: %v", err)
+	}
+
+	if err := Migrate(readOnlyStore{s}); err != ErrReadOnly {
+		t.Errorf("expected migrating a read-only store to fail with ErrReadOnly, got: %v", err)
+	}
+
+	if err := Migrate(s); err != nil {
+		t.Fatalf("expected migrating to succeed, got: %v", err)
+	}
+
+	fs, err := NewFileSystemWithStore("old", s)
+	if err != nil {
+		t.Fatalf("expected migrated file system to open, got: %v", err)
+	}
+
+	if _, err = fs.Stat(P{"dir", "a.txt"}); err != nil {
+		t.Errorf("expected migrated file system to hold the file, got: %v", err)
+	}
+}
+
+func TestMigrateUnversioned(t *testing.T) {
+	db, close := testdb(t)
+	defer close()
+
+	fs, err := NewFileSystem(t.Name(), db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testwrite(fs, t, P{"a.txt"}, []byte("hello"))
+
+	//databases of the current format from before versions were recorded have no meta bucket
+	if err = db.Update(func(tx *bolt.Tx) error { return tx.DeleteBucket(MetaBucketName) }); err != nil {
+		t.Fatal(err)
+	}
+
+	if fs, err = NewFileSystem(t.Name(), db); err != nil {
+		t.Fatalf("expected a file system without a recorded version to open, got: %v", err)
+	}
+
+	if data := testread(fs, t, P{"a.txt"}); string(data) != "hello" {
+		t.Errorf("expected content to survive, got: %q", data)
+	}
+}
+
+func TestFileInfoJSON(t *testing.T) {
+	now := time.Now().Round(0)
+	v1 := []byte(`{"N":"a.txt","M":420,"T":"` + now.Format(time.RFC3339Nano) + `","S":0}`)
+	v2, err := json.Marshal(&fileInfo{N: "a.txt", M: 0644, T: now, S: 5, I: 7, U: 1000, D: []byte("hello")})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//the exported form stays in sync with how file info is stored
+	exported, err := json.Marshal(FileInfoJSON{Name: "a.txt", Mode: 0644, ModTime: now, Size: 5, Ino: 7, UID: 1000, Data: []byte("hello")})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(exported) != string(v2) {
+		t.Errorf("expected exported form %s to equal stored form %s", exported, v2)
+	}
+
+	for i, c := range []struct {
+		v   []byte
+		ino uint64
+		d   string
+	}{{v1, 0, ""}, {v2, 7, "hello"}} {
+		fi := &fileInfo{}
+		if err = json.Unmarshal(c.v, fi); err != nil {
+			t.Fatalf("case %d: %v", i, err)
+		}
+
+		var info FileInfoJSON
+		if err = json.Unmarshal(c.v, &info); err != nil {
+			t.Fatalf("case %d: %v", i, err)
+		}
+
+		if fi.N != "a.txt" || fi.M != 0644 || !fi.T.Equal(now) || fi.I != c.ino || string(fi.D) != c.d {
+			t.Errorf("case %d: unexpected file info: %+v", i, fi)
+		}
+
+		if info.Name != fi.N || info.Mode != fi.M || !info.ModTime.Equal(fi.T) || info.Size != fi.S || info.Ino != fi.I || info.UID != fi.U || string(info.Data) != string(fi.D) {
+			t.Errorf("case %d: expected %+v to match %+v", i, info, fi)
+		}
+	}
+}
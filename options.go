@@ -0,0 +1,170 @@
+package treedb
+
+import (
+	"os"
+	"time"
+)
+
+//Option configures a FileSystem when it is created
+type Option func(fs *FileSystem)
+
+//RemovePolicy determines what happens when a file is removed while there are still handles open for it
+type RemovePolicy int
+
+const (
+	//RemoveWhileOpen allows files to be removed while they are open, like on Unix systems. Open handles might still perform IO
+	RemoveWhileOpen RemovePolicy = iota
+
+	//RemoveUnlessBusy refuses to remove files that are still opened for writing with ErrFileBusy, mimicking the sharing semantics of Windows
+	RemoveUnlessBusy
+)
+
+//WithRemovePolicy configures how Remove deals with files that are still open, by default files are removed while open
+func WithRemovePolicy(pol RemovePolicy) Option {
+	return func(fs *FileSystem) {
+		fs.rmpol = pol
+	}
+}
+
+//WithRootMode sets the permission bits of the root directory when the file system is created for the first time, by default it is 0777
+func WithRootMode(mode os.FileMode) Option {
+	return func(fs *FileSystem) {
+		fs.rootfi.M = os.ModeDir | mode.Perm()
+	}
+}
+
+//WithRootOwner sets the user and group that own the root directory when the file system is created for the first time
+func WithRootOwner(uid, gid uint32) Option {
+	return func(fs *FileSystem) {
+		fs.rootfi.U = uid
+		fs.rootfi.G = gid
+	}
+}
+
+//WithInlineThreshold stores the content of files up to 'n' bytes in their file info instead of in chunks, which saves the overhead of chunk ptrs and chunks for tiny files. Files move to chunks once they grow past the threshold. By default no files are stored inline
+func WithInlineThreshold(n int64) Option {
+	return func(fs *FileSystem) {
+		fs.inline = n
+	}
+}
+
+//WithChunkConfig changes how newly written content is split into chunks, existing content keeps its chunk boundaries until it is rewritten or rechunked
+func WithChunkConfig(cfg ChunkConfig) Option {
+	return func(fs *FileSystem) {
+		fs.chunking = cfg
+	}
+}
+
+//WithMaxDepth sets the maximum number of components in a path, deeper entries cannot be created such that recursive operations stay bounded. The default is DefaultMaxDepth
+func WithMaxDepth(n int) Option {
+	return func(fs *FileSystem) {
+		fs.maxDepth = n
+	}
+}
+
+//WithChunkVerification determines whether the content of chunks is hashed and compared to their key whenever they are read, such that corruption on disk surfaces as ErrChunkCorrupt instead of garbage. It is enabled by default, disabling it saves the cost of hashing on reads
+func WithChunkVerification(verify bool) Option {
+	return func(fs *FileSystem) {
+		fs.verify = verify
+	}
+}
+
+//WithChunkReplicas stores 'n' copies of every newly written chunk, each in a bucket of its own. When the primary copy of a chunk is missing or fails verification, reads fall back to an intact replica and repair the primary. By default chunks are stored once
+func WithChunkReplicas(n int) Option {
+	return func(fs *FileSystem) {
+		fs.replicas = nil
+		for i := 1; i < n; i++ {
+			fs.replicas = append(fs.replicas, replicaBucketName(fs.cbucket, i))
+		}
+	}
+}
+
+//WithChunkBucket stores chunks in the bucket named 'name' instead of ChunkBucketName, for layouts where groups of file systems in a database should not share their chunks. Only file systems that use the same chunk bucket deduplicate their content against each other, and a file system must always be opened with the bucket its chunks were written to. Replica buckets are named after it. Names that start with the prefix of a file system's bucket can't be used
+func WithChunkBucket(name []byte) Option {
+	return func(fs *FileSystem) {
+		fs.cbucket = append([]byte{}, name...)
+		for i := range fs.replicas {
+			fs.replicas[i] = replicaBucketName(fs.cbucket, i+1)
+		}
+	}
+}
+
+//WithChunkMirror writes every new chunk larger than 'minSize' bytes to backend 'mirror' as well, for example a NewDirChunkBackend on another disk. The mirror is written inside the transaction that stores the chunk, so it can't be a NewBoltChunkBackend on the database of the file system. When a chunk is missing from the database or fails verification, and its replicas can't help either, it is read from the mirror and repaired
+func WithChunkMirror(mirror ChunkBackend, minSize int) Option {
+	return func(fs *FileSystem) {
+		fs.mirror = mirror
+		fs.mirrorMin = minSize
+	}
+}
+
+//WithReadTimeout aborts the read transactions of file handles that are open for longer than 'd', such that a consumer that streams a file into a writer that stalls can't keep the transaction open and block the database from growing. A watchdog rolls the transaction back once the deadline passes while the reader waits for its consumer, and the deadline is checked before each chunk is read, after which the read fails with ErrReadTimeout. Content that is streamed to a consumer is copied out of the transaction first. By default reads never time out
+func WithReadTimeout(d time.Duration) Option {
+	return func(fs *FileSystem) {
+		fs.rtimeout = d
+	}
+}
+
+//WithReaddirSnapshot makes paged Readdir calls (with n > 0) on a handle list the directory as it was at the first call, similar to a POSIX telldir position. By default each page continues after the name the previous page ended with, so entries that are added or removed in between may or may not be listed. A snapshot holds the paths of all children in the handle until the last page was read, which takes memory in the order of the directory's size for huge directories
+func WithReaddirSnapshot() Option {
+	return func(fs *FileSystem) {
+		fs.rdsnap = true
+	}
+}
+
+//WithCaseInsensitiveNames keeps the names in a directory unique when case is ignored, as is needed to export the file system to one that is case-insensitive. Names keep the case they were created with and lookups still match them exactly, but a file or directory that is created with a name that only differs in case from that of a sibling is handled according to 'policy'. Checking for collisions lists the parent directory, which makes creating entries in large directories slower
+func WithCaseInsensitiveNames(policy CollisionPolicy) Option {
+	return func(fs *FileSystem) {
+		fs.nocase = true
+		fs.collide = policy
+	}
+}
+
+//WithClock sets the clock that tells the modification time of files that are created or written, by default WallClock is used. Read timeouts always use the wall clock
+func WithClock(c Clock) Option {
+	return func(fs *FileSystem) {
+		fs.clock = c
+	}
+}
+
+//WithMaxReaddirAll limits the number of entries that are read from a directory at once to 'n', such that listing a huge directory can't exhaust memory. Reading all entries with Readdir, Readdirnames or ReaddirTypes (with n <= 0) or with ReadDirSorted fails with ErrDirectoryTooLarge when the directory holds more, paged reads and EachEntry are not limited. By default there is no limit
+func WithMaxReaddirAll(n int) Option {
+	return func(fs *FileSystem) {
+		fs.rdmax = n
+	}
+}
+
+//WithReadahead makes file handles that are read sequentially keep the content of the next 'n' chunks in memory, such that reads with buffers smaller than a chunk don't fetch each chunk from the store again. Each open handle then holds up to 'n' chunks, ReadAt never reads ahead. By default reading ahead is disabled
+func WithReadahead(n int) Option {
+	return func(fs *FileSystem) {
+		fs.readahead = n
+	}
+}
+
+//WithBatchWrites coalesces the writes of concurrent callers that arrive within 'window' of each other into a single transaction, such that they share one commit and its fsync instead of each paying for their own. This trades latency for throughput: a write returns once the transaction of its batch committed, which is at most 'window' later than it would otherwise. Durability is unchanged for writes that returned, a crash loses at most the writes of the window that is still being collected, none of which returned yet. Writes of a single goroutine don't benefit since each waits for its own batch. IMPORTANT: the window is bolt's MaxBatchDelay, which is a setting of the shared *bolt.DB and applies to every user of it, also to other file systems on it that were opened without batching. It is changed without synchronization, so file systems with this option must be opened before the database is used concurrently. Opening fails when the database already batches with another window than bolt's default, such that two users never overwrite each other's window. It requires a bolt database, file systems on other stores fail to open
+func WithBatchWrites(window time.Duration) Option {
+	return func(fs *FileSystem) {
+		fs.batch = window
+	}
+}
+
+//WithAutoMigrate upgrades a file system that uses an older on-disk format when it is opened, without it opening such a file system fails with ErrNeedsMigration
+func WithAutoMigrate() Option {
+	return func(fs *FileSystem) {
+		fs.migrate = true
+	}
+}
+
+//WithPathLimits sets the maximum number of bytes in a path component and in the database key of a complete path, paths that exceed them cannot be created. The defaults are DefaultMaxNameLen and DefaultMaxPathLen
+func WithPathLimits(maxName, maxPath int) Option {
+	return func(fs *FileSystem) {
+		fs.maxName = maxName
+		fs.maxPath = maxPath
+	}
+}
+
+//WithInodeTracking remembers the path of every inode that is handed out through Stat, Open or Readdir and keeps it up-to-date across renames, such that PathOf and ParentIno can resolve them. It is meant for bindings that address files by inode, such as FUSE. The paths are kept for as long as the file system is open and their files exist
+func WithInodeTracking() Option {
+	return func(fs *FileSystem) {
+		fs.inodes.enabled = true
+	}
+}
@@ -2,12 +2,15 @@ package treedb
 
 import (
 	"errors"
+	"fmt"
 	"os"
+	"path"
 	"strings"
+	"unicode/utf8"
 )
 
 const (
-	//PathSeparator is used to join path into database keys. Bolt stores values in a bucket in byte-order, choosing a unicode code point all the way at the end allows us to make assumptions when we use a cursor to iterate over directory entries
+	//PathSeparator is used to join path into database keys. Bolt stores values in a bucket in byte-order, choosing a unicode code point all the way at the end allows us to make assumptions when we use a cursor to iterate over directory entries: siblings that share a directory's name as a prefix sort before the keys of its entries unless they continue with a code point outside of the BMP, and the entries can be skipped by seeking to the separator with its last byte incremented. Both are asserted by checkSeparator when the package is initialized
 	PathSeparator = "\uFFFF"
 
 	//PathPrintSeparator is used instead of the character above to print a path
@@ -20,8 +23,51 @@ const (
 var (
 	// ErrInvalidPath is returned when no valid filename can be created from path components
 	ErrInvalidPath = errors.New("invalid path components")
+
+	// ErrNameTooLong is returned when a path component is longer than allowed
+	ErrNameTooLong = errors.New("file name too long")
+
+	// ErrPathTooLong is returned when the database key of a path is longer than allowed
+	ErrPathTooLong = errors.New("path too long")
+)
+
+const (
+	//DefaultMaxNameLen is the default maximum number of bytes in a path component
+	DefaultMaxNameLen = 255
+
+	//DefaultMaxPathLen is the default maximum number of bytes in the database key of a path
+	DefaultMaxPathLen = 4096
+
+	//DefaultMaxDepth is the default maximum number of components in a path
+	DefaultMaxDepth = 256
 )
 
+func init() {
+	if err := checkSeparator(PathSeparator); err != nil {
+		panic(err)
+	}
+}
+
+//checkSeparator returns an error if 'sep' can't be used to separate the components of database keys. It must be a single code point that is the largest of all code points with an encoding of the same length, and whose encoding ends in a byte that can be incremented. Names with code points of a longer encoding sort after the separator, walkdir skips the entries of a directory by seeking such that they are listed in order nonetheless
+func checkSeparator(sep string) error {
+	r, n := utf8.DecodeRuneInString(sep)
+	if r == utf8.RuneError || n != len(sep) {
+		return fmt.Errorf("path separator %q is not a single code point", sep)
+	}
+
+	for _, larger := range []rune{0x7F, 0x7FF, 0xFFFF, utf8.MaxRune} {
+		if utf8.RuneLen(larger) == n && r != larger {
+			return fmt.Errorf("path separator %q is not the largest code point of its length, %q sorts after it", sep, larger)
+		}
+	}
+
+	if sep[len(sep)-1] == 0xFF {
+		return fmt.Errorf("path separator %q can't be skipped by incrementing its last byte", sep)
+	}
+
+	return nil
+}
+
 //P describes a platform agnostic path on the file system and is stored as
 //a slice of path components
 type P []string
@@ -31,9 +77,26 @@ var (
 	Root = P{}
 )
 
-//PathFromKey turns a database key into its Path representation
+//PathFromKey turns a database key into its Path representation, the root key yields Root and empty components are dropped
 func PathFromKey(k []byte) P {
-	return strings.Split(strings.TrimPrefix(string(k), PathSeparator), PathSeparator)
+	p := Root
+	for _, c := range strings.Split(string(k), PathSeparator) {
+		if c != "" {
+			p = append(p, c)
+		}
+	}
+
+	return p
+}
+
+//ParsePath turns a human friendly path with forward slashes into its Path representation, the path is cleaned first such that empty components and dot elements are removed
+func ParsePath(s string) P {
+	s = strings.TrimPrefix(path.Clean(PathPrintSeparator+s), PathPrintSeparator)
+	if s == "" {
+		return Root
+	}
+
+	return strings.Split(s, PathPrintSeparator)
 }
 
 //Validate is used to check if a given Path is valid, it
@@ -48,6 +111,16 @@ func (p P) Validate() error {
 	return nil
 }
 
+//IsRoot returns whether the path refers to the root, which has zero components
+func (p P) IsRoot() bool {
+	return len(p) == 0
+}
+
+//Depth returns the number of components in the path, the root has depth 0
+func (p P) Depth() int {
+	return len(p)
+}
+
 //Parent returns a path that refers to a parent, if the current
 //path is the root the root is still returned
 func (p P) Parent() P {
@@ -60,23 +133,76 @@ func (p P) Parent() P {
 
 //Base returns the base component of a path
 func (p P) Base() string {
-	if len(p) < 1 {
+	if p.IsRoot() {
 		return PathSeparator
 	}
 
 	return p[len(p)-1]
 }
 
+//Equals compare paths based on their joined components
+func (p P) Equals(d P) bool {
+	return (strings.Join(p, PathSeparator) == strings.Join(d, PathSeparator))
+}
+
 //Key returns a byte slice used for database retrieval and storage
 func (p P) Key() []byte {
 	return []byte(PathSeparator + strings.Join(p, PathSeparator))
 }
 
+//ValidateLen checks that no component of the path is longer than 'maxName' bytes and that its database key is not longer than 'maxPath' bytes, it returns ErrNameTooLong or ErrPathTooLong otherwise
+func (p P) ValidateLen(maxName, maxPath int) error {
+	n := 0
+	for _, c := range p {
+		if len(c) > maxName {
+			return ErrNameTooLong
+		}
+
+		n += len(PathSeparator) + len(c)
+	}
+
+	if n > maxPath {
+		return ErrPathTooLong
+	}
+
+	return nil
+}
+
 //String implements stringer for the Path type that returns something more human friendly that shows familiar forward slashes
 func (p P) String() string {
 	return PathPrintSeparator + strings.Join(p, PathPrintSeparator)
 }
 
+//MarshalText implements encoding.TextMarshaler such that paths appear as "/a/b/c" in JSON and other text formats. Paths that wouldn't parse back into the same components, such as those with a component that contains a forward slash, return ErrInvalidPath
+func (p P) MarshalText() (text []byte, err error) {
+	if err = p.Validate(); err != nil {
+		return nil, err
+	}
+
+	s := p.String()
+	if !ParsePath(s).Equals(p) {
+		return nil, ErrInvalidPath
+	}
+
+	return []byte(s), nil
+}
+
+//UnmarshalText implements encoding.TextUnmarshaler, 'text' is parsed like ParsePath does
+func (p *P) UnmarshalText(text []byte) error {
+	np := ParsePath(string(text))
+	if err := np.Validate(); err != nil {
+		return err
+	}
+
+	*p = np
+	return nil
+}
+
+//Set implements flag.Value such that a path can be passed on the command line, 's' is parsed like ParsePath does
+func (p *P) Set(s string) error {
+	return p.UnmarshalText([]byte(s))
+}
+
 //Err allows easy creation of PathErrors
 func (p P) Err(op string, err error) *os.PathError {
 	return &os.PathError{Op: op, Err: err, Path: p.String()}
@@ -2,9 +2,14 @@ package treedb
 
 import (
 	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
 	"os"
+	"reflect"
 	"testing"
+	"unicode/utf8"
 )
 
 func TestInvalidPathErr(t *testing.T) {
@@ -92,4 +97,104 @@ func TestFromKey(t *testing.T) {
 	if len(p) != 2 {
 		t.Errorf("expected key to be correctly parsed, got: %+v", p)
 	}
+
+	p = PathFromKey(Root.Key())
+	if !p.IsRoot() {
+		t.Errorf("expected root key to parse as root, got: %#v", p)
+	}
+
+	if !bytes.Equal(p.Key(), Root.Key()) || !PathFromKey(p.Key()).IsRoot() {
+		t.Errorf("expected root to round-trip, got key: %q", p.Key())
+	}
+
+	if (P{""}).IsRoot() || !Root.Parent().IsRoot() || !(P{"foo"}).Parent().IsRoot() {
+		t.Error("expected only paths without components to be root")
+	}
+}
+
+func TestPathKeyRoundTrip(t *testing.T) {
+	for _, p := range []P{Root, {"a"}, {"a", "b"}} {
+		rp := PathFromKey(p.Key())
+		if !reflect.DeepEqual(rp, p) {
+			t.Errorf("expected %#v to round-trip, got: %#v", p, rp)
+		}
+	}
+
+	//empty components, e.g. from a trailing separator, are dropped
+	rp := PathFromKey([]byte("\uFFFFa\uFFFF"))
+	if !reflect.DeepEqual(rp, P{"a"}) {
+		t.Errorf("expected empty components to be dropped, got: %#v", rp)
+	}
+}
+
+func TestParsePath(t *testing.T) {
+	for s, expected := range map[string]P{
+		"/":         Root,
+		".":         Root,
+		"a/b.txt":   {"a", "b.txt"},
+		"/a//b/":    {"a", "b"},
+		"/a/../b/.": {"b"},
+	} {
+		p := ParsePath(s)
+		if !reflect.DeepEqual(p, expected) {
+			t.Errorf("expected '%s' to parse as %#v, got: %#v", s, expected, p)
+		}
+	}
+}
+
+func TestPathText(t *testing.T) {
+	type config struct {
+		Dir   P
+		Files []P
+	}
+
+	in := config{Dir: P{"a", "b"}, Files: []P{Root, {"c.txt"}}}
+	data, err := json.Marshal(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(data) != `{"Dir":"/a/b","Files":["/","/c.txt"]}` {
+		t.Errorf("expected paths as text, got: %s", data)
+	}
+
+	var out config
+	if err = json.Unmarshal(data, &out); err != nil {
+		t.Fatal(err)
+	}
+
+	if !out.Dir.Equals(in.Dir) || len(out.Files) != 2 || !out.Files[0].IsRoot() || !out.Files[1].Equals(in.Files[1]) {
+		t.Errorf("expected %v after round trip, got: %v", in, out)
+	}
+
+	for _, p := range []P{{"a/b"}, {"."}, {"a\uFFFFb"}} {
+		if _, err = json.Marshal(p); !errors.Is(err, ErrInvalidPath) {
+			t.Errorf("expected %q not to marshal, got: %v", []string(p), err)
+		}
+	}
+
+	var p P
+	flags := flag.NewFlagSet(t.Name(), flag.ContinueOnError)
+	flags.Var(&p, "dir", "directory to use")
+	if err = flags.Parse([]string{"-dir", "/x/y/../z"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if !p.Equals(P{"x", "z"}) {
+		t.Errorf("expected flag to parse as /x/z, got: %v", p)
+	}
+}
+
+func TestCheckSeparator(t *testing.T) {
+	for _, sep := range []string{PathSeparator, string(utf8.MaxRune)} {
+		if err := checkSeparator(sep); err != nil {
+			t.Errorf("expected separator %q to be valid, got: %v", sep, err)
+		}
+	}
+
+	for _, sep := range []string{"", "/", "\uFFFE", "\uFFFF\uFFFF", "\xFF"} {
+		if err := checkSeparator(sep); err == nil {
+			t.Errorf("expected separator %q to be refused", sep)
+		}
+	}
 }
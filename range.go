@@ -0,0 +1,58 @@
+package treedb
+
+import (
+	"io"
+	"os"
+)
+
+//ReadRange reads 'length' bytes of the file at 'p' from offset 'off' onwards without opening a handle, for example to serve HTTP range requests. Only the chunks that cover the range are read, they are found by seeking the chunk ptrs of the file to 'off'. A range that reaches past the end of the file is clamped to its size and returned together with io.EOF, a range that starts at or after the end returns no bytes and io.EOF. Symbolic links are followed, bytes that open handles still buffer are not seen. Other errors will be of type *PathError
+func (fs *FileSystem) ReadRange(p P, off, length int64) (data []byte, err error) {
+	if err = p.Validate(); err != nil {
+		return nil, p.Err("readrange", err)
+	}
+
+	if off < 0 || length < 0 {
+		return nil, p.Err("readrange", os.ErrInvalid)
+	}
+
+	if err = fs.db.View(func(tx Tx) error {
+		rp, err := fs.followLinks(tx, p)
+		if err != nil {
+			return err
+		}
+
+		fi, err := fs.getfi(tx, rp)
+		if err != nil {
+			return err
+		}
+
+		if fs.expired(fi) {
+			return os.ErrNotExist
+		}
+
+		if fi.IsDir() {
+			return ErrIsDirectory
+		}
+
+		if off >= fi.S {
+			return io.EOF
+		}
+
+		if length > fi.S-off {
+			length, err = fi.S-off, io.EOF //clamped, but the bytes that are left are read
+		}
+
+		data = make([]byte, length)
+		if _, rerr := fs.readChunks(tx, fi, off, data); rerr != nil {
+			return rerr
+		}
+
+		return err
+	}); err == io.EOF {
+		return data, io.EOF
+	} else if err != nil {
+		return nil, p.Err("readrange", err)
+	}
+
+	return data, nil
+}
@@ -0,0 +1,78 @@
+package treedb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"testing"
+)
+
+func TestReadRange(t *testing.T) {
+	db, close := testdb(t)
+	defer close()
+
+	fs, err := NewFileSystem(t.Name(), db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//every four bytes hold their own offset, such that any range tells where it was read from
+	data := make([]byte, 4*miB)
+	for i := 0; i < len(data); i += 4 {
+		binary.BigEndian.PutUint32(data[i:], uint32(i))
+	}
+
+	testwrite(fs, t, P{"a.bin"}, data)
+	refs, err := fs.FileChunks(P{"a.bin"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(refs) < 3 {
+		t.Fatalf("expected the file to span at least 3 chunks, got: %d", len(refs))
+	}
+
+	//an interior range that crosses the boundaries of the second and third chunk
+	off, end := refs[1].Offset-10, refs[2].Offset+10
+	output, err := fs.ReadRange(P{"a.bin"}, off, end-off)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(output, data[off:end]) {
+		t.Errorf("expected the bytes of range [%d, %d), got %d other bytes", off, end, len(output))
+	}
+
+	//ranges past the end are clamped
+	output, err = fs.ReadRange(P{"a.bin"}, int64(len(data))-5, 100)
+	if err != io.EOF || !bytes.Equal(output, data[len(data)-5:]) {
+		t.Errorf("expected the last 5 bytes with io.EOF, got: %d bytes, %v", len(output), err)
+	}
+
+	if output, err = fs.ReadRange(P{"a.bin"}, int64(len(data)), 10); err != io.EOF || len(output) != 0 {
+		t.Errorf("expected no bytes and io.EOF at the end, got: %d bytes, %v", len(output), err)
+	}
+
+	//symbolic links are followed
+	if err = fs.Symlink("a.bin", P{"link"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if output, err = fs.ReadRange(P{"link"}, 4, 4); err != nil || !bytes.Equal(output, data[4:8]) {
+		t.Errorf("expected to read through the link, got: %v, %v", output, err)
+	}
+
+	if _, err = fs.ReadRange(P{"a.bin"}, -1, 10); !errors.Is(err, os.ErrInvalid) {
+		t.Errorf("expected a negative offset to be refused, got: %v", err)
+	}
+
+	if _, err = fs.ReadRange(Root, 0, 10); !errors.Is(err, ErrIsDirectory) {
+		t.Errorf("expected reading a directory to fail, got: %v", err)
+	}
+
+	if _, err = fs.ReadRange(P{"nonexisting"}, 0, 10); !os.IsNotExist(err) {
+		t.Errorf("expected reading a nonexisting file to fail, got: %v", err)
+	}
+}
@@ -0,0 +1,86 @@
+package treedb
+
+import (
+	"io"
+	"os"
+)
+
+//readahead is the state of a handle that prefetches chunks while it is read sequentially
+type readahead struct {
+	next   int64        //file offset right after the previous read, a read that starts elsewhere isn't sequential
+	chunks map[K][]byte //content of the chunks at and after the read position, by key such that they never go stale
+}
+
+//readAhead reads bytes of file 'fi' at the handle's position into 'b' like readChunks does. When the handle continues where the previous read ended the content of the chunks that hold the next bytes is kept in memory, up to as many chunks as the file system is configured to read ahead, such that reads that are smaller than a chunk don't fetch it again. A read at another position drops the chunks that were read ahead
+func (f *File) readAhead(tx Tx, fi *fileInfo, b []byte) (n int, err error) {
+	if f.pos != f.ra.next || fi.D != nil {
+		f.ra.chunks = nil
+	}
+
+	if fi.D == nil && f.pos < fi.S {
+		window := make(map[K][]byte, f.fs.readahead)
+		if err = f.fs.getChunkPtrs(tx, fi, f.pos, func(ptr chunkPtr) error {
+			if len(window) >= f.fs.readahead || ptr.off >= fi.S {
+				return errStopWalk
+			}
+
+			data, ok := f.ra.chunks[ptr.k]
+			if !ok {
+				v, err := f.fs.getChunk(tx, ptr)
+				if err != nil {
+					return err
+				}
+
+				data = append([]byte{}, v...) //chunks read from the store are only valid during the transaction
+			}
+
+			window[ptr.k] = data
+			return nil
+		}); err != nil {
+			return 0, err
+		}
+
+		f.ra.chunks = window
+	}
+
+	n, err = f.fs.readChunksCached(tx, fi, f.pos, b, f.ra.chunks)
+	f.ra.next = f.pos + int64(n)
+	return n, err
+}
+
+//ReadAt reads len(b) bytes from the file starting at byte offset 'off', it implements io.ReaderAt. It doesn't move the position of the handle and never reads ahead, since random access wouldn't use the chunks that follow. When fewer than len(b) bytes are read the error is io.EOF
+func (f *File) ReadAt(b []byte, off int64) (n int, err error) {
+	if !readable(f.flag) {
+		return 0, f.p.Err("read", os.ErrPermission)
+	}
+
+	if off < 0 {
+		return 0, f.p.Err("read", os.ErrInvalid)
+	}
+
+	if err = f.flush(true); err != nil {
+		return 0, f.p.Err("read", err)
+	}
+
+	if err = f.view(func(tx Tx) error {
+		fi, err := f.fs.getfi(tx, f.p)
+		if err != nil {
+			return err
+		}
+
+		if fi.IsDir() {
+			return ErrIsDirectory
+		}
+
+		n, err = f.fs.readChunks(tx, fi, off, b)
+		return err
+	}); err != nil && err != io.EOF {
+		return 0, f.p.Err("read", err)
+	}
+
+	if n < len(b) {
+		return n, io.EOF
+	}
+
+	return n, nil
+}
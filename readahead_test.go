@@ -0,0 +1,96 @@
+package treedb
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"io/ioutil"
+	"testing"
+)
+
+func TestReadahead(t *testing.T) {
+	data := make([]byte, 5*miB+123)
+	rand.Read(data)
+	for _, n := range []int{0, 1, 4} {
+		db, close := testdb(t)
+		defer close()
+
+		fs, err := NewFileSystem(t.Name(), db, WithReadahead(n))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		testwrite(fs, t, P{"a.bin"}, data)
+		f, err := fs.Open(P{"a.bin"})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		defer f.Close()
+
+		//sequential reads with a small buffer, and again after seeking back
+		for _, off := range []int64{0, 3*miB + 7} {
+			if _, err = f.Seek(off, io.SeekStart); err != nil {
+				t.Fatal(err)
+			}
+
+			output := bytes.NewBuffer(nil)
+			if _, err = io.CopyBuffer(output, struct{ io.Reader }{f}, make([]byte, 1000)); err != nil {
+				t.Fatal(err)
+			}
+
+			if !bytes.Equal(output.Bytes(), data[off:]) {
+				t.Errorf("expected reading ahead %d chunks from %d to read the same bytes", n, off)
+			}
+		}
+
+		//random access doesn't move the position
+		b := make([]byte, 4096)
+		for _, off := range []int64{2*miB - 10, 10, 4 * miB} {
+			if m, err := f.ReadAt(b, off); err != nil || m != len(b) || !bytes.Equal(b, data[off:off+int64(len(b))]) {
+				t.Errorf("expected ReadAt at %d to read the same bytes, got: %d, %v", off, m, err)
+			}
+		}
+
+		if m, err := f.ReadAt(b, int64(len(data))-10); err != io.EOF || m != 10 {
+			t.Errorf("expected ReadAt past the end to read 10 bytes and EOF, got: %d, %v", m, err)
+		}
+
+		if pos, _ := f.Seek(0, io.SeekCurrent); pos != int64(len(data)) {
+			t.Errorf("expected ReadAt to keep the position, got: %d", pos)
+		}
+	}
+}
+
+func BenchmarkSequentialRead(b *testing.B) {
+	data := make([]byte, 32*miB)
+	rand.Read(data)
+	for _, n := range []int{0, 4} {
+		b.Run(map[int]string{0: "NoReadahead", 4: "Readahead"}[n], func(b *testing.B) {
+			db, close := testdb(b)
+			defer close()
+
+			fs, err := NewFileSystem("bench", db, WithReadahead(n))
+			if err != nil {
+				b.Fatal(err)
+			}
+
+			testwrite(fs, b, P{"a.bin"}, data)
+			buf := make([]byte, 32*kiB)
+			b.SetBytes(int64(len(data)))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				f, err := fs.Open(P{"a.bin"})
+				if err != nil {
+					b.Fatal(err)
+				}
+
+				if _, err = io.CopyBuffer(ioutil.Discard, struct{ io.Reader }{f}, buf); err != nil {
+					b.Fatal(err)
+				}
+
+				f.Close()
+			}
+		})
+	}
+}
@@ -0,0 +1,119 @@
+package treedb
+
+import (
+	"os"
+	"sort"
+	"strings"
+)
+
+//SortKey determines the order of the entries returned by ReadDirSorted
+type SortKey int
+
+const (
+	//SortByName orders entries lexically by their name ignoring case, the way names are usually displayed, names that only differ in case are ordered by their bytes. Readdir lists names in byte order instead, which puts all upper case names first
+	SortByName SortKey = iota
+
+	//SortBySize orders entries from small to large, entries of the same size are ordered by name
+	SortBySize
+
+	//SortByModTime orders entries from old to new, entries with the same modification time are ordered by name
+	SortByModTime
+)
+
+//nameLess reports whether name 'a' is ordered before name 'b' by SortByName
+func nameLess(a, b string) bool {
+	if la, lb := strings.ToLower(a), strings.ToLower(b); la != lb {
+		return la < lb
+	}
+
+	return a < b
+}
+
+//ReadDirSorted returns the information of all entries in directory 'dir' ordered by 'by'. Unlike Readdir, which streams entries in the order of their database keys, all entries are collected in a single transaction and sorted in memory. If there is an error, it will be of type *PathError.
+func (fs *FileSystem) ReadDirSorted(dir P, by SortKey) (infos []os.FileInfo, err error) {
+	err = dir.Validate()
+	if err != nil {
+		return nil, dir.Err("readdir", err)
+	}
+
+	less := func(a, b os.FileInfo) bool { return nameLess(a.Name(), b.Name()) }
+	switch by {
+	case SortByName:
+	case SortBySize:
+		less = func(a, b os.FileInfo) bool {
+			if a.Size() != b.Size() {
+				return a.Size() < b.Size()
+			}
+
+			return nameLess(a.Name(), b.Name())
+		}
+	case SortByModTime:
+		less = func(a, b os.FileInfo) bool {
+			if !a.ModTime().Equal(b.ModTime()) {
+				return a.ModTime().Before(b.ModTime())
+			}
+
+			return nameLess(a.Name(), b.Name())
+		}
+	default:
+		return nil, dir.Err("readdir", os.ErrInvalid)
+	}
+
+	if err = fs.db.View(func(tx Tx) error {
+		fi, err := fs.getfi(tx, dir)
+		if err != nil {
+			return err
+		}
+
+		if !fi.IsDir() {
+			return ErrNotDirectory
+		}
+
+		return fs.walkdir(tx, dir, nil, func(p P, fi *fileInfo) error {
+			if fs.rdmax > 0 && len(infos) >= fs.rdmax {
+				return ErrDirectoryTooLarge
+			}
+
+			infos = append(infos, fi)
+			return nil
+		})
+	}); err != nil {
+		return nil, pathErr("readdir", dir, err)
+	}
+
+	sort.Slice(infos, func(i, j int) bool { return less(infos[i], infos[j]) })
+	return infos, nil
+}
+
+//EachEntry calls 'fn' with the information of each entry in directory 'dir' in the order of their names, without collecting them first such that directories of any size can be listed in bounded memory. All entries are read in a single transaction, which is kept open until the last call returns. An error returned by 'fn' stops the listing and is returned as is, other errors will be of type *PathError
+func (fs *FileSystem) EachEntry(dir P, fn func(fi os.FileInfo) error) (err error) {
+	err = dir.Validate()
+	if err != nil {
+		return dir.Err("readdir", err)
+	}
+
+	var fnErr error
+	if err = fs.db.View(func(tx Tx) error {
+		fi, err := fs.getfi(tx, dir)
+		if err != nil {
+			return err
+		}
+
+		if !fi.IsDir() {
+			return ErrNotDirectory
+		}
+
+		return fs.walkdir(tx, dir, nil, func(p P, fi *fileInfo) error {
+			fnErr = fn(fi)
+			return fnErr
+		})
+	}); err != nil {
+		if fnErr != nil {
+			return fnErr
+		}
+
+		return pathErr("readdir", dir, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,126 @@
+package treedb
+
+import (
+	"fmt"
+)
+
+//refsUsageKey is the key in the refs bucket that holds the space usage of a file system, it can't be confused with the key of a chunk since those are always sha256.Size bytes long
+var refsUsageKey = []byte("usage")
+
+//spaceUsage is kept up-to-date as chunk ptrs are written and removed, such that telling how much space a file system takes doesn't need to walk all of its chunk ptrs
+type spaceUsage struct {
+	chunks int64 //number of unique chunks that are referenced
+	unique int64 //bytes in those chunks
+	refd   int64 //bytes referenced by all chunk ptrs, a chunk counts once for each of its references
+}
+
+func decodeUsage(v []byte) (u spaceUsage) {
+	if len(v) != 24 {
+		return u
+	}
+
+	u.chunks = int64(btou64(v[0:]))
+	u.unique = int64(btou64(v[8:]))
+	u.refd = int64(btou64(v[16:]))
+	return u
+}
+
+func (u spaceUsage) encode() []byte {
+	return append(append(u64tob(uint64(u.chunks)), u64tob(uint64(u.unique))...), u64tob(uint64(u.refd))...)
+}
+
+//UniqueBytes returns the number of bytes in the distinct chunks that the files of this file system reference, a chunk that is shared by several files or offsets is counted once. It is read from a counter that is updated as chunks are referenced and released, such that it is cheap enough to check a quota on every write
+func (fs *FileSystem) UniqueBytes() (n int64, err error) {
+	if err = fs.db.View(func(tx Tx) error {
+		u, err := fs.usage(tx)
+		n = u.unique
+		return err
+	}); err != nil {
+		return 0, fmt.Errorf("failed to read space usage: %v", err)
+	}
+
+	return n, nil
+}
+
+//usage returns the space usage of the file system. File systems that were created before usage was counted and are opened read-only have no refs bucket, their chunk ptrs are walked instead
+func (fs *FileSystem) usage(tx Tx) (u spaceUsage, err error) {
+	if b := tx.Bucket(fs.rbucket); b != nil {
+		return decodeUsage(b.Get(refsUsageKey)), nil
+	}
+
+	refs := map[K]struct{}{}
+	err = tx.Bucket(fs.pbucket).ForEach(func(k, v []byte) error {
+		ptr := decodeChunkPtr(k, v)
+		u.refd += ptr.n
+		if _, ok := refs[ptr.k]; !ok {
+			refs[ptr.k] = struct{}{}
+			u.chunks++
+			u.unique += ptr.n
+		}
+
+		return nil
+	})
+
+	return u, err
+}
+
+//ref adds 'delta' (1 or -1) to the number of chunk ptrs that reference the chunk of 'ptr' and updates the space usage when the chunk gains its first or loses its last reference
+func (fs *FileSystem) ref(tx Tx, ptr chunkPtr, delta int) (err error) {
+	b := tx.Bucket(fs.rbucket)
+	u := decodeUsage(b.Get(refsUsageKey))
+	refs := uint64(0)
+	if v := b.Get(ptr.k[:]); v != nil {
+		refs = btou64(v)
+	}
+
+	switch {
+	case delta > 0:
+		if refs == 0 {
+			u.chunks++
+			u.unique += ptr.n
+		}
+
+		refs++
+		u.refd += ptr.n
+	case refs > 0:
+		refs--
+		u.refd -= ptr.n
+		if refs == 0 {
+			u.chunks--
+			u.unique -= ptr.n
+		}
+	default:
+		return nil //never counted, the usage can't go below zero
+	}
+
+	if refs == 0 {
+		err = b.Delete(ptr.k[:])
+	} else {
+		err = b.Put(ptr.k[:], u64tob(refs))
+	}
+
+	if err != nil {
+		return err
+	}
+
+	return b.Put(refsUsageKey, u.encode())
+}
+
+//countRefs counts the references of all chunk ptrs into an empty refs bucket, for file systems that were created before references were counted
+func (fs *FileSystem) countRefs(tx Tx) (err error) {
+	var ptrs []chunkPtr
+	if err = tx.Bucket(fs.pbucket).ForEach(func(k, v []byte) error {
+		ptrs = append(ptrs, decodeChunkPtr(k, v))
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	for _, ptr := range ptrs {
+		if err = fs.ref(tx, ptr, 1); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,196 @@
+package treedb
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"strconv"
+)
+
+//LostFound is the directory that orphaned entries are moved into by Repair
+var LostFound = P{"lost+found"}
+
+//OrphanAction determines how Repair deals with entries that cannot be reached from the root
+type OrphanAction int
+
+const (
+	//OrphanToLostFound moves orphaned entries into the LostFound directory, named after their inode number
+	OrphanToLostFound OrphanAction = iota
+
+	//OrphanDelete removes orphaned entries, including anything below them
+	OrphanDelete
+)
+
+//MissingChunkAction determines how Repair deals with files that reference chunks which are not stored
+type MissingChunkAction int
+
+const (
+	//MissingChunkZeroFill drops the reference such that the missing bytes read as zeros, the size of the file is left alone
+	MissingChunkZeroFill MissingChunkAction = iota
+
+	//MissingChunkTruncate truncates the file right before the first missing chunk
+	MissingChunkTruncate
+)
+
+//RepairPolicy selects what Repair does for each class of problem, a missing root is always recreated
+type RepairPolicy struct {
+	Orphans       OrphanAction //for entries without a parent or with a parent that is not a directory
+	MissingChunks MissingChunkAction
+}
+
+//rmtree removes the entry at 'p' and everything below it, keys are collected first since deleting invalidates the cursor
+func (fs *FileSystem) rmtree(tx Tx, p P, fi *fileInfo) (err error) {
+	if fi.IsDir() {
+		prefix := append(p.Key(), PathSeparator...)
+		ks := [][]byte{}
+		c := tx.Bucket(fs.fbucket).Cursor()
+		for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+			ks = append(ks, append([]byte{}, k...))
+		}
+
+		for _, k := range ks {
+			childp := PathFromKey(k)
+			childfi, err := fs.getfi(tx, childp)
+			if err != nil {
+				return err
+			}
+
+			if err = fs.rmfi(tx, childp, childfi); err != nil {
+				return err
+			}
+		}
+	}
+
+	return fs.rmfi(tx, p, fi)
+}
+
+//repairChunk fixes a file that references a missing chunk
+func (fs *FileSystem) repairChunk(tx Tx, prob Problem, action MissingChunkAction) (err error) {
+	fi, err := fs.getfi(tx, prob.Path)
+	if err != nil {
+		return err
+	}
+
+	switch action {
+	case MissingChunkZeroFill:
+		if err = fs.delChunkPtr(tx, fi, prob.Off); err != nil {
+			return err
+		}
+
+		//the content changed, which drops the cached tree hashes
+		return fs.putfi(tx, prob.Path, fi)
+	case MissingChunkTruncate:
+		if prob.Off >= fi.S {
+			return nil //already truncated because of an earlier missing chunk
+		}
+
+		if err = fs.delChunkPtrsFrom(tx, fi, prob.Off); err != nil {
+			return err
+		}
+
+		fi.S = prob.Off
+		fi.T = fs.clock.Now()
+		return fs.putfi(tx, prob.Path, fi)
+	default:
+		return fmt.Errorf("unknown missing chunk action: %d", action)
+	}
+}
+
+//repairOrphan moves or removes an entry that cannot be reached from the root
+func (fs *FileSystem) repairOrphan(tx Tx, prob Problem, action OrphanAction) (err error) {
+	fi, err := fs.getfi(tx, prob.Path)
+	if err != nil {
+		return err
+	}
+
+	switch action {
+	case OrphanDelete:
+		return fs.rmtree(tx, prob.Path, fi)
+	case OrphanToLostFound:
+		lfi, err := fs.getfi(tx, LostFound)
+		if err == os.ErrNotExist {
+			if err = fs.MkdirTx(tx, LostFound, 0700); err != nil {
+				return err
+			}
+		} else if err != nil {
+			return err
+		} else if !lfi.IsDir() {
+			return LostFound.Err("repair", ErrNotDirectory)
+		}
+
+		return fs.rename(tx, prob.Path, append(append(P{}, LostFound...), "#"+strconv.FormatUint(fi.I, 10)))
+	default:
+		return fmt.Errorf("unknown orphan action: %d", action)
+	}
+}
+
+//Repair fixes the problems reported by Check according to 'policy' in a single transaction, it returns the problems that it fixed
+func (fs *FileSystem) Repair(policy RepairPolicy) (fixed []Problem, err error) {
+	if err = fs.db.Update(func(tx Tx) error {
+		fixed = nil
+		problems, err := fs.check(tx)
+		if err != nil {
+			return err
+		}
+
+		//the root and missing chunks are fixed first, the paths of missing chunks are invalid once orphans are moved
+		for _, prob := range problems {
+			switch prob.Kind {
+			case ProblemMissingRoot:
+				ino, err := fs.nextIno(tx)
+				if err != nil {
+					return err
+				}
+
+				rootfi := fs.rootfi
+				rootfi.T = fs.clock.Now()
+				rootfi.I = ino
+				if err = fs.putfi(tx, Root, &rootfi); err != nil {
+					return err
+				}
+			case ProblemMissingChunk:
+				if err = fs.repairChunk(tx, prob, policy.MissingChunks); err != nil {
+					return err
+				}
+			default:
+				continue
+			}
+
+			fixed = append(fixed, prob)
+		}
+
+		//moving or removing an orphan might take orphans below it along, so we check again until there are none left. Every pass fixes at least the first orphan so this ends
+		for {
+			problems, err = fs.check(tx)
+			if err != nil {
+				return err
+			}
+
+			n := 0
+			for _, prob := range problems {
+				if prob.Kind != ProblemOrphan && prob.Kind != ProblemParentNotDirectory {
+					continue
+				}
+
+				if err = fs.repairOrphan(tx, prob, policy.Orphans); err == os.ErrNotExist {
+					continue //moved or removed together with an orphan above it, fixed in the next pass
+				} else if err != nil {
+					return err
+				}
+
+				fixed = append(fixed, prob)
+				n++
+			}
+
+			if n == 0 {
+				break
+			}
+		}
+
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	return fixed, nil
+}
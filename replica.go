@@ -0,0 +1,108 @@
+package treedb
+
+import (
+	"crypto/sha256"
+	"strconv"
+	"sync"
+)
+
+//ReplicaBucketName returns the name of the bucket that holds the 'i'th extra copy of every chunk in ChunkBucketName, replicas are numbered from 1
+func ReplicaBucketName(i int) []byte {
+	return replicaBucketName(ChunkBucketName, i)
+}
+
+//replicaBucketName returns the name of the bucket that holds the 'i'th extra copy of the chunks in bucket 'cbucket'
+func replicaBucketName(cbucket []byte, i int) []byte {
+	return append(append([]byte{}, cbucket...), "_r"+strconv.Itoa(i)...)
+}
+
+//heals keeps the content of corrupt chunks that was recovered from a replica while the transaction could not be written to, such that the primary copy can be repaired afterwards
+type heals struct {
+	mu     sync.Mutex
+	chunks map[K][]byte
+}
+
+//add queues chunk 'data' to be written under key 'k'
+func (h *heals) add(k K, data []byte) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.chunks == nil {
+		h.chunks = map[K][]byte{}
+	}
+
+	h.chunks[k] = data
+}
+
+//take returns all queued chunks and empties the queue
+func (h *heals) take() (chunks map[K][]byte) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	chunks, h.chunks = h.chunks, nil
+	return chunks
+}
+
+//putReplicas stores chunk 'data' under key 'k' in every replica bucket that doesn't have it yet
+func (fs *FileSystem) putReplicas(tx Tx, k K, data []byte) (err error) {
+	for _, name := range fs.replicas {
+		b := tx.Bucket(name)
+		if b.Get(k[:]) != nil {
+			continue
+		}
+
+		if err = b.Put(k[:], append([]byte{}, data...)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+//getReplica returns the first copy of the chunk that 'ptr' references that still hashes to its key, replica buckets are tried before the mirror
+func (fs *FileSystem) getReplica(tx Tx, ptr chunkPtr) (data []byte, ok bool) {
+	for _, name := range fs.replicas {
+		b := tx.Bucket(name)
+		if b == nil {
+			continue
+		}
+
+		if data = b.Get(ptr.k[:]); data != nil && sha256.Sum256(data) == ptr.k {
+			return data, true
+		}
+	}
+
+	if fs.mirror != nil {
+		if data, err := fs.mirror.Get(ptr.k); err == nil && sha256.Sum256(data) == ptr.k {
+			return data, true
+		}
+	}
+
+	return nil, false
+}
+
+//healChunk replaces the primary copy of chunk 'k' with 'data' that was recovered from a replica. In a read-only transaction the repair is queued until heal is called
+func (fs *FileSystem) healChunk(tx Tx, k K, data []byte) (err error) {
+	if tx.Writable() {
+		return tx.Bucket(fs.cbucket).Put(k[:], append([]byte{}, data...))
+	}
+
+	fs.heals.add(k, append([]byte{}, data...))
+	return nil
+}
+
+//heal writes the queued repairs of corrupt chunks. Repairs are best effort: if they fail the chunk is recovered from its replica again on a next read
+func (fs *FileSystem) heal() {
+	chunks := fs.heals.take()
+	if len(chunks) == 0 {
+		return
+	}
+
+	fs.db.Update(func(tx Tx) error {
+		for k, data := range chunks {
+			if err := tx.Bucket(fs.cbucket).Put(k[:], data); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
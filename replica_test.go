@@ -0,0 +1,76 @@
+package treedb
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"testing"
+
+	"github.com/boltdb/bolt"
+)
+
+//testcorrupt flips a byte of every chunk in bucket 'name'
+func testcorrupt(t *testing.T, db *bolt.DB, name []byte) {
+	if err := db.Update(func(tx *bolt.Tx) error {
+		c := tx.Bucket(name).Cursor()
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			corrupt := append([]byte{}, v...)
+			corrupt[0] ^= 0xFF
+			if err := tx.Bucket(name).Put(append([]byte{}, k...), corrupt); err != nil {
+				return err
+			}
+
+			c.Seek(k)
+		}
+
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestChunkReplicas(t *testing.T) {
+	db, close := testdb(t)
+	defer close()
+
+	fs, err := NewFileSystem(t.Name(), db, WithChunkReplicas(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := make([]byte, 600*kiB)
+	rand.Read(data)
+	testwrite(fs, t, P{"a.txt"}, data)
+
+	testcorrupt(t, db, ChunkBucketName)
+	if read := testread(fs, t, P{"a.txt"}); !bytes.Equal(read, data) {
+		t.Fatal("expected content to be read from the replica")
+	}
+
+	//the primary copies were repaired
+	if err = db.View(func(tx *bolt.Tx) error {
+		n := 0
+		err := tx.Bucket(ChunkBucketName).ForEach(func(k, v []byte) error {
+			if sum := sha256.Sum256(v); !bytes.Equal(sum[:], k) {
+				t.Errorf("expected chunk %x to be repaired", k)
+			}
+
+			n++
+			return nil
+		})
+
+		if n == 0 {
+			t.Error("expected chunks in the primary bucket")
+		}
+
+		return err
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	//a corrupt replica doesn't matter as long as the primary is intact
+	testcorrupt(t, db, ReplicaBucketName(1))
+	if read := testread(fs, t, P{"a.txt"}); !bytes.Equal(read, data) {
+		t.Error("expected content to be read from the primary")
+	}
+}
@@ -0,0 +1,53 @@
+package treedb
+
+import (
+	"os"
+	"sort"
+	"strings"
+)
+
+//Seed populates the file system with the files in 'spec', which maps '/' separated paths to their content. Missing parent directories are created and paths that end with a '/' create an (empty) directory, their content is ignored. Everything is created in a single transaction in the order of the sorted paths, which makes it useful to set up file systems in tests. If there is an error, it will be of type *PathError.
+func Seed(fs *FileSystem, spec map[string][]byte) (err error) {
+	names := make([]string, 0, len(spec))
+	for name := range spec {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+	return fs.db.Update(func(tx Tx) error {
+		for _, name := range names {
+			p := ParsePath(name)
+			if err := p.Validate(); err != nil {
+				return p.Err("seed", err)
+			}
+
+			if strings.HasSuffix(name, "/") {
+				if err := fs.mkdirAll(tx, p, 0777); err != nil {
+					return pathErr("seed", p, err)
+				}
+
+				continue
+			}
+
+			if err := fs.mkdirAll(tx, p.Parent(), 0777); err != nil {
+				return pathErr("seed", p, err)
+			}
+
+			f, err := fs.OpenFileTx(tx, p, os.O_CREATE|os.O_WRONLY, 0666)
+			if err != nil {
+				return err
+			}
+
+			if _, err = f.Write(spec[name]); err != nil {
+				f.Close()
+				return err
+			}
+
+			if err = f.Close(); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
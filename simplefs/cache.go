@@ -0,0 +1,191 @@
+package simplefs
+
+import (
+	"strings"
+	"sync"
+
+	"github.com/boltdb/bolt"
+)
+
+//statCache remembers which node id a path resolves to and the decoded nodes by their id, such that repeated stats don't descend from the root and decode again. Entries are invalidated once a transaction that rewrote them commits
+type statCache struct {
+	mu        sync.Mutex
+	ids       map[string]uint64
+	nodes     map[uint64]*node
+	committed uint64 //id of the last transaction that invalidated entries
+}
+
+func newStatCache() *statCache {
+	return &statCache{ids: map[string]uint64{}, nodes: map[uint64]*node{}}
+}
+
+//usable returns whether 'tx' can use the cache. Writable transactions might have changed nodes that are only invalidated when they commit
+func (c *statCache) usable(tx *bolt.Tx) bool {
+	return c != nil && !tx.Writable()
+}
+
+func pathKey(p P) string {
+	return strings.Join(p, PathSeparator)
+}
+
+//get returns the node id and node for path 'p', if they are cached
+func (c *statCache) get(p P) (id uint64, n *node, ok bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if id, ok = c.ids[pathKey(p)]; !ok {
+		return 0, nil, false
+	}
+
+	n, ok = c.nodes[id]
+	return id, n, ok
+}
+
+//put caches what path 'p' resolved to as read by 'tx'. Transactions that started before the last invalidation might have read stale nodes, what they read is not cached
+func (c *statCache) put(tx *bolt.Tx, p P, id uint64, n *node) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if uint64(tx.ID()) < c.committed {
+		return
+	}
+
+	c.ids[pathKey(p)] = id
+	c.nodes[id] = n
+}
+
+//invalidateNode drops node 'id' from the cache once 'tx' commits
+func (c *statCache) invalidateNode(tx *bolt.Tx, id uint64) {
+	if c == nil {
+		return
+	}
+
+	txid := uint64(tx.ID())
+	tx.OnCommit(func() {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		delete(c.nodes, id)
+		if txid > c.committed {
+			c.committed = txid
+		}
+	})
+}
+
+//invalidatePaths drops all cached paths once 'tx' commits, it is used when child ptrs change
+func (c *statCache) invalidatePaths(tx *bolt.Tx) {
+	if c == nil {
+		return
+	}
+
+	txid := uint64(tx.ID())
+	tx.OnCommit(func() {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		c.ids = map[string]uint64{}
+		if txid > c.committed {
+			c.committed = txid
+		}
+	})
+}
+
+//invalidateAll empties the cache once 'tx' commits, it is used when node ids are reassigned
+func (c *statCache) invalidateAll(tx *bolt.Tx) {
+	if c == nil {
+		return
+	}
+
+	txid := uint64(tx.ID())
+	tx.OnCommit(func() {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		c.ids = map[string]uint64{}
+		c.nodes = map[uint64]*node{}
+		if txid > c.committed {
+			c.committed = txid
+		}
+	})
+}
+
+//rootCache keeps the decoded root node, which every stat of the root needs. It is read when the stat cache is enabled
+type rootCache struct {
+	mu        sync.Mutex
+	n         *node
+	committed uint64 //id of the last transaction that invalidated the node
+}
+
+//get returns the root node, if it is cached
+func (c *rootCache) get() (n *node, ok bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.n, c.n != nil
+}
+
+//put caches root node 'n' as read by 'tx', unless 'tx' started before the node was last invalidated
+func (c *rootCache) put(tx *bolt.Tx, n *node) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if uint64(tx.ID()) < c.committed {
+		return
+	}
+
+	c.n = n
+}
+
+//invalidate drops the root node once 'tx' commits
+func (c *rootCache) invalidate(tx *bolt.Tx) {
+	if c == nil {
+		return
+	}
+
+	txid := uint64(tx.ID())
+	tx.OnCommit(func() {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		c.n = nil
+		if txid > c.committed {
+			c.committed = txid
+		}
+	})
+}
+
+//treeKey identifies a tree by its database, node bucket and root node
+type treeKey struct {
+	db    *bolt.DB
+	nodes string
+	root  uint64
+}
+
+//owners holds the trees that a file system serves in this process. A second file system on a tree would serve nodes from its caches that the first rewrote, so it is refused. Trees are released by Close, the trees of databases that were closed are released the next time a file system is created
+var owners = struct {
+	sync.Mutex
+	trees map[treeKey]*FileSystem
+}{trees: map[treeKey]*FileSystem{}}
+
+//claim makes 'fs' the owner of its tree, it returns ErrTreeInUse if another file system owns it
+func claim(fs *FileSystem) error {
+	owners.Lock()
+	defer owners.Unlock()
+	for k := range owners.trees {
+		if tx, err := k.db.Begin(false); err == bolt.ErrDatabaseNotOpen {
+			delete(owners.trees, k)
+		} else if err == nil {
+			tx.Rollback()
+		}
+	}
+
+	k := treeKey{fs.db, string(fs.nodes), fs.root}
+	if _, ok := owners.trees[k]; ok {
+		return ErrTreeInUse
+	}
+
+	owners.trees[k] = fs
+	return nil
+}
+
+//release gives up the tree of 'fs', if it owns it
+func release(fs *FileSystem) {
+	owners.Lock()
+	defer owners.Unlock()
+	k := treeKey{fs.db, string(fs.nodes), fs.root}
+	if owners.trees[k] == fs {
+		delete(owners.trees, k)
+	}
+}
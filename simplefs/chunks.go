@@ -52,7 +52,7 @@ func NewChunkBuf() (*ChunkBuf, error) {
 			d := make([]byte, chunk.Length)
 			copy(d, chunk.Data)
 
-			fmt.Println("inject:", chunk.Start, len(d))
+			logger.Printf("inject: %d %d", chunk.Start, len(d))
 			err = buf.inject(off+uint64(chunk.Start), d)
 			if err != nil {
 				doneErr = err
@@ -3,7 +3,6 @@ package simplefs
 import (
 	"bytes"
 	"crypto/rand"
-	"fmt"
 	"testing"
 )
 
@@ -316,7 +315,6 @@ func TestWriteFlushPasMaxSize(t *testing.T) {
 }
 
 func TestWriteAfterFlush(t *testing.T) {
-	fmt.Println("write after flush!")
 	cbuf, err := NewChunkBuf()
 	if err != nil {
 		t.Fatalf("didn't expect error, got: %v", err)
@@ -357,7 +355,7 @@ func TestWriteAfterFlush(t *testing.T) {
 	output := []byte{}
 	totalN := 0
 	for _, c := range cbuf.chunks {
-		fmt.Println(c.o, c.eof)
+		t.Log(c.o, c.eof)
 		totalN = totalN + len(c.d)
 		output = append(output, c.d...)
 	}
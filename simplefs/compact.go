@@ -0,0 +1,118 @@
+package simplefs
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/boltdb/bolt"
+)
+
+//Compact rewrites all nodes that are reachable from the root into a fresh node bucket with densely reassigned ids, starting at the root id. Child ptrs are updated to the new ids, nodes that are no longer reachable are dropped and the id sequence is reset to the highest id in use. Everything happens in a single transaction such that readers either see the old or the compacted tree. Node ids are reassigned, so files must not be open while compacting. Snapshots are dropped. A node bucket that holds the trees of other roots, see WithRootID, can't be compacted since their nodes would be dropped: ErrSharedBucket is returned instead
+func (fs *FileSystem) Compact() (err error) {
+	if fs.readOnly {
+		return ErrReadOnly
+	}
+
+	if err = fs.db.Update(func(tx *bolt.Tx) (err error) {
+		if b := tx.Bucket(rootsBucket(fs.nodes)); b != nil {
+			if err = b.ForEach(func(k, v []byte) error {
+				if btou64(k) != fs.root {
+					return ErrSharedBucket
+				}
+
+				return nil
+			}); err != nil {
+				return err
+			}
+		}
+
+		if err = compact(tx, fs.nodes, fs.root); err != nil {
+			return err
+		}
+
+		//the ids of snapshot roots are not reassigned, their nodes are unreachable and were dropped
+		if tx.Bucket(snapshotBucket(fs.nodes)) != nil {
+			if err = tx.DeleteBucket(snapshotBucket(fs.nodes)); err != nil {
+				return err
+			}
+		}
+
+		fs.cache.invalidateAll(tx)
+		fs.rootc.invalidate(tx)
+		return nil
+	}); err == ErrSharedBucket {
+		return err
+	} else if err != nil {
+		return fmt.Errorf("failed to compact: %v", err)
+	}
+
+	return nil
+}
+
+//rootsBucket returns the name of the bucket that records the ids of the roots of the trees in node bucket 'nodes', each file system records its root when it is created
+func rootsBucket(nodes []byte) []byte {
+	return append(append([]byte{}, nodes...), []byte(".roots")...)
+}
+
+//compact rewrites the tree at node 'root' in bucket 'name', breadth first. The compacted nodes are staged in a temporary bucket until they replace the original
+func compact(tx *bolt.Tx, name []byte, root uint64) (err error) {
+	tmpName := append(append([]byte{}, name...), []byte(".compact")...)
+	src := tx.Bucket(name)
+	dst, err := tx.CreateBucket(tmpName)
+	if err != nil {
+		return err
+	}
+
+	next := root
+	ids := map[uint64]uint64{root: next} //old to new ids
+	queue := []uint64{root}
+	for len(queue) > 0 {
+		oldID := queue[0]
+		queue = queue[1:]
+		newID := ids[oldID]
+
+		prefix := u64tob(oldID)
+		c := src.Cursor()
+		for k, v := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+			nk := append(u64tob(newID), k[len(prefix):]...)
+			nv := v
+			if bytes.HasPrefix(k[len(prefix):], ChildPtrSeparator) {
+				next++
+				ids[btou64(v)] = next
+				queue = append(queue, btou64(v))
+				nv = u64tob(next)
+			}
+
+			if err = dst.Put(nk, append([]byte{}, nv...)); err != nil {
+				return err
+			}
+		}
+	}
+
+	//bolt cannot rename buckets, so the compacted nodes are copied into a recreated node bucket
+	if err = tx.DeleteBucket(name); err != nil {
+		return err
+	}
+
+	nodes, err := tx.CreateBucket(name)
+	if err != nil {
+		return err
+	}
+
+	nodes.FillPercent = 1 //keys are written in order
+	if err = dst.ForEach(func(k, v []byte) error {
+		return nodes.Put(k, v)
+	}); err != nil {
+		return err
+	}
+
+	if err = nodes.SetSequence(next); err != nil {
+		return err
+	}
+
+	if err = tx.DeleteBucket(tmpName); err != nil {
+		return err
+	}
+
+	return nil
+}
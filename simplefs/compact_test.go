@@ -0,0 +1,143 @@
+package simplefs
+
+import (
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/boltdb/bolt"
+)
+
+func TestCompact(t *testing.T) {
+	fs, close := testfs(t)
+	defer close()
+
+	if err := fs.Mkdir(P{"dir"}, 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 100; i++ {
+		f, err := fs.OpenFile(P{"dir", fmt.Sprintf("%d.txt", i)}, os.O_CREATE, 0666)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err = f.Write([]byte(fmt.Sprintf("file %d", i))); err != nil {
+			t.Fatal(err)
+		}
+
+		if err = f.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	//only keep every tenth file
+	for i := 0; i < 100; i++ {
+		if i%10 == 0 {
+			continue
+		}
+
+		if err := fs.Remove(P{"dir", fmt.Sprintf("%d.txt", i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	seq := func() (n uint64) {
+		fs.db.View(func(tx *bolt.Tx) error {
+			n = tx.Bucket(fs.nodes).Sequence()
+			return nil
+		})
+
+		return n
+	}
+
+	before := seq()
+	if err := fs.Compact(); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+
+	if after := seq(); after != 12 || after >= before {
+		t.Errorf("expected sequence to be reset to 12 (was %d), got: %d", before, after)
+	}
+
+	fi, err := fs.Stat(P{"dir"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if fi.Size() != 10*8 {
+		t.Errorf("expected dir to have 10 children, got size: %d", fi.Size())
+	}
+
+	for i := 0; i < 100; i += 10 {
+		fi, err := fs.Stat(P{"dir", fmt.Sprintf("%d.txt", i)})
+		if err != nil {
+			t.Fatalf("expected file %d to survive compaction, got: %v", i, err)
+		}
+
+		if fi.Size() != int64(len(fmt.Sprintf("file %d", i))) {
+			t.Errorf("expected size of file %d to be preserved, got: %d", i, fi.Size())
+		}
+	}
+
+	_, err = fs.Stat(P{"dir", "1.txt"})
+	if !os.IsNotExist(err) {
+		t.Errorf("expected removed file to stay removed, got: %v", err)
+	}
+
+	//new nodes continue from the reset sequence
+	if err = fs.Mkdir(P{"dir2"}, 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	fi, err = fs.Stat(P{"dir2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if fi.(*fileInfo).nodeID != 13 {
+		t.Errorf("expected new node to get id 13, got: %d", fi.(*fileInfo).nodeID)
+	}
+}
+
+func TestCompactSharedBucket(t *testing.T) {
+	db, close := testdb(t)
+	defer close()
+
+	a, err := New(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := New(db, WithRootID(1000))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = b.Mkdir(P{"dir"}, 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	//both trees live in the default node bucket, compacting either would drop the other
+	for _, fs := range []*FileSystem{a, b} {
+		if err = fs.Compact(); err != ErrSharedBucket {
+			t.Errorf("expected compacting a shared bucket to return %v, got: %v", ErrSharedBucket, err)
+		}
+	}
+
+	for _, p := range []P{Root, {"dir"}} {
+		if _, err = b.Stat(p); err != nil {
+			t.Errorf("expected the other tree to be kept, got: %v", err)
+		}
+	}
+
+	//a tree with a bucket of its own can be compacted
+	c, err := New(db, WithID("c"), WithRootID(1000))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = c.Compact(); err != nil {
+		t.Errorf("expected no error, got: %v", err)
+	}
+}
@@ -0,0 +1,127 @@
+package simplefs
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/boltdb/bolt"
+)
+
+//Copy copies the file or directory at 'src' to 'dst', which must not exist yet. A file is copied into a new node whose chunk ptrs reference the same content keys, no chunk is written again no matter how large the file is. Directories are copied recursively. Copies keep the mode and modification time of what they copy, the whole tree is copied in a single transaction. If there is an error, it will be of type *PathError.
+func (fs *FileSystem) Copy(src, dst P) (err error) {
+	for _, p := range []P{src, dst} {
+		if err = p.Validate(); err != nil {
+			return p.Err("copy", err)
+		}
+	}
+
+	if fs.readOnly {
+		return dst.Err("copy", ErrReadOnly)
+	}
+
+	if dst.IsRoot() {
+		return dst.Err("copy", os.ErrExist)
+	}
+
+	//a directory cannot be copied into itself
+	if len(dst) > len(src) && dst[:len(src)].Equals(src) {
+		return src.Err("copy", os.ErrInvalid)
+	}
+
+	if err = fs.db.Update(func(tx *bolt.Tx) error {
+		fi, err := fs.stat(tx, src)
+		if err != nil {
+			return err
+		}
+
+		pfi, err := fs.stat(tx, dst.Parent())
+		if err != nil {
+			return err
+		}
+
+		if !pfi.IsDir() {
+			return ErrNotDirectory
+		}
+
+		if _, err = fs.stat(tx, dst); err == nil {
+			return os.ErrExist
+		} else if err != os.ErrNotExist {
+			return err
+		}
+
+		id, err := fs.copyNode(tx, fi.nodeID)
+		if err != nil {
+			return err
+		}
+
+		return fs.addChild(tx, pfi.nodeID, dst.Base(), id)
+	}); err != nil {
+		return src.Err("copy", err)
+	}
+
+	return nil
+}
+
+//copyNode creates a new node with the mode, modification time and ptrs of node 'id' and returns its id. Chunk ptrs are copied as is, the children of a directory are copied recursively
+func (fs *FileSystem) copyNode(tx *bolt.Tx, id uint64) (cid uint64, err error) {
+	ntx, err := fs.nodeTx(tx, id)
+	if err != nil {
+		return 0, fmt.Errorf("failed to start node tx: %v", err)
+	}
+
+	n, err := ntx.getNode()
+	if err != nil {
+		return 0, err
+	}
+
+	if n == nil {
+		return 0, os.ErrNotExist
+	}
+
+	cntx, err := fs.nodeTx(tx, 0)
+	if err != nil {
+		return 0, fmt.Errorf("failed to start new node tx: %v", err)
+	}
+
+	//ptrs are collected before any is written, writing to the bucket invalidates its cursors
+	if n.isDir() {
+		names, ids := []string{}, []uint64{}
+		if err = ntx.getChildPtrs(func(name string, id uint64) error {
+			names, ids = append(names, name), append(ids, id)
+			return nil
+		}); err != nil {
+			return 0, err
+		}
+
+		for i, name := range names {
+			ccid, err := fs.copyNode(tx, ids[i])
+			if err != nil {
+				return 0, err
+			}
+
+			if err = cntx.putChildPtr(name, ccid); err != nil {
+				return 0, err
+			}
+		}
+	} else {
+		offsets, keys := []int64{}, []K{}
+		if err = ntx.getChunkPtrs(func(offset int64, k K) error {
+			offsets, keys = append(offsets, offset), append(keys, k)
+			return nil
+		}); err != nil {
+			return 0, err
+		}
+
+		for i, offset := range offsets {
+			if err = cntx.putChunkPtr(offset, keys[i]); err != nil {
+				return 0, err
+			}
+		}
+	}
+
+	if _, _, err = cntx.putNodeWithTime(n.typ(), n.Mode, n.ModTime); err != nil {
+		return 0, fmt.Errorf("failed to put copied node: %v", err)
+	}
+
+	return cntx.id, nil
+}
@@ -0,0 +1,174 @@
+package simplefs
+
+import (
+	"crypto/rand"
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/boltdb/bolt"
+)
+
+//testChunkPtrs returns the chunk ptrs of the file at 'p' by their offset
+func testChunkPtrs(t *testing.T, fs *FileSystem, p P) (ptrs map[int64]K) {
+	ptrs = map[int64]K{}
+	if err := fs.db.View(func(tx *bolt.Tx) error {
+		fi, err := fs.stat(tx, p)
+		if err != nil {
+			return err
+		}
+
+		ntx, err := fs.nodeTx(tx, fi.nodeID)
+		if err != nil {
+			return err
+		}
+
+		return ntx.getChunkPtrs(func(offset int64, k K) error {
+			ptrs[offset] = k
+			return nil
+		})
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	return ptrs
+}
+
+func TestCopy(t *testing.T) {
+	fs, close := testfs(t)
+	defer close()
+
+	for _, p := range []P{{"a"}, {"a", "sub"}, {"a", "empty"}} {
+		if err := fs.Mkdir(p, 0750); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, p := range []P{{"a", "big.bin"}, {"a", "sub", "c.txt"}} {
+		f, err := fs.OpenFile(p, os.O_CREATE, 0640)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		data := make([]byte, 3*miB)
+		rand.Read(data)
+		if _, err = f.Write(data); err != nil {
+			t.Fatal(err)
+		}
+
+		if err = f.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	chunks := 0
+	countChunks := func() (n int) {
+		if err := fs.db.View(func(tx *bolt.Tx) error {
+			n = tx.Bucket(ChunkBucketName).Stats().KeyN
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+
+		return n
+	}
+
+	chunks = countChunks()
+
+	//a copied file references the same chunks through a node of its own
+	if err := fs.Copy(P{"a", "big.bin"}, P{"big.bin"}); err != nil {
+		t.Fatal(err)
+	}
+
+	src, dst := testChunkPtrs(t, fs, P{"a", "big.bin"}), testChunkPtrs(t, fs, P{"big.bin"})
+	if len(src) < 3 || fmt.Sprint(src) != fmt.Sprint(dst) {
+		t.Errorf("expected the copy to share the chunk ptrs of its source, got: %v and %v", src, dst)
+	}
+
+	if n := countChunks(); n != chunks {
+		t.Errorf("expected no chunks to be stored for a copy, got: %d (was %d)", n, chunks)
+	}
+
+	sfi, err := fs.Stat(P{"a", "big.bin"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dfi, err := fs.Stat(P{"big.bin"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if sfi.(*fileInfo).nodeID == dfi.(*fileInfo).nodeID || sfi.Size() != dfi.Size() || sfi.Mode() != dfi.Mode() || !sfi.ModTime().Equal(dfi.ModTime()) {
+		t.Errorf("expected a new node with the same size, mode and time, got: %+v and %+v", sfi, dfi)
+	}
+
+	//a directory is copied with all of its descendants
+	if err = fs.Copy(P{"a"}, P{"b"}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, pattern := range []P{{"*"}, {"*", "*"}} {
+		var names [2][]string
+		for i, dir := range []string{"a", "b"} {
+			matches, err := fs.Glob(append(P{dir}, pattern...))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for _, p := range matches {
+				names[i] = append(names[i], P(p[1:]).String())
+			}
+		}
+
+		if len(names[0]) == 0 || fmt.Sprint(names[0]) != fmt.Sprint(names[1]) {
+			t.Errorf("expected the copied tree to hold %v, got: %v", names[0], names[1])
+		}
+	}
+
+	for _, p := range []P{{"sub"}, {"empty"}, {"sub", "c.txt"}} {
+		sfi, err := fs.Stat(append(P{"a"}, p...))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		dfi, err := fs.Stat(append(P{"b"}, p...))
+		if err != nil {
+			t.Fatalf("expected %v to be copied, got: %v", p, err)
+		}
+
+		if sfi.Mode() != dfi.Mode() || sfi.Size() != dfi.Size() {
+			t.Errorf("expected copy of %v to equal it, got: %+v and %+v", p, sfi, dfi)
+		}
+	}
+
+	if n := countChunks(); n != chunks {
+		t.Errorf("expected no chunks to be stored for a copied tree, got: %d (was %d)", n, chunks)
+	}
+
+	//writing the copy leaves the source alone
+	f, err := fs.OpenFile(P{"b", "sub", "c.txt"}, os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = f.Write([]byte("changed")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if src, dst := testChunkPtrs(t, fs, P{"a", "sub", "c.txt"}), testChunkPtrs(t, fs, P{"b", "sub", "c.txt"}); fmt.Sprint(src) == fmt.Sprint(dst) {
+		t.Error("expected writing the copy to leave the chunk ptrs of its source alone")
+	}
+
+	if err = fs.Copy(P{"a"}, P{"b"}); err == nil || err.(*os.PathError).Err != os.ErrExist {
+		t.Errorf("expected copying onto an existing path to fail, got: %v", err)
+	}
+
+	if err = fs.Copy(P{"a"}, P{"a", "sub", "a"}); err == nil || err.(*os.PathError).Err != os.ErrInvalid {
+		t.Errorf("expected copying a directory into itself to fail, got: %v", err)
+	}
+}
@@ -0,0 +1,117 @@
+package simplefs
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/boltdb/bolt"
+)
+
+//checkEOF returns ErrMissingEOFMarker if the file node has chunk ptrs but none of them marks the end of the file, its size would silently be computed as zero
+func (ntx *nodeTx) checkEOF() (err error) {
+	ptrs, eof := 0, false
+	if err = ntx.getChunkPtrs(func(offset int64, k K) error {
+		if k == ZeroKey {
+			eof = true
+		}
+
+		ptrs++
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	if ptrs > 0 && !eof {
+		return ErrMissingEOFMarker
+	}
+
+	return nil
+}
+
+//inferEOF puts an EOF marker right after the chunk with the highest offset and returns the resulting file size
+func (ntx *nodeTx) inferEOF() (size int64, err error) {
+	last, lastk := int64(-1), K{}
+	if err = ntx.getChunkPtrs(func(offset int64, k K) error {
+		if offset > last {
+			last, lastk = offset, k
+		}
+
+		return nil
+	}); err != nil {
+		return 0, err
+	}
+
+	if last < 0 {
+		return 0, nil //an empty file needs no marker
+	}
+
+	if lastk != ZeroKey {
+		data := ntx.tx.Bucket(ChunkBucketName).Get(lastk[:])
+		if data == nil {
+			return 0, fmt.Errorf("last chunk %x doesn't exist", lastk)
+		}
+
+		last = last + int64(len(data))
+		if err = ntx.putChunkPtr(last, ZeroKey); err != nil {
+			return 0, err
+		}
+	}
+
+	return last, nil
+}
+
+//RepairEOF restores the EOF marker of the file at 'p' when it is missing, the size of the file is inferred from the end of its last chunk. Files that have a marker are left alone. If there is an error, it will be of type *PathError.
+func (fs *FileSystem) RepairEOF(p P) (err error) {
+	err = p.Validate()
+	if err != nil {
+		return p.Err("repaireof", err)
+	}
+
+	if fs.readOnly {
+		return p.Err("repaireof", ErrReadOnly)
+	}
+
+	if err = fs.db.Update(func(tx *bolt.Tx) error {
+		ntx, err := fs.nodeTx(tx, fs.root)
+		if err != nil {
+			return fmt.Errorf("failed to create node tx for '%v': %v", fs.root, err)
+		}
+
+		nid := ntx.getDescendantID(p)
+		if nid == 0 {
+			return os.ErrNotExist
+		}
+
+		if ntx, err = fs.nodeTx(tx, nid); err != nil {
+			return fmt.Errorf("failed to create node tx for '%v': %v", nid, err)
+		}
+
+		n, err := ntx.getNode()
+		if err != nil {
+			return err
+		}
+
+		if n == nil {
+			return os.ErrNotExist
+		}
+
+		if n.isDir() {
+			return nil //directories have no chunks
+		}
+
+		if err = ntx.checkEOF(); err != ErrMissingEOFMarker {
+			return err
+		}
+
+		if _, err = ntx.inferEOF(); err != nil {
+			return err
+		}
+
+		_, _, err = ntx.putNode(n.typ(), n.Mode)
+		return err
+	}); err != nil {
+		return p.Err("repaireof", err)
+	}
+
+	return nil
+}
@@ -12,8 +12,22 @@ var (
 var (
 	//ErrNotDirectory is returned when a directory was expected
 	ErrNotDirectory = errors.New("not a directory")
+	//ErrIsDirectory is returned when a directory is opened for writing or read as a file, directories hold child ptrs instead of content
+	ErrIsDirectory = errors.New("is a directory")
+	//ErrNotRegular is returned when the content is read or written of a node that is neither a regular file nor a directory, such as a node of a type that this version doesn't know
+	ErrNotRegular = errors.New("not a regular file")
 	//ErrNotEmptyDirectory tells us the directory was not empty
 	ErrNotEmptyDirectory = errors.New("directory is not empty")
+	//ErrReadOnly is returned when a read-only filesystem, such as a snapshot, is asked to change
+	ErrReadOnly = errors.New("read-only file system")
+	//ErrMissingEOFMarker is returned when a file is opened that has chunk ptrs but no EOF marker, for example because writing it was interrupted. RepairEOF can restore the marker
+	ErrMissingEOFMarker = errors.New("file is missing its EOF marker")
+	//ErrTreeInUse is returned when a file system is created on a tree that another file system in this process serves, see New
+	ErrTreeInUse = errors.New("tree is in use by another file system")
+	//ErrStaleHandle is returned when a file handle is used after the node it was opened on was removed and its id was given to another node
+	ErrStaleHandle = errors.New("stale file handle")
+	//ErrSharedBucket is returned when a file system is compacted whose node bucket also holds the tree of another root, see WithRootID
+	ErrSharedBucket = errors.New("node bucket holds other trees")
 )
 
 var (
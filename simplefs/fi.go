@@ -33,8 +33,18 @@ func (fi *fileInfo) Mode() os.FileMode { return fi.node.Mode }
 //ModTime holds when the file was last modified
 func (fi *fileInfo) ModTime() time.Time { return fi.node.ModTime }
 
-//IsDir reports whether m describes a directory. That is, it tests for the ModeDir bit being set in m.
-func (fi *fileInfo) IsDir() bool { return fi.Mode().IsDir() }
+//IsDir reports whether the file is a directory, as told by the type of its node
+func (fi *fileInfo) IsDir() bool { return fi.node.isDir() }
 
 //Sys returns underlying system values
 func (fi *fileInfo) Sys() interface{} { return nil }
+
+//Checksum returns the content checksum of a file or directory as returned by Stat, files with the same content have the same checksum. It returns nil for file information from elsewhere
+func Checksum(fi os.FileInfo) []byte {
+	sfi, ok := fi.(*fileInfo)
+	if !ok {
+		return nil
+	}
+
+	return sfi.node.Checksum
+}
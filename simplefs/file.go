@@ -1,8 +1,15 @@
 package simplefs
 
 import (
+	"bytes"
 	"io"
+	"os"
+	"runtime"
+	"sort"
+	"sync"
+	"time"
 
+	"github.com/boltdb/bolt"
 	"github.com/restic/chunker"
 )
 
@@ -12,51 +19,391 @@ const miB = kiB * 1024
 //@TODO what about concurrent file writing/reading?
 //@TODO can we do better then linux: http://0pointer.de/blog/projects/locking.html
 
-//File represents a handle for writing and reading
+//File represents a handle for writing and reading. A handle that is garbage collected without being closed stops chunking and committing in the background, its uncommitted writes are lost
 type File struct {
+	*file
+}
+
+//file holds the state of a handle, routines that chunk and commit in the background only refer to it such that the File that wraps it can be garbage collected
+type file struct {
 	buf    []byte
 	chkr   *chunker.Chunker
 	pol    chunker.Pol
 	Pw     io.WriteCloser
-	chunks map[uint][]byte
+	chunks map[int64][]byte //chunked but uncommitted bytes by their file offset
 
 	fs  *FileSystem //filesystem this file is on
 	nid uint64      //id of the node this handle is responsible for
+	gen uint64      //generation of the node when the handle was opened, zero if it isn't checked
+
+	mu     sync.Mutex    //protects the chunks map, which is filled by the chunking routine
+	wmu    sync.Mutex    //serializes writes with flushes of the chunker
+	cmu    sync.Mutex    //serializes commits, such that chunks are committed in the order they were written
+	pos    int64         //file offset of the next write
+	off    int64         //file offset at which the current chunker started
+	writes uint64        //number of writes, used to detect that the file is idle
+	doneCh chan struct{} //closed when the current chunker has chunked all written bytes
+	stopCh chan struct{} //closed to stop committing in the background
 }
 
-//NewFile creates an interface for writing and reading byte chunks through a traditional file interface
+//NewFile creates an interface for writing and reading byte chunks through a traditional file interface. The handle doesn't check the generation of the node, such that it writes to whatever node has the id
 func NewFile(fs *FileSystem, nodeID uint64) *File {
-	f := &File{
+	return newFile(fs, nodeID, 0)
+}
+
+//newFile creates a handle on node 'nodeID' that refuses to write once the node no longer has generation 'gen'
+func newFile(fs *FileSystem, nodeID uint64, gen uint64) *File {
+	f := &file{
 		fs:     fs,
 		nid:    nodeID,
+		gen:    gen,
 		pol:    chunker.Pol(0x3DA3358B4DC173),
-		chunks: map[uint][]byte{},
+		chunks: map[int64][]byte{},
+		stopCh: make(chan struct{}),
 	}
 
+	f.start(0)
+	if fs.commitInterval > 0 {
+		go f.committer(fs.commitInterval)
+	}
+
+	h := &File{f}
+	runtime.SetFinalizer(h, func(h *File) { h.stop() })
+	return h
+}
+
+//start sets up a new chunker that chunks written bytes from file offset 'off' onwards
+func (f *file) start(off int64) {
 	var pr io.Reader
 	pr, f.Pw = io.Pipe()
 
+	f.off = off
 	f.chkr = chunker.NewWithBoundaries(pr, f.pol, (256 * kiB), (1 * miB))
-	f.buf = make([]byte, f.chkr.MaxSize)
+	if f.buf == nil {
+		f.buf = make([]byte, f.chkr.MaxSize)
+	}
 
+	chkr, doneCh := f.chkr, make(chan struct{})
+	f.doneCh = doneCh
 	go func() {
+		defer close(doneCh)
 		for {
-			chunk, err := f.chkr.Next(f.buf)
-			if err == io.EOF {
+			chunk, err := chkr.Next(f.buf)
+			if err != nil {
 				break
 			}
 
-			f.chunks[chunk.Start] = make([]byte, chunk.Length)
-			copy(f.chunks[chunk.Start], chunk.Data)
+			f.mu.Lock()
+			f.chunks[off+int64(chunk.Start)] = append([]byte{}, chunk.Data...)
+			f.mu.Unlock()
 		}
 	}()
+}
+
+//flush closes the chunk writer, causing the chunker to turn any remaining (buffered) bytes into a last chunk. A new chunker is started at the current position. The caller must hold the write lock
+func (f *file) flush() error {
+	if f.pos == f.off {
+		return nil //nothing written since the chunker started
+	}
+
+	if err := f.Pw.Close(); err != nil {
+		return err
+	}
 
-	return f
+	<-f.doneCh
+	f.start(f.pos)
+	return nil
 }
 
-// Write writes len(b) bytes to the File. It returns the number of bytes written and an error, if any. Write returns a non-nil error when n != len(b).
-func (f *File) Write(b []byte) (n int, err error) {
+//commit writes the chunks that are ready to the database in a transaction of its own, the node's size is updated in the same transaction such that readers see a consistent file. Only the regions that were written are changed: stored chunks outside of them keep their ptrs, those that are partly overwritten are combined with the written bytes and rechunked
+func (f *file) commit() (err error) {
+	f.cmu.Lock()
+	defer f.cmu.Unlock()
+
+	f.mu.Lock()
+	chunks := f.chunks
+	f.chunks = map[int64][]byte{}
+	f.mu.Unlock()
+	if len(chunks) == 0 {
+		return nil
+	}
+
+	if err = f.fs.db.Update(func(tx *bolt.Tx) error {
+		ntx, err := f.fs.nodeTx(tx, f.nid)
+		if err != nil {
+			return err
+		}
+
+		n, err := f.checkNode(ntx)
+		if err != nil {
+			return err
+		}
+
+		//stored chunk ptrs by offset, with the length of their chunk. The EOF marker is moved if the file grows
+		eof, hasEOF := int64(0), false
+		stored := map[int64]K{}
+		lens := map[int64]int64{}
+		if err = ntx.getChunkPtrs(func(offset int64, k K) error {
+			if k == ZeroKey {
+				eof, hasEOF = offset, true
+				return nil
+			}
+
+			stored[offset] = k
+			lens[offset] = int64(len(tx.Bucket(ChunkBucketName).Get(k[:])))
+			return nil
+		}); err != nil {
+			return err
+		}
+
+		end := eof
+		regions := dirtyRegions(chunks, stored, lens)
+		for _, r := range regions {
+			if r.end > end {
+				end = r.end
+			}
+		}
+
+		//the marker is removed before chunks are written, a chunk that continues the file is stored under the same key
+		if hasEOF && end != eof {
+			if err = ntx.delChunkPtr(eof); err != nil {
+				return err
+			}
+		}
+
+		for _, r := range regions {
+			for offset := range stored {
+				if offset >= r.off && offset < r.end {
+					if err = ntx.delChunkPtr(offset); err != nil {
+						return err
+					}
+				}
+			}
+
+			written := map[int64][]byte{}
+			for off, data := range chunks {
+				if off >= r.off && off < r.end {
+					written[off] = data
+				}
+			}
+
+			if r.partial {
+				if written, err = f.rechunk(tx, r, stored, written); err != nil {
+					return err
+				}
+			}
+
+			for off, data := range written {
+				k, err := ntx.putChunk(data)
+				if err != nil {
+					return err
+				}
+
+				if err = ntx.putChunkPtr(off, k); err != nil {
+					return err
+				}
+			}
+		}
+
+		if !hasEOF || end != eof {
+			if err = ntx.putChunkPtr(end, ZeroKey); err != nil {
+				return err
+			}
+		}
+
+		_, _, err = ntx.putNode(n.typ(), n.Mode)
+		return err
+	}); err != nil {
+
+		//put the chunks back such that a next commit can try again
+		f.mu.Lock()
+		for off, data := range chunks {
+			if _, ok := f.chunks[off]; !ok {
+				f.chunks[off] = data
+			}
+		}
+
+		f.mu.Unlock()
+		return err
+	}
+
+	return nil
+}
+
+//region is a range of file offsets that was written since the last commit, widened to the stored chunks that it partly overwrites
+type region struct {
+	off     int64 //file offset of the first byte
+	end     int64 //file offset right after the last byte
+	partial bool  //whether a stored chunk is only partly overwritten, such that the region has to be rechunked
+}
+
+//dirtyRegions returns the regions of the file that the written 'chunks' change, in file order. Adjacent written chunks form a single region, a region that partly overwrites a stored chunk of 'stored' (with the lengths in 'lens') is widened to cover it completely. Regions that then overlap are merged
+func dirtyRegions(chunks map[int64][]byte, stored map[int64]K, lens map[int64]int64) (regions []region) {
+	offs := make([]int64, 0, len(chunks))
+	for off := range chunks {
+		offs = append(offs, off)
+	}
+
+	sort.Slice(offs, func(i, j int) bool { return offs[i] < offs[j] })
+	for _, off := range offs {
+		end := off + int64(len(chunks[off]))
+		if l := len(regions); l > 0 && off <= regions[l-1].end {
+			if end > regions[l-1].end {
+				regions[l-1].end = end
+			}
+
+			continue
+		}
+
+		regions = append(regions, region{off: off, end: end})
+	}
+
+	for i := range regions {
+		for offset, n := range lens {
+			if offset >= regions[i].end || offset+n <= regions[i].off {
+				continue //not overwritten
+			}
+
+			if offset < regions[i].off {
+				regions[i].off, regions[i].partial = offset, true
+			}
+
+			if offset+n > regions[i].end {
+				regions[i].end, regions[i].partial = offset+n, true
+			}
+		}
+	}
+
+	merged := regions[:0]
+	for _, r := range regions {
+		if l := len(merged); l > 0 && r.off < merged[l-1].end {
+			if r.end > merged[l-1].end {
+				merged[l-1].end = r.end
+			}
+
+			merged[l-1].partial = true
+			continue
+		}
+
+		merged = append(merged, r)
+	}
+
+	return merged
+}
+
+//rechunk assembles the content of region 'r' from the stored chunks that it covers with the 'written' chunks on top, and chunks it again. It returns the new chunks by their file offset
+func (f *file) rechunk(tx *bolt.Tx, r region, stored map[int64]K, written map[int64][]byte) (chunks map[int64][]byte, err error) {
+	data := make([]byte, r.end-r.off)
+	for offset, k := range stored {
+		if offset >= r.off && offset < r.end {
+			copy(data[offset-r.off:], tx.Bucket(ChunkBucketName).Get(k[:]))
+		}
+	}
+
+	for off, d := range written {
+		copy(data[off-r.off:], d)
+	}
+
+	chunks = map[int64][]byte{}
+	chkr := chunker.NewWithBoundaries(bytes.NewReader(data), f.pol, (256 * kiB), (1 * miB))
+	buf := make([]byte, chkr.MaxSize)
+	for {
+		chunk, err := chkr.Next(buf)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+
+		chunks[r.off+int64(chunk.Start)] = append([]byte{}, chunk.Data...)
+	}
+
+	return chunks, nil
+}
+
+//committer periodically commits the written chunks until the file or its file system is closed, if no writes took place during an interval the chunker is flushed as well
+func (f *file) committer(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	writes := uint64(0)
+	for {
+		select {
+		case <-f.stopCh:
+			return
+		case <-f.fs.closed:
+			return
+		case <-ticker.C:
+		}
+
+		f.wmu.Lock()
+		if f.writes == writes {
+			f.flush() //idle, errors surface on the next write, sync or close
+		}
+
+		writes = f.writes
+		f.wmu.Unlock()
+		f.commit()
+	}
+}
+
+//checkNode returns the node of the handle, it fails if the node was removed or if its id now belongs to another node
+func (f *file) checkNode(ntx *nodeTx) (n *node, err error) {
+	n, err = ntx.getNode()
+	if err != nil {
+		return nil, err
+	}
+
+	if n == nil {
+		return nil, os.ErrNotExist
+	}
+
+	if f.gen != 0 && n.Gen != f.gen {
+		return nil, ErrStaleHandle
+	}
+
+	return n, nil
+}
+
+//checkContent returns an error if the node of the handle is gone or isn't a regular file, before its content is read or written. Nodes without a stored type are regular files unless their mode says they are a directory
+func (f *file) checkContent() (err error) {
+	return f.fs.db.View(func(tx *bolt.Tx) error {
+		ntx, err := f.fs.nodeTx(tx, f.nid)
+		if err != nil {
+			return err
+		}
+
+		n, err := f.checkNode(ntx)
+		if err != nil {
+			return err
+		}
+
+		switch n.typ() {
+		case nodeFile:
+			return nil
+		case nodeDir:
+			return ErrIsDirectory
+		default:
+			return ErrNotRegular
+		}
+	})
+}
+
+// Write writes len(b) bytes to the File. It returns the number of bytes written and an error, if any. Write returns a non-nil error when n != len(b). Handles on a directory fail with ErrIsDirectory.
+func (f *file) Write(b []byte) (n int, err error) {
+	if f.fs.readOnly {
+		return 0, ErrReadOnly
+	}
+
+	if err = f.checkContent(); err != nil {
+		return 0, err
+	}
+
+	f.wmu.Lock()
+	defer f.wmu.Unlock()
 	n, err = f.Pw.Write(b)
+	f.pos += int64(n)
+	f.writes++
 	if err != nil {
 		return n, err
 	}
@@ -64,22 +411,125 @@ func (f *File) Write(b []byte) (n int, err error) {
 	return n, err
 }
 
-// Read reads up to len(b) bytes from the File. It returns the number of bytes read and an error, if any. EOF is signaled by a zero count with err set to io.EOF.
-func (f *File) Read(b []byte) (n int, err error) {
+// Read reads up to len(b) bytes from the File. It returns the number of bytes read and an error, if any. EOF is signaled by a zero count with err set to io.EOF. Handles on a directory fail with ErrIsDirectory.
+func (f *file) Read(b []byte) (n int, err error) {
+	if err = f.checkContent(); err != nil {
+		return 0, err
+	}
+
 	return 0, ErrNotImplemented
 }
 
-// Seek sets the offset for the next Read or Write on file to offset, interpreted according to whence: 0 means relative to the origin of the file, 1 means relative to the current offset, and 2 means relative to the end. It returns the new offset and an error, if any. The behavior of Seek on a file opened with O_APPEND is not specified.
-func (f *File) Seek(offset int64, whence int) (ret int64, err error) {
+// Seek sets the offset for the next Read or Write on file to offset, interpreted according to whence: 0 means relative to the origin of the file, 1 means relative to the current offset, and 2 means relative to the end. It returns the new offset and an error, if any. The behavior of Seek on a file opened with O_APPEND is not specified. Bytes that were written before seeking are committed first, writes after seeking overwrite the file from the new offset onwards
+func (f *file) Seek(offset int64, whence int) (ret int64, err error) {
+	f.wmu.Lock()
+	defer f.wmu.Unlock()
 
-	//seek forces us to close the chunk writer to flush stored bytes of the chunker to our map.
+	//seek forces us to close the chunk writer to flush stored bytes of the chunker to our map, they are committed such that what is written next is committed after them
+	if err = f.flush(); err != nil {
+		return 0, err
+	}
 
-	//the chunker should then be reset and start overwriting
+	if err = f.commit(); err != nil {
+		return 0, err
+	}
 
-	return 0, ErrNotImplemented
+	switch whence {
+	case io.SeekStart:
+		ret = offset
+	case io.SeekCurrent:
+		ret = f.pos + offset
+	case io.SeekEnd:
+		if err = f.fs.db.View(func(tx *bolt.Tx) error {
+			ntx, err := f.fs.nodeTx(tx, f.nid)
+			if err != nil {
+				return err
+			}
+
+			n, err := f.checkNode(ntx)
+			if err != nil {
+				return err
+			}
+
+			ret = n.Size + offset
+			return nil
+		}); err != nil {
+			return 0, err
+		}
+	default:
+		return 0, os.ErrInvalid
+	}
+
+	if ret < 0 {
+		return 0, os.ErrInvalid
+	}
+
+	//the chunker is then reset and starts overwriting at the new offset
+	if ret != f.pos {
+		if err = f.Pw.Close(); err != nil {
+			return 0, err
+		}
+
+		<-f.doneCh
+		f.pos = ret
+		f.start(ret)
+	}
+
+	return ret, nil
 }
 
 //Sync will commit in-memory chunks to the database, from there its up to the OS and disk hardware to make sure it arrives on the actual medium
-func (f *File) Sync() error {
-	return ErrNotImplemented
+func (f *file) Sync() (err error) {
+	f.wmu.Lock()
+	err = f.flush()
+	f.wmu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	return f.commit()
+}
+
+//Checkpoint commits the chunks that were cut from the bytes written so far, in a transaction of its own like all commits of the handle, such that long writes persist their progress and other writers get the database in between. Unlike Sync the chunker isn't flushed: bytes that don't form a complete chunk yet stay buffered, chunk boundaries stay where continued writing puts them and the written content deduplicates as if it was written in one go. It is meant for writers that don't enable committing in the background with WithCommitInterval and want to choose when progress is persisted
+func (f *file) Checkpoint() (err error) {
+	select {
+	case <-f.stopCh:
+		return os.ErrClosed
+	default:
+	}
+
+	return f.commit()
+}
+
+//stop ends chunking and committing in the background without committing what was written, it is called when a handle is garbage collected without being closed
+func (f *file) stop() {
+	f.wmu.Lock()
+	defer f.wmu.Unlock()
+	select {
+	case <-f.stopCh:
+		return
+	default:
+		close(f.stopCh)
+	}
+
+	f.Pw.Close()
+}
+
+//Close commits all written bytes and stops committing in the background, the file cannot be written to afterwards
+func (f *file) Close() (err error) {
+	f.wmu.Lock()
+	defer f.wmu.Unlock()
+	select {
+	case <-f.stopCh:
+		return os.ErrClosed
+	default:
+		close(f.stopCh)
+	}
+
+	if err = f.Pw.Close(); err != nil {
+		return err
+	}
+
+	<-f.doneCh
+	return f.commit()
 }
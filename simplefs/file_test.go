@@ -1,5 +1,19 @@
 package simplefs
 
+import (
+	"bytes"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"os"
+	"runtime"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
 // func TestWrite(t *testing.T) {
 // 	fs, close := testfs(t)
 // 	defer close()
@@ -44,3 +58,532 @@ package simplefs
 // 	fmt.Println("chunked bytes:", total)
 //
 // }
+
+func TestBackgroundCommit(t *testing.T) {
+	db, close := testdb(t)
+	defer close()
+
+	fs, err := New(db, WithCommitInterval(10*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := fs.OpenFile(P{"foo.txt"}, os.O_CREATE, 0777)
+	if err != nil {
+		t.Fatalf("didn't expect error, got: %v", err)
+	}
+
+	//write slowly while another file is created
+	total := 0
+	doneCh := make(chan error)
+	go func() {
+		input := make([]byte, 64*kiB)
+		for i := 0; i < 64; i++ {
+			rand.Read(input)
+			n, err := f.Write(input)
+			if err != nil {
+				doneCh <- err
+				return
+			}
+
+			total += n
+			time.Sleep(time.Millisecond)
+		}
+
+		doneCh <- nil
+	}()
+
+	createdCh := make(chan error)
+	go func() {
+		_, err := fs.OpenFile(P{"bar.txt"}, os.O_CREATE, 0777)
+		createdCh <- err
+	}()
+
+	select {
+	case err = <-createdCh:
+		if err != nil {
+			t.Fatalf("didn't expect error, got: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("creating another file while writing should not block")
+	}
+
+	if err = <-doneCh; err != nil {
+		t.Fatalf("didn't expect error, got: %v", err)
+	}
+
+	//once the file is idle, buffered bytes are committed without syncing
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		fi, err := fs.Stat(P{"foo.txt"})
+		if err != nil {
+			t.Fatalf("didn't expect stat error, got: %v", err)
+		}
+
+		if fi.Size() == int64(total) {
+			break
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatalf("expected size to become %d, got: %d", total, fi.Size())
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	err = f.Close()
+	if err != nil {
+		t.Fatalf("didn't expect error, got: %v", err)
+	}
+}
+
+func TestBackgroundCommitStops(t *testing.T) {
+	db, close := testdb(t)
+	defer close()
+
+	//waits for the number of goroutines to drop to 'n', handles that are no longer referenced are garbage collected meanwhile
+	settle := func(n int) {
+		deadline := time.Now().Add(5 * time.Second)
+		for runtime.NumGoroutine() > n {
+			if time.Now().After(deadline) {
+				t.Fatalf("expected %d goroutines, got: %d", n, runtime.NumGoroutine())
+			}
+
+			runtime.GC()
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	//without the option only the chunker runs in the background
+	fs, err := New(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	before := runtime.NumGoroutine()
+	f, err := fs.OpenFile(P{"foo.txt"}, os.O_CREATE, 0777)
+	if err != nil {
+		t.Fatalf("didn't expect error, got: %v", err)
+	}
+
+	if n := runtime.NumGoroutine(); n != before+1 {
+		t.Errorf("expected no background committer by default, got %d new goroutines", n-before)
+	}
+
+	if err = f.Close(); err != nil {
+		t.Fatalf("didn't expect error, got: %v", err)
+	}
+
+	if err = fs.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	fs, err = New(db, WithCommitInterval(time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//a handle that is never closed stops once it is garbage collected
+	settle(before)
+	if _, err = fs.OpenFile(P{"foo.txt"}, os.O_WRONLY, 0777); err != nil {
+		t.Fatalf("didn't expect error, got: %v", err)
+	}
+
+	settle(before)
+
+	//a handle that is still open stops committing once the file system is closed, its chunker runs until it is closed
+	f, err = fs.OpenFile(P{"foo.txt"}, os.O_WRONLY, 0777)
+	if err != nil {
+		t.Fatalf("didn't expect error, got: %v", err)
+	}
+
+	if err = fs.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	settle(before + 1)
+	if err = f.Close(); err != nil {
+		t.Fatalf("didn't expect error, got: %v", err)
+	}
+
+	settle(before)
+}
+
+func TestCheckpoint(t *testing.T) {
+	db, close := testdb(t)
+	defer close()
+
+	fs, err := New(db, WithCommitInterval(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := fs.OpenFile(P{"foo.txt"}, os.O_CREATE, 0777)
+	if err != nil {
+		t.Fatalf("didn't expect error, got: %v", err)
+	}
+
+	input := make([]byte, 12*miB)
+	rand.Read(input)
+	size := int64(0)
+	for i := 0; i < 4; i++ {
+		if _, err = f.Write(input[i*3*miB : (i+1)*3*miB]); err != nil {
+			t.Fatalf("didn't expect error, got: %v", err)
+		}
+
+		if err = f.Checkpoint(); err != nil {
+			t.Fatalf("didn't expect error, got: %v", err)
+		}
+
+		//what was chunked so far is persisted, the last bytes wait for more to be written
+		fi, err := fs.Stat(P{"foo.txt"})
+		if err != nil {
+			t.Fatalf("didn't expect stat error, got: %v", err)
+		}
+
+		if fi.Size() <= size || fi.Size() > int64((i+1)*3*miB) {
+			t.Errorf("expected checkpoint %d to grow the file up to %d bytes, got: %d", i, (i+1)*3*miB, fi.Size())
+		}
+
+		size = fi.Size()
+
+		//other writers make progress between checkpoints
+		createdCh := make(chan error)
+		go func() {
+			createdCh <- fs.Mkdir(P{fmt.Sprintf("dir%d", i)}, 0777)
+		}()
+
+		select {
+		case err = <-createdCh:
+			if err != nil {
+				t.Fatalf("didn't expect error, got: %v", err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("creating a directory between checkpoints should not block")
+		}
+	}
+
+	if err = f.Close(); err != nil {
+		t.Fatalf("didn't expect error, got: %v", err)
+	}
+
+	if fi, err := fs.Stat(P{"foo.txt"}); err != nil || fi.Size() != int64(len(input)) {
+		t.Errorf("expected all bytes to be committed on close, got: %v, %v", fi, err)
+	}
+
+	//chunks are cut as if the file was written in one go, none of them are lost where checkpoints left off
+	chunks, stored := 0, 0
+	if err = db.View(func(tx *bolt.Tx) error {
+		ntx, err := fs.nodeTx(tx, fs.root)
+		if err != nil {
+			return err
+		}
+
+		if ntx, err = fs.nodeTx(tx, ntx.getDescendantID(P{"foo.txt"})); err != nil {
+			return err
+		}
+
+		return ntx.getChunkPtrs(func(offset int64, k K) error {
+			if k != ZeroKey {
+				chunks++
+				stored += len(tx.Bucket(ChunkBucketName).Get(k[:]))
+			}
+
+			return nil
+		})
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if chunks < 12 || chunks > 48 || stored != len(input) {
+		t.Errorf("expected chunks between the minimum and maximum chunk size to hold all bytes, got: %d chunks with %d bytes", chunks, stored)
+	}
+
+	if err = f.Checkpoint(); err != os.ErrClosed {
+		t.Errorf("expected checkpointing a closed file to fail, got: %v", err)
+	}
+}
+
+func TestChecksum(t *testing.T) {
+	fs, close := testfs(t)
+	defer close()
+
+	write := func(data []byte, flag int) os.FileInfo {
+		f, err := fs.OpenFile(P{"foo.txt"}, flag, 0777)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err = f.Write(data); err != nil {
+			t.Fatal(err)
+		}
+
+		if err = f.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		fi, err := fs.Stat(P{"foo.txt"})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return fi
+	}
+
+	data := make([]byte, 600*kiB)
+	rand.Read(data)
+	fi1 := write(data, os.O_CREATE)
+	if len(Checksum(fi1)) == 0 {
+		t.Fatal("expected file to have a checksum")
+	}
+
+	//rewriting the same content changes nothing
+	fi2 := write(data, os.O_WRONLY)
+	if !bytes.Equal(Checksum(fi1), Checksum(fi2)) {
+		t.Error("expected checksum to be unchanged")
+	}
+
+	if !fi2.ModTime().Equal(fi1.ModTime()) {
+		t.Errorf("expected modtime to be unchanged, got: %v (was %v)", fi2.ModTime(), fi1.ModTime())
+	}
+
+	//while an actual edit changes both
+	data[0]++
+	fi3 := write(data, os.O_WRONLY)
+	if bytes.Equal(Checksum(fi1), Checksum(fi3)) {
+		t.Error("expected checksum to change")
+	}
+
+	if !fi3.ModTime().After(fi1.ModTime()) {
+		t.Errorf("expected modtime to be updated, got: %v (was %v)", fi3.ModTime(), fi1.ModTime())
+	}
+}
+
+func TestMissingEOFMarker(t *testing.T) {
+	fs, close := testfs(t)
+	defer close()
+
+	f, err := fs.OpenFile(P{"foo.txt"}, os.O_CREATE, 0777)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := make([]byte, 600*kiB)
+	rand.Read(data)
+	if _, err = f.Write(data); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	fi, err := fs.Stat(P{"foo.txt"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//drop the marker as if writing was interrupted
+	if err = fs.db.Update(func(tx *bolt.Tx) error {
+		ntx, err := fs.nodeTx(tx, fi.(*fileInfo).nodeID)
+		if err != nil {
+			return err
+		}
+
+		return ntx.delChunkPtr(fi.Size())
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = fs.OpenFile(P{"foo.txt"}, os.O_RDONLY, 0); err == nil || err.(*os.PathError).Err != ErrMissingEOFMarker {
+		t.Fatalf("expected ErrMissingEOFMarker, got: %v", err)
+	}
+
+	//stat doesn't walk the chunk ptrs
+	if _, err = fs.Stat(P{"foo.txt"}); err != nil {
+		t.Errorf("expected stat to succeed without checking the marker, got: %v", err)
+	}
+
+	if err = fs.RepairEOF(P{"foo.txt"}); err != nil {
+		t.Fatalf("expected repair to succeed, got: %v", err)
+	}
+
+	repaired, err := fs.Stat(P{"foo.txt"})
+	if err != nil {
+		t.Fatalf("expected repaired file to stat, got: %v", err)
+	}
+
+	if repaired.Size() != int64(len(data)) {
+		t.Errorf("expected inferred size to be %d, got: %d", len(data), repaired.Size())
+	}
+
+	//repairing an intact file changes nothing
+	if err = fs.RepairEOF(P{"foo.txt"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if again, _ := fs.Stat(P{"foo.txt"}); !bytes.Equal(Checksum(again), Checksum(repaired)) {
+		t.Error("expected repairing an intact file to leave it as is")
+	}
+}
+
+func TestStaleHandle(t *testing.T) {
+	fs, close := testfs(t)
+	defer close()
+
+	f, err := fs.OpenFile(P{"a.txt"}, os.O_CREATE, 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer f.Close()
+	if err = fs.Remove(P{"a.txt"}); err != nil {
+		t.Fatal(err)
+	}
+
+	//force the next node to reuse the id of the removed one
+	if err = fs.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(fs.nodes).SetSequence(f.nid - 1)
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	g, err := fs.OpenFile(P{"b.txt"}, os.O_CREATE, 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if g.nid != f.nid {
+		t.Fatalf("expected the new file to reuse node %d, got: %d", f.nid, g.nid)
+	}
+
+	if _, err = f.Write([]byte("foo")); err != ErrStaleHandle {
+		t.Errorf("expected writing a stale handle to fail with ErrStaleHandle, got: %v", err)
+	}
+
+	if _, err = g.Write([]byte("bar")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = g.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	fi, err := fs.Stat(P{"b.txt"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if fi.Size() != 3 {
+		t.Errorf("expected the new file to keep its own content, got %d bytes", fi.Size())
+	}
+}
+
+func TestPartialSync(t *testing.T) {
+	fs, close := testfs(t)
+	defer close()
+
+	data := make([]byte, 4*miB)
+	rand.Read(data)
+	f, err := fs.OpenFile(P{"a.bin"}, os.O_CREATE, 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = f.Write(data); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	fi, err := fs.Stat(P{"a.bin"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//returns the chunk ptrs of the file and its content as assembled from them
+	ptrs := func() (ptrs map[int64]K, content []byte) {
+		ptrs = map[int64]K{}
+		if err := fs.db.View(func(tx *bolt.Tx) error {
+			ntx, err := fs.nodeTx(tx, fi.(*fileInfo).nodeID)
+			if err != nil {
+				return err
+			}
+
+			return ntx.getChunkPtrs(func(offset int64, k K) error {
+				ptrs[offset] = k
+				return nil
+			})
+		}); err != nil {
+			t.Fatal(err)
+		}
+
+		offsets := []int64{}
+		for offset := range ptrs {
+			offsets = append(offsets, offset)
+		}
+
+		sort.Slice(offsets, func(i, j int) bool { return offsets[i] < offsets[j] })
+		for _, offset := range offsets {
+			if k := ptrs[offset]; k != ZeroKey {
+				if err := fs.db.View(func(tx *bolt.Tx) error {
+					content = append(content, tx.Bucket(ChunkBucketName).Get(k[:])...)
+					return nil
+				}); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+
+		return ptrs, content
+	}
+
+	before, _ := ptrs()
+	if len(before) < 4 {
+		t.Fatalf("expected the file to be stored in several chunks, got: %d", len(before))
+	}
+
+	//overwrite a few bytes in the middle
+	off := int64(2*miB + 123)
+	edit := []byte("0123456789")
+	if f, err = fs.OpenFile(P{"a.bin"}, os.O_WRONLY, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	defer f.Close()
+	if ret, err := f.Seek(off, io.SeekStart); err != nil || ret != off {
+		t.Fatalf("expected to seek to %d, got: %d, %v", off, ret, err)
+	}
+
+	if _, err = f.Write(edit); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = f.Sync(); err != nil {
+		t.Fatal(err)
+	}
+
+	after, content := ptrs()
+	copy(data[off:], edit)
+	if !bytes.Equal(content, data) {
+		t.Fatal("expected the file to hold the edited content")
+	}
+
+	//only the chunk that holds the edit is replaced, other chunks keep their ptrs
+	changed := 0
+	for offset, k := range before {
+		if after[offset] != k {
+			changed++
+		}
+	}
+
+	if changed != 1 {
+		t.Errorf("expected a single chunk to change, got: %d", changed)
+	}
+
+	if fi, err = fs.Stat(P{"a.bin"}); err != nil || fi.Size() != int64(len(data)) {
+		t.Errorf("expected the size to stay %d, got: %v", len(data), err)
+	}
+}
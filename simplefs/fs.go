@@ -4,8 +4,11 @@ import (
 	"crypto/sha256"
 	"fmt"
 	"os"
+	"sync"
+	"time"
 
 	"github.com/boltdb/bolt"
+	"github.com/cellstate/treedb"
 )
 
 //K is a content-based key
@@ -18,47 +21,158 @@ var (
 
 //FileSystem provides a filesystem abstraction on top of Bolt db
 type FileSystem struct {
-	db   *bolt.DB
-	root uint64
+	db    *bolt.DB
+	root  uint64 //id of the root node
+	nodes []byte //name of the bucket that holds the nodes
+
+	commitInterval time.Duration //how often open files commit in the background
+	cache          *statCache    //resolved paths and decoded nodes, if enabled
+	rootc          *rootCache    //decoded root node, if the stat cache is enabled
+	readOnly       bool          //set for snapshots, all mutations are refused
+	clock          treedb.Clock  //tells the modification time of nodes
+	closed         chan struct{} //closed when the file system is closed, which stops committing in the background
+	closeOnce      sync.Once
 }
 
-//New creates a simple filesystem on the provided database
-func New(db *bolt.DB) (fs *FileSystem, err error) {
+//New creates a simple filesystem on the provided database. A tree is served by a single file system in a process, creating another one on the same database, node bucket and root while the first isn't closed fails with ErrTreeInUse. Use WithID or WithRootID to give a file system a tree of its own
+func New(db *bolt.DB, opts ...Option) (fs *FileSystem, err error) {
 	fs = &FileSystem{
-		db:   db,
-		root: 1, //@TODO make this more flexible
+		db:    db,
+		root:  1,
+		nodes: NodeBucketName,
+
+		clock:  treedb.WallClock,
+		closed: make(chan struct{}),
+	}
+
+	for _, opt := range opts {
+		opt(fs)
+	}
+
+	if fs.root == 0 {
+		return nil, fmt.Errorf("invalid root node id: %d", fs.root) //zero is reserved for creating new nodes
+	}
+
+	if err = claim(fs); err != nil {
+		return nil, err
 	}
 
 	if err = fs.db.Update(func(tx *bolt.Tx) (err error) {
+		if _, err = tx.CreateBucketIfNotExists(ChunkBucketName); err != nil {
+			return err
+		}
+
 		var b *bolt.Bucket
-		if b, err = tx.CreateBucketIfNotExists(NodeBucketName); err != nil {
+		if b, err = tx.CreateBucketIfNotExists(fs.nodes); err != nil {
 			return err
 		}
 
-		//create root node if it doesnt exist
-		v := b.Get(u64tob(fs.root))
-		if v == nil {
-			ntx, err := newNodeTx(tx, 0)
-			if err != nil {
+		//create root node if it doesnt exist, new nodes get ids above it
+		ntx, err := fs.nodeTx(tx, fs.root)
+		if err != nil {
+			return err
+		}
+
+		n, err := ntx.getNode()
+		if err != nil {
+			return err
+		}
+
+		if n != nil && !n.isDir() {
+			return fmt.Errorf("root node %d is not a directory", fs.root) //the id is taken by a node of another tree
+		}
+
+		if n == nil {
+			if _, _, err = ntx.putNode(nodeDir, os.ModeDir|0777); err != nil {
 				return err
 			}
 
-			fs.root, _, err = ntx.putNode(os.ModeDir | 0777)
-			if err != nil {
-				return err
+			if b.Sequence() < fs.root {
+				if err = b.SetSequence(fs.root); err != nil {
+					return err
+				}
 			}
 		}
 
-		return nil
+		//roots are recorded such that compacting a tree can tell whether the bucket holds others
+		roots, err := tx.CreateBucketIfNotExists(rootsBucket(fs.nodes))
+		if err != nil {
+			return err
+		}
+
+		return roots.Put(u64tob(fs.root), []byte{})
 	}); err != nil {
+		release(fs)
 		return nil, fmt.Errorf("failed to prepare database: %v", err)
 	}
 
 	return fs, nil
 }
 
+//Close releases the tree of the file system, such that another file system can be created on it, and stops files from committing in the background. Files that are still open should be closed first, the database is left open
+func (fs *FileSystem) Close() error {
+	fs.closeOnce.Do(func() { close(fs.closed) })
+	release(fs)
+	return nil
+}
+
+//nodeTx starts a node interaction that keeps the stat cache up-to-date, if id == 0 a new node is created
+func (fs *FileSystem) nodeTx(tx *bolt.Tx, id uint64) (ntx *nodeTx, err error) {
+	ntx, err = openNodeTx(tx, fs.nodes, id)
+	if err != nil {
+		return nil, err
+	}
+
+	ntx.cache = fs.cache
+	ntx.clock = fs.clock
+	if id == fs.root {
+		ntx.root = fs.rootc
+	}
+
+	return ntx, nil
+}
+
+//statRoot returns info on the root node without descending, the decoded node is cached for read-only transactions if the stat cache is enabled
+func (fs *FileSystem) statRoot(tx *bolt.Tx) (fi *fileInfo, err error) {
+	if fs.cache.usable(tx) {
+		if n, ok := fs.rootc.get(); ok {
+			return newFileInfo(Root.Base(), n, fs.root), nil
+		}
+	}
+
+	ntx, err := fs.nodeTx(tx, fs.root)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create node tx for '%v': %v", fs.root, err)
+	}
+
+	n, err := ntx.getNode()
+	if err != nil {
+		return nil, err
+	}
+
+	if n == nil {
+		return nil, os.ErrNotExist
+	}
+
+	if fs.cache.usable(tx) {
+		fs.rootc.put(tx, n)
+	}
+
+	return newFileInfo(Root.Base(), n, fs.root), nil
+}
+
 func (fs *FileSystem) stat(tx *bolt.Tx, p P) (fi *fileInfo, err error) {
-	ntx, err := newNodeTx(tx, fs.root)
+	if p.IsRoot() {
+		return fs.statRoot(tx)
+	}
+
+	if fs.cache.usable(tx) {
+		if nid, n, ok := fs.cache.get(p); ok {
+			return newFileInfo(p.Base(), n, nid), nil
+		}
+	}
+
+	ntx, err := fs.nodeTx(tx, fs.root)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create node tx for '%v': %v", fs.root, err)
 	}
@@ -68,7 +182,7 @@ func (fs *FileSystem) stat(tx *bolt.Tx, p P) (fi *fileInfo, err error) {
 		return nil, os.ErrNotExist
 	}
 
-	ntx, err = newNodeTx(tx, nid)
+	ntx, err = fs.nodeTx(tx, nid)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create node tx for '%v': %v", nid, err)
 	}
@@ -82,6 +196,10 @@ func (fs *FileSystem) stat(tx *bolt.Tx, p P) (fi *fileInfo, err error) {
 		return nil, os.ErrNotExist
 	}
 
+	if fs.cache.usable(tx) {
+		fs.cache.put(tx, p, nid, n)
+	}
+
 	return newFileInfo(p.Base(), n, nid), nil
 }
 
@@ -106,6 +224,33 @@ func (fs *FileSystem) Stat(p P) (fi os.FileInfo, err error) {
 	return fi, nil
 }
 
+//addChild points directory 'parentID' to node 'id' under 'name' and rewrites the directory. Each child has a ptr of its own and the directory is rewritten from the node and ptrs as this transaction reads them, instead of from what was read before it started, such that concurrent creates in one directory never lose each other's children
+func (fs *FileSystem) addChild(tx *bolt.Tx, parentID uint64, name string, id uint64) (err error) {
+	pntx, err := fs.nodeTx(tx, parentID)
+	if err != nil {
+		return fmt.Errorf("failed to start parent node tx: %v", err)
+	}
+
+	pn, err := pntx.getNode()
+	if err != nil {
+		return err
+	}
+
+	if pn == nil {
+		return os.ErrNotExist
+	}
+
+	if err = pntx.putChildPtr(name, id); err != nil {
+		return fmt.Errorf("failed to put child ptr: %v", err)
+	}
+
+	if _, _, err = pntx.putNode(pn.typ(), pn.Mode); err != nil {
+		return fmt.Errorf("failed to update parent node: %v", err)
+	}
+
+	return nil
+}
+
 func (fs *FileSystem) mkdir(tx *bolt.Tx, p P, perm os.FileMode) (err error) {
 	pp := p.Parent()
 
@@ -127,32 +272,19 @@ func (fs *FileSystem) mkdir(tx *bolt.Tx, p P, perm os.FileMode) (err error) {
 			return err
 		}
 
-		//@TODO find out if parent cascading below can be generalized
-		ntx, err := newNodeTx(tx, 0)
+		ntx, err := fs.nodeTx(tx, 0)
 		if err != nil {
 			return fmt.Errorf("failed to start new node tx: %v", err)
 		}
 
-		nodeID, _, err := ntx.putNode(os.ModeDir | perm)
+		nodeID, _, err := ntx.putNode(nodeDir, os.ModeDir|perm)
 		if err != nil {
 			return fmt.Errorf("failed to put new node: %v", err)
 		}
 
-		pntx, err := newNodeTx(tx, pfi.nodeID)
-		if err != nil {
-			return fmt.Errorf("failed to start parent node tx: %v", err)
-		}
-
-		err = pntx.putChildPtr(p.Base(), nodeID)
-		if err != nil {
-			return fmt.Errorf("failed to put child ptr: %v", err)
-		}
-
-		_, _, err = pntx.putNode(pfi.Mode())
-		if err != nil {
-			return fmt.Errorf("failed to update parent node: %v", err)
+		if err = fs.addChild(tx, pfi.nodeID, p.Base(), nodeID); err != nil {
+			return err
 		}
-
 	} else {
 		if !fi.IsDir() {
 			//node at path exists but is not a directory
@@ -170,6 +302,10 @@ func (fs *FileSystem) Mkdir(p P, perm os.FileMode) (err error) {
 		return p.Err("mkdir", err)
 	}
 
+	if fs.readOnly {
+		return p.Err("mkdir", ErrReadOnly)
+	}
+
 	if err = fs.db.Update(func(tx *bolt.Tx) error {
 		err = fs.mkdir(tx, p, perm)
 		if err != nil {
@@ -197,7 +333,6 @@ func (fs *FileSystem) openFile(tx *bolt.Tx, p P, flag int, perm os.FileMode) (f
 	if flag&os.O_CREATE != 0 {
 		if fi == nil {
 
-			//@TODO generalize "addNode" logic below(?):
 			pp := p.Parent()
 
 			//check if parent exists
@@ -211,29 +346,18 @@ func (fs *FileSystem) openFile(tx *bolt.Tx, p P, flag int, perm os.FileMode) (f
 				return nil, ErrNotDirectory
 			}
 
-			ntx, err := newNodeTx(tx, 0)
+			ntx, err := fs.nodeTx(tx, 0)
 			if err != nil {
 				return nil, fmt.Errorf("failed to start new node tx: %v", err)
 			}
 
-			nodeID, n, err := ntx.putNode(perm)
+			nodeID, n, err := ntx.putNode(nodeFile, perm)
 			if err != nil {
 				return nil, fmt.Errorf("failed to put new node: %v", err)
 			}
 
-			pntx, err := newNodeTx(tx, pfi.nodeID)
-			if err != nil {
-				return nil, fmt.Errorf("failed to start parent node tx: %v", err)
-			}
-
-			err = pntx.putChildPtr(p.Base(), nodeID)
-			if err != nil {
-				return nil, fmt.Errorf("failed to put child ptr: %v", err)
-			}
-
-			_, _, err = pntx.putNode(pfi.Mode())
-			if err != nil {
-				return nil, fmt.Errorf("failed to update parent node: %v", err)
+			if err = fs.addChild(tx, pfi.nodeID, p.Base(), nodeID); err != nil {
+				return nil, err
 			}
 
 			fi = newFileInfo(p.Base(), n, nodeID)
@@ -247,7 +371,24 @@ func (fs *FileSystem) openFile(tx *bolt.Tx, p P, flag int, perm os.FileMode) (f
 		return nil, os.ErrNotExist
 	}
 
-	return NewFile(fs, fi.nodeID), nil
+	//directories can be opened to read their entries, but they have no content to write
+	if fi.IsDir() && flag&(os.O_WRONLY|os.O_RDWR|os.O_CREATE|os.O_TRUNC|os.O_APPEND) != 0 {
+		return nil, ErrIsDirectory
+	}
+
+	//the marker is checked once when a file is opened instead of on every stat, since that walks all its chunk ptrs
+	if !fi.IsDir() {
+		ntx, err := fs.nodeTx(tx, fi.nodeID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to start node tx: %v", err)
+		}
+
+		if err = ntx.checkEOF(); err != nil {
+			return nil, err
+		}
+	}
+
+	return newFile(fs, fi.nodeID, fi.node.Gen), nil
 }
 
 // OpenFile is the generalized open call. It opens the named file with specified flag (O_RDONLY etc.) and perm, (0666 etc.) if applicable. If successful, methods on the returned File can be used for I/O. If there is an error, it will be of type *PathError. Behaviour can be customized with the following flags:
@@ -266,28 +407,263 @@ func (fs *FileSystem) OpenFile(p P, flag int, perm os.FileMode) (f *File, err er
 		return nil, p.Err("open", err)
 	}
 
-	//begin the transaction
-	//@TODO dont use a writeable transaction if flags indicate read only
-	tx, err := fs.db.Begin(true)
+	if fs.readOnly && flag&(os.O_WRONLY|os.O_RDWR|os.O_CREATE|os.O_TRUNC|os.O_APPEND) != 0 {
+		return nil, p.Err("open", ErrReadOnly)
+	}
+
+	//begin the transaction, it only needs to be writable if the file might be created
+	tx, err := fs.db.Begin(flag&os.O_CREATE != 0)
 	if err != nil {
-		return nil, err
+		return nil, p.Err("open", err)
 	}
 
 	f, err = fs.openFile(tx, p, flag, perm)
 	if err != nil {
+		tx.Rollback() //nothing was changed that we want to keep
 		return nil, p.Err("open", err)
 	}
 
-	//always end the transaction
-	defer func() {
-		if !tx.Writable() {
-			return
+	//the file commits its writes in transactions of its own, so ours ends here
+	if !tx.Writable() {
+		tx.Rollback()
+		return f, nil
+	}
+
+	if err = tx.Commit(); err != nil {
+		f.Close()
+		return nil, p.Err("open", err)
+	}
+
+	return f, nil
+}
+
+//Chmod changes the mode of the named file to mode, the file type bits and modification time are preserved. If there is an error, it will be of type *PathError.
+func (fs *FileSystem) Chmod(p P, mode os.FileMode) (err error) {
+	err = p.Validate()
+	if err != nil {
+		return p.Err("chmod", err)
+	}
+
+	if fs.readOnly {
+		return p.Err("chmod", ErrReadOnly)
+	}
+
+	if err = fs.db.Update(func(tx *bolt.Tx) error {
+		fi, err := fs.stat(tx, p)
+		if err != nil {
+			return err
 		}
 
-		if cerr := tx.Commit(); cerr != nil {
-			err = cerr //commit errors will take precedence
+		ntx, err := fs.nodeTx(tx, fi.nodeID)
+		if err != nil {
+			return fmt.Errorf("failed to start node tx: %v", err)
 		}
-	}()
 
-	return f, nil
+		_, _, err = ntx.putNodeWithTime(fi.node.typ(), fi.Mode()&os.ModeType|mode.Perm(), fi.ModTime())
+		return err
+	}); err != nil {
+		return p.Err("chmod", err)
+	}
+
+	return nil
+}
+
+//Chtimes changes the modification time of the named file, the access time is accepted for compatibility with os.Chtimes but not stored. If there is an error, it will be of type *PathError.
+func (fs *FileSystem) Chtimes(p P, atime time.Time, mtime time.Time) (err error) {
+	err = p.Validate()
+	if err != nil {
+		return p.Err("chtimes", err)
+	}
+
+	if fs.readOnly {
+		return p.Err("chtimes", ErrReadOnly)
+	}
+
+	if err = fs.db.Update(func(tx *bolt.Tx) error {
+		fi, err := fs.stat(tx, p)
+		if err != nil {
+			return err
+		}
+
+		ntx, err := fs.nodeTx(tx, fi.nodeID)
+		if err != nil {
+			return fmt.Errorf("failed to start node tx: %v", err)
+		}
+
+		_, _, err = ntx.putNodeWithTime(fi.node.typ(), fi.Mode(), mtime)
+		return err
+	}); err != nil {
+		return p.Err("chtimes", err)
+	}
+
+	return nil
+}
+
+//Remove removes the named file or (empty) directory. If there is an error, it will be of type *PathError.
+func (fs *FileSystem) Remove(p P) (err error) {
+	err = p.Validate()
+	if err != nil {
+		return p.Err("remove", err)
+	}
+
+	if fs.readOnly {
+		return p.Err("remove", ErrReadOnly)
+	}
+
+	if p.IsRoot() {
+		return p.Err("remove", os.ErrPermission) //the root cannot be removed
+	}
+
+	if err = fs.db.Update(func(tx *bolt.Tx) error {
+		fi, err := fs.stat(tx, p)
+		if err != nil {
+			return err
+		}
+
+		ntx, err := fs.nodeTx(tx, fi.nodeID)
+		if err != nil {
+			return fmt.Errorf("failed to start node tx: %v", err)
+		}
+
+		if fi.IsDir() {
+			if err = ntx.getChildPtrs(func(name string, id uint64) error {
+				return ErrNotEmptyDirectory
+			}); err != nil {
+				return err
+			}
+		}
+
+		pfi, err := fs.stat(tx, p.Parent())
+		if err != nil {
+			return err
+		}
+
+		pntx, err := fs.nodeTx(tx, pfi.nodeID)
+		if err != nil {
+			return fmt.Errorf("failed to start parent node tx: %v", err)
+		}
+
+		if err = pntx.delChildPtr(p.Base()); err != nil {
+			return err
+		}
+
+		if _, _, err = pntx.putNode(pfi.node.typ(), pfi.Mode()); err != nil {
+			return fmt.Errorf("failed to update parent node: %v", err)
+		}
+
+		return ntx.delNode()
+	}); err != nil {
+		return p.Err("remove", err)
+	}
+
+	return nil
+}
+
+//Rename renames (moves) oldpath to newpath. If newpath already exists and is not a directory, Rename replaces it. A directory can only replace an empty directory. Since directories are nodes that are referenced by a child ptr in their parent, only that ptr is moved: renaming a directory takes the same time regardless of how many entries it holds, none of its descendants are rewritten. This is unlike treedb where all descendants are re-keyed. If there is an error, it will be of type *PathError.
+func (fs *FileSystem) Rename(oldp, newp P) (err error) {
+	for _, p := range []P{oldp, newp} {
+		if err = p.Validate(); err != nil {
+			return p.Err("rename", err)
+		}
+	}
+
+	if fs.readOnly {
+		return oldp.Err("rename", ErrReadOnly)
+	}
+
+	if oldp.IsRoot() || newp.IsRoot() {
+		return oldp.Err("rename", os.ErrPermission) //the root cannot be moved or replaced
+	}
+
+	if oldp.Equals(newp) {
+		return nil
+	}
+
+	//a directory cannot be moved into itself
+	if len(newp) > len(oldp) && newp[:len(oldp)].Equals(oldp) {
+		return oldp.Err("rename", os.ErrInvalid)
+	}
+
+	if err = fs.db.Update(func(tx *bolt.Tx) error {
+		fi, err := fs.stat(tx, oldp)
+		if err != nil {
+			return err
+		}
+
+		opfi, err := fs.stat(tx, oldp.Parent())
+		if err != nil {
+			return err
+		}
+
+		npfi, err := fs.stat(tx, newp.Parent())
+		if err != nil {
+			return err
+		}
+
+		if !npfi.IsDir() {
+			return ErrNotDirectory
+		}
+
+		//an existing destination is replaced, but only by the same type of file and only if its an empty directory
+		dfi, err := fs.stat(tx, newp)
+		if err == nil {
+			if fi.IsDir() != dfi.IsDir() {
+				return ErrNotDirectory
+			}
+
+			dntx, err := fs.nodeTx(tx, dfi.nodeID)
+			if err != nil {
+				return fmt.Errorf("failed to start node tx: %v", err)
+			}
+
+			if dfi.IsDir() {
+				if err = dntx.getChildPtrs(func(name string, id uint64) error {
+					return ErrNotEmptyDirectory
+				}); err != nil {
+					return err
+				}
+			}
+
+			if err = dntx.delNode(); err != nil {
+				return err
+			}
+		} else if err != os.ErrNotExist {
+			return err
+		}
+
+		//move the child ptr, the parents are rewritten to update their size and modification time
+		opntx, err := fs.nodeTx(tx, opfi.nodeID)
+		if err != nil {
+			return fmt.Errorf("failed to start parent node tx: %v", err)
+		}
+
+		npntx, err := fs.nodeTx(tx, npfi.nodeID)
+		if err != nil {
+			return fmt.Errorf("failed to start parent node tx: %v", err)
+		}
+
+		if err = opntx.delChildPtr(oldp.Base()); err != nil {
+			return err
+		}
+
+		if err = npntx.putChildPtr(newp.Base(), fi.nodeID); err != nil {
+			return err
+		}
+
+		if _, _, err = opntx.putNode(opfi.node.typ(), opfi.Mode()); err != nil {
+			return fmt.Errorf("failed to update parent node: %v", err)
+		}
+
+		if npfi.nodeID != opfi.nodeID {
+			if _, _, err = npntx.putNode(npfi.node.typ(), npfi.Mode()); err != nil {
+				return fmt.Errorf("failed to update parent node: %v", err)
+			}
+		}
+
+		return nil
+	}); err != nil {
+		return oldp.Err("rename", err)
+	}
+
+	return nil
 }
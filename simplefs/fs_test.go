@@ -1,10 +1,15 @@
 package simplefs
 
 import (
+	"bytes"
+	"errors"
+	"fmt"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/boltdb/bolt"
 )
@@ -54,6 +59,57 @@ func TestStatRoot(t *testing.T) {
 	}
 }
 
+func TestStatRootCached(t *testing.T) {
+	db, close := testdb(t)
+	defer close()
+
+	fs, err := New(db, WithStatCache())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//reading the root in a writable transaction bypasses the cache
+	uncached := func() os.FileInfo {
+		var fi os.FileInfo
+		if err := fs.db.Update(func(tx *bolt.Tx) (err error) {
+			fi, err = fs.stat(tx, Root)
+			return err
+		}); err != nil {
+			t.Fatal(err)
+		}
+
+		return fi
+	}
+
+	same := func(a, b os.FileInfo) bool {
+		return a.Name() == b.Name() && a.Mode() == b.Mode() && a.Size() == b.Size() &&
+			a.ModTime().Equal(b.ModTime()) && bytes.Equal(Checksum(a), Checksum(b))
+	}
+
+	for i, change := range []func() error{
+		func() error { return nil },
+		func() error { return fs.Mkdir(P{"a"}, 0777) },
+		func() error { return fs.Chmod(Root, 0700) },
+		func() error { return fs.Remove(P{"a"}) },
+	} {
+		if err := change(); err != nil {
+			t.Fatal(err)
+		}
+
+		//the first stat fills the cache, the second is served from it
+		for j := 0; j < 2; j++ {
+			fi, err := fs.Stat(Root)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if expected := uncached(); !same(fi, expected) {
+				t.Errorf("change %d, stat %d: expected %+v, got: %+v", i, j, expected, fi)
+			}
+		}
+	}
+}
+
 func TestMkDir(t *testing.T) {
 	fs, close := testfs(t)
 	defer close()
@@ -107,3 +163,624 @@ func TestOpenFileCreate(t *testing.T) {
 		t.Errorf("expected node to be a file, got: %+v", fi)
 	}
 }
+
+func TestOpenFileErrorDoesntLeakTx(t *testing.T) {
+	fs, close := testfs(t)
+	defer close()
+
+	_, err := fs.OpenFile(P{"foo.txt"}, os.O_CREATE, 0777)
+	if err != nil {
+		t.Fatalf("didn't expect error, got: %v", err)
+	}
+
+	for i := 0; i < 10; i++ {
+		_, err = fs.OpenFile(P{"foo.txt", "bar.txt"}, os.O_CREATE, 0777)
+		if err == nil || err.(*os.PathError).Err != ErrNotDirectory {
+			t.Fatalf("expected not directory error, got: %v", err)
+		}
+
+		_, err = fs.OpenFile(P{"bar.txt"}, os.O_RDONLY, 0)
+		if !os.IsNotExist(err) {
+			t.Fatalf("expected not exist error, got: %v", err)
+		}
+	}
+
+	doneCh := make(chan error)
+	go func() {
+		doneCh <- fs.Mkdir(P{"foo"}, 0777)
+	}()
+
+	select {
+	case err = <-doneCh:
+		if err != nil {
+			t.Fatalf("didn't expect error, got: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("writing after failed opens should not block")
+	}
+}
+
+func TestStatCacheChmod(t *testing.T) {
+	db, close := testdb(t)
+	defer close()
+
+	fs, err := New(db, WithStatCache())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = fs.Mkdir(P{"foo"}, 0777)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fi, err := fs.Stat(P{"foo"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if fi.Mode().Perm() != 0777 {
+		t.Fatalf("expected perm 0777, got: %v", fi.Mode())
+	}
+
+	err = fs.Chmod(P{"foo"}, 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fi, err = fs.Stat(P{"foo"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if fi.Mode() != os.ModeDir|0700 {
+		t.Errorf("expected stat to see the new mode, got: %v", fi.Mode())
+	}
+
+	//new children invalidate cached paths
+	_, err = fs.Stat(P{"foo", "bar"})
+	if !os.IsNotExist(err) {
+		t.Fatalf("expected not exist, got: %v", err)
+	}
+
+	err = fs.Mkdir(P{"foo", "bar"}, 0777)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = fs.Stat(P{"foo", "bar"})
+	if err != nil {
+		t.Errorf("expected new dir to be found, got: %v", err)
+	}
+}
+
+func BenchmarkStatDeep(b *testing.B) {
+	for _, c := range []struct {
+		name string
+		opts []Option
+	}{
+		{"NoCache", nil},
+		{"Cache", []Option{WithStatCache()}},
+	} {
+		b.Run(c.name, func(b *testing.B) {
+			tmpdir, err := ioutil.TempDir("", "dfs_bench_")
+			if err != nil {
+				b.Fatal(err)
+			}
+
+			defer os.RemoveAll(tmpdir)
+			db, err := bolt.Open(filepath.Join(tmpdir, "fs.bolt"), 0666, nil)
+			if err != nil {
+				b.Fatal(err)
+			}
+
+			defer db.Close()
+			fs, err := New(db, c.opts...)
+			if err != nil {
+				b.Fatal(err)
+			}
+
+			p := P{}
+			for _, name := range []string{"a", "b", "c", "d", "e", "f"} {
+				p = append(p, name)
+				if err = fs.Mkdir(p, 0777); err != nil {
+					b.Fatal(err)
+				}
+			}
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				for j := 0; j < 10000; j++ {
+					if _, err = fs.Stat(p); err != nil {
+						b.Fatal(err)
+					}
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkStatRoot(b *testing.B) {
+	for _, c := range []struct {
+		name string
+		opts []Option
+	}{
+		{"NoCache", nil},
+		{"Cache", []Option{WithStatCache()}},
+	} {
+		b.Run(c.name, func(b *testing.B) {
+			tmpdir, err := ioutil.TempDir("", "dfs_bench_")
+			if err != nil {
+				b.Fatal(err)
+			}
+
+			defer os.RemoveAll(tmpdir)
+			db, err := bolt.Open(filepath.Join(tmpdir, "fs.bolt"), 0666, nil)
+			if err != nil {
+				b.Fatal(err)
+			}
+
+			defer db.Close()
+			fs, err := New(db, c.opts...)
+			if err != nil {
+				b.Fatal(err)
+			}
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err = fs.Stat(Root); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestMultipleFileSystems(t *testing.T) {
+	db, close := testdb(t)
+	defer close()
+
+	fs1, err := New(db, WithID("one"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fs2, err := New(db, WithID("two"), WithRootID(100))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = fs1.Mkdir(P{"foo"}, 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = fs2.Mkdir(P{"bar"}, 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = fs1.Stat(P{"bar"}); !os.IsNotExist(err) {
+		t.Errorf("expected fs1 not to see fs2's dir, got: %v", err)
+	}
+
+	if _, err = fs2.Stat(P{"foo"}); !os.IsNotExist(err) {
+		t.Errorf("expected fs2 not to see fs1's dir, got: %v", err)
+	}
+
+	fi, err := fs2.Stat(P{"bar"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if fi.(*fileInfo).nodeID != 101 {
+		t.Errorf("expected new node to be assigned an id above the root, got: %d", fi.(*fileInfo).nodeID)
+	}
+
+	//reopening finds the existing tree
+	if err = fs1.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	fs1, err = New(db, WithID("one"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = fs1.Stat(P{"foo"}); err != nil {
+		t.Errorf("expected reopened fs to see its dir, got: %v", err)
+	}
+
+	if _, err = New(db, WithRootID(0)); err == nil {
+		t.Error("expected root id zero to be rejected")
+	}
+}
+
+func TestTreeInUse(t *testing.T) {
+	db, close := testdb(t)
+	defer close()
+
+	fs1, err := New(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = fs1.Mkdir(P{"foo"}, 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	//a second default file system would serve the same tree
+	if _, err = New(db, WithStatCache()); err != ErrTreeInUse {
+		t.Fatalf("expected ErrTreeInUse, got: %v", err)
+	}
+
+	//other trees on the same database can be served
+	fs2, err := New(db, WithRootID(1000))
+	if err != nil {
+		t.Fatalf("expected a tree with another root to be served, got: %v", err)
+	}
+
+	if _, err = fs2.Stat(P{"foo"}); !os.IsNotExist(err) {
+		t.Errorf("expected the other tree not to see the dir, got: %v", err)
+	}
+
+	if fs2.cache != nil || fs2.rootc != nil {
+		t.Error("expected a file system without stat cache not to cache stats")
+	}
+
+	//closing releases the tree
+	if err = fs1.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	fs1, err = New(db, WithStatCache())
+	if err != nil {
+		t.Fatalf("expected a released tree to be served again, got: %v", err)
+	}
+
+	if _, err = fs1.Stat(P{"foo"}); err != nil {
+		t.Errorf("expected the tree to hold the dir, got: %v", err)
+	}
+
+	//a root id that is taken by a file of the tree is refused
+	f, err := fs1.OpenFile(P{"foo", "a.txt"}, os.O_CREATE|os.O_WRONLY, 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	fi, err := fs1.Stat(P{"foo", "a.txt"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = New(db, WithRootID(fi.(*fileInfo).nodeID)); err == nil {
+		t.Error("expected a root id that belongs to a file to be rejected")
+	}
+
+	//the trees of a database that was closed are released when it is opened again
+	path := db.Path()
+	if err = db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if db, err = bolt.Open(path, 0666, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	defer db.Close()
+	if _, err = New(db); err != nil {
+		t.Errorf("expected the tree of a reopened database to be served, got: %v", err)
+	}
+
+	owners.Lock()
+	defer owners.Unlock()
+	for k := range owners.trees {
+		if k.db != db {
+			t.Errorf("expected trees of closed databases to be released, got: %+v", k)
+		}
+	}
+}
+
+func TestModTime(t *testing.T) {
+	fs, close := testfs(t)
+	defer close()
+
+	if err := fs.Mkdir(P{"foo"}, 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	fi1, err := fs.Stat(P{"foo"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//opening the directory read-only doesn't touch it
+	f, err := fs.OpenFile(P{"foo"}, os.O_RDONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	//neither does changing its permissions
+	if err = fs.Chmod(P{"foo"}, 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	fi2, err := fs.Stat(P{"foo"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !fi2.ModTime().Equal(fi1.ModTime()) {
+		t.Errorf("expected modtime to be unchanged, got: %v (was %v)", fi2.ModTime(), fi1.ModTime())
+	}
+
+	//an explicit time survives a round trip
+	mtime := time.Date(2001, 2, 3, 4, 5, 6, 7, time.UTC)
+	if err = fs.Chtimes(P{"foo"}, mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+
+	fi3, err := fs.Stat(P{"foo"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !fi3.ModTime().Equal(mtime) {
+		t.Errorf("expected modtime %v, got: %v", mtime, fi3.ModTime())
+	}
+
+	if fi3.Mode() != os.ModeDir|0700 {
+		t.Errorf("expected mode to be preserved, got: %v", fi3.Mode())
+	}
+
+	//adding a child does count as a modification
+	if err = fs.Mkdir(P{"foo", "bar"}, 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	fi4, err := fs.Stat(P{"foo"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !fi4.ModTime().After(mtime) {
+		t.Errorf("expected modtime to be updated, got: %v", fi4.ModTime())
+	}
+}
+
+func TestRenameDirectory(t *testing.T) {
+	fs, close := testfs(t)
+	defer close()
+
+	for _, p := range []P{{"a"}, {"a", "big"}, {"b"}} {
+		if err := fs.Mkdir(p, 0777); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	n := 2000
+	if err := fs.db.Update(func(tx *bolt.Tx) error {
+		for i := 0; i < n; i++ {
+			if err := fs.mkdir(tx, P{"a", "big", fmt.Sprintf("%d", i)}, 0777); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	stat := func(p P) *fileInfo {
+		fi, err := fs.Stat(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return fi.(*fileInfo)
+	}
+
+	before := map[string]time.Time{}
+	for i := 0; i < n; i++ {
+		before[fmt.Sprintf("%d", i)] = stat(P{"a", "big", fmt.Sprintf("%d", i)}).ModTime()
+	}
+
+	bigfi, afi, bfi := stat(P{"a", "big"}), stat(P{"a"}), stat(P{"b"})
+	time.Sleep(time.Millisecond)
+	if err := fs.Rename(P{"a", "big"}, P{"b", "moved"}); err != nil {
+		t.Fatalf("expected rename to succeed, got: %v", err)
+	}
+
+	if _, err := fs.Stat(P{"a", "big"}); !os.IsNotExist(err) {
+		t.Errorf("expected old path to be gone, got: %v", err)
+	}
+
+	//the directory and its descendants are the same nodes, untouched
+	movedfi := stat(P{"b", "moved"})
+	if movedfi.nodeID != bigfi.nodeID || !movedfi.ModTime().Equal(bigfi.ModTime()) || movedfi.Size() != bigfi.Size() {
+		t.Errorf("expected moved directory node to be untouched, got: %+v", movedfi)
+	}
+
+	for name, modtime := range before {
+		if fi := stat(P{"b", "moved", name}); !fi.ModTime().Equal(modtime) {
+			t.Fatalf("expected descendant %s to be untouched, modtime changed to %v", name, fi.ModTime())
+		}
+	}
+
+	//both parents changed
+	if fi := stat(P{"a"}); fi.Size() != afi.Size()-8 || !fi.ModTime().After(afi.ModTime()) {
+		t.Errorf("expected old parent to shrink and be modified, got: %+v", fi)
+	}
+
+	if fi := stat(P{"b"}); fi.Size() != bfi.Size()+8 || !fi.ModTime().After(bfi.ModTime()) {
+		t.Errorf("expected new parent to grow and be modified, got: %+v", fi)
+	}
+
+	//a directory cannot be moved into itself or replace a non-empty directory
+	if err := fs.Rename(P{"b"}, P{"b", "moved", "b"}); err == nil {
+		t.Error("expected moving a directory into itself to fail")
+	}
+
+	if err := fs.Mkdir(P{"a", "c"}, 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := fs.Rename(P{"a", "c"}, P{"b", "moved"}); err == nil || err.(*os.PathError).Err != ErrNotEmptyDirectory {
+		t.Errorf("expected ErrNotEmptyDirectory, got: %v", err)
+	}
+}
+
+func TestGlob(t *testing.T) {
+	fs, close := testfs(t)
+	defer close()
+
+	for _, p := range []P{{"a"}, {"b"}, {"b", "c.txt"}, {"c"}, {"c", "sub"}, {"c", "sub", "c.txt"}} {
+		if err := fs.Mkdir(p, 0777); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, p := range []P{{"c.txt"}, {"a", "c.txt"}, {"a", "d.txt"}, {"c", "c.txt"}, {"c", "cc.txt"}} {
+		f, err := fs.OpenFile(p, os.O_CREATE|os.O_WRONLY, 0666)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err = f.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, c := range []struct {
+		pattern P
+		matches []P
+	}{
+		{P{"*", "c.txt"}, []P{{"a", "c.txt"}, {"b", "c.txt"}, {"c", "c.txt"}}},
+		{P{"c", "c?.txt"}, []P{{"c", "cc.txt"}}},
+		{P{"[ab]", "*.txt"}, []P{{"a", "c.txt"}, {"a", "d.txt"}, {"b", "c.txt"}}},
+		{P{"*", "*", "c.txt"}, []P{{"c", "sub", "c.txt"}}},
+		{P{"c.txt", "*"}, nil},
+		{P{"x", "*"}, nil},
+		{Root, []P{Root}},
+	} {
+		matches, err := fs.Glob(c.pattern)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if fmt.Sprint(matches) != fmt.Sprint(c.matches) {
+			t.Errorf("expected %v to match %v, got: %v", c.pattern, c.matches, matches)
+		}
+	}
+
+	if _, err := fs.Glob(P{"[", "c.txt"}); err == nil {
+		t.Error("expected a malformed pattern to fail")
+	}
+}
+
+func TestConcurrentCreates(t *testing.T) {
+	db, close := testdb(t)
+	defer close()
+
+	fs, err := New(db, WithStatCache())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = fs.Mkdir(P{"dir"}, 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	const n = 100
+	errs := make(chan error, n)
+	wg := sync.WaitGroup{}
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			f, err := fs.OpenFile(P{"dir", fmt.Sprintf("%03d.txt", i)}, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0666)
+			if err != nil {
+				errs <- err
+				return
+			}
+
+			if _, err = f.Write([]byte("hello")); err != nil {
+				f.Close()
+				errs <- err
+				return
+			}
+
+			errs <- f.Close()
+		}(i)
+	}
+
+	wg.Wait()
+	for i := 0; i < n; i++ {
+		if err := <-errs; err != nil {
+			t.Error(err)
+		}
+	}
+
+	matches, err := fs.Glob(P{"dir", "*"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(matches) != n {
+		t.Fatalf("expected all %d files to survive, got: %d", n, len(matches))
+	}
+
+	for i, p := range matches {
+		if name := fmt.Sprintf("%03d.txt", i); p.Base() != name {
+			t.Errorf("expected %s, got: %v", name, p)
+		}
+	}
+
+	if fi, err := fs.Stat(P{"dir"}); err != nil || fi.Size() != 8*n {
+		t.Errorf("expected the directory to count all children, got: %v, %v", fi, err)
+	}
+}
+
+func TestOpenDirectory(t *testing.T) {
+	fs, close := testfs(t)
+	defer close()
+
+	if err := fs.Mkdir(P{"foo"}, 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	//opening for writing is refused early
+	for _, flag := range []int{os.O_WRONLY, os.O_RDWR, os.O_CREATE, os.O_RDONLY | os.O_TRUNC, os.O_WRONLY | os.O_APPEND} {
+		if _, err := fs.OpenFile(P{"foo"}, flag, 0777); !errors.Is(err, ErrIsDirectory) {
+			t.Errorf("expected opening a directory with flag %#x to fail with ErrIsDirectory, got: %v", flag, err)
+		}
+	}
+
+	//while a handle for reading its entries can't be used for content
+	f, err := fs.OpenFile(P{"foo"}, os.O_RDONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = f.Read(make([]byte, 10)); err != ErrIsDirectory {
+		t.Errorf("expected reading a directory to fail with ErrIsDirectory, got: %v", err)
+	}
+
+	if _, err = f.Write([]byte("hello")); err != ErrIsDirectory {
+		t.Errorf("expected writing a directory to fail with ErrIsDirectory, got: %v", err)
+	}
+
+	if err = f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if fi, err := fs.Stat(P{"foo"}); err != nil || !fi.IsDir() || fi.Size() != 0 {
+		t.Errorf("expected the directory to be left as is, got: %v, %v", fi, err)
+	}
+}
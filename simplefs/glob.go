@@ -0,0 +1,66 @@
+package simplefs
+
+import (
+	"path"
+	"strings"
+
+	"github.com/boltdb/bolt"
+)
+
+//glob is a path that matched the pattern so far and the node it resolves to
+type glob struct {
+	p  P
+	id uint64
+}
+
+//Glob returns the paths of all files and directories that match 'pattern', each component of which is matched against the name at the same depth with the syntax of path.Match. The tree is descended level by level and only children that match their component are visited, components without any special characters are looked up directly. Children are visited in order of their names, so matches are sorted by their components. A malformed component fails with path.ErrBadPattern. If there is an error, it will be of type *PathError.
+func (fs *FileSystem) Glob(pattern P) (matches []P, err error) {
+	for _, c := range pattern {
+		if _, err = path.Match(c, ""); err != nil {
+			return nil, pattern.Err("glob", err)
+		}
+	}
+
+	if err = fs.db.View(func(tx *bolt.Tx) error {
+		level := []glob{{Root, fs.root}}
+		for _, c := range pattern {
+			var next []glob
+			for _, g := range level {
+				ntx, err := fs.nodeTx(tx, g.id)
+				if err != nil {
+					return err
+				}
+
+				if !strings.ContainsAny(c, `*?[\`) {
+					if id := ntx.getDescendantID(P{c}); id != 0 {
+						next = append(next, glob{append(append(P{}, g.p...), c), id})
+					}
+
+					continue
+				}
+
+				if err = ntx.getChildPtrs(func(name string, id uint64) error {
+					if ok, _ := path.Match(c, name); ok {
+						next = append(next, glob{append(append(P{}, g.p...), name), id})
+					}
+
+					return nil
+				}); err != nil {
+					return err
+				}
+			}
+
+			level = next
+		}
+
+		for _, g := range level {
+			matches = append(matches, g.p)
+		}
+
+		return nil
+	}); err != nil {
+		return nil, pattern.Err("glob", err)
+	}
+
+	return matches, nil
+}
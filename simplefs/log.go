@@ -0,0 +1,23 @@
+package simplefs
+
+//Logger receives diagnostic output of the file system, it is satisfied by *log.Logger
+type Logger interface {
+	Printf(format string, v ...interface{})
+}
+
+//nopLogger discards all output, it is the default logger
+type nopLogger struct{}
+
+func (nopLogger) Printf(format string, v ...interface{}) {}
+
+//logger is the logger that diagnostic output is written to
+var logger Logger = nopLogger{}
+
+//SetLogger sets the logger that diagnostic output is written to, passing nil discards it again. It should be called before file systems are used
+func SetLogger(l Logger) {
+	if l == nil {
+		l = nopLogger{}
+	}
+
+	logger = l
+}
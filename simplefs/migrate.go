@@ -0,0 +1,72 @@
+package simplefs
+
+import (
+	"fmt"
+	"os"
+	"sort"
+
+	"github.com/boltdb/bolt"
+	"github.com/cellstate/treedb"
+)
+
+//MigrateSimpleToTree recreates the tree of simplefs 'src' in treedb 'dst', parents before their children. Files are assembled from the chunk blobs that 'src' stores under the same content keys, chunks that 'dst' already stores are not copied again. Modes and modification times are preserved, those of directories are set after their content was written. Directories that already exist in 'dst' are merged with and existing files are replaced. The source tree is read in a single transaction, content is copied file by file
+func MigrateSimpleToTree(src *FileSystem, dst *treedb.FileSystem) (err error) {
+	var entries []treedb.ReceiveEntry
+	if err = src.db.View(func(tx *bolt.Tx) error {
+		return src.migrations(tx, src.root, treedb.Root, &entries)
+	}); err != nil {
+		return fmt.Errorf("failed to walk source tree: %v", err)
+	}
+
+	return dst.ReceiveTree(entries, treedb.NewBoltChunkBackend(src.db, ChunkBucketName).Get)
+}
+
+//migrations appends the node 'id' at path 'p' and all nodes below it to 'entries', depth first
+func (fs *FileSystem) migrations(tx *bolt.Tx, id uint64, p treedb.P, entries *[]treedb.ReceiveEntry) (err error) {
+	ntx, err := fs.nodeTx(tx, id)
+	if err != nil {
+		return fmt.Errorf("failed to start node tx: %v", err)
+	}
+
+	n, err := ntx.getNode()
+	if err != nil {
+		return fmt.Errorf("failed to get node %d: %v", id, err)
+	}
+
+	//the type of the node decides whether a directory is created, its mode might not say so
+	mode := n.Mode &^ os.ModeDir
+	if n.isDir() {
+		mode |= os.ModeDir
+	}
+
+	e := treedb.ReceiveEntry{P: p, Mode: mode, ModTime: n.ModTime, File: treedb.SyncFile{Size: n.Size}}
+	if !n.isDir() {
+		if err = ntx.getChunkPtrs(func(offset int64, k K) error {
+			if k == ZeroKey {
+				return nil //the eof marker carries no content
+			}
+
+			data := tx.Bucket(ChunkBucketName).Get(k[:])
+			if data == nil {
+				return fmt.Errorf("chunk %x of node %d doesn't exist", k, id)
+			}
+
+			e.File.Chunks = append(e.File.Chunks, treedb.ChunkRef{Offset: offset, Key: treedb.K(k), Len: len(data)})
+			return nil
+		}); err != nil {
+			return err
+		}
+
+		//offsets are varint encoded, so chunk ptrs are not stored in file order
+		sort.Slice(e.File.Chunks, func(i, j int) bool { return e.File.Chunks[i].Offset < e.File.Chunks[j].Offset })
+	}
+
+	*entries = append(*entries, e)
+	if !n.isDir() {
+		return nil
+	}
+
+	return ntx.getChildPtrs(func(name string, id uint64) error {
+		return fs.migrations(tx, id, append(append(treedb.P{}, p...), name), entries)
+	})
+}
@@ -0,0 +1,110 @@
+package simplefs
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/cellstate/treedb"
+)
+
+func TestMigrateSimpleToTree(t *testing.T) {
+	src, close := testfs(t)
+	defer close()
+
+	db, close2 := testdb(t)
+	defer close2()
+
+	dst, err := treedb.NewFileSystem(t.Name(), db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = src.Mkdir(P{"a"}, 0750); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = src.Mkdir(P{"a", "b"}, 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	large := make([]byte, 3*miB)
+	rand.Read(large)
+	mtime := time.Date(2016, 8, 1, 12, 0, 0, 0, time.UTC)
+	for _, file := range []struct {
+		p    P
+		data []byte
+	}{
+		{P{"a", "x.bin"}, large},
+		{P{"a", "b", "y.txt"}, []byte("hello")},
+		{P{"z.txt"}, nil},
+	} {
+		f, err := src.OpenFile(file.p, os.O_CREATE, 0640)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err = f.Write(file.data); err != nil {
+			t.Fatal(err)
+		}
+
+		if err = f.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		if err = src.Chtimes(file.p, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err = MigrateSimpleToTree(src, dst); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+
+	//walking the destination yields the same paths with the same modes and times, and files of the same size
+	seen := 0
+	var walk func(p P)
+	walk = func(p P) {
+		infos, err := dst.ReadDirSorted(treedb.P(p), treedb.SortByName)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, dfi := range infos {
+			cp := append(append(P{}, p...), dfi.Name())
+			sfi, err := src.Stat(cp)
+			if err != nil {
+				t.Errorf("expected %s to exist in the source, got: %v", cp, err)
+				continue
+			}
+
+			seen++
+			if (!dfi.IsDir() && dfi.Size() != sfi.Size()) || dfi.Mode() != sfi.Mode() || !dfi.ModTime().Equal(sfi.ModTime()) {
+				t.Errorf("expected %s to be migrated as %d %v %v, got: %d %v %v", cp, sfi.Size(), sfi.Mode(), sfi.ModTime(), dfi.Size(), dfi.Mode(), dfi.ModTime())
+			}
+
+			if dfi.IsDir() {
+				walk(cp)
+			}
+		}
+	}
+
+	walk(Root)
+	if seen != 5 {
+		t.Errorf("expected 5 entries to be migrated, got: %d", seen)
+	}
+
+	f, err := dst.Open(treedb.P{"a", "x.bin"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer f.Close()
+	buf := make([]byte, len(large))
+	if _, err = io.ReadFull(f, buf); err != nil || !bytes.Equal(buf, large) {
+		t.Errorf("expected migrated content to equal the source, got: %v", err)
+	}
+}
@@ -2,18 +2,27 @@ package simplefs
 
 import (
 	"bytes"
+	"crypto/sha256"
 	"encoding/binary"
 	"encoding/json"
 	"fmt"
 	"os"
+	"sort"
 	"time"
 
 	"github.com/boltdb/bolt"
+	"github.com/cellstate/treedb"
 )
 
 var (
 	//NodeBucketName is the name of the bucket that will hold all nodes
 	NodeBucketName = []byte("nodes")
+
+	//ChunkBucketName is the name of the bucket that holds file content, chunks are stored under the sha256 of their content
+	ChunkBucketName = []byte("chunks")
+
+	//GenerationBucketName is the name of the bucket whose sequence hands out node generations, it is kept apart from the nodes such that compacting them doesn't reset it
+	GenerationBucketName = []byte("generations")
 )
 
 var (
@@ -69,27 +78,72 @@ func chunkPtrKey(id uint64, offset int64) (k []byte) {
 // 00000003						  : { ... }                #node info (a file)
 // 00000003:0						: 2511E0F94...979AF0F    #chunk at file offset 0 (dedup)
 type node struct {
-	Size    int64       `json:"s"` // node size in bytes
-	Mode    os.FileMode `json:"m"` // file mode bits
-	ModTime time.Time   `json:"t"` // modification time
+	Size     int64       `json:"s"`           // node size in bytes
+	Mode     os.FileMode `json:"m"`           // file mode bits
+	ModTime  time.Time   `json:"t"`           // modification time
+	Checksum []byte      `json:"c,omitempty"` // sha256 over the chunk ptrs of a file or the child ptrs of a directory
+	Gen      uint64      `json:"g,omitempty"` // generation, differs between nodes that had the same id at different times
+	Type     nodeType    `json:"k,omitempty"` // kind of node, zero for nodes that were written before it was stored
+}
+
+//nodeType tells what kind of file a node represents. It is stored next to the mode such that type checks don't depend on interpreting mode bits, and kinds of nodes can be added, for example for symlinks, fifos and devices, without changing how existing nodes are read
+type nodeType uint8
+
+const (
+	//nodeUnknown is the type of nodes that were written before types were stored, they are directories when their mode says so and regular files otherwise
+	nodeUnknown nodeType = iota
+	//nodeFile is a regular file, it holds chunk ptrs
+	nodeFile
+	//nodeDir is a directory, it holds child ptrs
+	nodeDir
+)
+
+//typeOfMode returns the type of node that is written for file mode 'mode'
+func typeOfMode(mode os.FileMode) nodeType {
+	if mode.IsDir() {
+		return nodeDir
+	}
+
+	return nodeFile
 }
 
+//typ returns the type of the node, nodes without a stored type are typed by their mode
+func (n *node) typ() nodeType {
+	if n.Type != nodeUnknown {
+		return n.Type
+	}
+
+	return typeOfMode(n.Mode)
+}
+
+//isDir returns whether the node is a directory
+func (n *node) isDir() bool { return n.typ() == nodeDir }
+
 //used for reading and writing low-level nodes
 type nodeTx struct {
-	id uint64
-	tx *bolt.Tx
+	id     uint64
+	tx     *bolt.Tx
+	bucket []byte       //name of the bucket that holds the nodes
+	cache  *statCache   //invalidated when nodes or child ptrs are written, if any
+	root   *rootCache   //invalidated when the node is written, only set for the root
+	clock  treedb.Clock //tells the modification time of written nodes
 }
 
-//start a new node interaction. If id == 0, a new node id is generated. This effectively creates a new node.
+//start a new node interaction in the default node bucket. If id == 0, a new node id is generated. This effectively creates a new node.
 func newNodeTx(tx *bolt.Tx, id uint64) (ntx *nodeTx, err error) {
+	return openNodeTx(tx, NodeBucketName, id)
+}
+
+//start a new node interaction with nodes in 'bucket'. If id == 0, a new node id is generated.
+func openNodeTx(tx *bolt.Tx, bucket []byte, id uint64) (ntx *nodeTx, err error) {
 	if id == 0 {
-		id, err = tx.Bucket(NodeBucketName).NextSequence()
+		id, err = tx.Bucket(bucket).NextSequence()
 		if err != nil {
 			return nil, err
 		}
 	}
 
-	return &nodeTx{id: id, tx: tx}, nil
+	return &nodeTx{id: id, tx: tx, bucket: bucket, clock: treedb.WallClock}, nil
 }
 
 //getDecendantID will descend into subnodes following path 'p'
@@ -97,7 +151,7 @@ func (ntx *nodeTx) getDescendantID(p P) (id uint64) {
 	id = ntx.id
 	for _, comp := range p {
 		k := childPtrKey(id, comp)
-		v := ntx.tx.Bucket(NodeBucketName).Get(k)
+		v := ntx.tx.Bucket(ntx.bucket).Get(k)
 		if v == nil {
 			return 0
 		}
@@ -110,7 +164,7 @@ func (ntx *nodeTx) getDescendantID(p P) (id uint64) {
 
 //getChunkPtrs will scan the children of node (if any) and call 'fn' for each
 func (ntx *nodeTx) getChunkPtrs(fn func(offset int64, k K) error) (err error) {
-	c := ntx.tx.Bucket(NodeBucketName).Cursor()
+	c := ntx.tx.Bucket(ntx.bucket).Cursor()
 	prefix := chunkPtrKey(ntx.id, -1)
 	for k, v := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
 		offsetb := bytes.TrimPrefix(k, prefix)
@@ -129,7 +183,7 @@ func (ntx *nodeTx) getChunkPtrs(fn func(offset int64, k K) error) (err error) {
 
 //putChunkPtr writes a prefixed key that points to a content-based chunk key
 func (ntx *nodeTx) putChunkPtr(offset int64, k K) (err error) {
-	err = ntx.tx.Bucket(NodeBucketName).Put(chunkPtrKey(ntx.id, offset), k[:])
+	err = ntx.tx.Bucket(ntx.bucket).Put(chunkPtrKey(ntx.id, offset), k[:])
 	if err != nil {
 		return fmt.Errorf("failed to put chunk ptr in %v: %v", ntx.id, err)
 	}
@@ -137,9 +191,35 @@ func (ntx *nodeTx) putChunkPtr(offset int64, k K) (err error) {
 	return nil
 }
 
+//delChunkPtr removes the chunk ptr at 'offset'
+func (ntx *nodeTx) delChunkPtr(offset int64) (err error) {
+	err = ntx.tx.Bucket(ntx.bucket).Delete(chunkPtrKey(ntx.id, offset))
+	if err != nil {
+		return fmt.Errorf("failed to delete chunk ptr in %v: %v", ntx.id, err)
+	}
+
+	return nil
+}
+
+//putChunk stores chunk 'data' under its content key, the same content is only stored once
+func (ntx *nodeTx) putChunk(data []byte) (k K, err error) {
+	k = sha256.Sum256(data)
+	b := ntx.tx.Bucket(ChunkBucketName)
+	if b.Get(k[:]) != nil {
+		return k, nil
+	}
+
+	err = b.Put(k[:], data)
+	if err != nil {
+		return k, fmt.Errorf("failed to put chunk %x: %v", k, err)
+	}
+
+	return k, nil
+}
+
 //getChildPtrs will scan the children of node (if any) and call 'fn' for each
 func (ntx *nodeTx) getChildPtrs(fn func(name string, id uint64) error) (err error) {
-	c := ntx.tx.Bucket(NodeBucketName).Cursor()
+	c := ntx.tx.Bucket(ntx.bucket).Cursor()
 	prefix := childPtrKey(ntx.id, "")
 	for k, v := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
 		name := bytes.TrimPrefix(k, prefix)
@@ -154,41 +234,124 @@ func (ntx *nodeTx) getChildPtrs(fn func(name string, id uint64) error) (err erro
 
 //putChildPtr writes a prefixed key that points to another node
 func (ntx *nodeTx) putChildPtr(name string, id uint64) (err error) {
-	err = ntx.tx.Bucket(NodeBucketName).Put(childPtrKey(ntx.id, name), u64tob(id))
+	err = ntx.tx.Bucket(ntx.bucket).Put(childPtrKey(ntx.id, name), u64tob(id))
 	if err != nil {
 		return fmt.Errorf("failed to put child ptr in %v: %v", ntx.id, err)
 	}
 
+	ntx.cache.invalidatePaths(ntx.tx)
+
 	return nil
 }
 
-//putInfo completes, serializes and (over)writes the actual node key in the db
-func (ntx *nodeTx) putNode(mode os.FileMode) (id uint64, n *node, err error) {
+//delChildPtr removes the ptr to child 'name'
+func (ntx *nodeTx) delChildPtr(name string) (err error) {
+	err = ntx.tx.Bucket(ntx.bucket).Delete(childPtrKey(ntx.id, name))
+	if err != nil {
+		return fmt.Errorf("failed to delete child ptr in %v: %v", ntx.id, err)
+	}
+
+	ntx.cache.invalidatePaths(ntx.tx)
+
+	return nil
+}
+
+//delNode removes the node information together with all of its ptrs, chunks themselves might be shared with other nodes and are kept
+func (ntx *nodeTx) delNode() (err error) {
+	b := ntx.tx.Bucket(ntx.bucket)
+	prefix := u64tob(ntx.id)
+	keys := [][]byte{}
+	c := b.Cursor()
+	for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+		keys = append(keys, k)
+	}
+
+	for _, k := range keys {
+		if err = b.Delete(k); err != nil {
+			return fmt.Errorf("failed to delete node %v: %v", ntx.id, err)
+		}
+	}
+
+	ntx.cache.invalidateNode(ntx.tx, ntx.id)
+	ntx.root.invalidate(ntx.tx)
+
+	return nil
+}
+
+//putInfo completes, serializes and (over)writes the actual node key in the db as a node of type 'typ'. The modification time is set to now, unless the checksum shows that the content didn't change
+func (ntx *nodeTx) putNode(typ nodeType, mode os.FileMode) (id uint64, n *node, err error) {
+	return ntx.writeNode(typ, mode, nil)
+}
+
+//putNodeWithTime works like putNode but always sets the modification time to 't', for example to restore a known time
+func (ntx *nodeTx) putNodeWithTime(typ nodeType, mode os.FileMode, t time.Time) (id uint64, n *node, err error) {
+	return ntx.writeNode(typ, mode, &t)
+}
+
+//writeNode writes the node as type 'typ' with modification time 't', if 't' is nil it is determined by comparing checksums with the node that is overwritten. The type is given by the caller instead of derived from the mode, such that rewriting a node keeps the type it was created with
+func (ntx *nodeTx) writeNode(typ nodeType, mode os.FileMode, t *time.Time) (id uint64, n *node, err error) {
 	n = &node{
-		Size:    0,
-		Mode:    mode,
-		ModTime: time.Now(), //@TODO only update if things changed (add checksum)?
+		Size: 0,
+		Mode: mode,
+		Type: typ,
 	}
 
 	//based on whether the node represents a directory of a file we scan over the chunks or children to update the node struct with up-to-date self information
-	if n.Mode.IsDir() {
+	h := sha256.New()
+	if n.isDir() {
 		if err = ntx.getChildPtrs(func(name string, id uint64) error {
 			n.Size = n.Size + 8 //8bytes for each uint64 id
+			h.Write(u64tob(id))
+			h.Write([]byte(name))
 			return nil
 		}); err != nil {
 			return 0, nil, err
 		}
 
 	} else {
+
+		//varint offsets don't sort numerically, so ptrs are ordered before hashing
+		ptrs := map[int64]K{}
+		offsets := []int64{}
 		if err = ntx.getChunkPtrs(func(offset int64, k K) error {
 			if k == ZeroKey {
 				n.Size = offset
 			}
 
+			ptrs[offset] = k
+			offsets = append(offsets, offset)
 			return nil
 		}); err != nil {
 			return 0, nil, err
 		}
+
+		sort.Slice(offsets, func(i, j int) bool { return offsets[i] < offsets[j] })
+		for _, offset := range offsets {
+			k := ptrs[offset]
+			h.Write(u64tob(uint64(offset)))
+			h.Write(k[:])
+		}
+	}
+
+	n.Checksum = h.Sum(nil)
+	old, err := ntx.getNode()
+	if err != nil {
+		return 0, nil, err
+	}
+
+	if old != nil {
+		n.Gen = old.Gen
+	} else if n.Gen, err = ntx.nextGeneration(); err != nil {
+		return 0, nil, err
+	}
+
+	if t != nil {
+		n.ModTime = *t
+	} else {
+		n.ModTime = ntx.clock.Now()
+		if old != nil && bytes.Equal(old.Checksum, n.Checksum) {
+			n.ModTime = old.ModTime
+		}
 	}
 
 	d, err := json.Marshal(n)
@@ -196,17 +359,35 @@ func (ntx *nodeTx) putNode(mode os.FileMode) (id uint64, n *node, err error) {
 		return 0, nil, ErrSerialize
 	}
 
-	err = ntx.tx.Bucket(NodeBucketName).Put(u64tob(ntx.id), d)
+	err = ntx.tx.Bucket(ntx.bucket).Put(u64tob(ntx.id), d)
 	if err != nil {
 		return 0, nil, fmt.Errorf("failed to put node %v: %v", ntx.id, err)
 	}
 
+	ntx.cache.invalidateNode(ntx.tx, ntx.id)
+	ntx.root.invalidate(ntx.tx)
+
 	return ntx.id, n, nil
 }
 
+//nextGeneration returns the generation of a node that is created, no two nodes get the same generation even if they get the same id
+func (ntx *nodeTx) nextGeneration() (gen uint64, err error) {
+	b, err := ntx.tx.CreateBucketIfNotExists(GenerationBucketName)
+	if err != nil {
+		return 0, fmt.Errorf("failed to create generation bucket: %v", err)
+	}
+
+	gen, err = b.NextSequence()
+	if err != nil {
+		return 0, fmt.Errorf("failed to get next generation: %v", err)
+	}
+
+	return gen, nil
+}
+
 //getNode deserializes the node information and returns it
 func (ntx *nodeTx) getNode() (n *node, err error) {
-	v := ntx.tx.Bucket(NodeBucketName).Get(u64tob(ntx.id))
+	v := ntx.tx.Bucket(ntx.bucket).Get(u64tob(ntx.id))
 	if v == nil {
 		return nil, nil
 	}
@@ -2,6 +2,7 @@ package simplefs
 
 import (
 	"crypto/rand"
+	"encoding/json"
 	"fmt"
 	"os"
 	"testing"
@@ -26,7 +27,7 @@ func TestCreateEmptyDirNode(t *testing.T) {
 			return err
 		}
 
-		id, n, err = ntx.putNode(os.ModeDir | 0777)
+		id, n, err = ntx.putNode(nodeDir, os.ModeDir|0777)
 		return err
 	}); err != nil {
 		t.Error(err)
@@ -54,9 +55,7 @@ func TestCreateEmptyFileInDirNode(t *testing.T) {
 	db, close := testdb(t)
 	defer close()
 
-	var fN *node
 	var fID uint64
-	var dN *node
 	var dID uint64
 	if err := db.Update(func(tx *bolt.Tx) error {
 		_, err := tx.CreateBucketIfNotExists(NodeBucketName)
@@ -69,7 +68,7 @@ func TestCreateEmptyFileInDirNode(t *testing.T) {
 			return err
 		}
 
-		fID, fN, err = fntx.putNode(0777)
+		fID, _, err = fntx.putNode(nodeFile, 0777)
 		if err != nil {
 			return err
 		}
@@ -84,7 +83,7 @@ func TestCreateEmptyFileInDirNode(t *testing.T) {
 			return err
 		}
 
-		dID, dN, err = dntx.putNode(os.ModeDir | 0777)
+		dID, _, err = dntx.putNode(nodeDir, os.ModeDir|0777)
 		return err
 	}); err != nil {
 		t.Error(err)
@@ -163,7 +162,7 @@ func TestDescendInDirNodes(t *testing.T) {
 			return err
 		}
 
-		f1id, _, err = f1ntx.putNode(os.ModeDir | 0777)
+		f1id, _, err = f1ntx.putNode(nodeDir, os.ModeDir|0777)
 		if err != nil {
 			return err
 		}
@@ -180,7 +179,7 @@ func TestDescendInDirNodes(t *testing.T) {
 			return err
 		}
 
-		f2id, _, err = f2ntx.putNode(os.ModeDir | 0777)
+		f2id, _, err = f2ntx.putNode(nodeDir, os.ModeDir|0777)
 		if err != nil {
 			return err
 		}
@@ -196,7 +195,7 @@ func TestDescendInDirNodes(t *testing.T) {
 			return err
 		}
 
-		root, _, err = f3ntx.putNode(os.ModeDir | 0777)
+		root, _, err = f3ntx.putNode(nodeDir, os.ModeDir|0777)
 		if err != nil {
 			return err
 		}
@@ -263,7 +262,7 @@ func TestPutChunkPtrs(t *testing.T) {
 			return err
 		}
 
-		fid, _, err = fntx.putNode(0777)
+		fid, _, err = fntx.putNode(nodeFile, 0777)
 		if err != nil {
 			return err
 		}
@@ -335,3 +334,130 @@ func TestPutChunkPtrs(t *testing.T) {
 		t.Errorf("expected this chunk, got: %+v", chunks)
 	}
 }
+
+func TestNodeType(t *testing.T) {
+	fs, close := testfs(t)
+	defer close()
+
+	if err := fs.Mkdir(P{"dir"}, 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := fs.OpenFile(P{"file.txt"}, os.O_CREATE, 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	//the type is stored with the node
+	ids := map[string]uint64{}
+	if err = fs.db.View(func(tx *bolt.Tx) error {
+		for name, expected := range map[string]nodeType{"dir": nodeDir, "file.txt": nodeFile} {
+			fi, err := fs.stat(tx, P{name})
+			if err != nil {
+				return err
+			}
+
+			ids[name] = fi.nodeID
+			n := &node{}
+			if err = json.Unmarshal(tx.Bucket(fs.nodes).Get(u64tob(fi.nodeID)), n); err != nil {
+				return err
+			}
+
+			if n.Type != expected {
+				t.Errorf("expected %s to be stored with type %d, got: %d", name, expected, n.Type)
+			}
+		}
+
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	//nodes that were written before types were stored are typed by their mode, anything but a directory is a regular file
+	if err = fs.db.Update(func(tx *bolt.Tx) error {
+		for _, id := range ids {
+			b := tx.Bucket(fs.nodes)
+			n := map[string]interface{}{}
+			if err := json.Unmarshal(b.Get(u64tob(id)), &n); err != nil {
+				return err
+			}
+
+			delete(n, "k")
+			v, err := json.Marshal(n)
+			if err != nil {
+				return err
+			}
+
+			if err = b.Put(u64tob(id), v); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if fi, err := fs.Stat(P{"dir"}); err != nil || !fi.IsDir() || fi.(*fileInfo).node.Type != nodeUnknown {
+		t.Errorf("expected an untyped directory to remain a directory, got: %v, %v", fi, err)
+	}
+
+	if f, err = fs.OpenFile(P{"file.txt"}, os.O_WRONLY, 0); err != nil {
+		t.Fatalf("expected an untyped file to be opened as a regular file, got: %v", err)
+	}
+
+	if _, err = f.Write([]byte("hello")); err != nil {
+		t.Errorf("expected an untyped file to be written, got: %v", err)
+	}
+
+	if err = f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	//and get their type once they are written again
+	if fi, err := fs.Stat(P{"file.txt"}); err != nil || fi.IsDir() || fi.Size() != 5 || fi.(*fileInfo).node.Type != nodeFile {
+		t.Errorf("expected the rewritten file to be typed, got: %+v, %v", fi, err)
+	}
+	//the type is given when a node is written, a mode that says otherwise doesn't change it
+	if err = fs.db.Update(func(tx *bolt.Tx) error {
+		ntx, err := fs.nodeTx(tx, ids["dir"])
+		if err != nil {
+			return err
+		}
+
+		_, n, err := ntx.putNode(nodeDir, 0777)
+		if err == nil && !n.isDir() {
+			t.Errorf("expected a node that is written as a directory to be one, got type: %d", n.Type)
+		}
+
+		return err
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	//content of nodes of other types is neither read nor written
+	if err = fs.db.Update(func(tx *bolt.Tx) error {
+		ntx, err := fs.nodeTx(tx, ids["file.txt"])
+		if err != nil {
+			return err
+		}
+
+		_, _, err = ntx.putNode(nodeDir+1, 0666)
+		return err
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if f, err = fs.OpenFile(P{"file.txt"}, os.O_WRONLY, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	defer f.Close()
+	if _, err = f.Write([]byte("hello")); err != ErrNotRegular {
+		t.Errorf("expected a node of another type not to be written, got: %v", err)
+	}
+}
@@ -0,0 +1,46 @@
+package simplefs
+
+import (
+	"time"
+
+	"github.com/cellstate/treedb"
+)
+
+//Option configures a FileSystem when it is created
+type Option func(fs *FileSystem)
+
+//WithCommitInterval sets how often open files commit the chunks that were written to them, each commit uses a short transaction of its own such that long writes don't starve other writers. When a file wasn't written to for a whole interval, bytes that the chunker still buffers are flushed and committed as well. Committing in the background is disabled by default or with an interval of zero, chunks are then only committed on Sync, Checkpoint and Close. It stops when the file or the file system is closed, or when the file is garbage collected
+func WithCommitInterval(d time.Duration) Option {
+	return func(fs *FileSystem) {
+		fs.commitInterval = d
+	}
+}
+
+//WithStatCache caches which node a path resolves to and the decoded nodes, including the root node, which speeds up repeated stats of deep paths and of the root. Cached entries are invalidated when transactions that rewrite them commit
+func WithStatCache() Option {
+	return func(fs *FileSystem) {
+		fs.cache = newStatCache()
+		fs.rootc = &rootCache{}
+	}
+}
+
+//WithClock sets the clock that tells the modification time of nodes that are written, by default treedb.WallClock is used
+func WithClock(c treedb.Clock) Option {
+	return func(fs *FileSystem) {
+		fs.clock = c
+	}
+}
+
+//WithID stores the nodes of the filesystem in a bucket of its own, named after 'id', such that several filesystems can share a database. Chunks are content-addressed and remain shared between them
+func WithID(id string) Option {
+	return func(fs *FileSystem) {
+		fs.nodes = append(append([]byte{}, NodeBucketName...), []byte("_"+id)...)
+	}
+}
+
+//WithRootID sets the id of the root node, it is created with this id if it doesn't exist yet. New nodes are assigned ids above it
+func WithRootID(id uint64) Option {
+	return func(fs *FileSystem) {
+		fs.root = id
+	}
+}
@@ -37,6 +37,11 @@ func (p P) Validate() error {
 	return nil
 }
 
+//IsRoot returns whether the path refers to the root, which has zero components
+func (p P) IsRoot() bool {
+	return len(p) == 0
+}
+
 //Parent returns a path that refers to a parent, if the current
 //path is the root the root is still returned
 func (p P) Parent() P {
@@ -49,7 +54,7 @@ func (p P) Parent() P {
 
 //Base returns the base component of a path
 func (p P) Base() string {
-	if len(p) < 1 {
+	if p.IsRoot() {
 		return PathSeparator
 	}
 
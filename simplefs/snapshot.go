@@ -0,0 +1,76 @@
+package simplefs
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/boltdb/bolt"
+)
+
+//snapshotBucket returns the name of the bucket that records the root ids of the snapshots of the tree in node bucket 'nodes'
+func snapshotBucket(nodes []byte) []byte {
+	return append(append([]byte{}, nodes...), []byte(".snapshots")...)
+}
+
+//SnapshotID captures the tree as it is now and returns the id of its root, which can be passed to OpenSnapshot to read the tree from that moment later on. Nodes are rewritten in place, so the tree is copied into new nodes in a single transaction and those are never written again. Files are copied with the chunk ptrs of their content, the content itself is shared, such that a snapshot costs a node per file and directory. Snapshots are dropped by Compact. A snapshot of a snapshot returns its own id
+func (fs *FileSystem) SnapshotID() (id uint64, err error) {
+	if fs.readOnly {
+		return fs.root, nil
+	}
+
+	if err = fs.db.Update(func(tx *bolt.Tx) error {
+		if id, err = fs.copyNode(tx, fs.root); err != nil {
+			return err
+		}
+
+		b, err := tx.CreateBucketIfNotExists(snapshotBucket(fs.nodes))
+		if err != nil {
+			return err
+		}
+
+		return b.Put(u64tob(id), []byte{})
+	}); err != nil {
+		return 0, fmt.Errorf("failed to snapshot: %v", err)
+	}
+
+	return id, nil
+}
+
+//OpenSnapshot returns a read-only filesystem that serves reads from the snapshot with root 'id', as returned by SnapshotID. Any attempt to change it returns ErrReadOnly
+func (fs *FileSystem) OpenSnapshot(id uint64) (snap *FileSystem, err error) {
+	if err = fs.db.View(func(tx *bolt.Tx) error {
+		if b := tx.Bucket(snapshotBucket(fs.nodes)); b == nil || b.Get(u64tob(id)) == nil {
+			return os.ErrNotExist //the id of a node that isn't a snapshot root might be written to
+		}
+
+		ntx, err := fs.nodeTx(tx, id)
+		if err != nil {
+			return err
+		}
+
+		n, err := ntx.getNode()
+		if err != nil {
+			return err
+		}
+
+		if n == nil {
+			return os.ErrNotExist
+		}
+
+		if !n.isDir() {
+			return ErrNotDirectory
+		}
+
+		return nil
+	}); err != nil {
+		return nil, fmt.Errorf("failed to open snapshot %d: %v", id, err)
+	}
+
+	return &FileSystem{
+		db:       fs.db,
+		root:     id,
+		nodes:    fs.nodes,
+		clock:    fs.clock,
+		readOnly: true,
+	}, nil
+}
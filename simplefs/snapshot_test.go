@@ -0,0 +1,137 @@
+package simplefs
+
+import (
+	"fmt"
+	"os"
+	"testing"
+)
+
+func TestSnapshot(t *testing.T) {
+	fs, close := testfs(t)
+	defer close()
+
+	if err := fs.Mkdir(P{"foo"}, 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	id, err := fs.SnapshotID()
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+
+	snap, err := fs.OpenSnapshot(id)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+
+	if _, err = snap.Stat(P{"foo"}); err != nil {
+		t.Errorf("expected snapshot to see the tree, got: %v", err)
+	}
+
+	//snapshots refuse to change
+	if err = snap.Mkdir(P{"bar"}, 0777); err == nil || err.(*os.PathError).Err != ErrReadOnly {
+		t.Errorf("expected ErrReadOnly, got: %v", err)
+	}
+
+	if _, err = snap.OpenFile(P{"foo.txt"}, os.O_CREATE, 0777); err == nil || err.(*os.PathError).Err != ErrReadOnly {
+		t.Errorf("expected ErrReadOnly, got: %v", err)
+	}
+
+	if err = snap.Remove(P{"foo"}); err == nil || err.(*os.PathError).Err != ErrReadOnly {
+		t.Errorf("expected ErrReadOnly, got: %v", err)
+	}
+
+	f, err := snap.OpenFile(P{"foo"}, os.O_RDONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = f.Write([]byte("x")); err != ErrReadOnly {
+		t.Errorf("expected ErrReadOnly, got: %v", err)
+	}
+
+	if err = f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	//only snapshot roots can be opened
+	for _, id := range []uint64{999, fs.root} {
+		if _, err = fs.OpenSnapshot(id); err == nil {
+			t.Errorf("expected opening %d as a snapshot to fail", id)
+		}
+	}
+}
+
+func TestSnapshotPointInTime(t *testing.T) {
+	fs, close := testfs(t)
+	defer close()
+
+	write := func(p P, data []byte) {
+		f, err := fs.OpenFile(p, os.O_CREATE|os.O_WRONLY, 0666)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err = f.Write(data); err != nil {
+			t.Fatal(err)
+		}
+
+		if err = f.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := fs.Mkdir(P{"foo"}, 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	write(P{"foo", "a.txt"}, []byte("hello"))
+	id, err := fs.SnapshotID()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//change the live tree in every way after the snapshot was taken
+	write(P{"foo", "a.txt"}, []byte("changed"))
+	if err = fs.Mkdir(P{"bar"}, 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = fs.Chmod(P{"foo"}, 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = fs.Rename(P{"foo", "a.txt"}, P{"bar", "a.txt"}); err != nil {
+		t.Fatal(err)
+	}
+
+	snap, err := fs.OpenSnapshot(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = snap.Stat(P{"bar"}); !os.IsNotExist(err) {
+		t.Errorf("expected the snapshot not to see a directory that was created later, got: %v", err)
+	}
+
+	if fi, err := snap.Stat(P{"foo"}); err != nil || fi.Mode().Perm() != 0777 {
+		t.Errorf("expected the snapshot to keep the old mode, got: %v, %v", fi, err)
+	}
+
+	if fi, err := snap.Stat(P{"foo", "a.txt"}); err != nil || fi.Size() != 5 {
+		t.Fatalf("expected the snapshot to keep a file that was moved later, got: %v, %v", fi, err)
+	}
+
+	if fmt.Sprint(testChunkPtrs(t, snap, P{"foo", "a.txt"})) == fmt.Sprint(testChunkPtrs(t, fs, P{"bar", "a.txt"})) {
+		t.Error("expected the snapshot to keep the old content")
+	}
+
+	//compacting reassigns node ids, the snapshot is dropped rather than served from other nodes
+	if err = fs.Compact(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = fs.OpenSnapshot(id); err == nil {
+		t.Error("expected a snapshot to be dropped by compaction")
+	}
+}
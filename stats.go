@@ -0,0 +1,72 @@
+package treedb
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+//FSStats describes the content of a file system and how efficiently it is stored
+type FSStats struct {
+	Files int64 //number of regular files
+	Dirs  int64 //number of directories, not counting the root
+	Links int64 //number of symbolic links
+
+	Bytes int64 //total size of all regular files, as reported by their file info
+
+	Chunks     int64   //number of unique chunks the files reference
+	ChunkBytes int64   //bytes stored in the unique chunks
+	DedupRatio float64 //bytes referenced by all files divided by the bytes of the unique chunks, zero when there are no chunks
+}
+
+//Stats walks the files of the file system and reports statistics about them and the chunks that hold their content, the chunks are read from counters that are kept as they are referenced. Chunks are counted once per file system even when the chunk bucket is shared with other file systems in the database
+func (fs *FileSystem) Stats() (stats FSStats, err error) {
+	if err = fs.db.View(func(tx Tx) error {
+		root := string(Root.Key())
+		if err := tx.Bucket(fs.fbucket).ForEach(func(k, v []byte) error {
+			if string(k) == root {
+				return nil
+			}
+
+			fi := &fileInfo{}
+			if err := json.Unmarshal(v, fi); err != nil {
+				return fmt.Errorf("failed to deserialize: %v", err)
+			}
+
+			if fs.expired(fi) {
+				return nil //gone, although it wasn't reaped yet
+			}
+
+			switch {
+			case fi.IsDir():
+				stats.Dirs++
+			case fi.M&os.ModeSymlink != 0:
+				stats.Links++
+			case fi.M.IsRegular():
+				stats.Files++
+				stats.Bytes += fi.S
+			}
+
+			return nil
+		}); err != nil {
+			return err
+		}
+
+		//chunks are counted as they are referenced, unique chunks only once
+		u, err := fs.usage(tx)
+		if err != nil {
+			return err
+		}
+
+		stats.Chunks, stats.ChunkBytes = u.chunks, u.unique
+		if stats.ChunkBytes > 0 {
+			stats.DedupRatio = float64(u.refd) / float64(stats.ChunkBytes)
+		}
+
+		return nil
+	}); err != nil {
+		return stats, err
+	}
+
+	return stats, nil
+}
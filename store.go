@@ -0,0 +1,136 @@
+package treedb
+
+import (
+	"github.com/boltdb/bolt"
+)
+
+//Store is the transactional key-value storage a FileSystem keeps its buckets in. It follows the semantics of a bolt database: a single writer at a time, readers see a consistent view and keys in a bucket are iterated in byte-order
+type Store interface {
+	Begin(writable bool) (Tx, error)
+	View(fn func(tx Tx) error) error
+	Update(fn func(tx Tx) error) error
+}
+
+//Tx is a read-only or read-write transaction on a Store
+type Tx interface {
+	Bucket(name []byte) Bucket
+	CreateBucketIfNotExists(name []byte) (Bucket, error)
+	ForEachBucket(fn func(name []byte) error) error
+	Writable() bool
+	Commit() error
+	Rollback() error
+}
+
+//Bucket is a collection of ordered key/value pairs, keys and values returned by it are only valid for the life of the transaction
+type Bucket interface {
+	Get(k []byte) []byte
+	Put(k []byte, v []byte) error
+	Delete(k []byte) error
+	Cursor() Cursor
+	ForEach(fn func(k, v []byte) error) error
+	NextSequence() (uint64, error)
+}
+
+//Cursor iterates over the keys of a bucket in byte-order, it returns a nil key when it moved past either end
+type Cursor interface {
+	First() (k []byte, v []byte)
+	Last() (k []byte, v []byte)
+	Next() (k []byte, v []byte)
+	Prev() (k []byte, v []byte)
+	Seek(seek []byte) (k []byte, v []byte)
+	Delete() error
+}
+
+//NewBoltStore returns a Store that keeps its buckets in bolt database 'db'
+func NewBoltStore(db *bolt.DB) Store {
+	return boltStore{db}
+}
+
+//BoltTx allows a transaction on the bolt database of a filesystem to be passed to its *Tx methods
+func BoltTx(tx *bolt.Tx) Tx {
+	return boltTx{tx}
+}
+
+//readOnlyStore refuses to start writable transactions on the store it wraps
+type readOnlyStore struct{ Store }
+
+func (s readOnlyStore) Begin(writable bool) (Tx, error) {
+	if writable {
+		return nil, ErrReadOnly
+	}
+
+	return s.Store.Begin(false)
+}
+
+func (s readOnlyStore) Update(fn func(tx Tx) error) error { return ErrReadOnly }
+
+type boltStore struct{ db *bolt.DB }
+
+func (s boltStore) Begin(writable bool) (Tx, error) {
+	tx, err := s.db.Begin(writable)
+	if err != nil {
+		return nil, err
+	}
+
+	return boltTx{tx}, nil
+}
+
+func (s boltStore) View(fn func(tx Tx) error) error {
+	return s.db.View(func(tx *bolt.Tx) error { return fn(boltTx{tx}) })
+}
+
+func (s boltStore) Update(fn func(tx Tx) error) error {
+	return s.db.Update(func(tx *bolt.Tx) error { return fn(boltTx{tx}) })
+}
+
+//batchStore runs the writable transactions of concurrent callers together in a single bolt transaction using bolt's Batch, such that they share one commit. When one of them fails the others are run again, the functions that are passed to Update must therefore only keep results of the run that commits
+type batchStore struct{ boltStore }
+
+func (s batchStore) Update(fn func(tx Tx) error) error {
+	return s.db.Batch(func(tx *bolt.Tx) error { return fn(boltTx{tx}) })
+}
+
+//baseStore returns the store that 's' batches the writes of, or 's' itself. File systems on the same database recognize each other by it
+func baseStore(s Store) Store {
+	if bs, ok := s.(batchStore); ok {
+		return bs.boltStore
+	}
+
+	return s
+}
+
+type boltTx struct{ *bolt.Tx }
+
+func (tx boltTx) Bucket(name []byte) Bucket {
+	b := tx.Tx.Bucket(name)
+	if b == nil {
+		return nil
+	}
+
+	return boltBucket{b}
+}
+
+func (tx boltTx) CreateBucketIfNotExists(name []byte) (Bucket, error) {
+	b, err := tx.Tx.CreateBucketIfNotExists(name)
+	if err != nil {
+		return nil, err
+	}
+
+	return boltBucket{b}, nil
+}
+
+func (tx boltTx) ForEachBucket(fn func(name []byte) error) error {
+	return tx.Tx.ForEach(func(name []byte, _ *bolt.Bucket) error { return fn(name) })
+}
+
+//filler is implemented by buckets that can be told how full to pack their pages when they are split
+type filler interface {
+	SetFillPercent(pct float64)
+}
+
+type boltBucket struct{ *bolt.Bucket }
+
+func (b boltBucket) Cursor() Cursor { return b.Bucket.Cursor() }
+
+//SetFillPercent sets the fill of the bucket for the rest of the transaction, see bolt.Bucket.FillPercent
+func (b boltBucket) SetFillPercent(pct float64) { b.Bucket.FillPercent = pct }
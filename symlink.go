@@ -0,0 +1,219 @@
+package treedb
+
+import (
+	"os"
+	"strings"
+)
+
+//MaxLinkHops is the number of symbolic links that are followed while resolving a single path before it fails with ErrTooManyLinks, the same limit as Linux uses
+const MaxLinkHops = 40
+
+//Symlink creates the named file as a symbolic link to 'target', a path with forward slashes that is resolved against the directory of the link unless it starts with a slash. The target is stored as the content of the link and doesn't have to exist. If there is an error, it will be of type *PathError.
+func (fs *FileSystem) Symlink(target string, p P) (err error) {
+	err = fs.validateNew(p)
+	if err != nil {
+		return p.Err("symlink", err)
+	}
+
+	if target == "" {
+		return p.Err("symlink", os.ErrInvalid)
+	}
+
+	if err = fs.db.Update(func(tx Tx) error {
+		pfi, err := fs.getfi(tx, p.Parent())
+		if err != nil {
+			return err
+		}
+
+		if !pfi.IsDir() {
+			return ErrNotDirectory
+		}
+
+		if _, err = fs.getlive(tx, p); err == nil {
+			return os.ErrExist
+		} else if err != os.ErrNotExist {
+			return err
+		}
+
+		if _, err = fs.resolveCollision(tx, p, nil, false); err != nil {
+			return err
+		}
+
+		ino, err := fs.nextIno(tx)
+		if err != nil {
+			return err
+		}
+
+		return fs.putfi(tx, p, &fileInfo{
+			N: p.Base(),
+			M: os.ModeSymlink | 0777,
+			T: fs.clock.Now(),
+			S: int64(len(target)),
+			I: ino,
+			D: []byte(target),
+		})
+	}); err != nil {
+		return pathErr("symlink", p, err)
+	}
+
+	return nil
+}
+
+//Readlink returns the target of the named symbolic link, it fails with os.ErrInvalid when the file isn't a link. If there is an error, it will be of type *PathError.
+func (fs *FileSystem) Readlink(p P) (target string, err error) {
+	err = p.Validate()
+	if err != nil {
+		return "", p.Err("readlink", err)
+	}
+
+	if err = fs.db.View(func(tx Tx) error {
+		target, err = fs.readlink(tx, p)
+		return err
+	}); err != nil {
+		return "", p.Err("readlink", err)
+	}
+
+	return target, nil
+}
+
+//ReadlinkTx works like Readlink as part of transaction 'tx' that is managed by the caller. If there is an error, it will be of type *PathError.
+func (fs *FileSystem) ReadlinkTx(tx Tx, p P) (target string, err error) {
+	err = p.Validate()
+	if err != nil {
+		return "", p.Err("readlink", err)
+	}
+
+	if target, err = fs.readlink(tx, p); err != nil {
+		return "", p.Err("readlink", err)
+	}
+
+	return target, nil
+}
+
+//readlink returns the target of the symbolic link at 'p'
+func (fs *FileSystem) readlink(tx Tx, p P) (target string, err error) {
+	fi, err := fs.getfi(tx, p)
+	if err != nil {
+		return "", err
+	}
+
+	if fi.M&os.ModeSymlink == 0 {
+		return "", os.ErrInvalid
+	}
+
+	return string(fi.D), nil
+}
+
+//Lstat returns a FileInfo describing the named file, if it is a symbolic link the link itself is described instead of the file it points to. If there is an error, it will be of type *PathError.
+func (fs *FileSystem) Lstat(p P) (fi os.FileInfo, err error) {
+	if err = fs.db.View(func(tx Tx) error {
+		fi, err = fs.LstatTx(tx, p)
+		return err
+	}); err != nil {
+		return nil, pathErr("lstat", p, err)
+	}
+
+	return fi, nil
+}
+
+//LstatTx works like Lstat as part of transaction 'tx' that is managed by the caller. Symbolic links in the directories of the path are followed, only the last component isn't. If there is an error, it will be of type *PathError.
+func (fs *FileSystem) LstatTx(tx Tx, p P) (fi os.FileInfo, err error) {
+	err = p.Validate()
+	if err != nil {
+		return nil, p.Err("lstat", err)
+	}
+
+	rp := p
+	if !p.IsRoot() {
+		dir, err := fs.followLinks(tx, p.Parent())
+		if err != nil {
+			return nil, p.Err("lstat", err)
+		}
+
+		rp = append(dir, p.Base())
+	}
+
+	ifi, err := fs.getfi(tx, rp)
+	if err != nil {
+		return nil, p.Err("lstat", err)
+	}
+
+	if fs.expired(ifi) {
+		return nil, p.Err("lstat", os.ErrNotExist)
+	}
+
+	fs.inodes.track(ifi.I, rp)
+	return ifi, nil
+}
+
+//followLinks resolves the symbolic links along path 'p', including its last component, and returns the path they lead to. Relative targets are resolved against the directory of their link, after MaxLinkHops links it gives up with ErrTooManyLinks
+func (fs *FileSystem) followLinks(tx Tx, p P) (rp P, err error) {
+	rp = append(P{}, p...)
+	hops := 0
+	for i := 1; i <= len(rp); i++ {
+		fi, err := fs.getfi(tx, rp[:i])
+		if err != nil {
+			return nil, err
+		}
+
+		if fi.M&os.ModeSymlink == 0 {
+			continue
+		}
+
+		if hops++; hops > MaxLinkHops {
+			return nil, ErrTooManyLinks
+		}
+
+		target := string(fi.D)
+		if target == "" {
+			return nil, os.ErrNotExist
+		}
+
+		if !strings.HasPrefix(target, PathPrintSeparator) {
+			target = rp[:i-1].String() + PathPrintSeparator + target
+		}
+
+		rp, i = append(ParsePath(target), rp[i:]...), 0
+	}
+
+	return rp, nil
+}
+
+//followContent returns the path that content IO on 'p' acts on: symbolic links along the path are followed, including the last component. When the last component doesn't exist it is resolved in the directory that its parent leads to, such that it can be created there, also when a dangling link points at it
+func (fs *FileSystem) followContent(tx Tx, p P) (rp P, err error) {
+	if p.IsRoot() {
+		return p, nil
+	}
+
+	for hops := 0; ; hops++ {
+		dir, err := fs.followLinks(tx, p.Parent())
+		if err != nil {
+			return nil, err
+		}
+
+		rp = append(dir[:len(dir):len(dir)], p.Base())
+		fi, err := fs.getfi(tx, rp)
+		if err == os.ErrNotExist {
+			return rp, nil
+		} else if err != nil {
+			return nil, err
+		}
+
+		if fi.M&os.ModeSymlink == 0 {
+			return rp, nil
+		}
+
+		if hops >= MaxLinkHops {
+			return nil, ErrTooManyLinks
+		}
+
+		target := string(fi.D)
+		if !strings.HasPrefix(target, PathPrintSeparator) {
+			target = dir.String() + PathPrintSeparator + target
+		}
+
+		if p = ParsePath(target); p.IsRoot() {
+			return p, nil
+		}
+	}
+}
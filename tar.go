@@ -0,0 +1,210 @@
+package treedb
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+//Tar writes the subtree at 'root' to 'w' as a standard tar stream, such that it can be extracted with common tools. Entries are named relative to 'root' with forward slashes, directories are written before their entries, which are listed in order of their names and depth first. A file at 'root' is written as a single entry named after it. Headers carry the mode, modification time and owner of each file, file content is streamed from the chunks. The tree is read in a single read transaction, memory use doesn't grow with the size of files. If there is an error, it will be of type *PathError
+func (fs *FileSystem) Tar(root P, w io.Writer) (err error) {
+	if err = root.Validate(); err != nil {
+		return pathErr("tar", root, err)
+	}
+
+	tw := tar.NewWriter(w)
+	if err = fs.db.View(func(tx Tx) error {
+		fi, err := fs.getfi(tx, root)
+		if err != nil {
+			return err
+		}
+
+		if !fi.IsDir() {
+			return fs.tarEntry(tx, root, fi, fi.N, tw)
+		}
+
+		return fs.tarDir(tx, root, "", tw)
+	}); err != nil {
+		return pathErr("tar", root, err)
+	}
+
+	if err = tw.Close(); err != nil {
+		return pathErr("tar", root, err)
+	}
+
+	return nil
+}
+
+//tarDir writes the entries of directory 'p' to 'tw' below name 'dir' in the archive, subdirectories are written recursively
+func (fs *FileSystem) tarDir(tx Tx, p P, dir string, tw *tar.Writer) (err error) {
+	return fs.walkdir(tx, p, nil, func(cp P, cfi *fileInfo) error {
+		name := path.Join(dir, cfi.N)
+		if err := fs.tarEntry(tx, cp, cfi, name, tw); err != nil {
+			return err
+		}
+
+		if !cfi.IsDir() {
+			return nil
+		}
+
+		return fs.tarDir(tx, cp, name, tw)
+	})
+}
+
+//tarEntry writes the header of 'fi' at path 'p' as 'name' to 'tw', followed by its content for regular files
+func (fs *FileSystem) tarEntry(tx Tx, p P, fi *fileInfo, name string, tw *tar.Writer) (err error) {
+	link := ""
+	if fi.M&os.ModeSymlink != 0 {
+		link = string(fi.D) //the target of a link is stored as its content
+	}
+
+	hdr, err := tar.FileInfoHeader(fi, link)
+	if err != nil {
+		return fmt.Errorf("cannot archive %v: %v", p, err)
+	}
+
+	hdr.Name = name
+	if fi.IsDir() {
+		hdr.Name += "/"
+	}
+
+	hdr.Uid, hdr.Gid = int(fi.U), int(fi.G)
+
+	if err = tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+
+	if !fi.M.IsRegular() {
+		return nil
+	}
+
+	_, err = fs.streamChunks(tx, fi, 0, tw, nil)
+	return err
+}
+
+//Untar reads a tar stream from 'r' and creates its directories, regular files and symbolic links below directory 'root', which is created if it doesn't exist. Parents that the archive doesn't list before their entries are created, existing directories are merged with and existing files are replaced. File content is streamed through the chunker as it is read, such that large files are never held in memory. Modes and modification times are taken from the headers, those of directories are applied once the whole archive was read since creating their entries changes them. Names that would leave 'root', also through links that the archive creates, and entries of other types, such as devices, are refused. If there is an error, it will be of type *PathError
+func (fs *FileSystem) Untar(root P, r io.Reader) (err error) {
+	if err = root.Validate(); err != nil {
+		return pathErr("untar", root, err)
+	}
+
+	type dirTime struct {
+		p P
+		t time.Time
+	}
+
+	var dirs []dirTime
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return pathErr("untar", root, err)
+		}
+
+		if hdr.Typeflag == tar.TypeXGlobalHeader {
+			continue //carries no entry, only defaults for the entries that follow
+		}
+
+		for _, c := range strings.Split(hdr.Name, "/") {
+			if c == ".." {
+				return pathErr("untar", root, ErrInvalidPath)
+			}
+		}
+
+		p := append(append(P{}, root...), ParsePath(hdr.Name)...)
+		mode := hdr.FileInfo().Mode()
+		if err = fs.db.Update(func(tx Tx) error {
+
+			//a link that the archive created earlier could lead entries below it out of the root
+			for i := len(root) + 1; i < len(p); i++ {
+				if fi, err := fs.getfi(tx, p[:i]); err == nil && fi.M&os.ModeSymlink != 0 {
+					return ErrInvalidPath
+				}
+			}
+
+			if hdr.Typeflag == tar.TypeDir {
+				return fs.mkdirAll(tx, p, mode.Perm())
+			}
+
+			return fs.mkdirAll(tx, p.Parent(), 0777)
+		}); err != nil {
+			return pathErr("untar", p, err)
+		}
+
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			dirs = append(dirs, dirTime{p, hdr.ModTime})
+		case tar.TypeReg, tar.TypeRegA:
+			if err = fs.untarFile(p, mode, hdr.ModTime, tr); err != nil {
+				return pathErr("untar", p, err)
+			}
+
+			continue
+		case tar.TypeSymlink:
+			if fi, err := fs.Lstat(p); err == nil && !fi.IsDir() {
+				if err = fs.Remove(p); err != nil {
+					return err
+				}
+			}
+
+			if err = fs.Symlink(hdr.Linkname, p); err != nil {
+				return err
+			}
+
+			continue
+		default:
+			return p.Err("untar", fmt.Errorf("unsupported entry type %q", hdr.Typeflag))
+		}
+
+		if err = fs.Chmod(p, mode); err != nil {
+			return err
+		}
+	}
+
+	//entries are created after their directory, so walking them backwards sets the times of directories after those of their content
+	for i := len(dirs) - 1; i >= 0; i-- {
+		if err = fs.Chtimes(dirs[i].p, dirs[i].t, dirs[i].t); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+//untarFile writes the content that is read from 'r' to the file at 'p', replacing a link at 'p', and gives it 'mode' and modification time 'mtime'
+func (fs *FileSystem) untarFile(p P, mode os.FileMode, mtime time.Time, r io.Reader) (err error) {
+
+	//an existing link is replaced rather than followed, its target might be outside of the root
+	if fi, err := fs.Lstat(p); err == nil && fi.Mode()&os.ModeSymlink != 0 {
+		if err = fs.Remove(p); err != nil {
+			return err
+		}
+	}
+
+	f, err := fs.OpenFile(p, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, mode.Perm())
+	if err != nil {
+		return err
+	}
+
+	if _, err = io.Copy(f, r); err != nil {
+		f.Close()
+		return err
+	}
+
+	if err = f.Close(); err != nil {
+		return err
+	}
+
+	//an existing file that is replaced keeps its mode when opened
+	if err = fs.Chmod(p, mode); err != nil {
+		return err
+	}
+
+	return fs.Chtimes(p, mtime, mtime)
+}
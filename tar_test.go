@@ -0,0 +1,289 @@
+package treedb
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTar(t *testing.T) {
+	db, close := testdb(t)
+	defer close()
+
+	clock := &testClock{t: time.Date(2016, 8, 1, 12, 0, 0, 0, time.UTC)}
+	fs, err := NewFileSystem(t.Name(), db, WithClock(clock))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	big := make([]byte, 3*miB+17)
+	rand.Read(big)
+	for _, p := range []P{{"src"}, {"src", "dir"}, {"src", "dir", "empty"}} {
+		if err = fs.Mkdir(p, 0750); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	testwrite(fs, t, P{"src", "a.txt"}, []byte("hello"))
+	testwrite(fs, t, P{"src", "dir", "big.bin"}, big)
+	testwrite(fs, t, P{"src", "dir", "sparse.bin"}, []byte("head"))
+	testwrite(fs, t, P{"outside.txt"}, []byte("not archived"))
+	if err = fs.Allocate(P{"src", "dir", "sparse.bin"}, miB); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = fs.Symlink("../a.txt", P{"src", "dir", "link"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = fs.Chmod(P{"src", "a.txt"}, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	buf := bytes.NewBuffer(nil)
+	if err = fs.Tar(P{"src"}, buf); err != nil {
+		t.Fatal(err)
+	}
+
+	sparse := append([]byte("head"), make([]byte, miB-4)...)
+	expected := []struct {
+		name string
+		typ  byte
+		mode os.FileMode
+		data []byte
+		link string
+	}{
+		{"a.txt", tar.TypeReg, 0600, []byte("hello"), ""},
+		{"dir/", tar.TypeDir, 0750, nil, ""},
+		{"dir/big.bin", tar.TypeReg, 0666, big, ""},
+		{"dir/empty/", tar.TypeDir, 0750, nil, ""},
+		{"dir/link", tar.TypeSymlink, 0777, nil, "../a.txt"},
+		{"dir/sparse.bin", tar.TypeReg, 0666, sparse, ""},
+	}
+
+	tr := tar.NewReader(buf)
+	for _, e := range expected {
+		hdr, err := tr.Next()
+		if err != nil {
+			t.Fatalf("expected entry %s, got: %v", e.name, err)
+		}
+
+		if hdr.Name != e.name || hdr.Typeflag != e.typ || os.FileMode(hdr.Mode).Perm() != e.mode || hdr.Linkname != e.link {
+			t.Errorf("expected entry %s of type %c with mode %v, got: %+v", e.name, e.typ, e.mode, hdr)
+		}
+
+		if !hdr.ModTime.Equal(clock.t) {
+			t.Errorf("expected %s to keep its modification time, got: %v", e.name, hdr.ModTime)
+		}
+
+		data, err := ioutil.ReadAll(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !bytes.Equal(data, e.data) {
+			t.Errorf("expected content of %s to be archived, got %d bytes", e.name, len(data))
+		}
+	}
+
+	if _, err = tr.Next(); err != io.EOF {
+		t.Errorf("expected no more entries, got: %v", err)
+	}
+
+	//a single file is archived under its name
+	buf.Reset()
+	if err = fs.Tar(P{"src", "a.txt"}, buf); err != nil {
+		t.Fatal(err)
+	}
+
+	tr = tar.NewReader(buf)
+	if hdr, err := tr.Next(); err != nil || hdr.Name != "a.txt" {
+		t.Errorf("expected the file to be archived by its name, got: %v, %v", hdr, err)
+	}
+
+	if err = fs.Tar(P{"nonexisting"}, ioutil.Discard); !os.IsNotExist(err) {
+		t.Errorf("expected archiving a nonexisting path to fail, got: %v", err)
+	}
+}
+
+func TestUntar(t *testing.T) {
+	db, close := testdb(t)
+	defer close()
+
+	fs, err := NewFileSystem(t.Name(), db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//a directory on the os file system is archived with its files listed before their directories
+	dir, err := ioutil.TempDir("", "treedb_untar_")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+	big := make([]byte, 3*miB+17)
+	rand.Read(big)
+	files := map[string][]byte{"a.txt": []byte("hello"), "sub/big.bin": big, "sub/deeper/empty.txt": nil}
+	for name, data := range files {
+		if err = os.MkdirAll(filepath.Join(dir, filepath.Dir(name)), 0755); err != nil {
+			t.Fatal(err)
+		}
+
+		if err = ioutil.WriteFile(filepath.Join(dir, name), data, 0640); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	buf := bytes.NewBuffer(nil)
+	tw := tar.NewWriter(buf)
+	expected := map[string]os.FileInfo{}
+	for _, name := range []string{"sub/deeper/empty.txt", "sub/big.bin", "a.txt", "sub/deeper", "sub"} {
+		fi, err := os.Stat(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		hdr, err := tar.FileInfoHeader(fi, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		hdr.Name = name
+		if err = tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+
+		if !fi.IsDir() {
+			if _, err = tw.Write(files[name]); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		expected[name] = fi
+	}
+
+	if err = tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = fs.Untar(P{"dst"}, buf); err != nil {
+		t.Fatal(err)
+	}
+
+	//walk the imported tree and match it against the archive
+	found := map[string]bool{}
+	var walk func(p P)
+	walk = func(p P) {
+		if err := fs.EachEntry(p, func(fi os.FileInfo) error {
+			cp := append(append(P{}, p...), fi.Name())
+			name := strings.Join(cp[1:], "/")
+			found[name] = true
+			efi, ok := expected[name]
+			if !ok {
+				t.Errorf("expected only entries of the archive, got: %s", name)
+				return nil
+			}
+
+			if fi.Mode() != efi.Mode() || !fi.ModTime().Equal(efi.ModTime().Round(time.Second)) {
+				t.Errorf("expected %s to have mode %v and time %v, got: %v, %v", name, efi.Mode(), efi.ModTime(), fi.Mode(), fi.ModTime())
+			}
+
+			if fi.IsDir() {
+				walk(cp)
+				return nil
+			}
+
+			if fi.Size() != efi.Size() {
+				t.Errorf("expected %s to be %d bytes, got: %d", name, efi.Size(), fi.Size())
+			}
+
+			if output := testread(fs, t, cp); !bytes.Equal(output, files[name]) {
+				t.Errorf("expected content of %s to be imported", name)
+			}
+
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	walk(P{"dst"})
+	if len(found) != len(expected) {
+		t.Errorf("expected %d entries, got: %v", len(expected), found)
+	}
+
+	//names that leave the root are refused
+	buf.Reset()
+	tw = tar.NewWriter(buf)
+	if err = tw.WriteHeader(&tar.Header{Name: "../escape.txt", Mode: 0644, Typeflag: tar.TypeReg}); err != nil {
+		t.Fatal(err)
+	}
+
+	tw.Close()
+	if err = fs.Untar(P{"dst"}, buf); !errors.Is(err, ErrInvalidPath) {
+		t.Errorf("expected a name outside the root to be refused, got: %v", err)
+	}
+
+	//links that the archive creates are replaced rather than followed, and entries below them are refused
+	testwrite(fs, t, P{"secret"}, []byte("secret"))
+	if err = fs.Mkdir(P{"outside"}, 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []struct {
+		link, name string
+		err        error
+	}{
+		{"x", "x", nil},
+		{"y", "y/pwn.txt", ErrInvalidPath},
+		{"z", "z/sub/pwn.txt", ErrInvalidPath},
+	} {
+		buf.Reset()
+		tw = tar.NewWriter(buf)
+		target := "/secret"
+		if c.name != c.link {
+			target = "/outside"
+		}
+
+		if err = tw.WriteHeader(&tar.Header{Name: c.link, Linkname: target, Mode: 0777, Typeflag: tar.TypeSymlink}); err != nil {
+			t.Fatal(err)
+		}
+
+		if err = tw.WriteHeader(&tar.Header{Name: c.name, Mode: 0644, Size: 3, Typeflag: tar.TypeReg}); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err = tw.Write([]byte("pwn")); err != nil {
+			t.Fatal(err)
+		}
+
+		tw.Close()
+		if err = fs.Untar(P{"dst"}, buf); !errors.Is(err, c.err) {
+			t.Errorf("expected untarring %s through link %s to return %v, got: %v", c.name, c.link, c.err, err)
+		}
+	}
+
+	if output := testread(fs, t, P{"secret"}); string(output) != "secret" {
+		t.Errorf("expected a file outside the root to be left alone, got: %s", output)
+	}
+
+	if output := testread(fs, t, P{"dst", "x"}); string(output) != "pwn" {
+		t.Errorf("expected the link to be replaced by the file, got: %s", output)
+	}
+
+	if err = fs.EachEntry(P{"outside"}, func(fi os.FileInfo) error {
+		t.Errorf("expected nothing to be written through a link, got: %s", fi.Name())
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,152 @@
+package treedb
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"hash"
+	"os"
+)
+
+//TreeHash returns a Merkle-style hash of 'root' and everything below it, such that a change anywhere in the tree can be detected by comparing a single key. A file hashes its mode, size and the offsets and keys of its chunks, or its inline content. A directory hashes its mode and the names and hashes of its entries in order of their names. Modification times, owners and inode numbers are left out, so trees that are built in a different order or at another time hash the same. Hashes are cached in the file info of every file and directory and a change drops those of the file and its ancestors, such that asking again after a change only rehashes along the changed paths and asking again without changes only reads the cached hash of 'root'. A read-only file system hashes without caching. If there is an error, it will be of type *PathError
+func (fs *FileSystem) TreeHash(root P) (k K, err error) {
+	if err = root.Validate(); err != nil {
+		return k, root.Err("treehash", err)
+	}
+
+	cached := false
+	if err = fs.db.View(func(tx Tx) error {
+		fi, err := fs.getfi(tx, root)
+		if err != nil {
+			return err
+		}
+
+		cached = len(fi.H) == len(k)
+		copy(k[:], fi.H)
+		return nil
+	}); err != nil {
+		return k, pathErr("treehash", root, err)
+	}
+
+	if cached {
+		return k, nil
+	}
+
+	hash := func(store bool) func(tx Tx) error {
+		return func(tx Tx) error {
+			fi, err := fs.getfi(tx, root)
+			if err != nil {
+				return err
+			}
+
+			k, _, err = fs.treeHash(tx, root, fi, store)
+			return err
+		}
+	}
+
+	if err = fs.db.Update(hash(true)); err == ErrReadOnly {
+		err = fs.db.View(hash(false))
+	}
+
+	if err != nil {
+		return k, pathErr("treehash", root, err)
+	}
+
+	return k, nil
+}
+
+//treeHash returns the hash of 'fi' at path 'p', the cached hash if it has one. Otherwise the entries of a directory are hashed depth first and, if 'store' is set, the hash is cached in the file info, in which case 'stored' tells that the transaction was written to. Files with an expiry disappear from the tree without being written, so neither their hash nor those of their ancestors are cached
+func (fs *FileSystem) treeHash(tx Tx, p P, fi *fileInfo, store bool) (k K, stored bool, err error) {
+	if len(fi.H) == len(k) {
+		copy(k[:], fi.H)
+		return k, false, nil
+	}
+
+	h := sha256.New()
+	writeUint64(h, uint64(fi.M))
+	volatile := fi.E != nil
+	if fi.IsDir() {
+
+		//writing invalidates the cursor of the walk, it is continued after the entry that was written
+		var after P
+		for done := false; !done; {
+			done = true
+			if err = fs.walkdir(tx, p, after, func(cp P, cfi *fileInfo) error {
+				ck, cstored, err := fs.treeHash(tx, cp, cfi, store)
+				if err != nil {
+					return err
+				}
+
+				//names are length-prefixed, such that no two listings write the same bytes
+				writeUint64(h, uint64(len(cfi.N)))
+				h.Write([]byte(cfi.N))
+				h.Write(ck[:])
+				if cfi.H == nil {
+					volatile = true
+				}
+
+				if cstored {
+					after, done = cp, false
+					return errStopWalk
+				}
+
+				return nil
+			}); err != nil {
+				return k, false, err
+			}
+		}
+	} else {
+		writeUint64(h, uint64(fi.S))
+		if fi.D != nil {
+			h.Write(fi.D)
+		} else if err = fs.getChunkPtrs(tx, fi, 0, func(ptr chunkPtr) error {
+			if ptr.off >= fi.S {
+				return errStopWalk
+			}
+
+			writeUint64(h, uint64(ptr.off))
+			h.Write(ptr.k[:])
+			return nil
+		}); err != nil {
+			return k, false, err
+		}
+	}
+
+	copy(k[:], h.Sum(nil))
+	if !store || volatile {
+		return k, false, nil
+	}
+
+	fi.H = append([]byte{}, k[:]...)
+	return k, true, fs.writefi(tx, p, fi)
+}
+
+//dropHashes drops the cached tree hashes of the ancestors of 'p'. A directory only has a hash while all its entries have one, so the walk up stops at the first ancestor without
+func (fs *FileSystem) dropHashes(tx Tx, p P) (err error) {
+	for !p.IsRoot() {
+		p = p.Parent()
+		fi, err := fs.getfi(tx, p)
+		if err == os.ErrNotExist {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		if fi.H == nil {
+			return nil
+		}
+
+		fi.H = nil
+		if err = fs.writefi(tx, p, fi); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+//writeUint64 writes 'v' to 'h' in big endian order
+func writeUint64(h hash.Hash, v uint64) {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], v)
+	h.Write(b[:])
+}
@@ -0,0 +1,214 @@
+package treedb
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"testing"
+
+	"github.com/boltdb/bolt"
+)
+
+func TestTreeHash(t *testing.T) {
+	db, close := testdb(t)
+	defer close()
+
+	fs, err := NewFileSystem(t.Name(), db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	big := make([]byte, 3*miB)
+	rand.Read(big)
+	files := map[string][]byte{"x/1.txt": []byte("one"), "x/y/2.txt": []byte("two"), "3.bin": big, "4.txt": nil}
+
+	//the same tree is built below 'a' and 'b' in opposite orders
+	for dir, order := range map[string][]string{
+		"a": {"x", "x/y", "x/1.txt", "x/y/2.txt", "3.bin", "4.txt"},
+		"b": {"4.txt", "3.bin", "x", "x/y", "x/y/2.txt", "x/1.txt"},
+	} {
+		if err = fs.Mkdir(P{dir}, 0777); err != nil {
+			t.Fatal(err)
+		}
+
+		for _, name := range order {
+			p := append(P{dir}, ParsePath(name)...)
+			if data, ok := files[name]; ok {
+				testwrite(fs, t, p, data)
+			} else if err = fs.Mkdir(p, 0777); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	hash := func(p P) K {
+		k, err := fs.TreeHash(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return k
+	}
+
+	ak, bk, rootk := hash(P{"a"}), hash(P{"b"}), hash(Root)
+	if ak != bk {
+		t.Errorf("expected trees with the same content to hash the same, got: %x and %x", ak, bk)
+	}
+
+	if hash(P{"a"}) != ak || hash(Root) != rootk {
+		t.Error("expected hashing again to be stable")
+	}
+
+	if hash(P{"a", "x", "1.txt"}) == hash(P{"a", "x", "y", "2.txt"}) {
+		t.Error("expected files with other content to hash differently")
+	}
+
+	//a change of a single byte deep down the tree changes the hashes up to the root
+	f, err := fs.OpenFile(P{"b", "3.bin"}, os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = f.Seek(2*miB, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = f.Write([]byte{big[2*miB] + 1}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if hash(P{"b"}) == ak {
+		t.Error("expected changed content to change the hash of the tree")
+	}
+
+	if hash(Root) == rootk {
+		t.Error("expected changed content to change the hash of the root")
+	}
+
+	if hash(P{"a"}) != ak {
+		t.Error("expected the unchanged tree to keep its hash")
+	}
+
+	//renaming an entry changes the hash as well
+	if err = fs.Rename(P{"a", "x", "1.txt"}, P{"a", "x", "0.txt"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if hash(P{"a"}) == ak {
+		t.Error("expected a renamed entry to change the hash of the tree")
+	}
+
+	if _, err = fs.TreeHash(P{"nonexisting"}); !os.IsNotExist(err) {
+		t.Errorf("expected hashing a nonexisting path to fail, got: %v", err)
+	}
+}
+
+func TestTreeHashCached(t *testing.T) {
+	db, close := testdb(t)
+	defer close()
+
+	fs, err := NewFileSystem(t.Name(), db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//two equal trees of 3 levels with 4 directories and 4 files each
+	for _, top := range []string{"a", "b"} {
+		for i := 0; i < 4; i++ {
+			for j := 0; j < 4; j++ {
+				p := P{top, fmt.Sprintf("d%d", i), fmt.Sprintf("e%d", j)}
+				if err = fs.db.Update(func(tx Tx) error { return fs.mkdirAll(tx, p, 0777) }); err != nil {
+					t.Fatal(err)
+				}
+
+				for k := 0; k < 4; k++ {
+					testwrite(fs, t, append(p, fmt.Sprintf("f%d.txt", k)), []byte(fmt.Sprintf("%d%d%d", i, j, k)))
+				}
+			}
+		}
+	}
+
+	//uncached counts the records that have no cached hash, which are those that the next TreeHash rehashes
+	uncached := func() (n int) {
+		if err := db.View(func(tx *bolt.Tx) error {
+			return tx.Bucket(fs.fbucket).ForEach(func(k, v []byte) error {
+				fi := FileInfoJSON{}
+				if err := json.Unmarshal(v, &fi); err != nil {
+					return err
+				}
+
+				if fi.Hash == nil {
+					n++
+				}
+
+				return nil
+			})
+		}); err != nil {
+			t.Fatal(err)
+		}
+
+		return n
+	}
+
+	rootk, err := fs.TreeHash(Root)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if n := uncached(); n != 0 {
+		t.Fatalf("expected every record to cache its hash, got %d without", n)
+	}
+
+	//editing a single file drops the hashes of the file and its 4 ancestors
+	testwrite(fs, t, P{"b", "d2", "e1", "f3.txt"}, []byte("changed"))
+	if n := uncached(); n != 5 {
+		t.Errorf("expected an edit to only drop the hashes along its path, got %d dropped", n)
+	}
+
+	bk, err := fs.TreeHash(Root)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if bk == rootk {
+		t.Error("expected the edit to change the root hash")
+	}
+
+	if n := uncached(); n != 0 {
+		t.Errorf("expected rehashing to cache the hashes again, got %d without", n)
+	}
+
+	//making the other tree equal again gives it the same hash as the edited one
+	testwrite(fs, t, P{"a", "d2", "e1", "f3.txt"}, []byte("changed"))
+	ak, err := fs.TreeHash(P{"a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if k, _ := fs.TreeHash(P{"b"}); ak != k {
+		t.Errorf("expected the cached hash of an equal tree to match, got: %x and %x", ak, k)
+	}
+
+	//adding and removing entries drops the hashes of their ancestors as well
+	if err = fs.Mkdir(P{"a", "d0", "new"}, 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	if k, _ := fs.TreeHash(P{"a"}); k == ak {
+		t.Error("expected a new entry to change the hash")
+	}
+
+	if err = fs.Remove(P{"a", "d0", "new"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if k, _ := fs.TreeHash(P{"a"}); k != ak {
+		t.Error("expected removing the new entry to restore the hash")
+	}
+}
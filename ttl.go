@@ -0,0 +1,124 @@
+package treedb
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+)
+
+//OpenFileTTL opens the named file like OpenFile and stamps it with an expiry 'ttl' from now, for temporary files such as scratch space or caches. Opening it again with a ttl moves the expiry, opening it with OpenFile leaves it as is. Once expired the file is treated as if it doesn't exist: it is left out of listings and tree hashes, Stat and Open fail with os.ErrNotExist and creating an entry with its name replaces it, even before ReapExpired removed it. Handles that were opened before it expired keep working. If there is an error, it will be of type *PathError.
+func (fs *FileSystem) OpenFileTTL(p P, flag int, perm os.FileMode, ttl time.Duration) (f *File, err error) {
+	if ttl <= 0 {
+		return nil, p.Err("open", os.ErrInvalid)
+	}
+
+	if err = fs.db.Update(func(tx Tx) (err error) {
+		if f != nil {
+			f.Close() //opened by a batched run that was rolled back
+		}
+
+		if f, err = fs.OpenFileTx(tx, p, flag, perm); err != nil {
+			return err
+		}
+
+		fi, err := fs.getfi(tx, f.p)
+		if err != nil {
+			return err
+		}
+
+		if fi.IsDir() {
+			return ErrIsDirectory
+		}
+
+		expires := fs.clock.Now().Add(ttl)
+		fi.E = &expires
+		return fs.putfi(tx, f.p, fi)
+	}); err != nil {
+		if f != nil {
+			f.Close() //opened, but the transaction failed to commit
+		}
+
+		return nil, pathErr("open", p, err)
+	}
+
+	//the transaction has ended, io will use transactions of its own
+	f.tx = nil
+	return f, nil
+}
+
+//ReapExpired removes all files that expired, together with their chunk ptrs, in a single pass over the file system and returns how many were removed. It can be called periodically by a background reaper. With the RemoveUnlessBusy policy files that are still open for writing are left for a later pass
+func (fs *FileSystem) ReapExpired() (n int, err error) {
+	var reaped []P
+	if err = fs.db.Update(func(tx Tx) error {
+		reaped = nil
+		var expired []P
+		if err := tx.Bucket(fs.fbucket).ForEach(func(k, v []byte) error {
+			if !bytes.Contains(v, []byte(`"E":`)) {
+				return nil //most files never expire, their records aren't decoded
+			}
+
+			fi := &fileInfo{}
+			if err := json.Unmarshal(v, fi); err != nil {
+				return fmt.Errorf("failed to deserialize: %v", err)
+			}
+
+			if fs.expired(fi) {
+				expired = append(expired, PathFromKey(k))
+			}
+
+			return nil
+		}); err != nil {
+			return err
+		}
+
+		//records are removed after the walk, since writing invalidates the cursor
+		for _, p := range expired {
+			if fs.rmpol == RemoveUnlessBusy && fs.handles.busy(p) {
+				continue
+			}
+
+			fi, err := fs.getfi(tx, p)
+			if err != nil {
+				return err
+			}
+
+			if err = fs.rmfi(tx, p, fi); err != nil {
+				return err
+			}
+
+			reaped = append(reaped, p)
+		}
+
+		return nil
+	}); err != nil {
+		return 0, fmt.Errorf("failed to reap expired files: %v", err)
+	}
+
+	for _, p := range reaped {
+		fs.inodes.removed(p)
+	}
+
+	return len(reaped), nil
+}
+
+//expired returns whether file 'fi' was opened with a ttl that has passed
+func (fs *FileSystem) expired(fi *fileInfo) bool {
+	return fi.E != nil && !fs.clock.Now().Before(*fi.E)
+}
+
+//getlive returns the info of the file at 'p' like getfi, but a file that expired is reported as os.ErrNotExist. In a writable transaction it is removed first, such that a new entry can take its place
+func (fs *FileSystem) getlive(tx Tx, p P) (fi *fileInfo, err error) {
+	if fi, err = fs.getfi(tx, p); err != nil || !fs.expired(fi) {
+		return fi, err
+	}
+
+	if tx.Writable() {
+		if err = fs.rmfi(tx, p, fi); err != nil {
+			return nil, err
+		}
+	}
+
+	return nil, os.ErrNotExist
+}
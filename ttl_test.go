@@ -0,0 +1,257 @@
+package treedb
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"io"
+	iofs "io/fs"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestOpenFileTTL(t *testing.T) {
+	db, close := testdb(t)
+	defer close()
+
+	clock := &testClock{t: time.Date(2016, 8, 1, 12, 0, 0, 0, time.UTC)}
+	fs, err := NewFileSystem(t.Name(), db, WithClock(clock))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := make([]byte, 2*miB)
+	rand.Read(data)
+	for name, ttl := range map[string]time.Duration{"short.bin": time.Minute, "long.bin": time.Hour} {
+		f, err := fs.OpenFileTTL(P{name}, os.O_CREATE|os.O_WRONLY, 0666, ttl)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err = f.Write(data); err != nil {
+			t.Fatal(err)
+		}
+
+		if err = f.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	testwrite(fs, t, P{"kept.txt"}, []byte("kept"))
+	if _, err = fs.OpenFileTTL(P{"kept.txt"}, os.O_RDONLY, 0, 0); err == nil {
+		t.Error("expected a ttl of zero to be rejected")
+	}
+
+	if _, err = fs.OpenFileTTL(Root, os.O_RDONLY, 0, time.Minute); err == nil {
+		t.Error("expected a directory not to expire")
+	}
+
+	if n, err := fs.ReapExpired(); err != nil || n != 0 {
+		t.Errorf("expected nothing to be reaped before expiry, got: %d, %v", n, err)
+	}
+
+	//expired files are invisible before they are reaped
+	clock.t = clock.t.Add(2 * time.Minute)
+	if _, err = fs.Stat(P{"short.bin"}); !os.IsNotExist(err) {
+		t.Errorf("expected an expired file not to exist, got: %v", err)
+	}
+
+	if _, err = fs.Open(P{"short.bin"}); !os.IsNotExist(err) {
+		t.Errorf("expected an expired file not to open, got: %v", err)
+	}
+
+	if output := testread(fs, t, P{"long.bin"}); !bytes.Equal(output, data) {
+		t.Error("expected a file that didn't expire yet to be readable")
+	}
+
+	unique, _, _, err := fs.DedupReport()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	n, err := fs.ReapExpired()
+	if err != nil || n != 1 {
+		t.Fatalf("expected one file to be reaped, got: %d, %v", n, err)
+	}
+
+	if after, _, _, err := fs.DedupReport(); err != nil || after != unique {
+		t.Errorf("expected the chunks that are shared with a live file to remain, got: %d, %v", after, err)
+	}
+
+	if problems, err := fs.Check(); err != nil || len(problems) != 0 {
+		t.Errorf("expected no problems after reaping, got: %v, %v", problems, err)
+	}
+
+	//a reaped file's name can be taken again, as can that of a file that expired but wasn't reaped yet
+	clock.t = clock.t.Add(time.Hour)
+	testwrite(fs, t, P{"long.bin"}, []byte("new"))
+	if output := testread(fs, t, P{"long.bin"}); string(output) != "new" {
+		t.Errorf("expected a new file in place of the expired one, got: %q", output)
+	}
+
+	if n, err := fs.ReapExpired(); err != nil || n != 0 {
+		t.Errorf("expected the new file not to expire, got: %d, %v", n, err)
+	}
+
+	live := 0
+	for _, p := range []P{{"kept.txt"}, {"long.bin"}} {
+		refs, err := fs.FileChunks(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		live += len(refs)
+	}
+
+	if _, total, _, err := fs.DedupReport(); err != nil || total != live {
+		t.Errorf("expected only the chunks of live files to be referenced, got: %d of %d, %v", total, live, err)
+	}
+
+	if _, err = fs.Stat(P{"kept.txt"}); err != nil {
+		t.Errorf("expected files without a ttl to remain, got: %v", err)
+	}
+}
+
+func TestExpiredListing(t *testing.T) {
+	db, close := testdb(t)
+	defer close()
+
+	clock := &testClock{t: time.Date(2016, 8, 1, 12, 0, 0, 0, time.UTC)}
+	fs, err := NewFileSystem(t.Name(), db, WithClock(clock))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, dir := range []P{{"dir"}, {"other"}} {
+		if err = fs.Mkdir(dir, 0777); err != nil {
+			t.Fatal(err)
+		}
+
+		testwrite(fs, t, append(dir, "kept.txt"), []byte("kept"))
+	}
+
+	for _, name := range []string{"a.txt", "b.txt", "c.txt"} {
+		f, err := fs.OpenFileTTL(P{"dir", name}, os.O_CREATE|os.O_WRONLY, 0666, time.Minute)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err = f.Write([]byte(name)); err != nil {
+			t.Fatal(err)
+		}
+
+		if err = f.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	//the hash is computed while the files are live, it must not outlive them
+	before, err := fs.TreeHash(Root)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	clock.t = clock.t.Add(2 * time.Minute)
+	expected := []string{"kept.txt"}
+	f, err := fs.Open(P{"dir"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if names, err := f.Readdirnames(0); err != nil || !reflect.DeepEqual(names, expected) {
+		t.Errorf("expected readdir to list %v, got: %v, %v", expected, names, err)
+	}
+
+	f.Close()
+	f, err = fs.Open(P{"dir"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if names, err := f.Readdirnames(1); err != nil || !reflect.DeepEqual(names, expected) {
+		t.Errorf("expected a page to list %v, got: %v, %v", expected, names, err)
+	}
+
+	if names, err := f.Readdirnames(1); err != io.EOF {
+		t.Errorf("expected the expired files not to fill the next page, got: %v, %v", names, err)
+	}
+
+	f.Close()
+	if infos, err := fs.ReadDirSorted(P{"dir"}, SortByName); err != nil || len(infos) != 1 || infos[0].Name() != "kept.txt" {
+		t.Errorf("expected sorted readdir to list %v, got: %v, %v", expected, infos, err)
+	}
+
+	var names []string
+	if err = fs.EachEntry(P{"dir"}, func(fi os.FileInfo) error {
+		names = append(names, fi.Name())
+		return nil
+	}); err != nil || !reflect.DeepEqual(names, expected) {
+		t.Errorf("expected each entry to list %v, got: %v, %v", expected, names, err)
+	}
+
+	for name, fn := range map[string]func(w io.Writer) error{
+		"export": func(w io.Writer) error { return fs.ExportMetadata(Root, w) },
+		"tar":    func(w io.Writer) error { return fs.Tar(Root, w) },
+	} {
+		buf := bytes.NewBuffer(nil)
+		if err = fn(buf); err != nil {
+			t.Fatal(err)
+		}
+
+		if bytes.Contains(buf.Bytes(), []byte("a.txt")) {
+			t.Errorf("%s: expected expired files to be left out", name)
+		}
+	}
+
+	if stats, err := fs.Stats(); err != nil || stats.Files != 2 || stats.Bytes != 8 {
+		t.Errorf("expected stats to leave out expired files, got: %+v, %v", stats, err)
+	}
+
+	if _, err = iofs.ReadFile(NewIOFS(fs), "dir/a.txt"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("expected reading an expired file to fail, got: %v", err)
+	}
+
+	after, err := fs.TreeHash(Root)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if after == before {
+		t.Error("expected the tree hash to change when files expire")
+	}
+
+	dirk, err := fs.TreeHash(P{"dir"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if otherk, err := fs.TreeHash(P{"other"}); err != nil || otherk != dirk {
+		t.Errorf("expected a directory with expired files to hash like one without, got: %v", err)
+	}
+
+	//the names of expired files can be taken by any kind of entry
+	if err = fs.Mkdir(P{"dir", "a.txt"}, 0777); err != nil {
+		t.Errorf("expected a directory to take the name of an expired file, got: %v", err)
+	}
+
+	if err = fs.Rename(P{"other"}, P{"dir", "b.txt"}); err != nil {
+		t.Errorf("expected a directory to be moved over an expired file, got: %v", err)
+	}
+
+	f, err = fs.OpenFile(P{"dir", "c.txt"}, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0666)
+	if err != nil {
+		t.Errorf("expected an exclusive create to take the name of an expired file, got: %v", err)
+	} else {
+		f.Close()
+	}
+
+	if n, err := fs.ReapExpired(); err != nil || n != 0 {
+		t.Errorf("expected the replaced files to be gone, got: %d, %v", n, err)
+	}
+
+	if problems, err := fs.Check(); err != nil || len(problems) != 0 {
+		t.Errorf("expected no problems after replacing expired files, got: %v, %v", problems, err)
+	}
+}
@@ -0,0 +1,94 @@
+package treedb
+
+import (
+	"errors"
+	"os"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+//VolumeID is the id of the file system that a volume holds
+const VolumeID = "volume"
+
+//ErrNotVolume is returned when opening a database file that doesn't hold a volume
+var ErrNotVolume = errors.New("not a volume")
+
+//Volume bundles a bolt database file with the file system it holds, it takes care of opening and closing the database and of setting up its buckets
+type Volume struct {
+	db *bolt.DB
+	fs *FileSystem
+}
+
+//CreateVolume creates a new volume in a database file at 'path', which must not exist yet. The file is created exclusively, such that of several callers that create the same volume at once only one succeeds. Options configure the volume's file system. If there is an error, it will be of type *PathError.
+func CreateVolume(path string, opts ...Option) (v *Volume, err error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0666)
+	if err != nil {
+		if perr, ok := err.(*os.PathError); ok {
+			err = perr.Err
+		}
+
+		return nil, &os.PathError{Op: "createvolume", Path: path, Err: err}
+	}
+
+	if err = f.Close(); err != nil {
+		os.Remove(path)
+		return nil, &os.PathError{Op: "createvolume", Path: path, Err: err}
+	}
+
+	//bolt sets up an empty file as a new database, a file that was created here is removed when that fails
+	if v, err = openVolume("createvolume", path, opts); err != nil {
+		os.Remove(path)
+		return nil, err
+	}
+
+	return v, nil
+}
+
+//OpenVolume opens an existing volume in the database file at 'path'. Options configure the volume's file system and should match those it was created with. If there is an error, it will be of type *PathError.
+func OpenVolume(path string, opts ...Option) (v *Volume, err error) {
+	if _, err = os.Stat(path); err != nil {
+		return nil, err
+	}
+
+	return openVolume("openvolume", path, opts)
+}
+
+//openVolume opens the database file and sets up the file system, the database file is locked such that it can only be opened by one volume at a time
+func openVolume(op, path string, opts []Option) (v *Volume, err error) {
+	db, err := bolt.Open(path, 0666, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, &os.PathError{Op: op, Path: path, Err: err}
+	}
+
+	if op == "openvolume" {
+		if err = db.View(func(tx *bolt.Tx) error {
+			if tx.Bucket([]byte("f_"+VolumeID)) == nil {
+				return ErrNotVolume
+			}
+
+			return nil
+		}); err != nil {
+			db.Close()
+			return nil, &os.PathError{Op: op, Path: path, Err: err}
+		}
+	}
+
+	fs, err := NewFileSystem(VolumeID, db, opts...)
+	if err != nil {
+		db.Close()
+		return nil, &os.PathError{Op: op, Path: path, Err: err}
+	}
+
+	return &Volume{db: db, fs: fs}, nil
+}
+
+//FileSystem returns the file system of the volume, it can't be used after the volume is closed
+func (v *Volume) FileSystem() *FileSystem {
+	return v.fs
+}
+
+//Close closes the database file, files that are still open should be closed first
+func (v *Volume) Close() error {
+	return v.db.Close()
+}
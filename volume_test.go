@@ -0,0 +1,112 @@
+package treedb
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/boltdb/bolt"
+)
+
+func TestVolume(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "dfs_test_")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(tmpdir)
+	path := filepath.Join(tmpdir, "vol.bolt")
+
+	_, err = OpenVolume(path)
+	if !os.IsNotExist(err) {
+		t.Errorf("expected a missing volume to not exist, got: %v", err)
+	}
+
+	v, err := CreateVolume(path)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+
+	testwrite(v.FileSystem(), t, P{"foo.txt"}, []byte("hello"))
+	if err = v.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = CreateVolume(path)
+	if !os.IsExist(err) {
+		t.Errorf("expected creating an existing volume to fail, got: %v", err)
+	}
+
+	v, err = OpenVolume(path)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+
+	defer v.Close()
+	if data := testread(v.FileSystem(), t, P{"foo.txt"}); string(data) != "hello" {
+		t.Errorf("expected written content to persist, got: %q", data)
+	}
+
+	//other database files are not volumes
+	other := filepath.Join(tmpdir, "other.bolt")
+	db, err := bolt.Open(other, 0666, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = OpenVolume(other)
+	if err == nil || err.(*os.PathError).Err != ErrNotVolume {
+		t.Errorf("expected ErrNotVolume, got: %v", err)
+	}
+}
+
+func TestCreateVolumeRace(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "dfs_test_")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(tmpdir)
+	path := filepath.Join(tmpdir, "vol.bolt")
+
+	//volumes are kept open until all callers are done, such that a loser can't open the file after the winner closed it
+	const n = 8
+	vols := make(chan *Volume, n)
+	errs := make(chan error, n)
+	start := make(chan struct{})
+	for i := 0; i < n; i++ {
+		go func() {
+			<-start
+			v, err := CreateVolume(path)
+			if err != nil {
+				errs <- err
+				return
+			}
+
+			vols <- v
+		}()
+	}
+
+	close(start)
+	created := 0
+	for i := 0; i < n; i++ {
+		select {
+		case v := <-vols:
+			defer v.Close()
+			created++
+		case err := <-errs:
+			if !os.IsExist(err) {
+				t.Errorf("expected losers of the race to get os.ErrExist, got: %v", err)
+			}
+		}
+	}
+
+	if created != 1 {
+		t.Errorf("expected exactly one volume to be created, got: %d", created)
+	}
+}